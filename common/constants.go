@@ -75,6 +75,32 @@ var MemoryCacheEnabled bool
 var LogConsumeEnabled = true
 
 var TLSInsecureSkipVerify bool
+
+// MetricsEnabled 是否开放 Prometheus /metrics 端点，MetricsToken 非空时需以 Bearer 令牌访问
+var MetricsEnabled bool
+var MetricsToken string
+
+// 链路追踪配置，导出地址等沿用 OTEL_EXPORTER_OTLP_* 标准环境变量
+var TracingEnabled bool
+var TracingExporter string
+var TracingServiceName string
+var TracingSampleRatio = 1.0
+var TracingPropagateUpstream bool
+
+// 日志配置：LogFormat 为 text（默认，沿用原有格式）、json 或 logfmt，
+// LogModuleLevels 形如 "relay=debug,model=warn"，按调用方所在的顶层包覆盖 LogLevel
+var LogFormat string
+var LogLevel string
+var LogModuleLevels string
+var LogMaxSizeMB int
+var LogMaxAgeDays int
+var LogMaxBackups int
+var LogCompress bool
+
+// 声明式配置：ConfigReconcileFile 非空时主节点启动后按该文件同步渠道、模型与配置项，
+// ConfigSecretPassphrase 为导入导出时加解密密钥类字段的默认口令
+var ConfigReconcileFile string
+var ConfigSecretPassphrase string
 var InsecureTLSConfig = &tls.Config{InsecureSkipVerify: true}
 
 var SMTPServer = ""
@@ -205,7 +231,9 @@ const (
 )
 
 const (
-	TopUpStatusPending = "pending"
-	TopUpStatusSuccess = "success"
-	TopUpStatusExpired = "expired"
+	TopUpStatusPending   = "pending"
+	TopUpStatusSuccess   = "success"
+	TopUpStatusExpired   = "expired"
+	TopUpStatusRefunding = "refunding"
+	TopUpStatusRefunded  = "refunded"
 )
@@ -1,11 +1,18 @@
 package common
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
+	"errors"
+	"strings"
 
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
 )
 
 func GenerateHMACWithKey(key []byte, data string) string {
@@ -30,3 +37,110 @@ func ValidatePasswordAndHash(password string, hash string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	return err == nil
 }
+
+const (
+	encryptedValuePrefix = "enc:"
+	passphraseSaltSize   = 16
+	// scrypt 参数，派生一次约需数十毫秒，增加离线穷举口令的成本
+	passphraseScryptN = 1 << 15
+	passphraseScryptR = 8
+	passphraseScryptP = 1
+)
+
+func passphraseCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	if passphrase == "" {
+		return nil, errors.New("passphrase is empty")
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, passphraseScryptN, passphraseScryptR, passphraseScryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// PassphraseEncrypter 以口令加随机盐经 scrypt 派生的 AES-GCM 密钥加密，同一个 Encrypter 加密的字段共用一个盐，只派生一次密钥
+type PassphraseEncrypter struct {
+	salt []byte
+	gcm  cipher.AEAD
+}
+
+func NewPassphraseEncrypter(passphrase string) (*PassphraseEncrypter, error) {
+	salt := make([]byte, passphraseSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	gcm, err := passphraseCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &PassphraseEncrypter{salt: salt, gcm: gcm}, nil
+}
+
+// Encrypt 加密结果形如 enc:<base64(盐|nonce|密文)>
+func (e *PassphraseEncrypter) Encrypt(plaintext string) (string, error) {
+	nonce := make([]byte, e.gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := e.gcm.Seal(append(append([]byte{}, e.salt...), nonce...), nonce, []byte(plaintext), nil)
+	return encryptedValuePrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// PassphraseDecrypter 解密 PassphraseEncrypter 生成的密文，按盐缓存派生的密钥
+type PassphraseDecrypter struct {
+	passphrase string
+	ciphers    map[string]cipher.AEAD
+}
+
+func NewPassphraseDecrypter(passphrase string) *PassphraseDecrypter {
+	return &PassphraseDecrypter{passphrase: passphrase, ciphers: make(map[string]cipher.AEAD)}
+}
+
+func (d *PassphraseDecrypter) Decrypt(value string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedValuePrefix))
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < passphraseSaltSize {
+		return "", errors.New("ciphertext too short")
+	}
+	salt := string(sealed[:passphraseSaltSize])
+	gcm, ok := d.ciphers[salt]
+	if !ok {
+		if gcm, err = passphraseCipher(d.passphrase, sealed[:passphraseSaltSize]); err != nil {
+			return "", err
+		}
+		d.ciphers[salt] = gcm
+	}
+	sealed = sealed[passphraseSaltSize:]
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("ciphertext too short")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("failed to decrypt value, check the passphrase")
+	}
+	return string(plaintext), nil
+}
+
+// EncryptWithPassphrase 使用口令加密单个值，每次调用生成新的盐
+func EncryptWithPassphrase(plaintext string, passphrase string) (string, error) {
+	encrypter, err := NewPassphraseEncrypter(passphrase)
+	if err != nil {
+		return "", err
+	}
+	return encrypter.Encrypt(plaintext)
+}
+
+// IsEncryptedValue 是否为 EncryptWithPassphrase 生成的密文
+func IsEncryptedValue(value string) bool {
+	return strings.HasPrefix(value, encryptedValuePrefix)
+}
+
+func DecryptWithPassphrase(value string, passphrase string) (string, error) {
+	return NewPassphraseDecrypter(passphrase).Decrypt(value)
+}
@@ -0,0 +1,43 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPassphraseEncrypter_RoundTrip(t *testing.T) {
+	encrypter, err := NewPassphraseEncrypter("secret")
+	require.NoError(t, err)
+	first, err := encrypter.Encrypt("sk-1")
+	require.NoError(t, err)
+	second, err := encrypter.Encrypt("sk-2")
+	require.NoError(t, err)
+	require.True(t, IsEncryptedValue(first))
+
+	decrypter := NewPassphraseDecrypter("secret")
+	plaintext, err := decrypter.Decrypt(first)
+	require.NoError(t, err)
+	require.Equal(t, "sk-1", plaintext)
+	plaintext, err = decrypter.Decrypt(second)
+	require.NoError(t, err)
+	require.Equal(t, "sk-2", plaintext)
+
+	_, err = NewPassphraseDecrypter("wrong").Decrypt(first)
+	require.Error(t, err)
+}
+
+func TestEncryptWithPassphrase_RandomSalt(t *testing.T) {
+	first, err := EncryptWithPassphrase("sk-1", "secret")
+	require.NoError(t, err)
+	second, err := EncryptWithPassphrase("sk-1", "secret")
+	require.NoError(t, err)
+	// 每次加密使用独立的盐值，相同明文的密文前缀也不同
+	require.NotEqual(t, first[:len(encryptedValuePrefix)+passphraseSaltSize], second[:len(encryptedValuePrefix)+passphraseSaltSize])
+
+	plaintext, err := DecryptWithPassphrase(second, "secret")
+	require.NoError(t, err)
+	require.Equal(t, "sk-1", plaintext)
+	_, err = DecryptWithPassphrase("enc:AAAA", "secret")
+	require.Error(t, err)
+}
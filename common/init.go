@@ -83,6 +83,28 @@ func InitEnv() {
 	MemoryCacheEnabled = os.Getenv("MEMORY_CACHE_ENABLED") == "true"
 	IsMasterNode = os.Getenv("NODE_TYPE") != "slave"
 	TLSInsecureSkipVerify = GetEnvOrDefaultBool("TLS_INSECURE_SKIP_VERIFY", false)
+	MetricsEnabled = GetEnvOrDefaultBool("METRICS_ENABLED", false)
+	MetricsToken = os.Getenv("METRICS_TOKEN")
+	LogFormat = strings.ToLower(GetEnvOrDefaultString("LOG_FORMAT", "text"))
+	LogLevel = strings.ToLower(os.Getenv("LOG_LEVEL"))
+	LogModuleLevels = os.Getenv("LOG_MODULE_LEVELS")
+	LogMaxSizeMB = GetEnvOrDefault("LOG_MAX_SIZE_MB", 100)
+	LogMaxAgeDays = GetEnvOrDefault("LOG_MAX_AGE_DAYS", 7)
+	LogMaxBackups = GetEnvOrDefault("LOG_MAX_BACKUPS", 0)
+	LogCompress = GetEnvOrDefaultBool("LOG_COMPRESS", false)
+	ConfigReconcileFile = os.Getenv("CONFIG_RECONCILE_FILE")
+	ConfigSecretPassphrase = os.Getenv("CONFIG_SECRET_PASSPHRASE")
+	TracingEnabled = GetEnvOrDefaultBool("TRACING_ENABLED", false)
+	TracingExporter = GetEnvOrDefaultString("TRACING_EXPORTER", "otlphttp")
+	TracingServiceName = GetEnvOrDefaultString("OTEL_SERVICE_NAME", "new-api")
+	TracingPropagateUpstream = GetEnvOrDefaultBool("TRACING_PROPAGATE_UPSTREAM", false)
+	if ratio := os.Getenv("TRACING_SAMPLE_RATIO"); ratio != "" {
+		if v, err := strconv.ParseFloat(ratio, 64); err == nil && v >= 0 && v <= 1 {
+			TracingSampleRatio = v
+		} else {
+			SysError(fmt.Sprintf("invalid TRACING_SAMPLE_RATIO: %s, using default value: %v", ratio, TracingSampleRatio))
+		}
+	}
 	if TLSInsecureSkipVerify {
 		if tr, ok := http.DefaultTransport.(*http.Transport); ok && tr != nil {
 			if tr.TLSClientConfig != nil {
@@ -9,6 +9,8 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/QuantumNous/new-api/pkg/tracing"
+
 	"github.com/go-redis/redis/v8"
 	"gorm.io/gorm"
 )
@@ -38,6 +40,9 @@ func InitRedisClient() (err error) {
 	}
 	opt.PoolSize = GetEnvOrDefault("REDIS_POOL_SIZE", 10)
 	RDB = redis.NewClient(opt)
+	if tracing.Enabled() {
+		RDB.AddHook(tracing.RedisHook{})
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
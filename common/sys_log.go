@@ -2,23 +2,39 @@ package common
 
 import (
 	"fmt"
+	"log/slog"
 	"os"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// SysLogger 开启结构化日志后由 logger.SetupLogger 设置，系统日志改为经由它输出
+var SysLogger *slog.Logger
+
 func SysLog(s string) {
+	if SysLogger != nil {
+		SysLogger.Info(s)
+		return
+	}
 	t := time.Now()
 	_, _ = fmt.Fprintf(gin.DefaultWriter, "[SYS] %v | %s \n", t.Format("2006/01/02 - 15:04:05"), s)
 }
 
 func SysError(s string) {
+	if SysLogger != nil {
+		SysLogger.Error(s)
+		return
+	}
 	t := time.Now()
 	_, _ = fmt.Fprintf(gin.DefaultErrorWriter, "[SYS] %v | %s \n", t.Format("2006/01/02 - 15:04:05"), s)
 }
 
 func FatalLog(v ...any) {
+	if SysLogger != nil {
+		SysLogger.Error(fmt.Sprint(v...), "fatal", true)
+		os.Exit(1)
+	}
 	t := time.Now()
 	_, _ = fmt.Fprintf(gin.DefaultErrorWriter, "[FATAL] %v | %v \n", t.Format("2006/01/02 - 15:04:05"), v)
 	os.Exit(1)
@@ -19,6 +19,10 @@ const (
 	ContextKeyTokenModelLimitEnabled ContextKey = "token_model_limit_enabled"
 	ContextKeyTokenModelLimit        ContextKey = "token_model_limit"
 	ContextKeyTokenCrossGroupRetry   ContextKey = "token_cross_group_retry"
+	ContextKeyTokenScopes            ContextKey = "token_scopes"
+	ContextKeyTokenOrgId             ContextKey = "token_org_id"
+	// ContextKeyTokenAutoRefillThreshold 令牌开启自动充值时的阈值
+	ContextKeyTokenAutoRefillThreshold ContextKey = "token_auto_refill_threshold"
 
 	/* channel related keys */
 	ContextKeyChannelId                ContextKey = "channel_id"
@@ -56,6 +60,11 @@ const (
 
 	ContextKeySystemPromptOverride ContextKey = "system_prompt_override"
 
+	// ContextKeyBodyCapture 本次请求开启了请求/响应内容留存
+	ContextKeyBodyCapture ContextKey = "body_capture"
+	// ContextKeyConsumeLogParams 本次请求最近一次写入消费日志的参数
+	ContextKeyConsumeLogParams ContextKey = "consume_log_params"
+
 	// ContextKeyAdminRejectReason stores an admin-only reject/block reason extracted from upstream responses.
 	// It is not returned to end users, but can be persisted into consume/error logs for debugging.
 	ContextKeyAdminRejectReason ContextKey = "admin_reject_reason"
@@ -0,0 +1,91 @@
+package controller
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+const auditExportBatchSize = 500
+
+// currentOptionValue 读取配置项当前值，用于审计记录中的变更前内容
+func currentOptionValue(key string) string {
+	common.OptionMapRWMutex.RLock()
+	defer common.OptionMapRWMutex.RUnlock()
+	return common.OptionMap[key]
+}
+
+// recordOptionAudit 以配置项名作为字段名记录变更，使敏感配置项按名称脱敏
+func recordOptionAudit(c *gin.Context, action string, key string, before string, after string) {
+	model.RecordAudit(c, action, model.AuditTargetOption, key, map[string]string{key: before}, map[string]string{key: after})
+}
+
+func parseAuditLogQuery(c *gin.Context) *model.AuditLogQuery {
+	actorId, _ := strconv.Atoi(c.Query("actor_id"))
+	startTimestamp, _ := strconv.ParseInt(c.Query("start_timestamp"), 10, 64)
+	endTimestamp, _ := strconv.ParseInt(c.Query("end_timestamp"), 10, 64)
+	return &model.AuditLogQuery{
+		ActorId:        actorId,
+		ActorName:      c.Query("actor_name"),
+		Action:         c.Query("action"),
+		TargetType:     c.Query("target_type"),
+		TargetId:       c.Query("target_id"),
+		StartTimestamp: startTimestamp,
+		EndTimestamp:   endTimestamp,
+	}
+}
+
+func GetAuditLogs(c *gin.Context) {
+	pageInfo := common.GetPageQuery(c)
+	logs, total, err := model.SearchAuditLogs(parseAuditLogQuery(c), pageInfo.GetStartIdx(), pageInfo.GetPageSize())
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	pageInfo.SetTotal(int(total))
+	pageInfo.SetItems(logs)
+	common.ApiSuccess(c, pageInfo)
+}
+
+// ExportAuditLogs 以 CSV 流式导出符合条件的审计记录
+func ExportAuditLogs(c *gin.Context) {
+	query := parseAuditLogQuery(c)
+	filename := fmt.Sprintf("audit-logs-%s.csv", time.Now().Format("20060102150405"))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(http.StatusOK)
+	// 写入 BOM 便于 Excel 识别 UTF-8
+	_, _ = c.Writer.WriteString("\xEF\xBB\xBF")
+	w := csv.NewWriter(c.Writer)
+	_ = w.Write([]string{"id", "created_at", "actor_id", "actor_name", "ip", "action", "target_type", "target_id", "diff"})
+	err := model.IterateAuditLogs(query, auditExportBatchSize, func(logs []*model.AuditLog) error {
+		for _, log := range logs {
+			_ = w.Write([]string{
+				strconv.Itoa(log.Id),
+				time.Unix(log.CreatedAt, 0).Format(time.RFC3339),
+				strconv.Itoa(log.ActorId),
+				log.ActorName,
+				log.Ip,
+				log.Action,
+				log.TargetType,
+				log.TargetId,
+				log.Diff,
+			})
+		}
+		w.Flush()
+		c.Writer.Flush()
+		return w.Error()
+	})
+	if err != nil {
+		// 响应头已发送，只能记录错误并截断输出
+		common.SysError("failed to export audit logs: " + err.Error())
+	}
+	w.Flush()
+}
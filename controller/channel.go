@@ -791,6 +791,9 @@ func AddChannel(c *gin.Context) {
 		common.ApiError(c, err)
 		return
 	}
+	for i := range channels {
+		model.RecordAudit(c, "channel.create", model.AuditTargetChannel, channels[i].Id, nil, &channels[i])
+	}
 	service.ResetProxyClientCache()
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
@@ -801,12 +804,14 @@ func AddChannel(c *gin.Context) {
 
 func DeleteChannel(c *gin.Context) {
 	id, _ := strconv.Atoi(c.Param("id"))
+	origin, _ := model.GetChannelById(id, true)
 	channel := model.Channel{Id: id}
 	err := channel.Delete()
 	if err != nil {
 		common.ApiError(c, err)
 		return
 	}
+	model.RecordAudit(c, "channel.delete", model.AuditTargetChannel, id, origin, nil)
 	model.InitChannelCache()
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
@@ -821,6 +826,7 @@ func DeleteDisabledChannel(c *gin.Context) {
 		common.ApiError(c, err)
 		return
 	}
+	model.RecordAudit(c, "channel.delete_disabled", model.AuditTargetChannel, "", nil, gin.H{"deleted": rows})
 	model.InitChannelCache()
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
@@ -857,6 +863,7 @@ func DisableTagChannels(c *gin.Context) {
 		common.ApiError(c, err)
 		return
 	}
+	model.RecordAudit(c, "channel_tag.disable", model.AuditTargetChannelTag, channelTag.Tag, nil, nil)
 	model.InitChannelCache()
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
@@ -880,6 +887,7 @@ func EnableTagChannels(c *gin.Context) {
 		common.ApiError(c, err)
 		return
 	}
+	model.RecordAudit(c, "channel_tag.enable", model.AuditTargetChannelTag, channelTag.Tag, nil, nil)
 	model.InitChannelCache()
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
@@ -932,6 +940,7 @@ func EditTagChannels(c *gin.Context) {
 		common.ApiError(c, err)
 		return
 	}
+	model.RecordAudit(c, "channel_tag.edit", model.AuditTargetChannelTag, channelTag.Tag, nil, channelTag)
 	model.InitChannelCache()
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
@@ -960,6 +969,7 @@ func DeleteChannelBatch(c *gin.Context) {
 		common.ApiError(c, err)
 		return
 	}
+	model.RecordAudit(c, "channel.delete_batch", model.AuditTargetChannel, "", gin.H{"ids": channelBatch.Ids}, nil)
 	model.InitChannelCache()
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
@@ -1094,6 +1104,9 @@ func UpdateChannel(c *gin.Context) {
 		common.ApiError(c, err)
 		return
 	}
+	if updated, err := model.GetChannelById(channel.Id, true); err == nil {
+		model.RecordAudit(c, "channel.update", model.AuditTargetChannel, channel.Id, originChannel, updated)
+	}
 	model.InitChannelCache()
 	service.ResetProxyClientCache()
 	channel.Key = ""
@@ -1332,13 +1345,15 @@ func CopyChannel(c *gin.Context) {
 	}
 
 	// insert
-	if err := model.BatchInsertChannels([]model.Channel{clone}); err != nil {
+	clones := []model.Channel{clone}
+	if err := model.BatchInsertChannels(clones); err != nil {
 		c.JSON(http.StatusOK, gin.H{"success": false, "message": err.Error()})
 		return
 	}
+	model.RecordAudit(c, "channel.copy", model.AuditTargetChannel, clones[0].Id, nil, &clones[0])
 	model.InitChannelCache()
 	// success
-	c.JSON(http.StatusOK, gin.H{"success": true, "message": "", "data": gin.H{"id": clone.Id}})
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "", "data": gin.H{"id": clones[0].Id}})
 }
 
 // MultiKeyManageRequest represents the request for multi-key management operations
@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 配置文档上限，防止误传超大文件占满内存
+const maxConfigDocumentBytes = 32 << 20
+
+// configPassphrase 优先使用请求头中的口令，避免口令出现在访问日志的查询参数中
+func configPassphrase(c *gin.Context) string {
+	if passphrase := c.GetHeader("X-Config-Passphrase"); passphrase != "" {
+		return passphrase
+	}
+	return common.ConfigSecretPassphrase
+}
+
+// ExportConfig 导出声明式配置，format 为 yaml（默认）或 json，secrets 为 omit（默认）、encrypt 或 plain
+func ExportConfig(c *gin.Context) {
+	format := c.DefaultQuery("format", service.ConfigFormatYAML)
+	if format != service.ConfigFormatYAML && format != service.ConfigFormatJSON {
+		common.ApiErrorMsg(c, "不支持的导出格式")
+		return
+	}
+	secrets := c.DefaultQuery("secrets", service.ConfigSecretsOmit)
+	doc, err := service.ExportConfig(secrets, configPassphrase(c))
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	content, err := service.EncodeConfigDocument(doc, format)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	model.RecordAudit(c, "config.export", model.AuditTargetConfig, "", nil, gin.H{"format": format, "secrets": secrets})
+	contentType := "application/yaml; charset=utf-8"
+	if format == service.ConfigFormatJSON {
+		contentType = "application/json; charset=utf-8"
+	}
+	filename := fmt.Sprintf("new-api-config-%s.%s", time.Now().Format("20060102150405"), format)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Data(http.StatusOK, contentType, content)
+}
+
+// ImportConfig 导入声明式配置，请求体为 YAML 或 JSON 文档，dry_run 默认为 true，仅返回变更计划
+func ImportConfig(c *gin.Context) {
+	dryRun := true
+	if v, err := strconv.ParseBool(c.DefaultQuery("dry_run", "true")); err == nil {
+		dryRun = v
+	}
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, maxConfigDocumentBytes+1))
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if len(data) > maxConfigDocumentBytes {
+		common.ApiErrorMsg(c, "配置文档过大")
+		return
+	}
+	doc, err := service.DecodeConfigDocument(data)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	result, err := service.ImportConfig(doc, configPassphrase(c), dryRun, c.GetInt("id"), c.GetString("username"))
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if !dryRun {
+		model.RecordAudit(c, "config.import", model.AuditTargetConfig, "", nil, gin.H{
+			"changed":   len(result.Changes) - result.Failed,
+			"unchanged": result.Unchanged,
+			"failed":    result.Failed,
+		})
+	}
+	common.ApiSuccess(c, result)
+}
@@ -0,0 +1,137 @@
+package controller
+
+import (
+	"strconv"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// quoteTopUpCoupon 计算优惠码对订单的优惠，未填写优惠码时返回 nil 且不修改支付金额
+func quoteTopUpCoupon(code string, userId int, group string, payMoney float64) (*model.CouponQuote, float64, error) {
+	if code == "" {
+		return nil, payMoney, nil
+	}
+	quote, err := model.QuoteCoupon(code, userId, group, payMoney)
+	if err != nil {
+		return nil, payMoney, err
+	}
+	return quote, quote.PayMoney, nil
+}
+
+// couponAmountData 询价接口的返回数据，使用优惠码时附带优惠明细
+func couponAmountData(payMoney string, quote *model.CouponQuote) any {
+	if quote == nil {
+		return payMoney
+	}
+	return gin.H{
+		"pay_money":          payMoney,
+		"coupon_discount":    quote.Discount,
+		"coupon_bonus_quota": quote.BonusQuota,
+	}
+}
+
+func GetCoupons(c *gin.Context) {
+	pageInfo := common.GetPageQuery(c)
+	coupons, total, err := model.GetAllCoupons(c.Query("keyword"), pageInfo)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	pageInfo.SetTotal(int(total))
+	pageInfo.SetItems(coupons)
+	common.ApiSuccess(c, pageInfo)
+}
+
+func AddCoupon(c *gin.Context) {
+	coupon := model.Coupon{}
+	if err := c.ShouldBindJSON(&coupon); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if err := coupon.Validate(); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	coupon.Id = 0
+	coupon.UsedCount = 0
+	if coupon.Status == 0 {
+		coupon.Status = model.CouponStatusEnabled
+	}
+	if err := coupon.Insert(); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	model.RecordLog(c.GetInt("id"), model.LogTypeManage, "管理员创建了优惠码 "+coupon.Code)
+	common.ApiSuccess(c, &coupon)
+}
+
+func UpdateCoupon(c *gin.Context) {
+	coupon := model.Coupon{}
+	if err := c.ShouldBindJSON(&coupon); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if _, err := model.GetCouponById(coupon.Id); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if err := coupon.Validate(); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if coupon.Status == 0 {
+		coupon.Status = model.CouponStatusEnabled
+	}
+	if err := coupon.Update(); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	model.RecordLog(c.GetInt("id"), model.LogTypeManage, "管理员修改了优惠码 "+coupon.Code)
+	common.ApiSuccess(c, &coupon)
+}
+
+func DeleteCoupon(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	coupon, err := model.GetCouponById(id)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if err := model.DeleteCouponById(id); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	model.RecordLog(c.GetInt("id"), model.LogTypeManage, "管理员删除了优惠码 "+coupon.Code)
+	common.ApiSuccess(c, nil)
+}
+
+func GetCouponUsages(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	pageInfo := common.GetPageQuery(c)
+	usages, total, err := model.GetCouponUsages(id, pageInfo)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	pageInfo.SetTotal(int(total))
+	pageInfo.SetItems(usages)
+	common.ApiSuccess(c, pageInfo)
+}
+
+// GetCouponStats 管理员查看优惠码使用统计
+func GetCouponStats(c *gin.Context) {
+	startTimestamp, _ := strconv.ParseInt(c.Query("start_timestamp"), 10, 64)
+	endTimestamp, _ := strconv.ParseInt(c.Query("end_timestamp"), 10, 64)
+	stats, total, err := model.GetCouponStats(startTimestamp, endTimestamp)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, gin.H{
+		"items": stats,
+		"total": total,
+	})
+}
@@ -1,11 +1,17 @@
 package controller
 
 import (
+	"fmt"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
+	"time"
 
 	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
 
 	"github.com/gin-gonic/gin"
 )
@@ -122,6 +128,31 @@ func GetLogsStat(c *gin.Context) {
 	return
 }
 
+// GetMarginReport 管理员查看收入、上游成本与毛利报表，group_by 可选 channel、model、group、day
+func GetMarginReport(c *gin.Context) {
+	startTimestamp, _ := strconv.ParseInt(c.Query("start_timestamp"), 10, 64)
+	endTimestamp, _ := strconv.ParseInt(c.Query("end_timestamp"), 10, 64)
+	channel, _ := strconv.Atoi(c.Query("channel"))
+	groupBy := c.DefaultQuery("group_by", model.MarginGroupByChannel)
+	items, total, err := model.GetMarginReport(model.MarginReportQuery{
+		GroupBy:        groupBy,
+		StartTimestamp: startTimestamp,
+		EndTimestamp:   endTimestamp,
+		ChannelId:      channel,
+		ModelName:      c.Query("model_name"),
+		Group:          c.Query("group"),
+	})
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, gin.H{
+		"group_by": groupBy,
+		"items":    items,
+		"total":    total,
+	})
+}
+
 func GetLogsSelfStat(c *gin.Context) {
 	username := c.GetString("username")
 	logType, _ := strconv.Atoi(c.Query("type"))
@@ -146,6 +177,242 @@ func GetLogsSelfStat(c *gin.Context) {
 	return
 }
 
+// 单次汇总查询最多返回的行数
+const maxUsageRollupPoints = 10000
+
+func parseUsageRollupQuery(c *gin.Context) (model.UsageRollupQuery, bool) {
+	startTimestamp, _ := strconv.ParseInt(c.Query("start_timestamp"), 10, 64)
+	endTimestamp, _ := strconv.ParseInt(c.Query("end_timestamp"), 10, 64)
+	channel, _ := strconv.Atoi(c.Query("channel"))
+	query := model.UsageRollupQuery{
+		Granularity:    c.DefaultQuery("granularity", model.UsageRollupGranularityHour),
+		StartTimestamp: startTimestamp,
+		EndTimestamp:   endTimestamp,
+		Username:       c.Query("username"),
+		TokenName:      c.Query("token_name"),
+		ModelName:      c.Query("model_name"),
+		ChannelId:      channel,
+		Group:          c.Query("group"),
+		GroupBy:        c.Query("group_by"),
+	}
+	if query.Granularity != model.UsageRollupGranularityHour && query.Granularity != model.UsageRollupGranularityDay {
+		common.ApiErrorMsg(c, "不支持的统计粒度")
+		return query, false
+	}
+	if !model.IsValidUsageRollupGroupBy(query.GroupBy) {
+		common.ApiErrorMsg(c, "不支持的聚合维度")
+		return query, false
+	}
+	return query, true
+}
+
+func respondUsageRollups(c *gin.Context, query model.UsageRollupQuery) {
+	points, err := model.GetUsageRollups(query, maxUsageRollupPoints)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	state, err := model.GetUsageRollupState()
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, gin.H{
+		"granularity":   query.Granularity,
+		"group_by":      query.GroupBy,
+		"covered_until": state.CoveredUntil,
+		"items":         points,
+	})
+}
+
+// GetUsageRollups 管理员按小时或天查看用量汇总，group_by 可选 model、channel、user、token、group
+func GetUsageRollups(c *gin.Context) {
+	query, ok := parseUsageRollupQuery(c)
+	if !ok {
+		return
+	}
+	respondUsageRollups(c, query)
+}
+
+// GetSelfUsageRollups 用户查看自己的用量汇总，不允许按渠道筛选或聚合
+func GetSelfUsageRollups(c *gin.Context) {
+	query, ok := parseUsageRollupQuery(c)
+	if !ok {
+		return
+	}
+	if query.GroupBy == "channel" || query.GroupBy == "user" {
+		common.ApiErrorMsg(c, "不支持的聚合维度")
+		return
+	}
+	query.UserId = c.GetInt("id")
+	query.Username = ""
+	query.ChannelId = 0
+	respondUsageRollups(c, query)
+}
+
+func parseLogExportQuery(c *gin.Context) (*model.LogExportQuery, string, bool) {
+	format := c.DefaultQuery("format", model.LogExportFormatCSV)
+	if !service.IsValidLogExportFormat(format) {
+		common.ApiErrorMsg(c, "不支持的导出格式")
+		return nil, "", false
+	}
+	logType, _ := strconv.Atoi(c.Query("type"))
+	startTimestamp, _ := strconv.ParseInt(c.Query("start_timestamp"), 10, 64)
+	endTimestamp, _ := strconv.ParseInt(c.Query("end_timestamp"), 10, 64)
+	channel, _ := strconv.Atoi(c.Query("channel"))
+	return &model.LogExportQuery{
+		LogType:        logType,
+		StartTimestamp: startTimestamp,
+		EndTimestamp:   endTimestamp,
+		ModelName:      c.Query("model_name"),
+		Username:       c.Query("username"),
+		TokenName:      c.Query("token_name"),
+		ChannelId:      channel,
+		Group:          c.Query("group"),
+	}, format, true
+}
+
+// parseSelfLogExportQuery 用户自助导出只能导出自己的日志，筛选条件与 GetUserLogs 一致
+func parseSelfLogExportQuery(c *gin.Context) (*model.LogExportQuery, string, bool) {
+	query, format, ok := parseLogExportQuery(c)
+	if !ok {
+		return nil, "", false
+	}
+	query.UserId = c.GetInt("id")
+	query.Username = ""
+	query.ChannelId = 0
+	return query, format, true
+}
+
+// streamLogExport 直接以流式响应导出，行数超过上限时提示改用后台任务
+func streamLogExport(c *gin.Context, query *model.LogExportQuery, format string) {
+	total, err := model.CountExportLogs(query)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if maxRows := operation_setting.GetLogExportSetting().SyncMaxRows; maxRows > 0 && total > int64(maxRows) {
+		common.ApiErrorMsg(c, fmt.Sprintf("导出行数 %d 超过直接导出上限 %d，请创建后台导出任务", total, maxRows))
+		return
+	}
+	filename := fmt.Sprintf("logs-%s.%s", time.Now().Format("20060102150405"), format)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Header("Content-Type", service.LogExportContentType(format))
+	c.Status(http.StatusOK)
+	_, err = service.WriteLogExport(c.Writer, query, format, c.Writer.Flush)
+	if err != nil {
+		// 响应头已发送，只能记录错误并截断输出
+		common.SysError("failed to export logs: " + err.Error())
+	}
+}
+
+// ExportLogs 管理员导出日志，format 为 csv（默认）或 jsonl，筛选条件与 GetAllLogs 一致
+func ExportLogs(c *gin.Context) {
+	query, format, ok := parseLogExportQuery(c)
+	if !ok {
+		return
+	}
+	streamLogExport(c, query, format)
+}
+
+// ExportSelfLogs 用户导出自己的日志
+func ExportSelfLogs(c *gin.Context) {
+	query, format, ok := parseSelfLogExportQuery(c)
+	if !ok {
+		return
+	}
+	streamLogExport(c, query, format)
+}
+
+func setLogExportDownloadUrl(job *model.LogExportJob) {
+	if job.Status == model.LogExportJobSucceeded {
+		job.DownloadUrl = fmt.Sprintf("/api/log/export/jobs/%d/download", job.Id)
+	}
+}
+
+func createLogExportJob(c *gin.Context, query *model.LogExportQuery, format string) {
+	job, err := service.CreateLogExportJob(c.GetInt("id"), query, format)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, job)
+}
+
+// CreateLogExportJob 管理员创建后台导出任务，适用于超过直接导出上限的大范围导出
+func CreateLogExportJob(c *gin.Context) {
+	query, format, ok := parseLogExportQuery(c)
+	if !ok {
+		return
+	}
+	createLogExportJob(c, query, format)
+}
+
+func CreateSelfLogExportJob(c *gin.Context) {
+	query, format, ok := parseSelfLogExportQuery(c)
+	if !ok {
+		return
+	}
+	createLogExportJob(c, query, format)
+}
+
+// GetLogExportJobs 列出当前用户创建的导出任务
+func GetLogExportJobs(c *gin.Context) {
+	pageInfo := common.GetPageQuery(c)
+	jobs, total, err := model.GetLogExportJobs(c.GetInt("id"), pageInfo.GetStartIdx(), pageInfo.GetPageSize())
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	for _, job := range jobs {
+		setLogExportDownloadUrl(job)
+	}
+	pageInfo.SetTotal(int(total))
+	pageInfo.SetItems(jobs)
+	common.ApiSuccess(c, pageInfo)
+}
+
+func getOwnLogExportJob(c *gin.Context) (*model.LogExportJob, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		common.ApiErrorMsg(c, "无效的参数")
+		return nil, false
+	}
+	job, err := model.GetLogExportJob(id, c.GetInt("id"))
+	if err != nil {
+		common.ApiError(c, err)
+		return nil, false
+	}
+	return job, true
+}
+
+func GetLogExportJob(c *gin.Context) {
+	job, ok := getOwnLogExportJob(c)
+	if !ok {
+		return
+	}
+	setLogExportDownloadUrl(job)
+	common.ApiSuccess(c, job)
+}
+
+// DownloadLogExportJob 下载已完成任务的导出文件
+func DownloadLogExportJob(c *gin.Context) {
+	job, ok := getOwnLogExportJob(c)
+	if !ok {
+		return
+	}
+	if job.Status != model.LogExportJobSucceeded {
+		common.ApiErrorMsg(c, "导出任务尚未完成")
+		return
+	}
+	if _, err := os.Stat(job.FilePath); err != nil {
+		common.ApiErrorMsg(c, fmt.Sprintf("导出文件不存在，可能已过期或位于节点 %s", job.Node))
+		return
+	}
+	c.Header("Content-Type", service.LogExportContentType(job.Format))
+	c.FileAttachment(job.FilePath, filepath.Base(job.FilePath))
+}
+
 func DeleteHistoryLogs(c *gin.Context) {
 	targetTimestamp, _ := strconv.ParseInt(c.Query("target_timestamp"), 10, 64)
 	if targetTimestamp == 0 {
@@ -167,3 +434,29 @@ func DeleteHistoryLogs(c *gin.Context) {
 	})
 	return
 }
+
+// GetLogBodyCapture 查看日志对应请求留存的请求体与响应体
+func GetLogBodyCapture(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		common.ApiErrorMsg(c, "无效的 id")
+		return
+	}
+	log, err := model.GetLogById(id)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	other, _ := common.StrToMap(log.Other)
+	requestId, _ := other["request_id"].(string)
+	if captured, _ := other["body_captured"].(bool); !captured || requestId == "" {
+		common.ApiErrorMsg(c, "该日志没有留存请求内容")
+		return
+	}
+	capture, err := service.GetBodyCapture(requestId)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, capture)
+}
@@ -10,9 +10,11 @@ import (
 	"time"
 
 	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
 	"github.com/QuantumNous/new-api/dto"
 	"github.com/QuantumNous/new-api/logger"
 	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/pkg/metrics"
 	"github.com/QuantumNous/new-api/service"
 	"github.com/QuantumNous/new-api/setting"
 	"github.com/QuantumNous/new-api/setting/system_setting"
@@ -27,6 +29,7 @@ func UpdateMidjourneyTaskBulk() {
 		time.Sleep(time.Duration(15) * time.Second)
 
 		tasks := model.GetAllUnFinishTasks()
+		metrics.SetTaskQueueDepths("midjourney", map[string]int{constant.TaskPlatformMidjourney: len(tasks)})
 		if len(tasks) == 0 {
 			continue
 		}
@@ -177,7 +180,7 @@ func UpdateMidjourneyTaskBulk() {
 					logger.LogError(ctx, "UpdateMidjourneyTask task error: "+err.Error())
 				} else {
 					if shouldReturnQuota {
-						err = model.IncreaseUserQuota(task.UserId, task.Quota, false)
+						err = model.UpdateUserQuotaWithLedger(task.UserId, task.Quota, model.LedgerSourceRefund, task.MjId, true)
 						if err != nil {
 							logger.LogError(ctx, "fail to increase user quota: "+err.Error())
 						}
@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"strconv"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+type optionRollbackRequest struct {
+	Key     string `json:"key"`
+	Version int    `json:"version"`
+}
+
+// maskOptionVersion 密钥类配置项与 GetOptions 一样不返回其值
+func maskOptionVersion(version *model.OptionVersion) {
+	if version != nil && model.IsSensitiveOptionKey(version.Key) {
+		version.Value = "***"
+	}
+}
+
+func GetOptionVersions(c *gin.Context) {
+	key := c.Query("key")
+	if key == "" {
+		common.ApiErrorMsg(c, "配置项不能为空")
+		return
+	}
+	pageInfo := common.GetPageQuery(c)
+	versions, total, err := model.GetOptionVersions(key, pageInfo.GetStartIdx(), pageInfo.GetPageSize())
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	for _, version := range versions {
+		maskOptionVersion(version)
+	}
+	pageInfo.SetTotal(int(total))
+	pageInfo.SetItems(versions)
+	common.ApiSuccess(c, pageInfo)
+}
+
+// DiffOptionVersions 比较配置项的两个版本，未指定 to 时与最新版本比较
+func DiffOptionVersions(c *gin.Context) {
+	key := c.Query("key")
+	from, _ := strconv.Atoi(c.Query("from"))
+	to, _ := strconv.Atoi(c.Query("to"))
+	if key == "" || from <= 0 {
+		common.ApiErrorMsg(c, "无效的参数")
+		return
+	}
+	diff, err := model.DiffOptionVersions(key, from, to)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if model.IsSensitiveOptionKey(key) {
+		maskOptionVersion(diff.From)
+		maskOptionVersion(diff.To)
+		for field := range diff.Changes {
+			diff.Changes[field] = model.FieldChange{Before: "***", After: "***"}
+		}
+	}
+	common.ApiSuccess(c, diff)
+}
+
+// RollbackOptionVersion 将配置项恢复为指定版本，其他节点在下一次 SyncOptions 时加载
+func RollbackOptionVersion(c *gin.Context) {
+	var req optionRollbackRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Key == "" || req.Version <= 0 {
+		common.ApiErrorMsg(c, "无效的参数")
+		return
+	}
+	before := currentOptionValue(req.Key)
+	target, err := model.RollbackOption(req.Key, req.Version, c.GetInt("id"), c.GetString("username"))
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	recordOptionAudit(c, "option.rollback", req.Key, before, target.Value)
+	maskOptionVersion(target)
+	common.ApiSuccess(c, target)
+}
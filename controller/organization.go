@@ -0,0 +1,404 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// checkOrgBilling 校验用户是否有权为组织充值，orgId 为 0 表示个人充值
+func checkOrgBilling(userId int, orgId int) error {
+	if orgId == 0 {
+		return nil
+	}
+	member, err := model.GetOrgMember(orgId, userId)
+	if err != nil || !member.CanManageBilling() {
+		return errors.New("无权为该组织充值")
+	}
+	return nil
+}
+
+// checkOrgTokenAccess 校验用户是否有权创建或修改组织令牌，orgId 为 0 表示个人令牌
+func checkOrgTokenAccess(userId int, orgId int) error {
+	if orgId == 0 {
+		return nil
+	}
+	return model.CheckOrgTokenUsable(orgId, userId)
+}
+
+// getOrgMemberFromParam 解析路径中的组织 id，并返回当前用户在该组织中的成员信息
+func getOrgMemberFromParam(c *gin.Context) (*model.OrganizationMember, error) {
+	orgId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return nil, err
+	}
+	member, err := model.GetOrgMember(orgId, c.GetInt("id"))
+	if err != nil {
+		return nil, errors.New("您不是该组织的成员")
+	}
+	return member, nil
+}
+
+func GetSelfOrganizations(c *gin.Context) {
+	orgs, err := model.GetUserOrganizations(c.GetInt("id"))
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, orgs)
+}
+
+func CreateOrganization(c *gin.Context) {
+	org := model.Organization{}
+	if err := c.ShouldBindJSON(&org); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if len(org.Name) > 64 {
+		common.ApiErrorMsg(c, "组织名称过长")
+		return
+	}
+	cleanOrg := model.Organization{
+		Name:    org.Name,
+		OwnerId: c.GetInt("id"),
+	}
+	if err := model.CreateOrganization(&cleanOrg); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, cleanOrg)
+}
+
+func GetOrganization(c *gin.Context) {
+	member, err := getOrgMemberFromParam(c)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	org, err := model.GetOrganizationById(member.OrgId)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, model.UserOrganization{Organization: *org, Role: member.Role})
+}
+
+func UpdateOrganization(c *gin.Context) {
+	member, err := getOrgMemberFromParam(c)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if !member.CanManageMembers() {
+		common.ApiErrorMsg(c, "无权修改该组织")
+		return
+	}
+	req := model.Organization{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if req.Name == "" || len(req.Name) > 64 {
+		common.ApiErrorMsg(c, "组织名称无效")
+		return
+	}
+	org, err := model.GetOrganizationById(member.OrgId)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	org.Name = req.Name
+	// 停用组织会让所有成员的组织令牌失效，只有所有者可以修改组织状态
+	if (req.Status == model.OrgStatusEnabled || req.Status == model.OrgStatusDisabled) && req.Status != org.Status {
+		if member.Role != model.OrgRoleOwner {
+			common.ApiErrorMsg(c, "只有组织所有者可以修改组织状态")
+			return
+		}
+		org.Status = req.Status
+	}
+	if err := org.Update(); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, org)
+}
+
+func DeleteOrganization(c *gin.Context) {
+	member, err := getOrgMemberFromParam(c)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if member.Role != model.OrgRoleOwner {
+		common.ApiErrorMsg(c, "只有组织所有者可以删除组织")
+		return
+	}
+	if err := model.DeleteOrganizationById(member.OrgId); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, nil)
+}
+
+func GetOrganizationMembers(c *gin.Context) {
+	member, err := getOrgMemberFromParam(c)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	members, err := model.GetOrgMembers(member.OrgId)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, members)
+}
+
+type orgMemberRequest struct {
+	UserId     int    `json:"user_id"`
+	Username   string `json:"username"`
+	Role       string `json:"role"`
+	SpendLimit int    `json:"spend_limit"`
+}
+
+func AddOrganizationMember(c *gin.Context) {
+	member, err := getOrgMemberFromParam(c)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if !member.CanManageMembers() {
+		common.ApiErrorMsg(c, "无权管理组织成员")
+		return
+	}
+	req := orgMemberRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if req.UserId == 0 {
+		req.UserId, err = model.GetUserIdByUsername(req.Username)
+		if err != nil {
+			common.ApiErrorMsg(c, "用户不存在")
+			return
+		}
+	}
+	if req.Role == "" {
+		req.Role = model.OrgRoleMember
+	}
+	if req.SpendLimit < 0 {
+		common.ApiErrorMsg(c, "消费上限不能为负数")
+		return
+	}
+	if !member.CanAssignRole(req.Role) {
+		common.ApiErrorMsg(c, "只有组织所有者可以任命管理员")
+		return
+	}
+	newMember := model.OrganizationMember{
+		OrgId:      member.OrgId,
+		UserId:     req.UserId,
+		Role:       req.Role,
+		SpendLimit: req.SpendLimit,
+	}
+	if err := newMember.Insert(); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, newMember)
+}
+
+func UpdateOrganizationMember(c *gin.Context) {
+	member, err := getOrgMemberFromParam(c)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if !member.CanManageMembers() {
+		common.ApiErrorMsg(c, "无权管理组织成员")
+		return
+	}
+	req := orgMemberRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if req.SpendLimit < 0 {
+		common.ApiErrorMsg(c, "消费上限不能为负数")
+		return
+	}
+	target, err := model.GetOrgMember(member.OrgId, req.UserId)
+	if err != nil {
+		common.ApiErrorMsg(c, "成员不存在")
+		return
+	}
+	// 所有者角色不可转移或降级，管理员不能修改其他管理员，也不能任命新的管理员
+	if target.Role == model.OrgRoleOwner || req.Role == model.OrgRoleOwner {
+		common.ApiErrorMsg(c, "不能修改组织所有者")
+		return
+	}
+	if member.Role != model.OrgRoleOwner && target.Role == model.OrgRoleAdmin {
+		common.ApiErrorMsg(c, "无权修改其他管理员")
+		return
+	}
+	if !member.CanAssignRole(req.Role) {
+		common.ApiErrorMsg(c, "只有组织所有者可以任命管理员")
+		return
+	}
+	target.Role = req.Role
+	target.SpendLimit = req.SpendLimit
+	if err := target.Update(); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, target)
+}
+
+func RemoveOrganizationMember(c *gin.Context) {
+	member, err := getOrgMemberFromParam(c)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	userId, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	// 成员可以主动退出组织
+	if userId != member.UserId {
+		if !member.CanManageMembers() {
+			common.ApiErrorMsg(c, "无权管理组织成员")
+			return
+		}
+		target, err := model.GetOrgMember(member.OrgId, userId)
+		if err != nil {
+			common.ApiErrorMsg(c, "成员不存在")
+			return
+		}
+		if member.Role != model.OrgRoleOwner && target.Role == model.OrgRoleAdmin {
+			common.ApiErrorMsg(c, "无权移除其他管理员")
+			return
+		}
+	}
+	if err := model.RemoveOrgMember(member.OrgId, userId); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, nil)
+}
+
+func GetOrganizationUsage(c *gin.Context) {
+	member, err := getOrgMemberFromParam(c)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if !member.CanManageBilling() {
+		common.ApiErrorMsg(c, "无权查看组织用量")
+		return
+	}
+	startTimestamp, _ := strconv.ParseInt(c.Query("start_timestamp"), 10, 64)
+	endTimestamp, _ := strconv.ParseInt(c.Query("end_timestamp"), 10, 64)
+	stats, err := model.GetOrgUsageStats(member.OrgId, startTimestamp, endTimestamp)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, stats)
+}
+
+type orgTransferRequest struct {
+	Quota int `json:"quota"`
+}
+
+func TransferQuotaToOrganization(c *gin.Context) {
+	member, err := getOrgMemberFromParam(c)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	req := orgTransferRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if err := model.TransferUserQuotaToOrg(member.UserId, member.OrgId, req.Quota); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, nil)
+}
+
+func GetAllOrganizations(c *gin.Context) {
+	pageInfo := common.GetPageQuery(c)
+	orgs, total, err := model.GetAllOrganizations(pageInfo)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	pageInfo.SetTotal(int(total))
+	pageInfo.SetItems(orgs)
+	common.ApiSuccess(c, pageInfo)
+}
+
+type orgAdminQuotaRequest struct {
+	Quota int `json:"quota"`
+}
+
+// AdminAddOrganizationQuota 管理员直接为组织额度池增加额度
+func AdminAddOrganizationQuota(c *gin.Context) {
+	orgId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	req := orgAdminQuotaRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if req.Quota <= 0 {
+		common.ApiErrorMsg(c, "额度必须大于 0")
+		return
+	}
+	if err := model.IncreaseOrgQuota(orgId, req.Quota, model.LedgerSourceAdmin, ""); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	model.RecordLog(c.GetInt("id"), model.LogTypeManage, fmt.Sprintf("管理员为组织 %d 增加额度 %s", orgId, logger.LogQuota(req.Quota)))
+	common.ApiSuccess(c, nil)
+}
+
+type creditLimitRequest struct {
+	CreditLimit int `json:"credit_limit"`
+}
+
+// AdminSetOrganizationCreditLimit 管理员设置组织的后付费信用额度，0 表示恢复为预付费
+func AdminSetOrganizationCreditLimit(c *gin.Context) {
+	orgId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	req := creditLimitRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if _, err := model.GetOrganizationById(orgId); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if err := model.SetOrgCreditLimit(orgId, req.CreditLimit); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	model.RecordLog(c.GetInt("id"), model.LogTypeManage, fmt.Sprintf("管理员将组织 %d 的信用额度设置为 %s", orgId, logger.LogQuota(req.CreditLimit)))
+	common.ApiSuccess(c, nil)
+}
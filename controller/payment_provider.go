@@ -0,0 +1,288 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+
+	"github.com/bytedance/gopkg/util/gopool"
+	"github.com/gin-gonic/gin"
+)
+
+// PaymentProvider 支付平台。下单、回调验签、主动查询与退款由各平台实现，
+// 订单落库、状态流转与额度入账由 createPaymentOrder / completePaymentOrder 统一处理。
+type PaymentProvider interface {
+	Name() string
+	// CreateOrder 在支付平台创建支付单，订单已以待支付状态落库
+	CreateOrder(order *PaymentOrder) (*PaymentLaunch, error)
+	// VerifyCallback 校验支付平台回调的签名并解析回调内容
+	VerifyCallback(c *gin.Context) (*PaymentCallback, error)
+	// QueryOrder 向支付平台查询订单的支付状态
+	QueryOrder(topUp *model.TopUp) (*PaymentQueryResult, error)
+	// Refund 向支付平台发起全额原路退款
+	Refund(topUp *model.TopUp, reason string) error
+}
+
+var (
+	ErrPaymentUnsupported = errors.New("该支付方式不支持此操作")
+	ErrPaymentSignature   = errors.New("支付回调签名验证失败")
+)
+
+// PaymentOrder 创建支付单所需的信息，除 TopUp 外的字段按平台需要填写
+type PaymentOrder struct {
+	TopUp    *model.TopUp
+	Subject  string
+	ClientIP string
+	// 易支付的支付渠道，例如 alipay、wxpay
+	Channel string
+	// Stripe 与 Creem 结账页使用
+	Email          string
+	Username       string
+	CustomerId     string
+	SuccessURL     string
+	CancelURL      string
+	StripeCouponId string
+	CreemProduct   *CreemProduct
+}
+
+// PaymentLaunch 拉起支付所需的信息
+type PaymentLaunch struct {
+	PayURL string
+	// 易支付需要前端以表单提交的参数
+	Params map[string]string
+	// 下单即生成的平台交易号，例如 Stripe Checkout Session id
+	ProviderTradeNo string
+}
+
+// PaymentCallback 验签后的支付回调
+type PaymentCallback struct {
+	TradeNo         string
+	ProviderTradeNo string
+	Paid            bool
+	Status          string
+	// 平台原始事件，Stripe 为 stripe.Event，Creem 为 *CreemWebhookEvent
+	Raw any
+}
+
+const (
+	PaymentQueryPending = "pending"
+	PaymentQueryPaid    = "paid"
+	PaymentQueryClosed  = "closed"
+)
+
+// PaymentQueryResult 主动查询得到的订单状态
+type PaymentQueryResult struct {
+	Status          string
+	ProviderTradeNo string
+}
+
+var paymentProviders = map[string]PaymentProvider{
+	model.PaymentProviderEpay:   epayAdaptor,
+	model.PaymentProviderStripe: stripeAdaptor,
+	model.PaymentProviderCreem:  creemAdaptor,
+	model.PaymentProviderWechat: wechatAdaptor,
+	model.PaymentProviderAlipay: alipayAdaptor,
+}
+
+var paymentProviderNames = map[string]string{
+	model.PaymentProviderEpay:   "在线充值",
+	model.PaymentProviderStripe: "Stripe",
+	model.PaymentProviderCreem:  "Creem",
+	model.PaymentProviderWechat: "微信支付",
+	model.PaymentProviderAlipay: "支付宝",
+}
+
+func GetPaymentProvider(name string) PaymentProvider {
+	return paymentProviders[name]
+}
+
+// createPaymentOrder 以待支付状态保存订单后在支付平台下单，下单失败的订单置为过期
+func createPaymentOrder(provider PaymentProvider, order *PaymentOrder) (*PaymentLaunch, error) {
+	topUp := order.TopUp
+	topUp.Provider = provider.Name()
+	topUp.Status = common.TopUpStatusPending
+	topUp.CreateTime = time.Now().Unix()
+	if err := topUp.Insert(); err != nil {
+		common.SysLog(fmt.Sprintf("创建%s订单失败: %v", provider.Name(), err))
+		return nil, errors.New("创建订单失败")
+	}
+	launch, err := provider.CreateOrder(order)
+	if err != nil {
+		common.SysLog(fmt.Sprintf("%s下单失败: %s, %v", provider.Name(), topUp.TradeNo, err))
+		if err := model.ExpireTopUp(topUp.TradeNo); err != nil {
+			common.SysLog(fmt.Sprintf("过期充值订单失败: %s, %v", topUp.TradeNo, err))
+		}
+		return nil, errors.New("拉起支付失败")
+	}
+	if launch.ProviderTradeNo != "" {
+		if err := model.SetTopUpProviderTradeNo(topUp.TradeNo, launch.ProviderTradeNo); err != nil {
+			common.SysLog(fmt.Sprintf("记录支付平台交易号失败: %s, %v", topUp.TradeNo, err))
+		}
+	}
+	return launch, nil
+}
+
+// completePaymentOrder 支付平台确认到账后完成订单并入账，重复通知直接返回成功
+func completePaymentOrder(provider PaymentProvider, tradeNo string, providerTradeNo string) error {
+	LockOrder(tradeNo)
+	defer UnlockOrder(tradeNo)
+
+	topUp, err := model.CompleteTopUp(tradeNo, providerTradeNo)
+	if errors.Is(err, model.ErrTopUpNotPending) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	model.RecordLog(topUp.UserId, model.LogTypeTopup, fmt.Sprintf("使用%s充值成功，充值金额: %v，支付金额：%.2f",
+		paymentProviderNames[provider.Name()], logger.LogQuota(topUp.CreditedQuota), topUp.Money))
+	return nil
+}
+
+type RefundTopUpRequest struct {
+	TradeNo string `json:"trade_no"`
+	Reason  string `json:"reason"`
+	// 线下退款：只扣回额度并标记订单，不调用支付平台退款接口；
+	// 也用于完成支付平台已退款但扣回额度失败、停留在退款中的订单
+	Offline bool `json:"offline"`
+}
+
+// RefundTopUp 管理员为已支付订单办理退款
+func RefundTopUp(c *gin.Context) {
+	var req RefundTopUpRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.TradeNo == "" {
+		common.ApiErrorMsg(c, "参数错误")
+		return
+	}
+
+	LockOrder(req.TradeNo)
+	defer UnlockOrder(req.TradeNo)
+
+	var refundFn func(topUp *model.TopUp) error
+	if !req.Offline {
+		refundFn = func(topUp *model.TopUp) error {
+			provider := GetPaymentProvider(topUp.GetProvider())
+			if provider == nil {
+				return errors.New("未知的支付方式")
+			}
+			err := provider.Refund(topUp, req.Reason)
+			if errors.Is(err, ErrPaymentUnsupported) {
+				return errors.New("该支付方式不支持原路退款，请线下退款后使用线下退款模式")
+			}
+			return err
+		}
+	}
+	topUp, err := model.RefundTopUp(req.TradeNo, req.Reason, refundFn)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	mode := "原路退款"
+	if req.Offline {
+		mode = "线下退款"
+	}
+	model.RecordLog(c.GetInt("id"), model.LogTypeManage, fmt.Sprintf("管理员为充值订单 %s 办理%s，扣回额度 %s", topUp.TradeNo, mode, logger.LogQuota(topUp.RefundedQuota)))
+	common.ApiSuccess(c, topUp)
+}
+
+const (
+	paymentReconcileTickInterval = 5 * time.Minute
+	paymentReconcileBatchSize    = 100
+)
+
+var (
+	paymentReconcileOnce    sync.Once
+	paymentReconcileRunning atomic.Bool
+	// 对账游标，每轮从上一轮处理到的订单之后继续，查询失败的订单不会一直占用同一批次
+	paymentReconcileCursor int
+)
+
+// StartPaymentReconcileTask 定期查询长时间未支付的订单，补记漏掉回调的已支付订单并过期超时订单
+func StartPaymentReconcileTask() {
+	paymentReconcileOnce.Do(func() {
+		if !common.IsMasterNode {
+			return
+		}
+
+		gopool.Go(func() {
+			logger.LogInfo(context.Background(), fmt.Sprintf("payment reconcile task started: tick=%s", paymentReconcileTickInterval))
+
+			ticker := time.NewTicker(paymentReconcileTickInterval)
+			defer ticker.Stop()
+
+			runPaymentReconcileOnce()
+			for range ticker.C {
+				runPaymentReconcileOnce()
+			}
+		})
+	})
+}
+
+func runPaymentReconcileOnce() {
+	setting := operation_setting.GetPaymentSetting()
+	if !setting.ReconcileEnabled {
+		return
+	}
+	if !paymentReconcileRunning.CompareAndSwap(false, true) {
+		return
+	}
+	defer paymentReconcileRunning.Store(false)
+
+	ctx := context.Background()
+	now := time.Now().Unix()
+	before := now - int64(max(setting.ReconcileMinutes, 1))*60
+	topUps, err := model.GetPendingTopUps(before, paymentReconcileCursor, paymentReconcileBatchSize)
+	if err != nil {
+		logger.LogWarn(ctx, fmt.Sprintf("payment reconcile task: failed to load pending orders: %v", err))
+		return
+	}
+	// 本轮不足一批时说明已到末尾，下一轮从头开始
+	if len(topUps) < paymentReconcileBatchSize {
+		paymentReconcileCursor = 0
+	} else {
+		paymentReconcileCursor = topUps[len(topUps)-1].Id
+	}
+	completed, expired := 0, 0
+	for _, topUp := range topUps {
+		stale := setting.PendingExpireHours > 0 && now-topUp.CreateTime > int64(setting.PendingExpireHours)*3600
+		status := PaymentQueryPending
+		if provider := GetPaymentProvider(topUp.GetProvider()); provider != nil {
+			result, err := provider.QueryOrder(topUp)
+			if err == nil {
+				status = result.Status
+				if status == PaymentQueryPaid {
+					if err := completePaymentOrder(provider, topUp.TradeNo, result.ProviderTradeNo); err != nil {
+						logger.LogWarn(ctx, fmt.Sprintf("payment reconcile task: failed to complete order %s: %v", topUp.TradeNo, err))
+						continue
+					}
+					completed++
+					continue
+				}
+			} else if !errors.Is(err, ErrPaymentUnsupported) {
+				// 查询失败时未超时的订单留待下一轮，超时订单仍然过期
+				logger.LogWarn(ctx, fmt.Sprintf("payment reconcile task: failed to query order %s: %v", topUp.TradeNo, err))
+				if !stale {
+					continue
+				}
+			}
+		}
+		if status == PaymentQueryClosed || stale {
+			if err := model.ExpireTopUp(topUp.TradeNo); err != nil && !errors.Is(err, model.ErrTopUpNotPending) {
+				logger.LogWarn(ctx, fmt.Sprintf("payment reconcile task: failed to expire order %s: %v", topUp.TradeNo, err))
+				continue
+			}
+			expired++
+		}
+	}
+	if completed > 0 || expired > 0 {
+		logger.LogInfo(ctx, fmt.Sprintf("payment reconcile task: completed %d, expired %d pending orders", completed, expired))
+	}
+}
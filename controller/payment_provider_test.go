@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// failingQueryProvider 查询订单总是失败的支付平台
+type failingQueryProvider struct{}
+
+func (failingQueryProvider) Name() string { return "test_failing" }
+
+func (failingQueryProvider) CreateOrder(*PaymentOrder) (*PaymentLaunch, error) {
+	return nil, ErrPaymentUnsupported
+}
+
+func (failingQueryProvider) VerifyCallback(*gin.Context) (*PaymentCallback, error) {
+	return nil, ErrPaymentUnsupported
+}
+
+func (failingQueryProvider) QueryOrder(*model.TopUp) (*PaymentQueryResult, error) {
+	return nil, errors.New("query timeout")
+}
+
+func (failingQueryProvider) Refund(*model.TopUp, string) error {
+	return ErrPaymentUnsupported
+}
+
+func setupPaymentReconcileTest(t *testing.T) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&model.TopUp{}))
+	oldDB := model.DB
+	provider := failingQueryProvider{}
+	paymentProviders[provider.Name()] = provider
+	t.Cleanup(func() {
+		model.DB = oldDB
+		delete(paymentProviders, provider.Name())
+		paymentReconcileCursor = 0
+		if sqlDB, err := db.DB(); err == nil {
+			_ = sqlDB.Close()
+		}
+	})
+	model.DB = db
+	paymentReconcileCursor = 0
+}
+
+func createReconcileTestTopUp(t *testing.T, createTime int64) *model.TopUp {
+	t.Helper()
+	topUp := &model.TopUp{
+		UserId:     1,
+		Amount:     1,
+		Money:      1,
+		TradeNo:    "trade-" + common.GetRandomString(8),
+		Provider:   failingQueryProvider{}.Name(),
+		CreateTime: createTime,
+		Status:     common.TopUpStatusPending,
+	}
+	require.NoError(t, topUp.Insert())
+	return topUp
+}
+
+func TestRunPaymentReconcileOnce_ExpiresStaleOrdersWhenQueryFails(t *testing.T) {
+	setupPaymentReconcileTest(t)
+	setting := operation_setting.GetPaymentSetting()
+	require.True(t, setting.ReconcileEnabled)
+	now := time.Now().Unix()
+	stale := createReconcileTestTopUp(t, now-int64(setting.PendingExpireHours)*3600-60)
+	recent := createReconcileTestTopUp(t, now-int64(setting.ReconcileMinutes)*60-60)
+
+	runPaymentReconcileOnce()
+
+	// 查询失败时超时订单仍然过期，未超时订单留待下一轮
+	require.Equal(t, common.TopUpStatusExpired, model.GetTopUpByTradeNo(stale.TradeNo).Status)
+	require.Equal(t, common.TopUpStatusPending, model.GetTopUpByTradeNo(recent.TradeNo).Status)
+	require.Zero(t, paymentReconcileCursor)
+}
+
+func TestRunPaymentReconcileOnce_AdvancesCursor(t *testing.T) {
+	setupPaymentReconcileTest(t)
+	createTime := time.Now().Unix() - int64(operation_setting.GetPaymentSetting().ReconcileMinutes)*60 - 60
+	var last *model.TopUp
+	for i := 0; i < paymentReconcileBatchSize+1; i++ {
+		last = createReconcileTestTopUp(t, createTime)
+	}
+
+	// 第一批订单查询都失败，下一轮从这一批之后继续
+	runPaymentReconcileOnce()
+	require.Equal(t, last.Id-1, paymentReconcileCursor)
+	runPaymentReconcileOnce()
+	require.Zero(t, paymentReconcileCursor)
+}
@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetPriceOverrides 管理员查询价格覆盖，支持按 user_id 过滤，active=true 时仅返回当前生效的记录
+func GetPriceOverrides(c *gin.Context) {
+	pageInfo := common.GetPageQuery(c)
+	userId, _ := strconv.Atoi(c.Query("user_id"))
+	overrides, total, err := model.GetPriceOverrides(userId, c.Query("active") == "true", pageInfo)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	pageInfo.SetTotal(int(total))
+	pageInfo.SetItems(overrides)
+	common.ApiSuccess(c, pageInfo)
+}
+
+func AddPriceOverride(c *gin.Context) {
+	override := model.PriceOverride{}
+	if err := c.ShouldBindJSON(&override); err != nil {
+		common.ApiErrorMsg(c, "无效的参数")
+		return
+	}
+	override.Id = 0
+	if _, err := model.GetUserById(override.UserId, false); err != nil {
+		common.ApiErrorMsg(c, "用户不存在")
+		return
+	}
+	if err := override.Validate(); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if err := override.Insert(); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	model.RecordLog(override.UserId, model.LogTypeManage, fmt.Sprintf("管理员为模型 %s 设置了价格覆盖 #%d", override.ModelName, override.Id))
+	common.ApiSuccess(c, &override)
+}
+
+func UpdatePriceOverride(c *gin.Context) {
+	override := model.PriceOverride{}
+	if err := c.ShouldBindJSON(&override); err != nil || override.Id == 0 {
+		common.ApiErrorMsg(c, "无效的参数")
+		return
+	}
+	origin, err := model.GetPriceOverrideById(override.Id)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	// 覆盖记录所属用户不可修改
+	override.UserId = origin.UserId
+	if err := override.Validate(); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if err := override.Update(); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	model.RecordLog(override.UserId, model.LogTypeManage, fmt.Sprintf("管理员修改了模型 %s 的价格覆盖 #%d", override.ModelName, override.Id))
+	common.ApiSuccess(c, &override)
+}
+
+func DeletePriceOverride(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		common.ApiErrorMsg(c, "无效的 id")
+		return
+	}
+	origin, err := model.GetPriceOverrideById(id)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if err := model.DeletePriceOverrideById(id); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	model.RecordLog(origin.UserId, model.LogTypeManage, fmt.Sprintf("管理员删除了模型 %s 的价格覆盖 #%d", origin.ModelName, origin.Id))
+	common.ApiSuccess(c, nil)
+}
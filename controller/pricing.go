@@ -1,6 +1,8 @@
 package controller
 
 import (
+	"time"
+
 	"github.com/QuantumNous/new-api/model"
 	"github.com/QuantumNous/new-api/service"
 	"github.com/QuantumNous/new-api/setting/ratio_setting"
@@ -17,7 +19,9 @@ func GetPricing(c *gin.Context) {
 		groupRatio[s] = f
 	}
 	var group string
+	var priceOverrides []*model.PriceOverride
 	if exists {
+		priceOverrides = model.GetUserActivePriceOverrides(userId.(int))
 		user, err := model.GetUserCache(userId.(int))
 		if err == nil {
 			group = user.Group
@@ -46,12 +50,15 @@ func GetPricing(c *gin.Context) {
 		"usable_group":       usableGroup,
 		"supported_endpoint": model.GetSupportedEndpointMap(),
 		"auto_groups":        service.GetUserAutoGroup(group),
+		"pricing_windows":    ratio_setting.GetPricingWindowsStatus(time.Now()),
+		"price_overrides":    priceOverrides,
 	})
 }
 
 func ResetModelRatio(c *gin.Context) {
 	defaultStr := ratio_setting.DefaultModelRatio2JSONString()
-	err := model.UpdateOption("ModelRatio", defaultStr)
+	before := currentOptionValue("ModelRatio")
+	err := model.UpdateOptionByUser("ModelRatio", defaultStr, c.GetInt("id"), c.GetString("username"))
 	if err != nil {
 		c.JSON(200, gin.H{
 			"success": false,
@@ -67,6 +74,7 @@ func ResetModelRatio(c *gin.Context) {
 		})
 		return
 	}
+	recordOptionAudit(c, "option.reset_model_ratio", "ModelRatio", before, defaultStr)
 	c.JSON(200, gin.H{
 		"success": true,
 		"message": "重置模型倍率成功",
@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"strconv"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+func getLedgerStatement(c *gin.Context, accountType string, accountId int) {
+	pageInfo := common.GetPageQuery(c)
+	startTimestamp, _ := strconv.ParseInt(c.Query("start_timestamp"), 10, 64)
+	endTimestamp, _ := strconv.ParseInt(c.Query("end_timestamp"), 10, 64)
+	query := model.LedgerQuery{
+		AccountType:    accountType,
+		AccountId:      accountId,
+		SourceType:     c.Query("source_type"),
+		StartTimestamp: startTimestamp,
+		EndTimestamp:   endTimestamp,
+	}
+	entries, total, err := model.GetLedgerEntries(query, pageInfo)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	summary, err := model.GetLedgerStatementSummary(accountType, accountId, startTimestamp, endTimestamp)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	pageInfo.SetTotal(int(total))
+	pageInfo.SetItems(entries)
+	common.ApiSuccess(c, gin.H{
+		"page":    pageInfo,
+		"summary": summary,
+	})
+}
+
+// GetSelfLedger 当前用户的额度对账单
+func GetSelfLedger(c *gin.Context) {
+	getLedgerStatement(c, model.LedgerAccountUser, c.GetInt("id"))
+}
+
+// GetUserLedger 管理员查看用户的额度对账单
+func GetUserLedger(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		common.ApiErrorMsg(c, "无效的用户 id")
+		return
+	}
+	getLedgerStatement(c, model.LedgerAccountUser, id)
+}
+
+// GetOrganizationLedger 管理员查看组织额度池的对账单
+func GetOrganizationLedger(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		common.ApiErrorMsg(c, "无效的组织 id")
+		return
+	}
+	getLedgerStatement(c, model.LedgerAccountOrg, id)
+}
+
+// GetLedgerReconcileReport 返回最近一次余额与账本的核对结果
+func GetLedgerReconcileReport(c *gin.Context) {
+	common.ApiSuccess(c, service.GetLedgerReconcileReport())
+}
+
+// RunLedgerReconcile 立即执行一次余额与账本核对
+func RunLedgerReconcile(c *gin.Context) {
+	if !service.RunLedgerReconcile() {
+		common.ApiErrorMsg(c, "对账正在进行中")
+		return
+	}
+	common.ApiSuccess(c, service.GetLedgerReconcileReport())
+}
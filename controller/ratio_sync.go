@@ -322,6 +322,16 @@ func FetchUpstreamRatios(c *gin.Context) {
 
 	differences := buildDifferences(localData, successfulChannels)
 
+	upstreamNames := make([]string, 0, len(upstreams))
+	for _, u := range upstreams {
+		upstreamNames = append(upstreamNames, u.Name)
+	}
+	// 拉取结果只用于对比，实际应用倍率通过 UpdateOption 完成并另行审计
+	model.RecordAudit(c, "ratio_sync.fetch", model.AuditTargetRatioSync, "", nil, gin.H{
+		"upstreams":   upstreamNames,
+		"differences": len(differences),
+	})
+
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"data": gin.H{
@@ -100,6 +100,8 @@ func AddRedemption(c *gin.Context) {
 			CreatedTime: common.GetTimestamp(),
 			Quota:       redemption.Quota,
 			ExpiredTime: redemption.ExpiredTime,
+
+			QuotaExpireDays: redemption.QuotaExpireDays,
 		}
 		err = cleanRedemption.Insert()
 		if err != nil {
@@ -110,6 +112,7 @@ func AddRedemption(c *gin.Context) {
 			})
 			return
 		}
+		model.RecordAudit(c, "redemption.create", model.AuditTargetRedemption, cleanRedemption.Id, nil, &cleanRedemption)
 		keys = append(keys, key)
 	}
 	c.JSON(http.StatusOK, gin.H{
@@ -122,11 +125,16 @@ func AddRedemption(c *gin.Context) {
 
 func DeleteRedemption(c *gin.Context) {
 	id, _ := strconv.Atoi(c.Param("id"))
-	err := model.DeleteRedemptionById(id)
+	origin, err := model.GetRedemptionById(id)
+	if err != nil {
+		origin = nil
+	}
+	err = model.DeleteRedemptionById(id)
 	if err != nil {
 		common.ApiError(c, err)
 		return
 	}
+	model.RecordAudit(c, "redemption.delete", model.AuditTargetRedemption, id, origin, nil)
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "",
@@ -147,6 +155,7 @@ func UpdateRedemption(c *gin.Context) {
 		common.ApiError(c, err)
 		return
 	}
+	originRedemption := *cleanRedemption
 	if statusOnly == "" {
 		if err := validateExpiredTime(redemption.ExpiredTime); err != nil {
 			c.JSON(http.StatusOK, gin.H{"success": false, "message": err.Error()})
@@ -156,6 +165,7 @@ func UpdateRedemption(c *gin.Context) {
 		cleanRedemption.Name = redemption.Name
 		cleanRedemption.Quota = redemption.Quota
 		cleanRedemption.ExpiredTime = redemption.ExpiredTime
+		cleanRedemption.QuotaExpireDays = redemption.QuotaExpireDays
 	}
 	if statusOnly != "" {
 		cleanRedemption.Status = redemption.Status
@@ -165,6 +175,7 @@ func UpdateRedemption(c *gin.Context) {
 		common.ApiError(c, err)
 		return
 	}
+	model.RecordAudit(c, "redemption.update", model.AuditTargetRedemption, cleanRedemption.Id, &originRedemption, cleanRedemption)
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "",
@@ -179,6 +190,7 @@ func DeleteInvalidRedemption(c *gin.Context) {
 		common.ApiError(c, err)
 		return
 	}
+	model.RecordAudit(c, "redemption.delete_invalid", model.AuditTargetRedemption, "", nil, gin.H{"deleted": rows})
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "",
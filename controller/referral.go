@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetSelfReferralCommissions 邀请人查看自己获得的返佣记录与汇总
+func GetSelfReferralCommissions(c *gin.Context) {
+	userId := c.GetInt("id")
+	pageInfo := common.GetPageQuery(c)
+	commissions, total, err := model.GetReferralCommissions(userId, 0, pageInfo)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	summary, err := model.GetReferralCommissionSummary(userId)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	pageInfo.SetTotal(int(total))
+	pageInfo.SetItems(commissions)
+	setting := operation_setting.GetReferralSetting()
+	common.ApiSuccess(c, gin.H{
+		"page":               pageInfo,
+		"summary":            summary,
+		"commission_enabled": setting.CommissionEnabled,
+		"commission_rates":   setting.CommissionRates,
+		"commission_days":    setting.CommissionDays,
+	})
+}
+
+// GetReferralCommissions 管理员按邀请人或被邀请人查询返佣记录
+func GetReferralCommissions(c *gin.Context) {
+	inviterId, _ := strconv.Atoi(c.Query("inviter_id"))
+	inviteeId, _ := strconv.Atoi(c.Query("invitee_id"))
+	pageInfo := common.GetPageQuery(c)
+	commissions, total, err := model.GetReferralCommissions(inviterId, inviteeId, pageInfo)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	pageInfo.SetTotal(int(total))
+	pageInfo.SetItems(commissions)
+	common.ApiSuccess(c, pageInfo)
+}
+
+// RevokeReferralCommission 管理员撤销异常返佣，从邀请人的邀请额度中扣回
+func RevokeReferralCommission(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		common.ApiErrorMsg(c, "无效的返佣记录 id")
+		return
+	}
+	commission, err := model.RevokeReferralCommission(id)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	model.RecordLog(commission.InviterId, model.LogTypeManage, fmt.Sprintf("管理员撤销了订单 %s 的邀请返佣，扣回邀请额度 %s",
+		commission.TradeNo, logger.LogQuota(commission.RevokedQuota)))
+	common.ApiSuccess(c, commission)
+}
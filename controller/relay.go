@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/constant"
@@ -15,6 +16,8 @@ import (
 	"github.com/QuantumNous/new-api/logger"
 	"github.com/QuantumNous/new-api/middleware"
 	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/pkg/metrics"
+	"github.com/QuantumNous/new-api/pkg/tracing"
 	"github.com/QuantumNous/new-api/relay"
 	relaycommon "github.com/QuantumNous/new-api/relay/common"
 	relayconstant "github.com/QuantumNous/new-api/relay/constant"
@@ -28,6 +31,8 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func relayHandler(c *gin.Context, info *relaycommon.RelayInfo) *types.NewAPIError {
@@ -84,6 +89,10 @@ func Relay(c *gin.Context, relayFormat types.RelayFormat) {
 		defer ws.Close()
 	}
 
+	// 先于错误响应的 defer 注册，保证错误响应也被留存
+	bodyCapture := service.StartBodyCapture(c, relayFormat)
+	defer bodyCapture.Finish(c)
+
 	defer func() {
 		if newAPIError != nil {
 			logger.LogError(c, fmt.Sprintf("relay error: %s", newAPIError.Error()))
@@ -121,11 +130,35 @@ func Relay(c *gin.Context, relayFormat types.RelayFormat) {
 		return
 	}
 
+	service.TrafficRelayStarted(c, relayInfo)
+	defer func() {
+		observation := metrics.RelayObservation{
+			ChannelId:   common.GetContextKeyInt(c, constant.ContextKeyChannelId),
+			Model:       relayInfo.OriginModelName,
+			Group:       relayInfo.UsingGroup,
+			RelayFormat: string(relayFormat),
+			StatusCode:  c.Writer.Status(),
+			Duration:    time.Since(relayInfo.StartTime),
+			Retries:     max(len(c.GetStringSlice("use_channel"))-1, 0),
+		}
+		if newAPIError != nil {
+			observation.StatusCode = newAPIError.StatusCode
+		}
+		if relayInfo.IsStream && relayInfo.HasSendResponse() {
+			observation.TTFT = relayInfo.FirstResponseTime.Sub(relayInfo.StartTime)
+		}
+		metrics.ObserveRelay(observation)
+		service.TrafficRelayFinished(c, relayInfo, observation.StatusCode, newAPIError.Unwrap())
+	}()
+
 	needSensitiveCheck := setting.ShouldCheckPromptSensitive()
 	needCountToken := constant.CountToken
+	// 令牌限制了输入 token 时，即使关闭了 token 统计也需要计算输入长度
+	scopes, _ := common.GetContextKeyType[*dto.TokenScopes](c, constant.ContextKeyTokenScopes)
+	needScopeInputCheck := scopes != nil && scopes.MaxInputTokens > 0
 	// Avoid building huge CombineText (strings.Join) when token counting and sensitive check are both disabled.
 	var meta *types.TokenCountMeta
-	if needSensitiveCheck || needCountToken {
+	if needSensitiveCheck || needCountToken || needScopeInputCheck {
 		meta = request.GetTokenCountMeta()
 	} else {
 		meta = fastTokenCountMetaForPricing(request)
@@ -140,7 +173,9 @@ func Relay(c *gin.Context, relayFormat types.RelayFormat) {
 		}
 	}
 
+	endSpan := startRelaySpan(c, "relay.count_tokens")
 	tokens, err := service.EstimateRequestToken(c, meta, relayInfo)
+	endSpan(err)
 	if err != nil {
 		newAPIError = types.NewError(err, types.ErrorCodeCountTokenFailed)
 		return
@@ -148,7 +183,19 @@ func Relay(c *gin.Context, relayFormat types.RelayFormat) {
 
 	relayInfo.SetEstimatePromptTokens(tokens)
 
+	newAPIError = checkScopeInputTokens(c, func() int {
+		if !needCountToken && meta != nil {
+			return service.CountTextToken(meta.CombineText, relayInfo.OriginModelName)
+		}
+		return tokens
+	})
+	if newAPIError != nil {
+		return
+	}
+
+	endSpan = startRelaySpan(c, "relay.price")
 	priceData, err := helper.ModelPriceHelper(c, relayInfo, tokens, meta)
+	endSpan(err)
 	if err != nil {
 		newAPIError = types.NewError(err, types.ErrorCodeModelPriceError)
 		return
@@ -159,7 +206,9 @@ func Relay(c *gin.Context, relayFormat types.RelayFormat) {
 	if priceData.FreeModel {
 		logger.LogInfo(c, fmt.Sprintf("模型 %s 免费，跳过预扣费", relayInfo.OriginModelName))
 	} else {
+		endSpan = startRelaySpan(c, "relay.pre_consume", attribute.Int("quota", priceData.QuotaToPreConsume))
 		newAPIError = service.PreConsumeQuota(c, priceData.QuotaToPreConsume, relayInfo)
+		endSpan(newAPIError.Unwrap())
 		if newAPIError != nil {
 			return
 		}
@@ -184,7 +233,9 @@ func Relay(c *gin.Context, relayFormat types.RelayFormat) {
 	}
 
 	for ; retryParam.GetRetry() <= common.RetryTimes; retryParam.IncreaseRetry() {
+		endSpan = startRelaySpan(c, "relay.select_channel", attribute.Int("relay.retry", retryParam.GetRetry()))
 		channel, channelErr := getChannel(c, relayInfo, retryParam)
+		endSpan(channelErr.Unwrap())
 		if channelErr != nil {
 			logger.LogError(c, channelErr.Error())
 			newAPIError = channelErr
@@ -204,6 +255,7 @@ func Relay(c *gin.Context, relayFormat types.RelayFormat) {
 		}
 		c.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody))
 
+		endAttempt := startRelayAttemptSpan(c, relayInfo, retryParam.GetRetry(), channel)
 		switch relayFormat {
 		case types.RelayFormatOpenAIRealtime:
 			newAPIError = relay.WssHelper(c, relayInfo)
@@ -214,6 +266,7 @@ func Relay(c *gin.Context, relayFormat types.RelayFormat) {
 		default:
 			newAPIError = relayHandler(c, relayInfo)
 		}
+		endAttempt(newAPIError)
 
 		if newAPIError == nil {
 			return
@@ -242,6 +295,22 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+// checkScopeInputTokens 令牌限制了输入 token 数时校验本次请求，所有转发入口都需调用；
+// countInput 为 nil 表示该入口无法估算输入长度（如 Midjourney、异步任务提交），此时直接拒绝
+func checkScopeInputTokens(c *gin.Context, countInput func() int) *types.NewAPIError {
+	scopes, _ := common.GetContextKeyType[*dto.TokenScopes](c, constant.ContextKeyTokenScopes)
+	if scopes == nil || scopes.MaxInputTokens <= 0 {
+		return nil
+	}
+	if countInput == nil {
+		return types.NewErrorWithStatusCode(fmt.Errorf("该令牌限制了输入 token 数，不能用于 %s", c.Request.URL.Path), types.ErrorCodeTokenScopeDenied, http.StatusForbidden, types.ErrOptionWithSkipRetry())
+	}
+	if inputTokens := countInput(); inputTokens > scopes.MaxInputTokens {
+		return types.NewErrorWithStatusCode(fmt.Errorf("请求输入 token 数 %d 超过令牌上限 %d", inputTokens, scopes.MaxInputTokens), types.ErrorCodeTokenScopeDenied, http.StatusForbidden, types.ErrOptionWithSkipRetry())
+	}
+	return nil
+}
+
 func addUsedChannel(c *gin.Context, channelId int) {
 	useChannel := c.GetStringSlice("use_channel")
 	useChannel = append(useChannel, fmt.Sprintf("%d", channelId))
@@ -392,6 +461,19 @@ func RelayMidjourney(c *gin.Context) {
 
 	var mjErr *dto.MidjourneyResponse
 	switch relayInfo.RelayMode {
+	case relayconstant.RelayModeMidjourneyNotify, relayconstant.RelayModeMidjourneyTaskFetch,
+		relayconstant.RelayModeMidjourneyTaskFetchByCondition, relayconstant.RelayModeMidjourneyTaskImageSeed:
+	default:
+		if scopeErr := checkScopeInputTokens(c, nil); scopeErr != nil {
+			c.JSON(scopeErr.StatusCode, gin.H{
+				"description": scopeErr.Error(),
+				"type":        "new_api_error",
+				"code":        constant.MjRequestError,
+			})
+			return
+		}
+	}
+	switch relayInfo.RelayMode {
 	case relayconstant.RelayModeMidjourneyNotify:
 		mjErr = relay.RelayMidjourneyNotify(c)
 	case relayconstant.RelayModeMidjourneyTaskFetch, relayconstant.RelayModeMidjourneyTaskFetchByCondition:
@@ -453,6 +535,12 @@ func RelayTask(c *gin.Context) {
 	if err != nil {
 		return
 	}
+	if !isTaskFetchMode(relayInfo.RelayMode) {
+		if scopeErr := checkScopeInputTokens(c, nil); scopeErr != nil {
+			c.JSON(scopeErr.StatusCode, service.TaskErrorWrapperLocal(scopeErr.Err, string(types.ErrorCodeTokenScopeDenied), scopeErr.StatusCode))
+			return
+		}
+	}
 	taskErr := taskRelayHandler(c, relayInfo)
 	if taskErr == nil {
 		retryTimes = 0
@@ -504,15 +592,22 @@ func RelayTask(c *gin.Context) {
 
 func taskRelayHandler(c *gin.Context, relayInfo *relaycommon.RelayInfo) *dto.TaskError {
 	var err *dto.TaskError
-	switch relayInfo.RelayMode {
-	case relayconstant.RelayModeSunoFetch, relayconstant.RelayModeSunoFetchByID, relayconstant.RelayModeVideoFetchByID:
+	if isTaskFetchMode(relayInfo.RelayMode) {
 		err = relay.RelayTaskFetch(c, relayInfo.RelayMode)
-	default:
+	} else {
 		err = relay.RelayTaskSubmit(c, relayInfo)
 	}
 	return err
 }
 
+func isTaskFetchMode(relayMode int) bool {
+	switch relayMode {
+	case relayconstant.RelayModeSunoFetch, relayconstant.RelayModeSunoFetchByID, relayconstant.RelayModeVideoFetchByID:
+		return true
+	}
+	return false
+}
+
 func shouldRetryTaskRelay(c *gin.Context, channelId int, taskErr *dto.TaskError, retryTimes int) bool {
 	if taskErr == nil {
 		return false
@@ -554,3 +649,43 @@ func shouldRetryTaskRelay(c *gin.Context, channelId int, taskErr *dto.TaskError,
 	}
 	return true
 }
+
+// startRelaySpan 为中继的一个阶段创建子 span，阶段内通过 c.Request.Context() 发起的调用挂在该 span 下，
+// 返回的函数结束 span 并恢复原请求上下文
+func startRelaySpan(c *gin.Context, name string, attrs ...attribute.KeyValue) func(err error) {
+	if !tracing.Enabled() {
+		return func(error) {}
+	}
+	parent := c.Request.Context()
+	ctx, span := tracing.Start(parent, name, attrs...)
+	c.Request = c.Request.WithContext(ctx)
+	return func(err error) {
+		c.Request = c.Request.WithContext(parent)
+		tracing.EndWithError(span, err)
+	}
+}
+
+// startRelayAttemptSpan 为一次渠道尝试创建子 span，记录渠道、状态码与首字耗时
+func startRelayAttemptSpan(c *gin.Context, info *relaycommon.RelayInfo, retry int, channel *model.Channel) func(apiErr *types.NewAPIError) {
+	if !tracing.Enabled() {
+		return func(*types.NewAPIError) {}
+	}
+	end := startRelaySpan(c, "relay.attempt",
+		attribute.Int("relay.retry", retry),
+		attribute.Int("channel.id", channel.Id),
+		attribute.Int("channel.type", channel.Type),
+		attribute.String("model", info.OriginModelName),
+	)
+	span := trace.SpanFromContext(c.Request.Context())
+	return func(apiErr *types.NewAPIError) {
+		status := c.Writer.Status()
+		if apiErr != nil {
+			status = apiErr.StatusCode
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if info.HasSendResponse() {
+			span.SetAttributes(attribute.Int64("relay.ttft_ms", info.FirstResponseTime.Sub(info.StartTime).Milliseconds()))
+		}
+		end(apiErr.Unwrap())
+	}
+}
@@ -0,0 +1,56 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	relayconstant "github.com/QuantumNous/new-api/relay/constant"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func newScopeTestContext(scopes *dto.TokenScopes) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/mj/submit/imagine", nil)
+	if scopes != nil {
+		common.SetContextKey(c, constant.ContextKeyTokenScopes, scopes)
+	}
+	return c
+}
+
+func TestCheckScopeInputTokens(t *testing.T) {
+	counted := 0
+	count := func() int {
+		counted++
+		return 100
+	}
+
+	// 未限制输入时不估算，也不拒绝无法估算的入口
+	require.Nil(t, checkScopeInputTokens(newScopeTestContext(nil), count))
+	require.Nil(t, checkScopeInputTokens(newScopeTestContext(&dto.TokenScopes{MaxTokens: 10}), nil))
+	require.Zero(t, counted)
+
+	limited := &dto.TokenScopes{MaxInputTokens: 100}
+	require.Nil(t, checkScopeInputTokens(newScopeTestContext(limited), count))
+	limited.MaxInputTokens = 99
+	apiErr := checkScopeInputTokens(newScopeTestContext(limited), count)
+	require.NotNil(t, apiErr)
+	require.Equal(t, http.StatusForbidden, apiErr.StatusCode)
+
+	// Midjourney 与异步任务无法估算输入，限制了输入的令牌直接拒绝
+	apiErr = checkScopeInputTokens(newScopeTestContext(limited), nil)
+	require.NotNil(t, apiErr)
+	require.Equal(t, http.StatusForbidden, apiErr.StatusCode)
+	require.Contains(t, apiErr.Error(), "/mj/submit/imagine")
+}
+
+func TestIsTaskFetchMode(t *testing.T) {
+	require.True(t, isTaskFetchMode(relayconstant.RelayModeSunoFetch))
+	require.True(t, isTaskFetchMode(relayconstant.RelayModeVideoFetchByID))
+	require.False(t, isTaskFetchMode(relayconstant.RelayModeSunoSubmit))
+}
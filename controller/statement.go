@@ -0,0 +1,194 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// getStatementOwner 解析账单主体，org_id 非 0 时为组织账单，需要组织的账单管理权限
+func getStatementOwner(userId int, orgId int) (string, int, error) {
+	if orgId == 0 {
+		return model.LedgerAccountUser, userId, nil
+	}
+	member, err := model.GetOrgMember(orgId, userId)
+	if err != nil || !member.CanManageBilling() {
+		return "", 0, errors.New("无权查看该组织的账单")
+	}
+	return model.LedgerAccountOrg, orgId, nil
+}
+
+// getSelfStatement 读取路径中的账单并校验当前用户的访问权限
+func getSelfStatement(c *gin.Context) (*model.Statement, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return nil, errors.New("无效的账单 id")
+	}
+	statement, err := model.GetStatementById(id)
+	if err != nil {
+		return nil, errors.New("账单不存在")
+	}
+	orgId := 0
+	if statement.OwnerType == model.LedgerAccountOrg {
+		orgId = statement.OwnerId
+	}
+	ownerType, ownerId, err := getStatementOwner(c.GetInt("id"), orgId)
+	if err != nil || ownerType != statement.OwnerType || ownerId != statement.OwnerId {
+		return nil, errors.New("账单不存在")
+	}
+	return statement, nil
+}
+
+func writeStatementFile(c *gin.Context, statement *model.Statement) {
+	var (
+		content     []byte
+		err         error
+		contentType string
+		ext         string
+	)
+	switch c.DefaultQuery("format", "csv") {
+	case "csv":
+		content, err = service.RenderStatementCSV(statement)
+		contentType, ext = "text/csv; charset=utf-8", "csv"
+	case "html":
+		content, err = service.RenderStatementHTML(statement)
+		contentType, ext = "text/html; charset=utf-8", "html"
+	default:
+		common.ApiErrorMsg(c, "不支持的账单格式")
+		return
+	}
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	filename := fmt.Sprintf("statement-%s-%s-%d.%s", statement.Period, statement.OwnerType, statement.OwnerId, ext)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Data(http.StatusOK, contentType, content)
+}
+
+func GetSelfStatements(c *gin.Context) {
+	orgId, _ := strconv.Atoi(c.Query("org_id"))
+	ownerType, ownerId, err := getStatementOwner(c.GetInt("id"), orgId)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	pageInfo := common.GetPageQuery(c)
+	statements, total, err := model.GetStatements(ownerType, ownerId, pageInfo)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	pageInfo.SetTotal(int(total))
+	pageInfo.SetItems(statements)
+	common.ApiSuccess(c, pageInfo)
+}
+
+type generateStatementRequest struct {
+	Period    string `json:"period"`
+	OrgId     int    `json:"org_id"`
+	OwnerType string `json:"owner_type"` // 仅管理员接口使用
+	OwnerId   int    `json:"owner_id"`   // 仅管理员接口使用
+}
+
+// GenerateSelfStatement 生成当前用户或其组织已结束月份的账单，已存在时重新生成
+func GenerateSelfStatement(c *gin.Context) {
+	var req generateStatementRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.ApiErrorMsg(c, "无效的参数")
+		return
+	}
+	closed, err := model.IsStatementPeriodClosed(req.Period)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if !closed {
+		common.ApiErrorMsg(c, "只能生成已结束月份的账单")
+		return
+	}
+	ownerType, ownerId, err := getStatementOwner(c.GetInt("id"), req.OrgId)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	statement, err := model.GenerateStatement(ownerType, ownerId, req.Period)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, statement)
+}
+
+func DownloadSelfStatement(c *gin.Context) {
+	statement, err := getSelfStatement(c)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	writeStatementFile(c, statement)
+}
+
+func EmailSelfStatement(c *gin.Context) {
+	statement, err := getSelfStatement(c)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if err := service.SendStatementEmail(statement); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, nil)
+}
+
+// GetStatements 管理员查询指定用户或组织的账单
+func GetStatements(c *gin.Context) {
+	ownerId, _ := strconv.Atoi(c.Query("owner_id"))
+	ownerType := c.DefaultQuery("owner_type", model.LedgerAccountUser)
+	pageInfo := common.GetPageQuery(c)
+	statements, total, err := model.GetStatements(ownerType, ownerId, pageInfo)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	pageInfo.SetTotal(int(total))
+	pageInfo.SetItems(statements)
+	common.ApiSuccess(c, pageInfo)
+}
+
+// AdminGenerateStatement 管理员为指定用户或组织生成账单
+func AdminGenerateStatement(c *gin.Context) {
+	var req generateStatementRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.OwnerId == 0 {
+		common.ApiErrorMsg(c, "无效的参数")
+		return
+	}
+	statement, err := model.GenerateStatement(req.OwnerType, req.OwnerId, req.Period)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, statement)
+}
+
+func AdminDownloadStatement(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		common.ApiErrorMsg(c, "无效的账单 id")
+		return
+	}
+	statement, err := model.GetStatementById(id)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	writeStatementFile(c, statement)
+}
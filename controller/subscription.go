@@ -0,0 +1,279 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting"
+
+	"github.com/gin-gonic/gin"
+	"github.com/thanhpk/randstr"
+)
+
+func GetSubscriptionPlans(c *gin.Context) {
+	plans, err := model.GetSubscriptionPlans(true)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, plans)
+}
+
+func GetSelfSubscription(c *gin.Context) {
+	userId := c.GetInt("id")
+	active, err := model.GetActiveUserSubscription(userId)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	history, err := model.GetUserSubscriptions(userId)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, gin.H{
+		"active":  active,
+		"history": history,
+	})
+}
+
+type SubscribeRequest struct {
+	PlanId        int    `json:"plan_id"`
+	PaymentMethod string `json:"payment_method"`
+}
+
+func Subscribe(c *gin.Context) {
+	var req SubscribeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	userId := c.GetInt("id")
+	switch req.PaymentMethod {
+	case "", model.SubscriptionProviderBalance:
+		sub, err := model.SubscribeWithBalance(userId, req.PlanId)
+		if err != nil {
+			common.ApiError(c, err)
+			return
+		}
+		common.ApiSuccess(c, sub)
+	case PaymentMethodStripe, PaymentMethodCreem:
+		payLink, err := requestSubscriptionPay(userId, req.PlanId, req.PaymentMethod)
+		if err != nil {
+			common.ApiError(c, err)
+			return
+		}
+		common.ApiSuccess(c, gin.H{"pay_link": payLink})
+	default:
+		common.ApiErrorMsg(c, "不支持的支付渠道")
+	}
+}
+
+// requestSubscriptionPay 创建待支付订阅并返回第三方支付链接，支付回调后激活订阅
+func requestSubscriptionPay(userId int, planId int, paymentMethod string) (string, error) {
+	plan, err := model.GetSubscriptionPlanById(planId)
+	if err != nil || !plan.Enabled {
+		return "", errors.New("订阅套餐不存在")
+	}
+	user, err := model.GetUserById(userId, false)
+	if err != nil {
+		return "", err
+	}
+	reference := fmt.Sprintf("sub-ref-%d-%d-%s", user.Id, time.Now().UnixMilli(), randstr.String(4))
+	referenceId := "sub_" + common.Sha1([]byte(reference))
+
+	var payLink string
+	switch paymentMethod {
+	case PaymentMethodStripe:
+		if plan.StripePriceId == "" {
+			return "", errors.New("该套餐不支持 Stripe 支付")
+		}
+		payLink, err = genStripeSubscriptionLink(referenceId, user.StripeCustomer, user.Email, plan.StripePriceId)
+	case PaymentMethodCreem:
+		if plan.CreemProductId == "" {
+			return "", errors.New("该套餐不支持 Creem 支付")
+		}
+		payLink, err = genCreemLink(referenceId, &CreemProduct{
+			ProductId: plan.CreemProductId,
+			Name:      plan.Name,
+			Price:     plan.Price,
+			Currency:  plan.Currency,
+		}, user.Email, user.Username)
+	}
+	if err != nil {
+		log.Printf("获取订阅支付链接失败: %v", err)
+		return "", errors.New("拉起支付失败")
+	}
+	if err := model.CreatePendingSubscription(userId, plan, paymentMethod, referenceId); err != nil {
+		return "", errors.New("创建订单失败")
+	}
+	return payLink, nil
+}
+
+type subscriptionRenewRequest struct {
+	Id        int  `json:"id"`
+	AutoRenew bool `json:"auto_renew"`
+}
+
+// UpdateSubscriptionRenew 开启或关闭自动续订，第三方订阅仅支持关闭
+func UpdateSubscriptionRenew(c *gin.Context) {
+	var req subscriptionRenewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	sub, err := model.GetUserSubscriptionById(req.Id)
+	if err != nil || sub.UserId != c.GetInt("id") || sub.Status != model.SubscriptionStatusActive {
+		common.ApiErrorMsg(c, "订阅不存在")
+		return
+	}
+	if req.AutoRenew == sub.AutoRenew {
+		common.ApiSuccess(c, sub)
+		return
+	}
+	switch sub.Provider {
+	case model.SubscriptionProviderBalance:
+	case model.SubscriptionProviderStripe, model.SubscriptionProviderCreem:
+		if req.AutoRenew {
+			common.ApiErrorMsg(c, "已取消的订阅无法恢复，请在到期后重新订阅")
+			return
+		}
+		if sub.Provider == model.SubscriptionProviderStripe {
+			err = cancelStripeSubscription(sub.ProviderSubscriptionId)
+		} else {
+			err = cancelCreemSubscription(sub.ProviderSubscriptionId)
+		}
+		if err != nil {
+			common.SysLog(fmt.Sprintf("failed to cancel %s subscription %s: %s", sub.Provider, sub.ProviderSubscriptionId, err.Error()))
+			common.ApiErrorMsg(c, "取消订阅失败，请稍后重试")
+			return
+		}
+	default:
+		common.ApiErrorMsg(c, "该订阅不支持自动续订")
+		return
+	}
+	if err := sub.SetAutoRenew(req.AutoRenew); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, sub)
+}
+
+func GetAllSubscriptionPlans(c *gin.Context) {
+	plans, err := model.GetSubscriptionPlans(false)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, gin.H{
+		"plans":          plans,
+		"stripe_enabled": setting.StripeApiSecret != "",
+		"creem_enabled":  setting.CreemApiKey != "",
+	})
+}
+
+func AddSubscriptionPlan(c *gin.Context) {
+	plan := model.SubscriptionPlan{}
+	if err := c.ShouldBindJSON(&plan); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	plan.Id = 0
+	if err := plan.Insert(); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, plan)
+}
+
+func UpdateSubscriptionPlan(c *gin.Context) {
+	plan := model.SubscriptionPlan{}
+	if err := c.ShouldBindJSON(&plan); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if _, err := model.GetSubscriptionPlanById(plan.Id); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if err := plan.Update(); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, plan)
+}
+
+func DeleteSubscriptionPlan(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if err := model.DeleteSubscriptionPlanById(id); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	common.ApiSuccess(c, nil)
+}
+
+func GetAllSubscriptions(c *gin.Context) {
+	pageInfo := common.GetPageQuery(c)
+	subs, total, err := model.GetAllUserSubscriptions(c.Query("status"), pageInfo)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	pageInfo.SetTotal(int(total))
+	pageInfo.SetItems(subs)
+	common.ApiSuccess(c, pageInfo)
+}
+
+type grantSubscriptionRequest struct {
+	UserId int `json:"user_id"`
+	PlanId int `json:"plan_id"`
+}
+
+func GrantSubscription(c *gin.Context) {
+	var req grantSubscriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if _, err := model.GetUserById(req.UserId, false); err != nil {
+		common.ApiErrorMsg(c, "用户不存在")
+		return
+	}
+	sub, err := model.GrantSubscription(req.UserId, req.PlanId)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	service.NotifySubscriptionEvent(sub.UserId, "套餐已开通", fmt.Sprintf("管理员已为您开通套餐 %s。", sub.Plan.Name))
+	common.ApiSuccess(c, sub)
+}
+
+// ExpireSubscription 管理员立即终止订阅，不会调用第三方取消接口
+func ExpireSubscription(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	sub, err := model.GetUserSubscriptionById(id)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if err := model.ExpireSubscription(sub); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	model.RecordLog(sub.UserId, model.LogTypeManage, fmt.Sprintf("管理员终止了订阅 #%d", sub.Id))
+	common.ApiSuccess(c, nil)
+}
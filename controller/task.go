@@ -16,6 +16,7 @@ import (
 	"github.com/QuantumNous/new-api/dto"
 	"github.com/QuantumNous/new-api/logger"
 	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/pkg/metrics"
 	"github.com/QuantumNous/new-api/relay"
 
 	"github.com/gin-gonic/gin"
@@ -34,6 +35,11 @@ func UpdateTaskBulk() {
 		for _, t := range allTasks {
 			platformTask[t.Platform] = append(platformTask[t.Platform], t)
 		}
+		depths := make(map[string]int, len(platformTask))
+		for platform, tasks := range platformTask {
+			depths[string(platform)] = len(tasks)
+		}
+		metrics.SetTaskQueueDepths("task", depths)
 		for platform, tasks := range platformTask {
 			if len(tasks) == 0 {
 				continue
@@ -165,7 +171,7 @@ func updateSunoTaskAll(ctx context.Context, channelId int, taskIds []string, tas
 			} else {
 				quota := task.Quota
 				if quota != 0 {
-					err = model.IncreaseUserQuota(task.UserId, quota, false)
+					err = model.UpdateUserQuotaWithLedger(task.UserId, quota, model.LedgerSourceRefund, task.TaskID, true)
 					if err != nil {
 						logger.LogError(ctx, "fail to increase user quota: "+err.Error())
 					}
@@ -168,6 +168,18 @@ func AddToken(c *gin.Context) {
 			return
 		}
 	}
+	if err := token.ValidateScopes(); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if err := token.ValidateAutoRefill(); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if err := checkOrgTokenAccess(c.GetInt("id"), token.OrgId); err != nil {
+		common.ApiError(c, err)
+		return
+	}
 	key, err := common.GenerateKey()
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
@@ -178,19 +190,25 @@ func AddToken(c *gin.Context) {
 		return
 	}
 	cleanToken := model.Token{
-		UserId:             c.GetInt("id"),
-		Name:               token.Name,
-		Key:                key,
-		CreatedTime:        common.GetTimestamp(),
-		AccessedTime:       common.GetTimestamp(),
-		ExpiredTime:        token.ExpiredTime,
-		RemainQuota:        token.RemainQuota,
-		UnlimitedQuota:     token.UnlimitedQuota,
-		ModelLimitsEnabled: token.ModelLimitsEnabled,
-		ModelLimits:        token.ModelLimits,
-		AllowIps:           token.AllowIps,
-		Group:              token.Group,
-		CrossGroupRetry:    token.CrossGroupRetry,
+		UserId:              c.GetInt("id"),
+		Name:                token.Name,
+		Key:                 key,
+		CreatedTime:         common.GetTimestamp(),
+		AccessedTime:        common.GetTimestamp(),
+		ExpiredTime:         token.ExpiredTime,
+		RemainQuota:         token.RemainQuota,
+		UnlimitedQuota:      token.UnlimitedQuota,
+		ModelLimitsEnabled:  token.ModelLimitsEnabled,
+		ModelLimits:         token.ModelLimits,
+		AllowIps:            token.AllowIps,
+		Group:               token.Group,
+		CrossGroupRetry:     token.CrossGroupRetry,
+		Scopes:              token.Scopes,
+		OrgId:               token.OrgId,
+		AutoRefillEnabled:   token.AutoRefillEnabled,
+		AutoRefillThreshold: token.AutoRefillThreshold,
+		AutoRefillAmount:    token.AutoRefillAmount,
+		AutoRefillDailyMax:  token.AutoRefillDailyMax,
 	}
 	err = cleanToken.Insert()
 	if err != nil {
@@ -252,6 +270,18 @@ func UpdateToken(c *gin.Context) {
 			return
 		}
 	}
+	if err := token.ValidateScopes(); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if err := token.ValidateAutoRefill(); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	if err := checkOrgTokenAccess(userId, token.OrgId); err != nil {
+		common.ApiError(c, err)
+		return
+	}
 	cleanToken, err := model.GetTokenByIds(token.Id, userId)
 	if err != nil {
 		common.ApiError(c, err)
@@ -286,6 +316,12 @@ func UpdateToken(c *gin.Context) {
 		cleanToken.AllowIps = token.AllowIps
 		cleanToken.Group = token.Group
 		cleanToken.CrossGroupRetry = token.CrossGroupRetry
+		cleanToken.OrgId = token.OrgId
+		cleanToken.Scopes = token.Scopes
+		cleanToken.AutoRefillEnabled = token.AutoRefillEnabled
+		cleanToken.AutoRefillThreshold = token.AutoRefillThreshold
+		cleanToken.AutoRefillAmount = token.AutoRefillAmount
+		cleanToken.AutoRefillDailyMax = token.AutoRefillDailyMax
 	}
 	err = cleanToken.Update()
 	if err != nil {
@@ -1,15 +1,17 @@
 package controller
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/QuantumNous/new-api/common"
-	"github.com/QuantumNous/new-api/logger"
 	"github.com/QuantumNous/new-api/model"
 	"github.com/QuantumNous/new-api/service"
 	"github.com/QuantumNous/new-api/setting"
@@ -115,11 +117,14 @@ type EpayRequest struct {
 	Amount        int64  `json:"amount"`
 	PaymentMethod string `json:"payment_method"`
 	TopUpCode     string `json:"top_up_code"`
+	OrgId         int    `json:"org_id"`
+	CouponCode    string `json:"coupon_code"`
 }
 
 type AmountRequest struct {
-	Amount    int64  `json:"amount"`
-	TopUpCode string `json:"top_up_code"`
+	Amount     int64  `json:"amount"`
+	TopUpCode  string `json:"top_up_code"`
+	CouponCode string `json:"coupon_code"`
 }
 
 func GetEpayClient() *epay.Client {
@@ -189,6 +194,10 @@ func RequestEpay(c *gin.Context) {
 	}
 
 	id := c.GetInt("id")
+	if err := checkOrgBilling(id, req.OrgId); err != nil {
+		c.JSON(200, gin.H{"message": "error", "data": err.Error()})
+		return
+	}
 	group, err := model.GetUserGroup(id, true)
 	if err != nil {
 		c.JSON(200, gin.H{"message": "error", "data": "获取用户分组失败"})
@@ -199,35 +208,24 @@ func RequestEpay(c *gin.Context) {
 		c.JSON(200, gin.H{"message": "error", "data": "充值金额过低"})
 		return
 	}
+	couponQuote, payMoney, err := quoteTopUpCoupon(req.CouponCode, id, group, payMoney)
+	if err != nil {
+		c.JSON(200, gin.H{"message": "error", "data": err.Error()})
+		return
+	}
 
 	if !operation_setting.ContainsPayMethod(req.PaymentMethod) {
 		c.JSON(200, gin.H{"message": "error", "data": "支付方式不存在"})
 		return
 	}
 
-	callBackAddress := service.GetCallbackAddress()
-	returnUrl, _ := url.Parse(system_setting.ServerAddress + "/console/log")
-	notifyUrl, _ := url.Parse(callBackAddress + "/api/user/epay/notify")
-	tradeNo := fmt.Sprintf("%s%d", common.GetRandomString(6), time.Now().Unix())
-	tradeNo = fmt.Sprintf("USR%dNO%s", id, tradeNo)
 	client := GetEpayClient()
 	if client == nil {
 		c.JSON(200, gin.H{"message": "error", "data": "当前管理员未配置支付信息"})
 		return
 	}
-	uri, params, err := client.Purchase(&epay.PurchaseArgs{
-		Type:           req.PaymentMethod,
-		ServiceTradeNo: tradeNo,
-		Name:           fmt.Sprintf("TUC%d", req.Amount),
-		Money:          strconv.FormatFloat(payMoney, 'f', 2, 64),
-		Device:         epay.PC,
-		NotifyUrl:      notifyUrl,
-		ReturnUrl:      returnUrl,
-	})
-	if err != nil {
-		c.JSON(200, gin.H{"message": "error", "data": "拉起支付失败"})
-		return
-	}
+	tradeNo := fmt.Sprintf("%s%d", common.GetRandomString(6), time.Now().Unix())
+	tradeNo = fmt.Sprintf("USR%dNO%s", id, tradeNo)
 	amount := req.Amount
 	if operation_setting.GetQuotaDisplayType() == operation_setting.QuotaDisplayTypeTokens {
 		dAmount := decimal.NewFromInt(int64(amount))
@@ -240,15 +238,116 @@ func RequestEpay(c *gin.Context) {
 		Money:         payMoney,
 		TradeNo:       tradeNo,
 		PaymentMethod: req.PaymentMethod,
-		CreateTime:    time.Now().Unix(),
-		Status:        "pending",
+		OrgId:         req.OrgId,
 	}
-	err = topUp.Insert()
+	couponQuote.ApplyTo(topUp)
+	launch, err := createPaymentOrder(epayAdaptor, &PaymentOrder{
+		TopUp:   topUp,
+		Subject: fmt.Sprintf("TUC%d", req.Amount),
+		Channel: req.PaymentMethod,
+	})
 	if err != nil {
-		c.JSON(200, gin.H{"message": "error", "data": "创建订单失败"})
+		c.JSON(200, gin.H{"message": "error", "data": err.Error()})
 		return
 	}
-	c.JSON(200, gin.H{"message": "success", "data": params, "url": uri})
+	c.JSON(200, gin.H{"message": "success", "data": launch.Params, "url": launch.PayURL})
+}
+
+var epayAdaptor = &EpayAdaptor{}
+
+type EpayAdaptor struct {
+}
+
+func (*EpayAdaptor) Name() string {
+	return model.PaymentProviderEpay
+}
+
+func (*EpayAdaptor) CreateOrder(order *PaymentOrder) (*PaymentLaunch, error) {
+	client := GetEpayClient()
+	if client == nil {
+		return nil, errors.New("当前管理员未配置支付信息")
+	}
+	callBackAddress := service.GetCallbackAddress()
+	returnUrl, _ := url.Parse(system_setting.ServerAddress + "/console/log")
+	notifyUrl, _ := url.Parse(callBackAddress + "/api/user/epay/notify")
+	uri, params, err := client.Purchase(&epay.PurchaseArgs{
+		Type:           order.Channel,
+		ServiceTradeNo: order.TopUp.TradeNo,
+		Name:           order.Subject,
+		Money:          strconv.FormatFloat(order.TopUp.Money, 'f', 2, 64),
+		Device:         epay.PC,
+		NotifyUrl:      notifyUrl,
+		ReturnUrl:      returnUrl,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PaymentLaunch{PayURL: uri, Params: params}, nil
+}
+
+func (*EpayAdaptor) VerifyCallback(c *gin.Context) (*PaymentCallback, error) {
+	params := lo.Reduce(lo.Keys(c.Request.URL.Query()), func(r map[string]string, t string, i int) map[string]string {
+		r[t] = c.Request.URL.Query().Get(t)
+		return r
+	}, map[string]string{})
+	client := GetEpayClient()
+	if client == nil {
+		return nil, errors.New("未找到配置信息")
+	}
+	verifyInfo, err := client.Verify(params)
+	if err != nil || !verifyInfo.VerifyStatus {
+		return nil, ErrPaymentSignature
+	}
+	return &PaymentCallback{
+		TradeNo:         verifyInfo.ServiceTradeNo,
+		ProviderTradeNo: verifyInfo.TradeNo,
+		Paid:            verifyInfo.TradeStatus == epay.StatusTradeSuccess,
+		Status:          verifyInfo.TradeStatus,
+		Raw:             verifyInfo,
+	}, nil
+}
+
+// QueryOrder 通过易支付通用的 api.php?act=order 接口查询订单
+func (*EpayAdaptor) QueryOrder(topUp *model.TopUp) (*PaymentQueryResult, error) {
+	if operation_setting.PayAddress == "" || operation_setting.EpayId == "" || operation_setting.EpayKey == "" {
+		return nil, errors.New("当前管理员未配置支付信息")
+	}
+	query := url.Values{}
+	query.Set("act", "order")
+	query.Set("pid", operation_setting.EpayId)
+	query.Set("key", operation_setting.EpayKey)
+	query.Set("out_trade_no", topUp.TradeNo)
+	apiUrl := strings.TrimSuffix(operation_setting.PayAddress, "/") + "/api.php?" + query.Encode()
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+	resp, err := client.Get(apiUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Code    any    `json:"code"`
+		Msg     string `json:"msg"`
+		TradeNo string `json:"trade_no"`
+		Status  any    `json:"status"`
+	}
+	if err := common.DecodeJson(resp.Body, &result); err != nil {
+		return nil, err
+	}
+	// 部分易支付实现以字符串返回数字字段
+	if fmt.Sprint(result.Code) != "1" {
+		// 订单不存在说明用户未打开支付页面
+		return &PaymentQueryResult{Status: PaymentQueryPending}, nil
+	}
+	if fmt.Sprint(result.Status) == "1" {
+		return &PaymentQueryResult{Status: PaymentQueryPaid, ProviderTradeNo: result.TradeNo}, nil
+	}
+	return &PaymentQueryResult{Status: PaymentQueryPending}, nil
+}
+
+func (*EpayAdaptor) Refund(topUp *model.TopUp, reason string) error {
+	return ErrPaymentUnsupported
 }
 
 // tradeNo lock
@@ -279,66 +378,28 @@ func UnlockOrder(tradeNo string) {
 }
 
 func EpayNotify(c *gin.Context) {
-	params := lo.Reduce(lo.Keys(c.Request.URL.Query()), func(r map[string]string, t string, i int) map[string]string {
-		r[t] = c.Request.URL.Query().Get(t)
-		return r
-	}, map[string]string{})
-	client := GetEpayClient()
-	if client == nil {
-		log.Println("易支付回调失败 未找到配置信息")
-		_, err := c.Writer.Write([]byte("fail"))
-		if err != nil {
+	callback, err := epayAdaptor.VerifyCallback(c)
+	if err != nil {
+		log.Printf("易支付回调失败: %v", err)
+		if _, err := c.Writer.Write([]byte("fail")); err != nil {
 			log.Println("易支付回调写入失败")
 		}
 		return
 	}
-	verifyInfo, err := client.Verify(params)
-	if err == nil && verifyInfo.VerifyStatus {
-		_, err := c.Writer.Write([]byte("success"))
-		if err != nil {
-			log.Println("易支付回调写入失败")
-		}
-	} else {
-		_, err := c.Writer.Write([]byte("fail"))
-		if err != nil {
-			log.Println("易支付回调写入失败")
-		}
-		log.Println("易支付回调签名验证失败")
-		return
+	if _, err := c.Writer.Write([]byte("success")); err != nil {
+		log.Println("易支付回调写入失败")
 	}
 
-	if verifyInfo.TradeStatus == epay.StatusTradeSuccess {
-		log.Println(verifyInfo)
-		LockOrder(verifyInfo.ServiceTradeNo)
-		defer UnlockOrder(verifyInfo.ServiceTradeNo)
-		topUp := model.GetTopUpByTradeNo(verifyInfo.ServiceTradeNo)
-		if topUp == nil {
-			log.Printf("易支付回调未找到订单: %v", verifyInfo)
-			return
-		}
-		if topUp.Status == "pending" {
-			topUp.Status = "success"
-			err := topUp.Update()
-			if err != nil {
-				log.Printf("易支付回调更新订单失败: %v", topUp)
-				return
-			}
-			//user, _ := model.GetUserById(topUp.UserId, false)
-			//user.Quota += topUp.Amount * 500000
-			dAmount := decimal.NewFromInt(int64(topUp.Amount))
-			dQuotaPerUnit := decimal.NewFromFloat(common.QuotaPerUnit)
-			quotaToAdd := int(dAmount.Mul(dQuotaPerUnit).IntPart())
-			err = model.IncreaseUserQuota(topUp.UserId, quotaToAdd, true)
-			if err != nil {
-				log.Printf("易支付回调更新用户失败: %v", topUp)
-				return
-			}
-			log.Printf("易支付回调更新用户成功 %v", topUp)
-			model.RecordLog(topUp.UserId, model.LogTypeTopup, fmt.Sprintf("使用在线充值成功，充值金额: %v，支付金额：%f", logger.LogQuota(quotaToAdd), topUp.Money))
-		}
-	} else {
-		log.Printf("易支付异常回调: %v", verifyInfo)
+	if !callback.Paid {
+		log.Printf("易支付异常回调: %v", callback.Raw)
+		return
 	}
+	log.Println(callback.Raw)
+	if err := completePaymentOrder(epayAdaptor, callback.TradeNo, callback.ProviderTradeNo); err != nil {
+		log.Printf("易支付回调处理订单失败: %s, %v", callback.TradeNo, err)
+		return
+	}
+	log.Printf("易支付回调更新用户成功 %s", callback.TradeNo)
 }
 
 func RequestAmount(c *gin.Context) {
@@ -364,7 +425,12 @@ func RequestAmount(c *gin.Context) {
 		c.JSON(200, gin.H{"message": "error", "data": "充值金额过低"})
 		return
 	}
-	c.JSON(200, gin.H{"message": "success", "data": strconv.FormatFloat(payMoney, 'f', 2, 64)})
+	couponQuote, payMoney, err := quoteTopUpCoupon(req.CouponCode, id, group, payMoney)
+	if err != nil {
+		c.JSON(200, gin.H{"message": "error", "data": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "success", "data": couponAmountData(strconv.FormatFloat(payMoney, 'f', 2, 64), couponQuote)})
 }
 
 func GetUserTopUps(c *gin.Context) {
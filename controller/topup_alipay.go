@@ -53,6 +53,8 @@ func RequestAlipayPay(c *gin.Context) {
 	var req struct {
 		Amount        int64  `json:"amount"`
 		PaymentMethod string `json:"payment_method"`
+		OrgId         int    `json:"org_id"`
+		CouponCode    string `json:"coupon_code"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -72,6 +74,10 @@ func RequestAlipayPay(c *gin.Context) {
 	}
 
 	id := c.GetInt("id")
+	if err := checkOrgBilling(id, req.OrgId); err != nil {
+		c.JSON(200, gin.H{"message": "error", "data": err.Error()})
+		return
+	}
 	user, _ := model.GetUserById(id, false)
 
 	// 计算实际支付金额
@@ -86,6 +92,11 @@ func RequestAlipayPay(c *gin.Context) {
 		c.JSON(200, gin.H{"message": "error", "data": "充值金额过低"})
 		return
 	}
+	couponQuote, payMoney, err := quoteTopUpCoupon(req.CouponCode, id, group, payMoney)
+	if err != nil {
+		c.JSON(200, gin.H{"message": "error", "data": err.Error()})
+		return
+	}
 
 	// 生成订单号
 	reference := fmt.Sprintf("alipay-ref-%d-%d-%s", user.Id, time.Now().UnixMilli(), randstr.String(4))
@@ -105,40 +116,124 @@ func RequestAlipayPay(c *gin.Context) {
 		Money:         payMoney,
 		TradeNo:       referenceId,
 		PaymentMethod: PaymentMethodAlipay,
-		CreateTime:    time.Now().Unix(),
-		Status:        common.TopUpStatusPending,
+		OrgId:         req.OrgId,
 	}
+	couponQuote.ApplyTo(topUp)
 
-	if err := topUp.Insert(); err != nil {
-		c.JSON(200, gin.H{"message": "error", "data": "创建订单失败"})
-		return
-	}
-
-	// 调用支付宝预下单（扫码支付）
-	notifyUrl := system_setting.ServerAddress + "/api/alipay/notify"
-	qrCode, err := alipayQRCodePay(referenceId, payMoney, notifyUrl)
+	launch, err := createPaymentOrder(alipayAdaptor, &PaymentOrder{TopUp: topUp})
 	if err != nil {
-		log.Printf("支付宝预下单失败: %v", err)
-		c.JSON(200, gin.H{"message": "error", "data": "拉起支付失败"})
+		c.JSON(200, gin.H{"message": "error", "data": err.Error()})
 		return
 	}
 
 	c.JSON(200, gin.H{
 		"message": "success",
 		"data": gin.H{
-			"pay_url":  qrCode,
+			"pay_url":  launch.PayURL,
 			"order_id": referenceId,
 		},
 	})
 }
 
+var alipayAdaptor = &AlipayAdaptor{}
+
+// AlipayAdaptor 支付宝当面付（扫码支付）
+type AlipayAdaptor struct {
+}
+
+func (*AlipayAdaptor) Name() string {
+	return model.PaymentProviderAlipay
+}
+
+func (*AlipayAdaptor) CreateOrder(order *PaymentOrder) (*PaymentLaunch, error) {
+	// 调用支付宝预下单（扫码支付）
+	notifyUrl := system_setting.ServerAddress + "/api/alipay/notify"
+	qrCode, err := alipayQRCodePay(order.TopUp.TradeNo, order.TopUp.Money, notifyUrl)
+	if err != nil {
+		return nil, err
+	}
+	return &PaymentLaunch{PayURL: qrCode}, nil
+}
+
+func (*AlipayAdaptor) VerifyCallback(c *gin.Context) (*PaymentCallback, error) {
+	// 解析表单数据
+	if err := c.Request.ParseForm(); err != nil {
+		return nil, fmt.Errorf("解析表单失败: %w", err)
+	}
+	if err := ensureAlipayClient(); err != nil {
+		return nil, err
+	}
+	notification, err := alipayClient.DecodeNotification(c.Request.Form)
+	if err != nil {
+		log.Printf("支付宝签名验证失败: %v", err)
+		return nil, ErrPaymentSignature
+	}
+	tradeStatus := string(notification.TradeStatus)
+	return &PaymentCallback{
+		TradeNo:         notification.OutTradeNo,
+		ProviderTradeNo: notification.TradeNo,
+		Paid:            tradeStatus == "TRADE_SUCCESS" || tradeStatus == "TRADE_FINISHED",
+		Status:          tradeStatus,
+		Raw:             notification,
+	}, nil
+}
+
+func (*AlipayAdaptor) QueryOrder(topUp *model.TopUp) (*PaymentQueryResult, error) {
+	if err := ensureAlipayClient(); err != nil {
+		return nil, err
+	}
+	rsp, err := alipayClient.TradeQuery(context.Background(), alipay.TradeQuery{OutTradeNo: topUp.TradeNo})
+	if err != nil {
+		return nil, fmt.Errorf("调用支付宝API失败: %w", err)
+	}
+	if rsp.IsFailure() {
+		// 用户未扫码时支付宝侧尚未创建交易
+		if rsp.SubCode == "ACQ.TRADE_NOT_EXIST" {
+			return &PaymentQueryResult{Status: PaymentQueryPending}, nil
+		}
+		return nil, fmt.Errorf("支付宝返回错误: %s - %s", rsp.Code, rsp.SubMsg)
+	}
+	switch rsp.TradeStatus {
+	case "TRADE_SUCCESS", "TRADE_FINISHED":
+		return &PaymentQueryResult{Status: PaymentQueryPaid, ProviderTradeNo: rsp.TradeNo}, nil
+	case "TRADE_CLOSED":
+		return &PaymentQueryResult{Status: PaymentQueryClosed}, nil
+	}
+	return &PaymentQueryResult{Status: PaymentQueryPending}, nil
+}
+
+func (*AlipayAdaptor) Refund(topUp *model.TopUp, reason string) error {
+	if err := ensureAlipayClient(); err != nil {
+		return err
+	}
+	p := alipay.TradeRefund{}
+	p.OutTradeNo = topUp.TradeNo
+	p.RefundAmount = fmt.Sprintf("%.2f", topUp.Money)
+	p.RefundReason = reason
+	// 全额退款只发起一次，以订单号作为退款请求号保证重试幂等
+	p.OutRequestNo = topUp.TradeNo
+	rsp, err := alipayClient.TradeRefund(context.Background(), p)
+	if err != nil {
+		return fmt.Errorf("调用支付宝API失败: %w", err)
+	}
+	if rsp.IsFailure() {
+		return fmt.Errorf("支付宝退款失败: %s - %s", rsp.Code, rsp.SubMsg)
+	}
+	return nil
+}
+
+// ensureAlipayClient 懒加载初始化客户端
+func ensureAlipayClient() error {
+	if alipayClient == nil {
+		return InitAlipayClient()
+	}
+	return nil
+}
+
 // 支付宝扫码支付（当面付）
 func alipayQRCodePay(outTradeNo string, totalAmount float64, notifyUrl string) (string, error) {
-	// 懒加载初始化客户端
-	if alipayClient == nil {
-		if err := InitAlipayClient(); err != nil {
-			return "", err
-		}
+	if err := ensureAlipayClient(); err != nil {
+		return "", err
 	}
 
 	var p = alipay.TradePreCreate{}
@@ -165,89 +260,29 @@ func alipayQRCodePay(outTradeNo string, totalAmount float64, notifyUrl string) (
 
 // 支付宝支付回调
 func AlipayNotifyHandler(c *gin.Context) {
-	// 解析表单数据
-	if err := c.Request.ParseForm(); err != nil {
-		log.Printf("支付宝回调解析表单失败: %v", err)
-		c.String(200, "fail")
-		return
-	}
-
-	// 懒加载初始化客户端
-	if alipayClient == nil {
-		if err := InitAlipayClient(); err != nil {
-			log.Printf("支付宝回调初始化客户端失败: %v", err)
-			c.String(200, "fail")
-			return
-		}
-	}
-
-	// 验签
-	notification, err := alipayClient.DecodeNotification(c.Request.Form)
+	callback, err := alipayAdaptor.VerifyCallback(c)
 	if err != nil {
-		log.Printf("支付宝签名验证失败: %v", err)
+		log.Printf("支付宝回调处理失败: %v", err)
 		c.String(200, "fail")
 		return
 	}
 
-	// 获取通知参数
-	outTradeNo := notification.OutTradeNo
-	tradeStatus := notification.TradeStatus
-	tradeNo := notification.TradeNo
-
-	log.Printf("支付宝回调 - 订单号: %s, 支付宝流水号: %s, 状态: %s", outTradeNo, tradeNo, tradeStatus)
+	log.Printf("支付宝回调 - 订单号: %s, 支付宝流水号: %s, 状态: %s", callback.TradeNo, callback.ProviderTradeNo, callback.Status)
 
-	// 查询订单
-	LockOrder(outTradeNo)
-	defer UnlockOrder(outTradeNo)
-
-	topUp := model.GetTopUpByTradeNo(outTradeNo)
-	if topUp == nil {
-		log.Printf("支付宝回调: 订单不存在 - %s", outTradeNo)
+	if !callback.Paid {
+		log.Printf("支付宝回调状态异常: %s - %s", callback.TradeNo, callback.Status)
 		c.String(200, "fail")
 		return
 	}
 
-	// 幂等性检查
-	if topUp.Status != common.TopUpStatusPending {
-		log.Printf("支付宝回调: 订单已处理 - %s, 状态: %s", outTradeNo, topUp.Status)
-		c.String(200, "success")
+	if err := completePaymentOrder(alipayAdaptor, callback.TradeNo, callback.ProviderTradeNo); err != nil {
+		log.Printf("支付宝充值处理失败: %s, %v", callback.TradeNo, err)
+		c.String(200, "fail")
 		return
 	}
 
-	// 交易成功
-	if tradeStatus == "TRADE_SUCCESS" || tradeStatus == "TRADE_FINISHED" {
-		// 增加用户配额
-		dAmount := decimal.NewFromInt(topUp.Amount)
-		dQuotaPerUnit := decimal.NewFromFloat(common.QuotaPerUnit)
-		quotaToAdd := int(dAmount.Mul(dQuotaPerUnit).IntPart())
-
-		err := model.IncreaseUserQuota(topUp.UserId, quotaToAdd, true)
-		if err != nil {
-			log.Printf("支付宝充值增加配额失败: %v", err)
-			c.String(200, "fail")
-			return
-		}
-
-		// 更新订单状态
-		topUp.Status = common.TopUpStatusSuccess
-		topUp.CompleteTime = time.Now().Unix()
-		if err := topUp.Update(); err != nil {
-			log.Printf("支付宝充值更新订单失败: %v", err)
-			c.String(200, "fail")
-			return
-		}
-
-		// 记录日志
-		model.RecordLog(topUp.UserId, model.LogTypeTopup, fmt.Sprintf("使用支付宝支付成功，充值金额: %d，支付金额：%.2f", quotaToAdd, topUp.Money))
-
-		log.Printf("支付宝支付成功 - 订单号: %s, 支付宝流水号: %s, 金额: %.2f, 配额: %d",
-			outTradeNo, tradeNo, topUp.Money, quotaToAdd)
-
-		c.String(200, "success")
-	} else {
-		log.Printf("支付宝回调状态异常: %s - %s", outTradeNo, tradeStatus)
-		c.String(200, "fail")
-	}
+	log.Printf("支付宝支付成功 - 订单号: %s, 支付宝流水号: %s", callback.TradeNo, callback.ProviderTradeNo)
+	c.String(200, "success")
 }
 
 // 获取支付宝支付金额
@@ -296,7 +331,8 @@ func getAlipayMinTopup() int64 {
 // 获取支付宝支付金额（用于前端显示）
 func RequestAlipayAmount(c *gin.Context) {
 	var req struct {
-		Amount int64 `json:"amount"`
+		Amount     int64  `json:"amount"`
+		CouponCode string `json:"coupon_code"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -322,6 +358,11 @@ func RequestAlipayAmount(c *gin.Context) {
 		c.JSON(200, gin.H{"message": "error", "data": "充值金额过低"})
 		return
 	}
+	couponQuote, payMoney, err := quoteTopUpCoupon(req.CouponCode, id, group, payMoney)
+	if err != nil {
+		c.JSON(200, gin.H{"message": "error", "data": err.Error()})
+		return
+	}
 
-	c.JSON(200, gin.H{"message": "success", "data": fmt.Sprintf("%.2f", payMoney)})
+	c.JSON(200, gin.H{"message": "success", "data": couponAmountData(fmt.Sprintf("%.2f", payMoney), couponQuote)})
 }
@@ -6,13 +6,17 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/logger"
 	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/service"
 	"github.com/QuantumNous/new-api/setting"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -51,6 +55,8 @@ func verifyCreemSignature(payload string, signature string, secret string) bool
 type CreemPayRequest struct {
 	ProductId     string `json:"product_id"`
 	PaymentMethod string `json:"payment_method"`
+	OrgId         int    `json:"org_id"`
+	CouponCode    string `json:"coupon_code"`
 }
 
 type CreemProduct struct {
@@ -99,33 +105,47 @@ func (*CreemAdaptor) RequestPay(c *gin.Context, req *CreemPayRequest) {
 	}
 
 	id := c.GetInt("id")
+	if err := checkOrgBilling(id, req.OrgId); err != nil {
+		c.JSON(200, gin.H{"message": "error", "data": err.Error()})
+		return
+	}
 	user, _ := model.GetUserById(id, false)
 
+	// Creem 产品价格固定，只支持仅赠送额度的优惠码
+	couponQuote, _, err := quoteTopUpCoupon(req.CouponCode, id, user.Group, selectedProduct.Price)
+	if err != nil {
+		c.JSON(200, gin.H{"message": "error", "data": err.Error()})
+		return
+	}
+	if couponQuote != nil && couponQuote.Coupon.HasDiscount() {
+		c.JSON(200, gin.H{"message": "error", "data": "该支付方式仅支持赠送额度的优惠码"})
+		return
+	}
+
 	// 生成唯一的订单引用ID
 	reference := fmt.Sprintf("creem-api-ref-%d-%d-%s", user.Id, time.Now().UnixMilli(), randstr.String(4))
 	referenceId := "ref_" + common.Sha1([]byte(reference))
 
 	// 先创建订单记录，使用产品配置的金额和充值额度
 	topUp := &model.TopUp{
-		UserId:     id,
-		Amount:     selectedProduct.Quota, // 充值额度
-		Money:      selectedProduct.Price, // 支付金额
-		TradeNo:    referenceId,
-		CreateTime: time.Now().Unix(),
-		Status:     common.TopUpStatusPending,
-	}
-	err = topUp.Insert()
-	if err != nil {
-		log.Printf("创建Creem订单失败: %v", err)
-		c.JSON(200, gin.H{"message": "error", "data": "创建订单失败"})
-		return
+		UserId:        id,
+		Amount:        selectedProduct.Quota, // 充值额度
+		Money:         selectedProduct.Price, // 支付金额
+		TradeNo:       referenceId,
+		PaymentMethod: PaymentMethodCreem,
+		OrgId:         req.OrgId,
 	}
+	couponQuote.ApplyTo(topUp)
 
 	// 创建支付链接，传入用户邮箱
-	checkoutUrl, err := genCreemLink(referenceId, selectedProduct, user.Email, user.Username)
+	launch, err := createPaymentOrder(creemAdaptor, &PaymentOrder{
+		TopUp:        topUp,
+		Email:        user.Email,
+		Username:     user.Username,
+		CreemProduct: selectedProduct,
+	})
 	if err != nil {
-		log.Printf("获取Creem支付链接失败: %v", err)
-		c.JSON(200, gin.H{"message": "error", "data": "拉起支付失败"})
+		c.JSON(200, gin.H{"message": "error", "data": err.Error()})
 		return
 	}
 
@@ -135,12 +155,113 @@ func (*CreemAdaptor) RequestPay(c *gin.Context, req *CreemPayRequest) {
 	c.JSON(200, gin.H{
 		"message": "success",
 		"data": gin.H{
-			"checkout_url": checkoutUrl,
+			"checkout_url": launch.PayURL,
 			"order_id":     referenceId,
 		},
 	})
 }
 
+func (*CreemAdaptor) Name() string {
+	return model.PaymentProviderCreem
+}
+
+func (*CreemAdaptor) CreateOrder(order *PaymentOrder) (*PaymentLaunch, error) {
+	if order.CreemProduct == nil {
+		return nil, fmt.Errorf("未指定Creem产品")
+	}
+	checkout, err := createCreemCheckout(order.TopUp.TradeNo, order.CreemProduct, order.Email, order.Username)
+	if err != nil {
+		return nil, err
+	}
+	return &PaymentLaunch{PayURL: checkout.CheckoutUrl, ProviderTradeNo: checkout.Id}, nil
+}
+
+// VerifyCallback 校验 Creem webhook 签名并解析事件，Raw 为 *CreemWebhookEvent
+func (*CreemAdaptor) VerifyCallback(c *gin.Context) (*PaymentCallback, error) {
+	bodyBytes, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return nil, fmt.Errorf("读取请求body失败: %w", err)
+	}
+
+	// 获取签名头
+	signature := c.GetHeader(CreemSignatureHeader)
+	if setting.CreemTestMode {
+		log.Printf("Creem Webhook - Signature: %s , Body: %s", signature, bodyBytes)
+	} else if signature == "" {
+		log.Printf("Creem Webhook缺少签名头")
+		return nil, ErrPaymentSignature
+	}
+
+	// 验证签名
+	if !verifyCreemSignature(string(bodyBytes), signature, setting.CreemWebhookSecret) {
+		return nil, ErrPaymentSignature
+	}
+
+	var event CreemWebhookEvent
+	if err := common.Unmarshal(bodyBytes, &event); err != nil {
+		return nil, fmt.Errorf("解析参数失败: %w", err)
+	}
+	return &PaymentCallback{
+		TradeNo:         event.Object.RequestId,
+		ProviderTradeNo: event.Object.Id,
+		Paid:            event.Object.Order.Status == "paid",
+		Status:          event.Object.Order.Status,
+		Raw:             &event,
+	}, nil
+}
+
+// QueryOrder 通过 checkout id 查询 Creem 结账状态
+func (*CreemAdaptor) QueryOrder(topUp *model.TopUp) (*PaymentQueryResult, error) {
+	if topUp.ProviderTradeNo == "" {
+		return nil, ErrPaymentUnsupported
+	}
+	if setting.CreemApiKey == "" {
+		return nil, fmt.Errorf("未配置Creem API密钥")
+	}
+	apiUrl := "https://api.creem.io/v1/checkouts"
+	if setting.CreemTestMode {
+		apiUrl = "https://test-api.creem.io/v1/checkouts"
+	}
+	req, err := http.NewRequest("GET", apiUrl+"?checkout_id="+url.QueryEscape(topUp.ProviderTradeNo), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-api-key", setting.CreemApiKey)
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("Creem API http status %d ", resp.StatusCode)
+	}
+	var checkout struct {
+		Id     string `json:"id"`
+		Status string `json:"status"`
+		Order  struct {
+			Status string `json:"status"`
+		} `json:"order"`
+	}
+	if err := common.DecodeJson(resp.Body, &checkout); err != nil {
+		return nil, err
+	}
+	switch {
+	case checkout.Order.Status == "paid" || checkout.Status == "completed":
+		return &PaymentQueryResult{Status: PaymentQueryPaid, ProviderTradeNo: checkout.Id}, nil
+	case checkout.Status == "expired":
+		return &PaymentQueryResult{Status: PaymentQueryClosed}, nil
+	}
+	return &PaymentQueryResult{Status: PaymentQueryPending}, nil
+}
+
+// Refund Creem 未开放退款接口，需在 Creem 后台退款后使用线下退款
+func (*CreemAdaptor) Refund(topUp *model.TopUp, reason string) error {
+	return ErrPaymentUnsupported
+}
+
 func RequestCreemPay(c *gin.Context) {
 	var req CreemPayRequest
 
@@ -221,12 +342,31 @@ type CreemWebhookEvent struct {
 			UpdatedAt string `json:"updated_at"`
 			Mode      string `json:"mode"`
 		} `json:"customer"`
-		Status   string            `json:"status"`
-		Metadata map[string]string `json:"metadata"`
-		Mode     string            `json:"mode"`
+		Status       string            `json:"status"`
+		Metadata     map[string]string `json:"metadata"`
+		Mode         string            `json:"mode"`
+		Subscription json.RawMessage   `json:"subscription"`
 	} `json:"object"`
 }
 
+// creemObjectId 兼容 Creem 回调中以 id 字符串或对象形式返回的关联对象
+func creemObjectId(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var id string
+	if err := json.Unmarshal(raw, &id); err == nil {
+		return id
+	}
+	var obj struct {
+		Id string `json:"id"`
+	}
+	if err := json.Unmarshal(raw, &obj); err == nil {
+		return obj.Id
+	}
+	return ""
+}
+
 // 保留旧的结构体作为兼容
 type CreemWebhookData struct {
 	Type string `json:"type"`
@@ -238,53 +378,31 @@ type CreemWebhookData struct {
 }
 
 func CreemWebhook(c *gin.Context) {
-	// 读取body内容用于打印，同时保留原始数据供后续使用
-	bodyBytes, err := io.ReadAll(c.Request.Body)
-	if err != nil {
-		log.Printf("读取Creem Webhook请求body失败: %v", err)
-		c.AbortWithStatus(http.StatusBadRequest)
-		return
-	}
-
-	// 获取签名头
-	signature := c.GetHeader(CreemSignatureHeader)
-
 	// 打印关键信息（避免输出完整敏感payload）
 	log.Printf("Creem Webhook - URI: %s", c.Request.RequestURI)
-	if setting.CreemTestMode {
-		log.Printf("Creem Webhook - Signature: %s , Body: %s", signature, bodyBytes)
-	} else if signature == "" {
-		log.Printf("Creem Webhook缺少签名头")
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
-	}
 
-	// 验证签名
-	if !verifyCreemSignature(string(bodyBytes), signature, setting.CreemWebhookSecret) {
-		log.Printf("Creem Webhook签名验证失败")
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
-	}
-
-	log.Printf("Creem Webhook签名验证成功")
-
-	// 重新设置body供后续的ShouldBindJSON使用
-	c.Request.Body = io.NopCloser(bytes.NewReader(bodyBytes))
-
-	// 解析新格式的webhook数据
-	var webhookEvent CreemWebhookEvent
-	if err := c.ShouldBindJSON(&webhookEvent); err != nil {
-		log.Printf("解析Creem Webhook参数失败: %v", err)
+	callback, err := creemAdaptor.VerifyCallback(c)
+	if err != nil {
+		log.Printf("Creem Webhook处理失败: %v", err)
+		if errors.Is(err, ErrPaymentSignature) {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
+	webhookEvent := callback.Raw.(*CreemWebhookEvent)
 
 	log.Printf("Creem Webhook解析成功 - EventType: %s, EventId: %s", webhookEvent.EventType, webhookEvent.Id)
 
 	// 根据事件类型处理不同的webhook
 	switch webhookEvent.EventType {
 	case "checkout.completed":
-		handleCheckoutCompleted(c, &webhookEvent)
+		handleCheckoutCompleted(c, webhookEvent)
+	case "subscription.paid":
+		handleCreemSubscriptionPaid(c, webhookEvent)
+	case "subscription.canceled", "subscription.expired":
+		handleCreemSubscriptionCanceled(c, webhookEvent)
 	default:
 		log.Printf("忽略Creem Webhook事件类型: %s", webhookEvent.EventType)
 		c.Status(http.StatusOK)
@@ -308,7 +426,20 @@ func handleCheckoutCompleted(c *gin.Context, event *CreemWebhookEvent) {
 		return
 	}
 
-	// 验证订单类型，目前只处理一次性付款
+	// 订阅订单：激活本地订阅，后续续费由 subscription.paid 处理
+	if event.Object.Order.Type == "recurring" {
+		sub, err := model.ActivateSubscriptionByTradeNo(referenceId, creemObjectId(event.Object.Subscription))
+		if err != nil {
+			log.Printf("Creem订阅激活失败: %s, 订单号: %s", err.Error(), referenceId)
+			c.Status(http.StatusOK)
+			return
+		}
+		service.NotifySubscriptionEvent(sub.UserId, "套餐订阅成功", fmt.Sprintf("您已成功订阅套餐 %s。", sub.Plan.Name))
+		c.Status(http.StatusOK)
+		return
+	}
+
+	// 验证订单类型，一次性付款按充值处理
 	if event.Object.Order.Type != "onetime" {
 		log.Printf("暂不支持的订单类型: %s, 跳过处理", event.Object.Order.Type)
 		c.Status(http.StatusOK)
@@ -361,6 +492,57 @@ func handleCheckoutCompleted(c *gin.Context, event *CreemWebhookEvent) {
 	c.Status(http.StatusOK)
 }
 
+// 处理订阅续费成功事件，首期付款与重复回调会被忽略
+func handleCreemSubscriptionPaid(c *gin.Context, event *CreemWebhookEvent) {
+	sub, err := model.RenewSubscriptionByProviderId(model.SubscriptionProviderCreem, event.Object.Id)
+	if err != nil {
+		log.Printf("Creem订阅续费处理失败: %s, 订阅ID: %s", err.Error(), event.Object.Id)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if sub != nil {
+		service.NotifySubscriptionEvent(sub.UserId, "套餐续订成功", fmt.Sprintf("您的套餐 %s 已续订，本周期额度 %s。", sub.Plan.Name, logger.FormatQuota(sub.Plan.IncludedQuota)))
+	}
+	c.Status(http.StatusOK)
+}
+
+func handleCreemSubscriptionCanceled(c *gin.Context, event *CreemWebhookEvent) {
+	if err := model.CancelSubscriptionByProviderId(model.SubscriptionProviderCreem, event.Object.Id); err != nil {
+		log.Printf("Creem订阅取消处理失败: %s, 订阅ID: %s", err.Error(), event.Object.Id)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// cancelCreemSubscription 调用 Creem 接口取消订阅
+func cancelCreemSubscription(subscriptionId string) error {
+	if setting.CreemApiKey == "" {
+		return fmt.Errorf("未配置Creem API密钥")
+	}
+	apiUrl := "https://api.creem.io/v1/subscriptions/" + subscriptionId + "/cancel"
+	if setting.CreemTestMode {
+		apiUrl = "https://test-api.creem.io/v1/subscriptions/" + subscriptionId + "/cancel"
+	}
+	req, err := http.NewRequest("POST", apiUrl, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-api-key", setting.CreemApiKey)
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Creem API http status %d ", resp.StatusCode)
+	}
+	return nil
+}
+
 type CreemCheckoutRequest struct {
 	ProductId string `json:"product_id"`
 	RequestId string `json:"request_id"`
@@ -376,8 +558,17 @@ type CreemCheckoutResponse struct {
 }
 
 func genCreemLink(referenceId string, product *CreemProduct, email string, username string) (string, error) {
+	checkout, err := createCreemCheckout(referenceId, product, email, username)
+	if err != nil {
+		return "", err
+	}
+	return checkout.CheckoutUrl, nil
+}
+
+// createCreemCheckout 创建 Creem 结账会话，返回支付链接与 checkout id
+func createCreemCheckout(referenceId string, product *CreemProduct, email string, username string) (*CreemCheckoutResponse, error) {
 	if setting.CreemApiKey == "" {
-		return "", fmt.Errorf("未配置Creem API密钥")
+		return nil, fmt.Errorf("未配置Creem API密钥")
 	}
 
 	// 根据测试模式选择 API 端点
@@ -407,13 +598,13 @@ func genCreemLink(referenceId string, product *CreemProduct, email string, usern
 	// 序列化请求数据
 	jsonData, err := json.Marshal(requestData)
 	if err != nil {
-		return "", fmt.Errorf("序列化请求数据失败: %v", err)
+		return nil, fmt.Errorf("序列化请求数据失败: %v", err)
 	}
 
 	// 创建 HTTP 请求
 	req, err := http.NewRequest("POST", apiUrl, bytes.NewBuffer(jsonData))
 	if err != nil {
-		return "", fmt.Errorf("创建HTTP请求失败: %v", err)
+		return nil, fmt.Errorf("创建HTTP请求失败: %v", err)
 	}
 
 	// 设置请求头
@@ -429,33 +620,33 @@ func genCreemLink(referenceId string, product *CreemProduct, email string, usern
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("发送HTTP请求失败: %v", err)
+		return nil, fmt.Errorf("发送HTTP请求失败: %v", err)
 	}
 	defer resp.Body.Close()
 
 	// 读取响应
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("读取响应失败: %v", err)
+		return nil, fmt.Errorf("读取响应失败: %v", err)
 	}
 
 	log.Printf("Creem API resp - status code: %d, resp: %s", resp.StatusCode, string(body))
 
 	// 检查响应状态
 	if resp.StatusCode/100 != 2 {
-		return "", fmt.Errorf("Creem API http status %d ", resp.StatusCode)
+		return nil, fmt.Errorf("Creem API http status %d ", resp.StatusCode)
 	}
 	// 解析响应
 	var checkoutResp CreemCheckoutResponse
 	err = json.Unmarshal(body, &checkoutResp)
 	if err != nil {
-		return "", fmt.Errorf("解析响应失败: %v", err)
+		return nil, fmt.Errorf("解析响应失败: %v", err)
 	}
 
 	if checkoutResp.CheckoutUrl == "" {
-		return "", fmt.Errorf("Creem API resp no checkout url ")
+		return nil, fmt.Errorf("Creem API resp no checkout url ")
 	}
 
 	log.Printf("Creem 支付链接创建成功 - 订单号: %s, 支付链接: %s", referenceId, checkoutResp.CheckoutUrl)
-	return checkoutResp.CheckoutUrl, nil
+	return &checkoutResp, nil
 }
@@ -1,16 +1,20 @@
 package controller
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/logger"
 	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/service"
 	"github.com/QuantumNous/new-api/setting"
 	"github.com/QuantumNous/new-api/setting/operation_setting"
 	"github.com/QuantumNous/new-api/setting/system_setting"
@@ -18,6 +22,10 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/stripe/stripe-go/v81"
 	"github.com/stripe/stripe-go/v81/checkout/session"
+	"github.com/stripe/stripe-go/v81/coupon"
+	"github.com/stripe/stripe-go/v81/price"
+	"github.com/stripe/stripe-go/v81/refund"
+	"github.com/stripe/stripe-go/v81/subscription"
 	"github.com/stripe/stripe-go/v81/webhook"
 	"github.com/thanhpk/randstr"
 )
@@ -40,6 +48,10 @@ type StripePayRequest struct {
 	// CancelURL is the optional custom URL to redirect when payment is canceled.
 	// If empty, defaults to the server's console topup page.
 	CancelURL string `json:"cancel_url,omitempty"`
+	// OrgId is the optional organization to credit instead of the user.
+	OrgId int `json:"org_id,omitempty"`
+	// CouponCode is the optional top-up coupon code.
+	CouponCode string `json:"coupon_code,omitempty"`
 }
 
 type StripeAdaptor struct {
@@ -61,7 +73,12 @@ func (*StripeAdaptor) RequestAmount(c *gin.Context, req *StripePayRequest) {
 		c.JSON(200, gin.H{"message": "error", "data": "充值金额过低"})
 		return
 	}
-	c.JSON(200, gin.H{"message": "success", "data": strconv.FormatFloat(payMoney, 'f', 2, 64)})
+	couponQuote, payMoney, err := quoteTopUpCoupon(req.CouponCode, id, group, payMoney)
+	if err != nil {
+		c.JSON(200, gin.H{"message": "error", "data": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "success", "data": couponAmountData(strconv.FormatFloat(payMoney, 'f', 2, 64), couponQuote)})
 }
 
 func (*StripeAdaptor) RequestPay(c *gin.Context, req *StripePayRequest) {
@@ -89,41 +106,154 @@ func (*StripeAdaptor) RequestPay(c *gin.Context, req *StripePayRequest) {
 	}
 
 	id := c.GetInt("id")
+	if err := checkOrgBilling(id, req.OrgId); err != nil {
+		c.JSON(200, gin.H{"message": "error", "data": err.Error()})
+		return
+	}
 	user, _ := model.GetUserById(id, false)
 	chargedMoney := GetChargedAmount(float64(req.Amount), *user)
 
+	// Stripe charges by Price ID, so the coupon discount is applied through a one-off
+	// Stripe coupon. Money still holds the USD amount used to compute the credited quota.
+	var couponQuote *model.CouponQuote
+	stripeCouponId := ""
+	if req.CouponCode != "" {
+		stripePayMoney := getStripePayMoney(float64(req.Amount), user.Group)
+		quote, _, err := quoteTopUpCoupon(req.CouponCode, id, user.Group, stripePayMoney)
+		if err != nil {
+			c.JSON(200, gin.H{"message": "error", "data": err.Error()})
+			return
+		}
+		couponQuote = quote
+		if couponQuote.Discount > 0 {
+			stripeCouponId, err = genStripeCoupon(couponQuote, stripePayMoney)
+			if err != nil {
+				log.Println("创建Stripe优惠券失败", err)
+				c.JSON(200, gin.H{"message": "error", "data": "拉起支付失败"})
+				return
+			}
+		}
+	}
+
 	reference := fmt.Sprintf("new-api-ref-%d-%d-%s", user.Id, time.Now().UnixMilli(), randstr.String(4))
 	referenceId := "ref_" + common.Sha1([]byte(reference))
 
-	payLink, err := genStripeLink(referenceId, user.StripeCustomer, user.Email, req.Amount, req.SuccessURL, req.CancelURL)
-	if err != nil {
-		log.Println("获取Stripe Checkout支付链接失败", err)
-		c.JSON(200, gin.H{"message": "error", "data": "拉起支付失败"})
-		return
-	}
-
 	topUp := &model.TopUp{
 		UserId:        id,
 		Amount:        req.Amount,
 		Money:         chargedMoney,
 		TradeNo:       referenceId,
 		PaymentMethod: PaymentMethodStripe,
-		CreateTime:    time.Now().Unix(),
-		Status:        common.TopUpStatusPending,
-	}
-	err = topUp.Insert()
+		OrgId:         req.OrgId,
+	}
+	couponQuote.ApplyTo(topUp)
+	launch, err := createPaymentOrder(stripeAdaptor, &PaymentOrder{
+		TopUp:          topUp,
+		Email:          user.Email,
+		CustomerId:     user.StripeCustomer,
+		SuccessURL:     req.SuccessURL,
+		CancelURL:      req.CancelURL,
+		StripeCouponId: stripeCouponId,
+	})
 	if err != nil {
-		c.JSON(200, gin.H{"message": "error", "data": "创建订单失败"})
+		c.JSON(200, gin.H{"message": "error", "data": err.Error()})
 		return
 	}
 	c.JSON(200, gin.H{
 		"message": "success",
 		"data": gin.H{
-			"pay_link": payLink,
+			"pay_link": launch.PayURL,
 		},
 	})
 }
 
+// Name returns the provider name stored on top-up orders.
+func (*StripeAdaptor) Name() string {
+	return model.PaymentProviderStripe
+}
+
+// CreateOrder creates a Checkout Session for the order. The session id is kept as the
+// provider trade number so the order can be queried and refunded later.
+func (*StripeAdaptor) CreateOrder(order *PaymentOrder) (*PaymentLaunch, error) {
+	result, err := genStripeLink(order.TopUp.TradeNo, order.CustomerId, order.Email, order.TopUp.Amount, order.SuccessURL, order.CancelURL, order.StripeCouponId)
+	if err != nil {
+		return nil, err
+	}
+	return &PaymentLaunch{PayURL: result.URL, ProviderTradeNo: result.ID}, nil
+}
+
+// VerifyCallback verifies the webhook signature. Raw holds the stripe.Event; the
+// trade fields are only filled for checkout session events.
+func (*StripeAdaptor) VerifyCallback(c *gin.Context) (*PaymentCallback, error) {
+	payload, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	signature := c.GetHeader("Stripe-Signature")
+	endpointSecret := setting.StripeWebhookSecret
+	event, err := webhook.ConstructEventWithOptions(payload, signature, endpointSecret, webhook.ConstructEventOptions{
+		IgnoreAPIVersionMismatch: true,
+	})
+	if err != nil {
+		log.Printf("Stripe Webhook验签失败: %v\n", err)
+		return nil, ErrPaymentSignature
+	}
+
+	callback := &PaymentCallback{Raw: event}
+	if strings.HasPrefix(string(event.Type), "checkout.session.") {
+		callback.TradeNo = event.GetObjectValue("client_reference_id")
+		callback.ProviderTradeNo = event.GetObjectValue("id")
+		callback.Status = event.GetObjectValue("status")
+		callback.Paid = callback.Status == string(stripe.CheckoutSessionStatusComplete)
+	}
+	return callback, nil
+}
+
+// QueryOrder retrieves the Checkout Session of the order.
+func (*StripeAdaptor) QueryOrder(topUp *model.TopUp) (*PaymentQueryResult, error) {
+	// Orders created before the session id was recorded cannot be looked up
+	if topUp.ProviderTradeNo == "" {
+		return nil, ErrPaymentUnsupported
+	}
+	stripe.Key = setting.StripeApiSecret
+	result, err := session.Get(topUp.ProviderTradeNo, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case result.Status == stripe.CheckoutSessionStatusComplete && result.PaymentStatus != stripe.CheckoutSessionPaymentStatusUnpaid:
+		return &PaymentQueryResult{Status: PaymentQueryPaid}, nil
+	case result.Status == stripe.CheckoutSessionStatusExpired:
+		return &PaymentQueryResult{Status: PaymentQueryClosed}, nil
+	}
+	return &PaymentQueryResult{Status: PaymentQueryPending}, nil
+}
+
+// Refund refunds the PaymentIntent of the order's Checkout Session in full.
+func (*StripeAdaptor) Refund(topUp *model.TopUp, reason string) error {
+	if topUp.ProviderTradeNo == "" {
+		return ErrPaymentUnsupported
+	}
+	stripe.Key = setting.StripeApiSecret
+	result, err := session.Get(topUp.ProviderTradeNo, nil)
+	if err != nil {
+		return err
+	}
+	if result.PaymentIntent == nil || result.PaymentIntent.ID == "" {
+		return fmt.Errorf("Stripe 订单没有可退款的支付")
+	}
+	params := &stripe.RefundParams{
+		PaymentIntent: stripe.String(result.PaymentIntent.ID),
+	}
+	params.AddMetadata("trade_no", topUp.TradeNo)
+	if reason != "" {
+		params.AddMetadata("reason", reason)
+	}
+	_, err = refund.New(params)
+	return err
+}
+
 func RequestStripeAmount(c *gin.Context) {
 	var req StripePayRequest
 	err := c.ShouldBindJSON(&req)
@@ -145,30 +275,27 @@ func RequestStripePay(c *gin.Context) {
 }
 
 func StripeWebhook(c *gin.Context) {
-	payload, err := io.ReadAll(c.Request.Body)
+	callback, err := stripeAdaptor.VerifyCallback(c)
 	if err != nil {
+		if errors.Is(err, ErrPaymentSignature) {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
 		log.Printf("解析Stripe Webhook参数失败: %v\n", err)
 		c.AbortWithStatus(http.StatusServiceUnavailable)
 		return
 	}
-
-	signature := c.GetHeader("Stripe-Signature")
-	endpointSecret := setting.StripeWebhookSecret
-	event, err := webhook.ConstructEventWithOptions(payload, signature, endpointSecret, webhook.ConstructEventOptions{
-		IgnoreAPIVersionMismatch: true,
-	})
-
-	if err != nil {
-		log.Printf("Stripe Webhook验签失败: %v\n", err)
-		c.AbortWithStatus(http.StatusBadRequest)
-		return
-	}
+	event := callback.Raw.(stripe.Event)
 
 	switch event.Type {
 	case stripe.EventTypeCheckoutSessionCompleted:
 		sessionCompleted(event)
 	case stripe.EventTypeCheckoutSessionExpired:
 		sessionExpired(event)
+	case stripe.EventTypeInvoicePaid:
+		invoicePaid(event)
+	case stripe.EventTypeCustomerSubscriptionDeleted:
+		subscriptionDeleted(event)
 	default:
 		log.Printf("不支持的Stripe Webhook事件类型: %s\n", event.Type)
 	}
@@ -185,6 +312,16 @@ func sessionCompleted(event stripe.Event) {
 		return
 	}
 
+	if event.GetObjectValue("mode") == string(stripe.CheckoutSessionModeSubscription) {
+		sub, err := model.ActivateSubscriptionByTradeNo(referenceId, event.GetObjectValue("subscription"))
+		if err != nil {
+			log.Println(err.Error(), referenceId)
+			return
+		}
+		service.NotifySubscriptionEvent(sub.UserId, "套餐订阅成功", fmt.Sprintf("您已成功订阅套餐 %s。", sub.Plan.Name))
+		return
+	}
+
 	err := model.Recharge(referenceId, customerId)
 	if err != nil {
 		log.Println(err.Error(), referenceId)
@@ -209,28 +346,87 @@ func sessionExpired(event stripe.Event) {
 		return
 	}
 
-	topUp := model.GetTopUpByTradeNo(referenceId)
-	if topUp == nil {
-		log.Println("充值订单不存在", referenceId)
+	if err := model.ExpireTopUp(referenceId); err != nil {
+		log.Println("过期充值订单失败", referenceId, ", err:", err.Error())
 		return
 	}
 
-	if topUp.Status != common.TopUpStatusPending {
-		log.Println("充值订单状态错误", referenceId)
-	}
+	log.Println("充值订单已过期", referenceId)
+}
 
-	topUp.Status = common.TopUpStatusExpired
-	err := topUp.Update()
+// invoicePaid 处理订阅周期续费成功，首期账单由 checkout.session.completed 处理
+func invoicePaid(event stripe.Event) {
+	if event.GetObjectValue("billing_reason") != "subscription_cycle" {
+		return
+	}
+	subscriptionId := event.GetObjectValue("subscription")
+	sub, err := model.RenewSubscriptionByProviderId(model.SubscriptionProviderStripe, subscriptionId)
 	if err != nil {
-		log.Println("过期充值订单失败", referenceId, ", err:", err.Error())
+		log.Println(err.Error(), subscriptionId)
 		return
 	}
+	if sub != nil {
+		service.NotifySubscriptionEvent(sub.UserId, "套餐续订成功", fmt.Sprintf("您的套餐 %s 已续订，本周期额度 %s。", sub.Plan.Name, logger.FormatQuota(sub.Plan.IncludedQuota)))
+	}
+}
 
-	log.Println("充值订单已过期", referenceId)
+func subscriptionDeleted(event stripe.Event) {
+	subscriptionId := event.GetObjectValue("id")
+	if err := model.CancelSubscriptionByProviderId(model.SubscriptionProviderStripe, subscriptionId); err != nil {
+		log.Println("取消Stripe订阅失败", subscriptionId, ", err:", err.Error())
+		return
+	}
+	log.Println("Stripe订阅已取消", subscriptionId)
 }
 
-// genStripeLink generates a Stripe Checkout session URL for payment.
-// It creates a new checkout session with the specified parameters and returns the payment URL.
+// genStripeSubscriptionLink 创建订阅模式的 Stripe Checkout 会话，续费由 Stripe 按价格的计费周期自动发起
+func genStripeSubscriptionLink(referenceId string, customerId string, email string, priceId string) (string, error) {
+	if !strings.HasPrefix(setting.StripeApiSecret, "sk_") && !strings.HasPrefix(setting.StripeApiSecret, "rk_") {
+		return "", fmt.Errorf("无效的Stripe API密钥")
+	}
+
+	stripe.Key = setting.StripeApiSecret
+
+	params := &stripe.CheckoutSessionParams{
+		ClientReferenceID: stripe.String(referenceId),
+		SuccessURL:        stripe.String(system_setting.ServerAddress + "/console/topup"),
+		CancelURL:         stripe.String(system_setting.ServerAddress + "/console/topup"),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{
+			{
+				Price:    stripe.String(priceId),
+				Quantity: stripe.Int64(1),
+			},
+		},
+		Mode: stripe.String(string(stripe.CheckoutSessionModeSubscription)),
+	}
+
+	if "" == customerId {
+		if "" != email {
+			params.CustomerEmail = stripe.String(email)
+		}
+	} else {
+		params.Customer = stripe.String(customerId)
+	}
+
+	result, err := session.New(params)
+	if err != nil {
+		return "", err
+	}
+
+	return result.URL, nil
+}
+
+// cancelStripeSubscription 在当前周期结束时取消 Stripe 订阅
+func cancelStripeSubscription(subscriptionId string) error {
+	stripe.Key = setting.StripeApiSecret
+	_, err := subscription.Update(subscriptionId, &stripe.SubscriptionParams{
+		CancelAtPeriodEnd: stripe.Bool(true),
+	})
+	return err
+}
+
+// genStripeLink generates a Stripe Checkout session for payment.
+// It creates a new checkout session with the specified parameters and returns the session.
 //
 // Parameters:
 //   - referenceId: unique reference identifier for the transaction
@@ -239,11 +435,12 @@ func sessionExpired(event stripe.Event) {
 //   - amount: quantity of units to purchase
 //   - successURL: custom URL to redirect after successful payment (empty for default)
 //   - cancelURL: custom URL to redirect when payment is canceled (empty for default)
+//   - couponId: Stripe coupon to apply (empty for none); disables promotion codes when set
 //
-// Returns the checkout session URL or an error if the session creation fails.
-func genStripeLink(referenceId string, customerId string, email string, amount int64, successURL string, cancelURL string) (string, error) {
+// Returns the checkout session or an error if the session creation fails.
+func genStripeLink(referenceId string, customerId string, email string, amount int64, successURL string, cancelURL string, couponId string) (*stripe.CheckoutSession, error) {
 	if !strings.HasPrefix(setting.StripeApiSecret, "sk_") && !strings.HasPrefix(setting.StripeApiSecret, "rk_") {
-		return "", fmt.Errorf("无效的Stripe API密钥")
+		return nil, fmt.Errorf("无效的Stripe API密钥")
 	}
 
 	stripe.Key = setting.StripeApiSecret
@@ -269,6 +466,13 @@ func genStripeLink(referenceId string, customerId string, email string, amount i
 		Mode:                stripe.String(string(stripe.CheckoutSessionModePayment)),
 		AllowPromotionCodes: stripe.Bool(setting.StripePromotionCodesEnabled),
 	}
+	// Stripe does not allow discounts together with promotion codes
+	if couponId != "" {
+		params.AllowPromotionCodes = nil
+		params.Discounts = []*stripe.CheckoutSessionDiscountParams{
+			{Coupon: stripe.String(couponId)},
+		}
+	}
 
 	if "" == customerId {
 		if "" != email {
@@ -280,12 +484,50 @@ func genStripeLink(referenceId string, customerId string, email string, amount i
 		params.Customer = stripe.String(customerId)
 	}
 
-	result, err := session.New(params)
+	return session.New(params)
+}
+
+// genStripeCoupon creates a single-use Stripe coupon matching the top-up coupon discount.
+// Fixed discounts take the quoted amount off in the currency of the configured Price,
+// percentage discounts take the same share of payMoney off.
+func genStripeCoupon(quote *model.CouponQuote, payMoney float64) (string, error) {
+	if payMoney <= 0 {
+		return "", fmt.Errorf("invalid pay money")
+	}
+	stripe.Key = setting.StripeApiSecret
+	// Stripe limits coupon names to 40 characters
+	name := quote.Code
+	if len(name) > 40 {
+		name = name[:40]
+	}
+	params := &stripe.CouponParams{
+		Name:           stripe.String(name),
+		Duration:       stripe.String(string(stripe.CouponDurationOnce)),
+		MaxRedemptions: stripe.Int64(1),
+	}
+	if quote.Coupon.DiscountType == model.CouponDiscountFixed {
+		amountOff := int64(math.Round(quote.Discount * 100))
+		if amountOff <= 0 {
+			return "", fmt.Errorf("invalid discount")
+		}
+		stripePrice, err := price.Get(setting.StripePriceId, nil)
+		if err != nil {
+			return "", err
+		}
+		params.AmountOff = stripe.Int64(amountOff)
+		params.Currency = stripe.String(string(stripePrice.Currency))
+	} else {
+		percentOff := math.Round(quote.Discount/payMoney*10000) / 100
+		if percentOff <= 0 {
+			return "", fmt.Errorf("invalid discount")
+		}
+		params.PercentOff = stripe.Float64(math.Min(percentOff, 100))
+	}
+	result, err := coupon.New(params)
 	if err != nil {
 		return "", err
 	}
-
-	return result.URL, nil
+	return result.ID, nil
 }
 
 func GetChargedAmount(count float64, user model.User) float64 {
@@ -24,6 +24,9 @@ import (
 
 const PaymentMethodWechat = "wechat"
 
+// wechatHttpClient 调用微信支付接口的客户端，设置超时避免对账任务被无响应的请求阻塞
+var wechatHttpClient = &http.Client{Timeout: 30 * time.Second}
+
 // 微信支付统一下单请求
 type WechatUnifiedOrderReq struct {
 	XMLName        xml.Name `xml:"xml"`
@@ -67,6 +70,8 @@ func RequestWechatPay(c *gin.Context) {
 	var req struct {
 		Amount        int64  `json:"amount"`
 		PaymentMethod string `json:"payment_method"`
+		OrgId         int    `json:"org_id"`
+		CouponCode    string `json:"coupon_code"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -86,6 +91,10 @@ func RequestWechatPay(c *gin.Context) {
 	}
 
 	id := c.GetInt("id")
+	if err := checkOrgBilling(id, req.OrgId); err != nil {
+		c.JSON(200, gin.H{"message": "error", "data": err.Error()})
+		return
+	}
 	user, _ := model.GetUserById(id, false)
 
 	// 计算实际支付金额
@@ -100,9 +109,11 @@ func RequestWechatPay(c *gin.Context) {
 		c.JSON(200, gin.H{"message": "error", "data": "充值金额过低"})
 		return
 	}
-
-	// 转换为分
-	totalFee := int(payMoney * 100)
+	couponQuote, payMoney, err := quoteTopUpCoupon(req.CouponCode, id, group, payMoney)
+	if err != nil {
+		c.JSON(200, gin.H{"message": "error", "data": err.Error()})
+		return
+	}
 
 	// 生成订单号（微信支付要求out_trade_no最长32字符）
 	reference := fmt.Sprintf("wechat-ref-%d-%d-%s", user.Id, time.Now().UnixMilli(), randstr.String(4))
@@ -123,33 +134,140 @@ func RequestWechatPay(c *gin.Context) {
 		Money:         payMoney,
 		TradeNo:       referenceId,
 		PaymentMethod: PaymentMethodWechat,
-		CreateTime:    time.Now().Unix(),
-		Status:        common.TopUpStatusPending,
-	}
-
-	if err := topUp.Insert(); err != nil {
-		c.JSON(200, gin.H{"message": "error", "data": "创建订单失败"})
-		return
+		OrgId:         req.OrgId,
 	}
+	couponQuote.ApplyTo(topUp)
 
-	// 调用微信统一下单
-	notifyUrl := system_setting.ServerAddress + "/api/wechat/notify"
-	codeUrl, err := wechatUnifiedOrder(referenceId, totalFee, notifyUrl, c.ClientIP())
+	launch, err := createPaymentOrder(wechatAdaptor, &PaymentOrder{
+		TopUp:    topUp,
+		ClientIP: c.ClientIP(),
+	})
 	if err != nil {
-		log.Printf("微信统一下单失败: %v", err)
-		c.JSON(200, gin.H{"message": "error", "data": "拉起支付失败"})
+		c.JSON(200, gin.H{"message": "error", "data": err.Error()})
 		return
 	}
 
 	c.JSON(200, gin.H{
 		"message": "success",
 		"data": gin.H{
-			"pay_url":  codeUrl,
+			"pay_url":  launch.PayURL,
 			"order_id": referenceId,
 		},
 	})
 }
 
+var wechatAdaptor = &WechatAdaptor{}
+
+// WechatAdaptor 微信支付（APIv2 Native 支付）
+type WechatAdaptor struct {
+}
+
+func (*WechatAdaptor) Name() string {
+	return model.PaymentProviderWechat
+}
+
+func (*WechatAdaptor) CreateOrder(order *PaymentOrder) (*PaymentLaunch, error) {
+	// 转换为分
+	totalFee := int(decimal.NewFromFloat(order.TopUp.Money).Mul(decimal.NewFromInt(100)).Round(0).IntPart())
+	notifyUrl := system_setting.ServerAddress + "/api/wechat/notify"
+	codeUrl, err := wechatUnifiedOrder(order.TopUp.TradeNo, totalFee, notifyUrl, order.ClientIP)
+	if err != nil {
+		return nil, err
+	}
+	return &PaymentLaunch{PayURL: codeUrl}, nil
+}
+
+func (*WechatAdaptor) VerifyCallback(c *gin.Context) (*PaymentCallback, error) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return nil, fmt.Errorf("读取数据失败: %w", err)
+	}
+
+	var notify WechatNotify
+	if err := xml.Unmarshal(body, &notify); err != nil {
+		return nil, fmt.Errorf("解析数据失败: %w", err)
+	}
+
+	// 将XML解析为map用于签名验证（需要包含所有字段）
+	params, err := parseWechatXML(body)
+	if err != nil {
+		return nil, ErrPaymentSignature
+	}
+
+	// 验签
+	if !verifyWechatSign(params, setting.WechatApiV2Key) {
+		log.Printf("微信回调签名验证失败 - 订单号: %s", params["out_trade_no"])
+		return nil, ErrPaymentSignature
+	}
+
+	if notify.ReturnCode != "SUCCESS" {
+		return nil, fmt.Errorf("微信回调返回失败: %s", notify.ReturnMsg)
+	}
+
+	return &PaymentCallback{
+		TradeNo:         notify.OutTradeNo,
+		ProviderTradeNo: notify.TransactionId,
+		Paid:            notify.ResultCode == "SUCCESS",
+		Status:          notify.ResultCode,
+		Raw:             &notify,
+	}, nil
+}
+
+// QueryOrder 调用微信支付查询订单接口
+func (*WechatAdaptor) QueryOrder(topUp *model.TopUp) (*PaymentQueryResult, error) {
+	if setting.WechatMchId == "" || setting.WechatApiV2Key == "" {
+		return nil, fmt.Errorf("微信支付未配置")
+	}
+	params := map[string]string{
+		"mch_id":       setting.WechatMchId,
+		"out_trade_no": topUp.TradeNo,
+		"nonce_str":    randstr.String(32),
+	}
+	if setting.WechatAppId != "" {
+		params["appid"] = setting.WechatAppId
+	}
+	params["sign"] = wechatSign(params, setting.WechatApiV2Key)
+
+	resp, err := wechatHttpClient.Post("https://api.mch.weixin.qq.com/pay/orderquery", "application/xml", strings.NewReader(buildWechatXML(params)))
+	if err != nil {
+		return nil, fmt.Errorf("请求微信API失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("读取响应失败: %w", err)
+	}
+	result, err := parseWechatXML(body)
+	if err != nil {
+		return nil, fmt.Errorf("解析响应失败: %w", err)
+	}
+	if result["return_code"] != "SUCCESS" {
+		return nil, fmt.Errorf("微信返回错误: %s", result["return_msg"])
+	}
+	if !verifyWechatSign(result, setting.WechatApiV2Key) {
+		return nil, fmt.Errorf("微信查询订单响应签名验证失败")
+	}
+	if result["result_code"] != "SUCCESS" {
+		if result["err_code"] == "ORDERNOTEXIST" {
+			return &PaymentQueryResult{Status: PaymentQueryPending}, nil
+		}
+		return nil, fmt.Errorf("查询订单失败: %s - %s", result["err_code"], result["err_code_des"])
+	}
+	switch result["trade_state"] {
+	case "SUCCESS":
+		return &PaymentQueryResult{Status: PaymentQueryPaid, ProviderTradeNo: result["transaction_id"]}, nil
+	case "CLOSED", "REVOKED", "PAYERROR":
+		return &PaymentQueryResult{Status: PaymentQueryClosed}, nil
+	}
+	return &PaymentQueryResult{Status: PaymentQueryPending}, nil
+}
+
+// Refund 微信支付 APIv2 申请退款需要商户 API 证书，暂不支持原路退款
+func (*WechatAdaptor) Refund(topUp *model.TopUp, reason string) error {
+	return ErrPaymentUnsupported
+}
+
 // 微信统一下单
 func wechatUnifiedOrder(outTradeNo string, totalFee int, notifyUrl string, clientIP string) (string, error) {
 	if setting.WechatMchId == "" || setting.WechatApiV2Key == "" {
@@ -181,7 +299,7 @@ func wechatUnifiedOrder(outTradeNo string, totalFee int, notifyUrl string, clien
 	reqXML := buildWechatXML(params)
 
 	// 发送请求
-	resp, err := http.Post("https://api.mch.weixin.qq.com/pay/unifiedorder", "application/xml", strings.NewReader(reqXML))
+	resp, err := wechatHttpClient.Post("https://api.mch.weixin.qq.com/pay/unifiedorder", "application/xml", strings.NewReader(reqXML))
 	if err != nil {
 		return "", fmt.Errorf("请求微信API失败: %w", err)
 	}
@@ -246,23 +364,8 @@ func verifyWechatSign(params map[string]string, apiKey string) bool {
 	return receivedSign == calculatedSign
 }
 
-// 微信支付回调
-func WechatNotifyHandler(c *gin.Context) {
-	body, err := io.ReadAll(c.Request.Body)
-	if err != nil {
-		log.Printf("微信回调读取数据失败: %v", err)
-		wechatNotifyResponse(c, "FAIL", "读取数据失败")
-		return
-	}
-
-	var notify WechatNotify
-	if err := xml.Unmarshal(body, &notify); err != nil {
-		log.Printf("微信回调解析数据失败: %v", err)
-		wechatNotifyResponse(c, "FAIL", "解析数据失败")
-		return
-	}
-
-	// 将XML解析为map用于签名验证（需要包含所有字段）
+// parseWechatXML 将微信返回的 XML 解析为参数表，用于验签
+func parseWechatXML(body []byte) (map[string]string, error) {
 	params := make(map[string]string)
 	decoder := xml.NewDecoder(strings.NewReader(string(body)))
 	for {
@@ -271,9 +374,7 @@ func WechatNotifyHandler(c *gin.Context) {
 			break
 		}
 		if err != nil {
-			log.Printf("微信回调XML解析错误: %v", err)
-			wechatNotifyResponse(c, "FAIL", "签名验证失败")
-			return
+			return nil, err
 		}
 
 		if se, ok := token.(xml.StartElement); ok {
@@ -288,78 +389,31 @@ func WechatNotifyHandler(c *gin.Context) {
 			}
 		}
 	}
+	return params, nil
+}
 
-	// 验签
-	if !verifyWechatSign(params, setting.WechatApiV2Key) {
-		log.Printf("微信回调签名验证失败 - 订单号: %s, 收到的签名: %s", params["out_trade_no"], params["sign"])
-		// 输出所有参数用于调试（生产环境应该移除敏感信息）
-		var paramKeys []string
-		for k := range params {
-			if k != "sign" {
-				paramKeys = append(paramKeys, k)
-			}
-		}
-		log.Printf("微信回调参数: %v", paramKeys)
-		wechatNotifyResponse(c, "FAIL", "签名验证失败")
-		return
-	}
-
-	if notify.ReturnCode != "SUCCESS" {
-		log.Printf("微信回调返回失败: %s", notify.ReturnMsg)
-		wechatNotifyResponse(c, "FAIL", notify.ReturnMsg)
+// 微信支付回调
+func WechatNotifyHandler(c *gin.Context) {
+	callback, err := wechatAdaptor.VerifyCallback(c)
+	if err != nil {
+		log.Printf("微信回调处理失败: %v", err)
+		wechatNotifyResponse(c, "FAIL", err.Error())
 		return
 	}
 
-	if notify.ResultCode != "SUCCESS" {
-		log.Printf("微信支付失败: %s", notify.OutTradeNo)
+	if !callback.Paid {
+		log.Printf("微信支付失败: %s", callback.TradeNo)
 		wechatNotifyResponse(c, "FAIL", "支付失败")
 		return
 	}
 
-	// 查询订单
-	LockOrder(notify.OutTradeNo)
-	defer UnlockOrder(notify.OutTradeNo)
-
-	topUp := model.GetTopUpByTradeNo(notify.OutTradeNo)
-	if topUp == nil {
-		log.Printf("微信回调: 订单不存在 - %s", notify.OutTradeNo)
-		wechatNotifyResponse(c, "FAIL", "订单不存在")
-		return
-	}
-
-	// 幂等性检查
-	if topUp.Status != common.TopUpStatusPending {
-		log.Printf("微信回调: 订单已处理 - %s, 状态: %s", notify.OutTradeNo, topUp.Status)
-		wechatNotifyResponse(c, "SUCCESS", "OK")
-		return
-	}
-
-	// 处理充值
-	dAmount := decimal.NewFromInt(topUp.Amount)
-	dQuotaPerUnit := decimal.NewFromFloat(common.QuotaPerUnit)
-	quotaToAdd := int(dAmount.Mul(dQuotaPerUnit).IntPart())
-
-	err = model.IncreaseUserQuota(topUp.UserId, quotaToAdd, true)
-	if err != nil {
-		log.Printf("微信充值增加配额失败: %v", err)
+	if err := completePaymentOrder(wechatAdaptor, callback.TradeNo, callback.ProviderTradeNo); err != nil {
+		log.Printf("微信充值处理失败: %s, %v", callback.TradeNo, err)
 		wechatNotifyResponse(c, "FAIL", "处理失败")
 		return
 	}
 
-	// 更新订单状态
-	topUp.Status = common.TopUpStatusSuccess
-	topUp.CompleteTime = time.Now().Unix()
-	if err := topUp.Update(); err != nil {
-		log.Printf("微信充值更新订单失败: %v", err)
-		wechatNotifyResponse(c, "FAIL", "更新订单失败")
-		return
-	}
-
-	// 记录日志
-	model.RecordLog(topUp.UserId, model.LogTypeTopup, fmt.Sprintf("使用微信支付成功，充值金额: %d，支付金额：%.2f", quotaToAdd, topUp.Money))
-
-	log.Printf("微信支付成功 - 订单号: %s, 微信流水号: %s, 金额: %.2f, 配额: %d",
-		notify.OutTradeNo, notify.TransactionId, topUp.Money, quotaToAdd)
+	log.Printf("微信支付成功 - 订单号: %s, 微信流水号: %s", callback.TradeNo, callback.ProviderTradeNo)
 
 	wechatNotifyResponse(c, "SUCCESS", "OK")
 }
@@ -427,7 +481,8 @@ func getWechatMinTopup() int64 {
 // 获取微信支付金额（用于前端显示）
 func RequestWechatAmount(c *gin.Context) {
 	var req struct {
-		Amount int64 `json:"amount"`
+		Amount     int64  `json:"amount"`
+		CouponCode string `json:"coupon_code"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -453,6 +508,11 @@ func RequestWechatAmount(c *gin.Context) {
 		c.JSON(200, gin.H{"message": "error", "data": "充值金额过低"})
 		return
 	}
+	couponQuote, payMoney, err := quoteTopUpCoupon(req.CouponCode, id, group, payMoney)
+	if err != nil {
+		c.JSON(200, gin.H{"message": "error", "data": err.Error()})
+		return
+	}
 
-	c.JSON(200, gin.H{"message": "success", "data": fmt.Sprintf("%.2f", payMoney)})
+	c.JSON(200, gin.H{"message": "success", "data": couponAmountData(fmt.Sprintf("%.2f", payMoney), couponQuote)})
 }
@@ -0,0 +1,119 @@
+package controller
+
+import (
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	trafficKeepAliveInterval = 15 * time.Second
+	trafficWriteTimeout      = 10 * time.Second
+)
+
+// 管理端查看依赖会话 Cookie，使用默认的同源校验防止跨站 WebSocket 劫持
+var trafficUpgrader = websocket.Upgrader{}
+
+func parseTrafficFilter(c *gin.Context) service.TrafficFilter {
+	userId, _ := strconv.Atoi(c.Query("user_id"))
+	channelId, _ := strconv.Atoi(c.Query("channel_id"))
+	return service.TrafficFilter{
+		UserId:    userId,
+		Model:     c.Query("model"),
+		ChannelId: channelId,
+		Status:    c.Query("status"),
+	}
+}
+
+// StreamTraffic 以 SSE 推送中继请求事件，连接时先推送进行中与最近完成的请求
+func StreamTraffic(c *gin.Context) {
+	sub, snapshot := service.SubscribeTraffic(parseTrafficFilter(c))
+	defer service.UnsubscribeTraffic(sub)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	for _, event := range snapshot {
+		c.SSEvent("traffic", event)
+	}
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(trafficKeepAliveInterval)
+	defer ticker.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event := <-sub.C:
+			c.SSEvent("traffic", event)
+			return true
+		case <-ticker.C:
+			c.SSEvent("ping", gin.H{"dropped": sub.Dropped.Load()})
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		case <-sub.Done:
+			return false
+		}
+	})
+}
+
+// TrafficWebSocket 以 WebSocket 推送中继请求事件，过滤参数与 StreamTraffic 相同
+func TrafficWebSocket(c *gin.Context) {
+	ws, err := trafficUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		common.SysError("traffic websocket upgrade failed: " + err.Error())
+		return
+	}
+	defer ws.Close()
+
+	sub, snapshot := service.SubscribeTraffic(parseTrafficFilter(c))
+	defer service.UnsubscribeTraffic(sub)
+
+	// 读取客户端消息以感知连接关闭
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(v any) bool {
+		_ = ws.SetWriteDeadline(time.Now().Add(trafficWriteTimeout))
+		return ws.WriteJSON(v) == nil
+	}
+	for _, event := range snapshot {
+		if !write(event) {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(trafficKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-sub.C:
+			if !write(event) {
+				return
+			}
+		case <-ticker.C:
+			_ = ws.SetWriteDeadline(time.Now().Add(trafficWriteTimeout))
+			if err := ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-sub.Done:
+			_ = ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(trafficWriteTimeout))
+			return
+		}
+	}
+}
@@ -471,6 +471,11 @@ func GetSelf(c *gin.Context) {
 		"sidebar_modules":   userSetting.SidebarModules, // 正确提取sidebar_modules字段
 		"permissions":       permissions,                // 新增权限字段
 	}
+	if breakdown, err := model.GetUserQuotaBreakdown(user.Id); err != nil {
+		common.SysLog(fmt.Sprintf("failed to get quota breakdown for user %d: %s", user.Id, err.Error()))
+	} else {
+		responseData["quota_breakdown"] = breakdown
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
@@ -641,12 +646,26 @@ func UpdateUser(c *gin.Context) {
 		updatedUser.Password = "" // rollback to what it should be
 	}
 	updatePassword := updatedUser.Password != ""
+	newQuota := updatedUser.Quota
 	if err := updatedUser.Edit(updatePassword); err != nil {
 		common.ApiError(c, err)
 		return
 	}
-	if originUser.Quota != updatedUser.Quota {
-		model.RecordLog(originUser.Id, model.LogTypeManage, fmt.Sprintf("管理员将用户额度从 %s修改为 %s", logger.LogQuota(originUser.Quota), logger.LogQuota(updatedUser.Quota)))
+	if newQuota != originUser.Quota {
+		oldQuota, err := model.AdminSetUserQuota(originUser.Id, newQuota)
+		if err != nil {
+			common.ApiError(c, err)
+			return
+		}
+		if oldQuota != newQuota {
+			model.RecordLog(originUser.Id, model.LogTypeManage, fmt.Sprintf("管理员将用户额度从 %s修改为 %s", logger.LogQuota(oldQuota), logger.LogQuota(newQuota)))
+		}
+	}
+	if auditUser, err := model.GetUserById(updatedUser.Id, false); err == nil {
+		if updatePassword {
+			auditUser.Password = updatedUser.Password
+		}
+		model.RecordAudit(c, "user.update", model.AuditTargetUser, updatedUser.Id, originUser, auditUser)
 	}
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
@@ -804,6 +823,7 @@ func DeleteUser(c *gin.Context) {
 		})
 		return
 	}
+	model.RecordAudit(c, "user.delete", model.AuditTargetUser, id, originUser, nil)
 }
 
 func DeleteSelf(c *gin.Context) {
@@ -870,6 +890,7 @@ func CreateUser(c *gin.Context) {
 		common.ApiError(c, err)
 		return
 	}
+	model.RecordAudit(c, "user.create", model.AuditTargetUser, cleanUser.Id, nil, &cleanUser)
 
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
@@ -915,6 +936,7 @@ func ManageUser(c *gin.Context) {
 		})
 		return
 	}
+	originUser := user
 	switch req.Action {
 	case "disable":
 		user.Status = common.UserStatusDisabled
@@ -980,6 +1002,11 @@ func ManageUser(c *gin.Context) {
 		common.ApiError(c, err)
 		return
 	}
+	if req.Action == "delete" {
+		model.RecordAudit(c, "user.delete", model.AuditTargetUser, user.Id, &originUser, nil)
+	} else {
+		model.RecordAudit(c, "user."+req.Action, model.AuditTargetUser, user.Id, &originUser, &user)
+	}
 	clearUser := model.User{
 		Role:   user.Role,
 		Status: user.Status,
@@ -992,6 +1019,74 @@ func ManageUser(c *gin.Context) {
 	return
 }
 
+type grantQuotaRequest struct {
+	Id         int `json:"id"`
+	Quota      int `json:"quota"`
+	ExpireDays int `json:"expire_days"`
+}
+
+// AdminGrantUserQuota 管理员为用户发放额度批次，expire_days 为 0 表示永不过期
+func AdminGrantUserQuota(c *gin.Context) {
+	var req grantQuotaRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Id == 0 {
+		common.ApiErrorMsg(c, "无效的参数")
+		return
+	}
+	user, err := model.GetUserById(req.Id, false)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	myRole := c.GetInt("role")
+	if myRole <= user.Role && myRole != common.RoleRootUser {
+		common.ApiErrorMsg(c, "无权更新同权限等级或更高权限等级的用户信息")
+		return
+	}
+	if err := model.AdminGrantQuota(user.Id, req.Quota, req.ExpireDays); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	model.RecordAudit(c, "user.grant_quota", model.AuditTargetUser, user.Id, nil, req)
+	expire := "永不过期"
+	if req.ExpireDays > 0 {
+		expire = fmt.Sprintf("%d 天后过期", req.ExpireDays)
+	}
+	model.RecordLog(user.Id, model.LogTypeManage, fmt.Sprintf("管理员发放额度 %s，%s", logger.LogQuota(req.Quota), expire))
+	common.ApiSuccess(c, nil)
+}
+
+type userCreditLimitRequest struct {
+	Id          int `json:"id"`
+	CreditLimit int `json:"credit_limit"`
+}
+
+// AdminSetUserCreditLimit 管理员设置用户的后付费信用额度，0 表示恢复为预付费
+func AdminSetUserCreditLimit(c *gin.Context) {
+	var req userCreditLimitRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Id == 0 {
+		common.ApiErrorMsg(c, "无效的参数")
+		return
+	}
+	user, err := model.GetUserById(req.Id, false)
+	if err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	myRole := c.GetInt("role")
+	if myRole <= user.Role && myRole != common.RoleRootUser {
+		common.ApiErrorMsg(c, "无权更新同权限等级或更高权限等级的用户信息")
+		return
+	}
+	if err := model.SetUserCreditLimit(user.Id, req.CreditLimit); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	model.RecordAudit(c, "user.set_credit_limit", model.AuditTargetUser, user.Id,
+		gin.H{"credit_limit": user.CreditLimit}, gin.H{"credit_limit": req.CreditLimit})
+	model.RecordLog(user.Id, model.LogTypeManage, fmt.Sprintf("管理员将信用额度设置为 %s", logger.LogQuota(req.CreditLimit)))
+	common.ApiSuccess(c, nil)
+}
+
 func EmailBind(c *gin.Context) {
 	email := c.Query("email")
 	code := c.Query("code")
@@ -1027,7 +1122,8 @@ func EmailBind(c *gin.Context) {
 }
 
 type topUpRequest struct {
-	Key string `json:"key"`
+	Key   string `json:"key"`
+	OrgId int    `json:"org_id"`
 }
 
 var topUpLocks sync.Map
@@ -1088,7 +1184,11 @@ func TopUp(c *gin.Context) {
 		common.ApiError(c, err)
 		return
 	}
-	quota, err := model.Redeem(req.Key, id)
+	if err := checkOrgBilling(id, req.OrgId); err != nil {
+		common.ApiError(c, err)
+		return
+	}
+	quota, err := model.Redeem(req.Key, id, req.OrgId)
 	if err != nil {
 		common.ApiError(c, err)
 		return
@@ -1,5 +1,7 @@
 package dto
 
+import "fmt"
+
 type ChannelSettings struct {
 	ForceFormat            bool   `json:"force_format,omitempty"`
 	ThinkingToContent      bool   `json:"thinking_to_content,omitempty"`
@@ -31,6 +33,39 @@ type ChannelOtherSettings struct {
 	DisableStore          bool          `json:"disable_store,omitempty"`           // 是否禁用 store 透传（默认允许透传，禁用后可能导致 Codex 无法使用）
 	AllowSafetyIdentifier bool          `json:"allow_safety_identifier,omitempty"` // 是否允许 safety_identifier 透传（默认过滤以保护用户隐私）
 	AwsKeyType            AwsKeyType    `json:"aws_key_type,omitempty"`
+	// 上游成本定义，用于统计渠道成本与毛利，不影响用户计费
+	UpstreamCost *UpstreamCostSetting `json:"upstream_cost,omitempty"`
+}
+
+// UpstreamCostSetting 渠道的上游成本，ModelPrices 中配置了的模型按显式价格计算，
+// 其余模型按官方价格（系统模型倍率，不含分组倍率）乘以 Multiplier 计算，Multiplier 为 0 表示不统计。
+type UpstreamCostSetting struct {
+	Multiplier  float64                       `json:"multiplier,omitempty"`
+	ModelPrices map[string]UpstreamModelPrice `json:"model_prices,omitempty"`
+}
+
+// UpstreamModelPrice 模型的上游价格，token 价格单位为美元 / 百万 tokens，PerCall 非 0 时按次计价（美元 / 次）
+type UpstreamModelPrice struct {
+	Input      float64 `json:"input,omitempty"`
+	Output     float64 `json:"output,omitempty"`
+	CacheRead  float64 `json:"cache_read,omitempty"`
+	CacheWrite float64 `json:"cache_write,omitempty"`
+	PerCall    float64 `json:"per_call,omitempty"`
+}
+
+func (s *UpstreamCostSetting) Validate() error {
+	if s == nil {
+		return nil
+	}
+	if s.Multiplier < 0 {
+		return fmt.Errorf("上游成本倍率不能为负数")
+	}
+	for name, price := range s.ModelPrices {
+		if price.Input < 0 || price.Output < 0 || price.CacheRead < 0 || price.CacheWrite < 0 || price.PerCall < 0 {
+			return fmt.Errorf("模型 %s 的上游价格不能为负数", name)
+		}
+	}
+	return nil
 }
 
 func (s *ChannelOtherSettings) IsOpenRouterEnterprise() bool {
@@ -0,0 +1,69 @@
+package dto
+
+import "strings"
+
+// TokenScopes 令牌作用域，限制令牌可访问的端点与请求形态，零值表示不限制
+type TokenScopes struct {
+	AllowedEndpoints []string `json:"allowed_endpoints,omitempty"` // 允许访问的端点路径前缀，如 /v1/embeddings、/v1/chat/completions
+	MaxTokens        int      `json:"max_tokens,omitempty"`        // 单次请求允许的最大输出 token（max_tokens / max_completion_tokens / max_output_tokens）
+	DisableStream    bool     `json:"disable_stream,omitempty"`    // 是否禁止流式请求
+	MaxInputTokens   int      `json:"max_input_tokens,omitempty"`  // 单次请求允许的最大输入 token（按预估值判断），设置后不能提交无法估算输入的 Midjourney 与异步任务
+	AllowedTools     []string `json:"allowed_tools,omitempty"`     // 允许使用的工具类型，如 function、web_search、file_search；为空表示不限制
+}
+
+const (
+	TokenScopeToolFunction  = "function"
+	TokenScopeToolWebSearch = "web_search"
+)
+
+func (s *TokenScopes) IsEmpty() bool {
+	return s == nil || (len(s.AllowedEndpoints) == 0 && s.MaxTokens <= 0 && !s.DisableStream &&
+		s.MaxInputTokens <= 0 && len(s.AllowedTools) == 0)
+}
+
+// NeedRequestBody 是否需要解析请求体才能完成校验
+func (s *TokenScopes) NeedRequestBody() bool {
+	return s != nil && (s.MaxTokens > 0 || s.DisableStream || len(s.AllowedTools) > 0)
+}
+
+func (s *TokenScopes) IsEndpointAllowed(path string) bool {
+	if s == nil || len(s.AllowedEndpoints) == 0 {
+		return true
+	}
+	for _, endpoint := range s.AllowedEndpoints {
+		// 按路径段匹配，/v1/model 不应放行 /v1/models
+		endpoint = strings.TrimSpace(endpoint)
+		if endpoint == "" {
+			continue
+		}
+		endpoint = strings.TrimRight(endpoint, "/")
+		if endpoint == "" || path == endpoint || strings.HasPrefix(path, endpoint+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *TokenScopes) IsToolAllowed(tool string) bool {
+	if s == nil || len(s.AllowedTools) == 0 {
+		return true
+	}
+	for _, allowed := range s.AllowedTools {
+		if strings.EqualFold(strings.TrimSpace(allowed), tool) {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeScopeToolType 将各家的内置工具类型归一化，例如 web_search_preview、web_search_20250305 统一为 web_search
+func NormalizeScopeToolType(toolType string) string {
+	toolType = strings.ToLower(strings.TrimSpace(toolType))
+	switch {
+	case toolType == "", toolType == "custom":
+		return TokenScopeToolFunction
+	case strings.HasPrefix(toolType, "web_search"), toolType == "googlesearch", toolType == "google_search":
+		return TokenScopeToolWebSearch
+	}
+	return toolType
+}
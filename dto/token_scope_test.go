@@ -0,0 +1,34 @@
+package dto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenScopesIsEndpointAllowed_SegmentBoundary(t *testing.T) {
+	scopes := &TokenScopes{AllowedEndpoints: []string{"/v1/model", "/v1/chat/"}}
+
+	require.True(t, scopes.IsEndpointAllowed("/v1/model"))
+	require.True(t, scopes.IsEndpointAllowed("/v1/model/abc"))
+	require.False(t, scopes.IsEndpointAllowed("/v1/models"))
+	require.False(t, scopes.IsEndpointAllowed("/v1/modelsx/abc"))
+	require.True(t, scopes.IsEndpointAllowed("/v1/chat/completions"))
+	require.False(t, scopes.IsEndpointAllowed("/v1/chatx"))
+	require.False(t, scopes.IsEndpointAllowed("/v1/embeddings"))
+}
+
+func TestTokenScopesIsEndpointAllowed_Empty(t *testing.T) {
+	var nilScopes *TokenScopes
+	require.True(t, nilScopes.IsEndpointAllowed("/v1/embeddings"))
+	require.True(t, (&TokenScopes{}).IsEndpointAllowed("/v1/embeddings"))
+	require.True(t, (&TokenScopes{AllowedEndpoints: []string{"/"}}).IsEndpointAllowed("/v1/embeddings"))
+	require.False(t, (&TokenScopes{AllowedEndpoints: []string{" "}}).IsEndpointAllowed("/v1/embeddings"))
+}
+
+func TestTokenScopesIsToolAllowed(t *testing.T) {
+	scopes := &TokenScopes{AllowedTools: []string{"function"}}
+	require.True(t, scopes.IsToolAllowed(NormalizeScopeToolType("")))
+	require.True(t, scopes.IsToolAllowed(NormalizeScopeToolType("custom")))
+	require.False(t, scopes.IsToolAllowed(NormalizeScopeToolType("web_search_preview")))
+}
@@ -5,17 +5,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
-	"sync"
 	"time"
 
 	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/setting/operation_setting"
 
-	"github.com/bytedance/gopkg/util/gopool"
 	"github.com/gin-gonic/gin"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 const (
@@ -25,74 +24,84 @@ const (
 	loggerDebug = "DEBUG"
 )
 
-const maxLogCount = 1000000
-
-var logCount int
-var setupLogLock sync.Mutex
-var setupLogWorking bool
-
+// SetupLogger 按环境变量配置日志级别与格式；设置了日志目录时同时写入按大小轮转、按天数清理的日志文件
 func SetupLogger() {
-	defer func() {
-		setupLogWorking = false
-	}()
+	configureLevels()
 	if *common.LogDir != "" {
-		ok := setupLogLock.TryLock()
-		if !ok {
-			log.Println("setup log is already working")
-			return
-		}
-		defer func() {
-			setupLogLock.Unlock()
-		}()
-		logPath := filepath.Join(*common.LogDir, fmt.Sprintf("oneapi-%s.log", time.Now().Format("20060102150405")))
-		fd, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Fatal("failed to open log file")
+		fileWriter := &lumberjack.Logger{
+			Filename:   filepath.Join(*common.LogDir, "oneapi.log"),
+			MaxSize:    common.LogMaxSizeMB,
+			MaxAge:     common.LogMaxAgeDays,
+			MaxBackups: common.LogMaxBackups,
+			LocalTime:  true,
+			Compress:   common.LogCompress,
 		}
-		gin.DefaultWriter = io.MultiWriter(os.Stdout, fd)
-		gin.DefaultErrorWriter = io.MultiWriter(os.Stderr, fd)
+		gin.DefaultWriter = io.MultiWriter(os.Stdout, fileWriter)
+		gin.DefaultErrorWriter = io.MultiWriter(os.Stderr, fileWriter)
 	}
+	setupStructured(gin.DefaultWriter, gin.DefaultErrorWriter)
 }
 
 func LogInfo(ctx context.Context, msg string) {
-	logHelper(ctx, loggerINFO, msg)
+	logHelper(ctx, slog.LevelInfo, callerModule(), msg)
 }
 
 func LogWarn(ctx context.Context, msg string) {
-	logHelper(ctx, loggerWarn, msg)
+	logHelper(ctx, slog.LevelWarn, callerModule(), msg)
 }
 
 func LogError(ctx context.Context, msg string) {
-	logHelper(ctx, loggerError, msg)
+	logHelper(ctx, slog.LevelError, callerModule(), msg)
 }
 
 func LogDebug(ctx context.Context, msg string, args ...any) {
-	if common.DebugEnabled {
-		if len(args) > 0 {
-			msg = fmt.Sprintf(msg, args...)
-		}
-		logHelper(ctx, loggerDebug, msg)
+	module := callerModule()
+	if !levelEnabled(module, slog.LevelDebug) {
+		return
 	}
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	logHelper(ctx, slog.LevelDebug, module, msg)
 }
 
-func logHelper(ctx context.Context, level string, msg string) {
+func logHelper(ctx context.Context, level slog.Level, module string, msg string) {
+	if !levelEnabled(module, level) {
+		return
+	}
+	if structured != nil {
+		attrs := contextAttrs(ctx)
+		if module != "" {
+			attrs = append(attrs, "module", module)
+		}
+		structured.Log(ctx, level, msg, attrs...)
+		return
+	}
 	writer := gin.DefaultErrorWriter
-	if level == loggerINFO {
+	if level == slog.LevelInfo {
 		writer = gin.DefaultWriter
 	}
-	id := ctx.Value(common.RequestIdKey)
+	var id any
+	if ctx != nil {
+		id = ctx.Value(common.RequestIdKey)
+	}
 	if id == nil {
 		id = "SYSTEM"
 	}
 	now := time.Now()
-	_, _ = fmt.Fprintf(writer, "[%s] %v | %s | %s \n", level, now.Format("2006/01/02 - 15:04:05"), id, msg)
-	logCount++ // we don't need accurate count, so no lock here
-	if logCount > maxLogCount && !setupLogWorking {
-		logCount = 0
-		setupLogWorking = true
-		gopool.Go(func() {
-			SetupLogger()
-		})
+	_, _ = fmt.Fprintf(writer, "[%s] %v | %s | %s \n", legacyLevelName(level), now.Format("2006/01/02 - 15:04:05"), id, msg)
+}
+
+func legacyLevelName(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return loggerError
+	case level >= slog.LevelWarn:
+		return loggerWarn
+	case level >= slog.LevelInfo:
+		return loggerINFO
+	default:
+		return loggerDebug
 	}
 }
 
@@ -151,10 +160,15 @@ func FormatQuota(quota int) string {
 
 // LogJson 仅供测试使用 only for test
 func LogJson(ctx context.Context, msg string, obj any) {
+	// 模块需在这里计算，经 LogDebug 转调时调用方会变成 logger 本身
+	module := callerModule()
+	if !levelEnabled(module, slog.LevelDebug) {
+		return
+	}
 	jsonStr, err := json.Marshal(obj)
 	if err != nil {
-		LogError(ctx, fmt.Sprintf("json marshal failed: %s", err.Error()))
+		logHelper(ctx, slog.LevelError, module, fmt.Sprintf("json marshal failed: %s", err.Error()))
 		return
 	}
-	LogDebug(ctx, fmt.Sprintf("%s | %s", msg, string(jsonStr)))
+	logHelper(ctx, slog.LevelDebug, module, fmt.Sprintf("%s | %s", msg, string(jsonStr)))
 }
@@ -0,0 +1,54 @@
+package logger_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+// setupTestJSONLogger 以 json 格式输出到缓冲区，结束时恢复原有配置
+func setupTestJSONLogger(t *testing.T, level string, moduleLevels string) (*bytes.Buffer, *bytes.Buffer) {
+	t.Helper()
+	oldOut, oldErr := gin.DefaultWriter, gin.DefaultErrorWriter
+	oldFormat, oldLevel, oldModuleLevels, oldLogDir := common.LogFormat, common.LogLevel, common.LogModuleLevels, *common.LogDir
+	t.Cleanup(func() {
+		gin.DefaultWriter, gin.DefaultErrorWriter = oldOut, oldErr
+		common.LogFormat, common.LogLevel, common.LogModuleLevels, *common.LogDir = oldFormat, oldLevel, oldModuleLevels, oldLogDir
+		logger.SetupLogger()
+	})
+	var out, errOut bytes.Buffer
+	gin.DefaultWriter, gin.DefaultErrorWriter = &out, &errOut
+	common.LogFormat, common.LogLevel, common.LogModuleLevels, *common.LogDir = logger.LogFormatJSON, level, moduleLevels, ""
+	logger.SetupLogger()
+	return &out, &errOut
+}
+
+func TestLogJson_UsesCallerModuleLevel(t *testing.T) {
+	// 调用方所在模块开启调试日志时输出，模块字段为调用方而不是 logger
+	out, _ := setupTestJSONLogger(t, "info", "logger_test=debug")
+	logger.LogJson(context.Background(), "payload", map[string]int{"a": 1})
+	require.Contains(t, out.String(), `"module":"logger_test"`)
+	require.Contains(t, out.String(), `payload | {\"a\":1}`)
+
+	// logger 模块本身开启调试日志不影响调用方
+	out, _ = setupTestJSONLogger(t, "info", "logger=debug")
+	logger.LogJson(context.Background(), "payload", map[string]int{"a": 1})
+	require.Empty(t, out.String())
+}
+
+func TestLogFunctions_ModuleLevels(t *testing.T) {
+	out, errOut := setupTestJSONLogger(t, "error", "logger_test=warn")
+	ctx := context.Background()
+	logger.LogInfo(ctx, "info message")
+	logger.LogDebug(ctx, "debug %s", "message")
+	logger.LogWarn(ctx, "warn message")
+	require.Empty(t, out.String())
+	require.Contains(t, errOut.String(), "warn message")
+	require.Contains(t, errOut.String(), `"level":"WARN"`)
+}
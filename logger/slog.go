@@ -0,0 +1,209 @@
+package logger
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	LogFormatText   = "text"
+	LogFormatJSON   = "json"
+	LogFormatLogfmt = "logfmt"
+
+	modulePathPrefix = "github.com/QuantumNous/new-api/"
+)
+
+var (
+	defaultLevel = slog.LevelInfo
+	moduleLevels map[string]slog.Level
+	// 结构化日志输出，text 格式下为 nil
+	structured *slog.Logger
+)
+
+// configureLevels 解析 LOG_LEVEL 与 LOG_MODULE_LEVELS，未配置 LOG_LEVEL 时 DEBUG 模式下默认输出调试日志
+func configureLevels() {
+	defaultLevel = slog.LevelInfo
+	if common.DebugEnabled {
+		defaultLevel = slog.LevelDebug
+	}
+	if common.LogLevel != "" {
+		if level, ok := parseLevel(common.LogLevel); ok {
+			defaultLevel = level
+		} else {
+			common.SysError("invalid LOG_LEVEL: " + common.LogLevel)
+		}
+	}
+	levels := make(map[string]slog.Level)
+	for _, item := range strings.Split(common.LogModuleLevels, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		module, value, found := strings.Cut(item, "=")
+		level, ok := parseLevel(strings.TrimSpace(value))
+		if !found || !ok {
+			common.SysError("invalid LOG_MODULE_LEVELS item: " + item)
+			continue
+		}
+		levels[strings.TrimSpace(module)] = level
+	}
+	moduleLevels = levels
+}
+
+func parseLevel(s string) (slog.Level, bool) {
+	if strings.EqualFold(s, "err") {
+		return slog.LevelError, true
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, false
+	}
+	return level, true
+}
+
+func levelFor(module string) slog.Level {
+	if level, ok := moduleLevels[module]; ok {
+		return level
+	}
+	return defaultLevel
+}
+
+func levelEnabled(module string, level slog.Level) bool {
+	return level >= levelFor(module)
+}
+
+// callerModule 返回调用日志函数的代码所在的顶层包名，如 relay、model、controller。
+// 仅在结构化输出或配置了模块级别时计算，避免 text 格式下的额外开销。
+func callerModule() string {
+	if structured == nil && len(moduleLevels) == 0 {
+		return ""
+	}
+	// 0: callerModule，1: LogInfo 等导出函数，2: 调用方
+	pc, _, _, ok := runtime.Caller(2)
+	if !ok {
+		return ""
+	}
+	fn := runtime.FuncForPC(pc)
+	if fn == nil {
+		return ""
+	}
+	name := strings.TrimPrefix(fn.Name(), modulePathPrefix)
+	if i := strings.IndexAny(name, "/."); i > 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// contextAttrs 从请求上下文中提取关联字段，gin.Context 上还会附带用户、令牌、渠道与模型
+func contextAttrs(ctx context.Context) []any {
+	if ctx == nil {
+		return nil
+	}
+	attrs := make([]any, 0, 10)
+	if id := ctx.Value(common.RequestIdKey); id != nil {
+		attrs = append(attrs, "request_id", id)
+	}
+	c, ok := ctx.(*gin.Context)
+	if !ok {
+		return attrs
+	}
+	if userId := common.GetContextKeyInt(c, constant.ContextKeyUserId); userId != 0 {
+		attrs = append(attrs, "user_id", userId)
+	}
+	if tokenId := common.GetContextKeyInt(c, constant.ContextKeyTokenId); tokenId != 0 {
+		attrs = append(attrs, "token_id", tokenId)
+	}
+	if channelId := common.GetContextKeyInt(c, constant.ContextKeyChannelId); channelId != 0 {
+		attrs = append(attrs, "channel_id", channelId)
+	}
+	if model := common.GetContextKeyString(c, constant.ContextKeyOriginalModel); model != "" {
+		attrs = append(attrs, "model", model)
+	}
+	return attrs
+}
+
+// setupStructured 按 LOG_FORMAT 创建结构化日志输出，warn 及以上级别写入错误输出
+func setupStructured(out io.Writer, errOut io.Writer) {
+	structured = nil
+	common.SysLogger = nil
+	var newHandler func(w io.Writer, opts *slog.HandlerOptions) slog.Handler
+	switch common.LogFormat {
+	case LogFormatJSON:
+		newHandler = func(w io.Writer, opts *slog.HandlerOptions) slog.Handler {
+			return slog.NewJSONHandler(w, opts)
+		}
+	case LogFormatLogfmt:
+		newHandler = func(w io.Writer, opts *slog.HandlerOptions) slog.Handler {
+			return slog.NewTextHandler(w, opts)
+		}
+	case "", LogFormatText:
+		return
+	default:
+		common.SysError(fmt.Sprintf("unsupported LOG_FORMAT: %s, using text", common.LogFormat))
+		return
+	}
+	// 请求日志的级别在 logHelper 中按模块过滤，这里放行所有级别
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	structured = slog.New(splitHandler{out: newHandler(out, opts), err: newHandler(errOut, opts)})
+	sysOpts := &slog.HandlerOptions{Level: levelFor("sys")}
+	common.SysLogger = slog.New(splitHandler{out: newHandler(out, sysOpts), err: newHandler(errOut, sysOpts)}).With("module", "sys")
+}
+
+// StructuredEnabled 是否以 json 或 logfmt 格式输出日志
+func StructuredEnabled() bool {
+	return structured != nil
+}
+
+// LogAccess 以结构化格式记录一次 HTTP 请求，查询参数可能包含密钥，因此只记录路径
+func LogAccess(c *gin.Context, latency time.Duration) {
+	if structured == nil || !levelEnabled("http", slog.LevelInfo) {
+		return
+	}
+	attrs := append(contextAttrs(c),
+		"module", "http",
+		"status", c.Writer.Status(),
+		"latency_ms", latency.Milliseconds(),
+		"client_ip", c.ClientIP(),
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+	)
+	structured.Log(c, slog.LevelInfo, "request", attrs...)
+}
+
+// splitHandler 将 warn 及以上级别的日志交给 err，其余交给 out，与 text 格式的输出流保持一致
+type splitHandler struct {
+	out slog.Handler
+	err slog.Handler
+}
+
+func (h splitHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if level >= slog.LevelWarn {
+		return h.err.Enabled(ctx, level)
+	}
+	return h.out.Enabled(ctx, level)
+}
+
+func (h splitHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		return h.err.Handle(ctx, r)
+	}
+	return h.out.Handle(ctx, r)
+}
+
+func (h splitHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return splitHandler{out: h.out.WithAttrs(attrs), err: h.err.WithAttrs(attrs)}
+}
+
+func (h splitHandler) WithGroup(name string) slog.Handler {
+	return splitHandler{out: h.out.WithGroup(name), err: h.err.WithGroup(name)}
+}
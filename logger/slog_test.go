@@ -0,0 +1,102 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+// setTestLogLevels 设置日志级别相关配置并重新解析，结束时恢复
+func setTestLogLevels(t *testing.T, debug bool, level string, moduleLevels string) {
+	t.Helper()
+	oldDebug, oldLevel, oldModuleLevels := common.DebugEnabled, common.LogLevel, common.LogModuleLevels
+	t.Cleanup(func() {
+		common.DebugEnabled, common.LogLevel, common.LogModuleLevels = oldDebug, oldLevel, oldModuleLevels
+		configureLevels()
+	})
+	common.DebugEnabled, common.LogLevel, common.LogModuleLevels = debug, level, moduleLevels
+	configureLevels()
+}
+
+func TestParseLevel(t *testing.T) {
+	for input, expected := range map[string]slog.Level{
+		"debug": slog.LevelDebug,
+		"INFO":  slog.LevelInfo,
+		"warn":  slog.LevelWarn,
+		"error": slog.LevelError,
+		"err":   slog.LevelError,
+		"ERR":   slog.LevelError,
+	} {
+		level, ok := parseLevel(input)
+		require.True(t, ok, input)
+		require.Equal(t, expected, level, input)
+	}
+	for _, input := range []string{"", "verbose", "fatal"} {
+		_, ok := parseLevel(input)
+		require.False(t, ok, input)
+	}
+}
+
+func TestConfigureLevels(t *testing.T) {
+	setTestLogLevels(t, false, "", "")
+	require.Equal(t, slog.LevelInfo, defaultLevel)
+	require.Empty(t, moduleLevels)
+
+	// DEBUG 模式下默认输出调试日志，显式的 LOG_LEVEL 优先
+	setTestLogLevels(t, true, "", "")
+	require.Equal(t, slog.LevelDebug, defaultLevel)
+	setTestLogLevels(t, true, "err", "")
+	require.Equal(t, slog.LevelError, defaultLevel)
+	// 无效的 LOG_LEVEL 沿用默认级别
+	setTestLogLevels(t, false, "loud", "")
+	require.Equal(t, slog.LevelInfo, defaultLevel)
+
+	// 无效的模块配置项被跳过，其余配置项仍然生效
+	setTestLogLevels(t, false, "warn", " relay=debug, model = err ,bad, http=loud,,controller=")
+	require.Equal(t, map[string]slog.Level{"relay": slog.LevelDebug, "model": slog.LevelError}, moduleLevels)
+}
+
+func TestLevelEnabled_ModuleOverrides(t *testing.T) {
+	setTestLogLevels(t, false, "warn", "relay=debug,model=error")
+
+	require.True(t, levelEnabled("relay", slog.LevelDebug))
+	require.False(t, levelEnabled("model", slog.LevelWarn))
+	require.True(t, levelEnabled("model", slog.LevelError))
+	require.False(t, levelEnabled("controller", slog.LevelInfo))
+	require.True(t, levelEnabled("controller", slog.LevelWarn))
+	require.False(t, levelEnabled("", slog.LevelInfo))
+}
+
+func TestSplitHandler_RoutesByLevel(t *testing.T) {
+	var out, errOut bytes.Buffer
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	logger := slog.New(splitHandler{out: slog.NewJSONHandler(&out, opts), err: slog.NewJSONHandler(&errOut, opts)}).With("module", "test")
+
+	logger.Debug("debug message")
+	logger.Info("info message")
+	logger.Warn("warn message")
+	logger.Error("error message")
+	require.Contains(t, out.String(), "debug message")
+	require.Contains(t, out.String(), "info message")
+	require.NotContains(t, out.String(), "warn message")
+	require.Contains(t, errOut.String(), "warn message")
+	require.Contains(t, errOut.String(), "error message")
+	require.NotContains(t, errOut.String(), "info message")
+	// WithAttrs 的字段两个输出都带上
+	require.Contains(t, out.String(), `"module":"test"`)
+	require.Contains(t, errOut.String(), `"module":"test"`)
+
+	handler := splitHandler{
+		out: slog.NewJSONHandler(&out, &slog.HandlerOptions{Level: slog.LevelInfo}),
+		err: slog.NewJSONHandler(&errOut, &slog.HandlerOptions{Level: slog.LevelError}),
+	}
+	require.False(t, handler.Enabled(context.Background(), slog.LevelDebug))
+	require.True(t, handler.Enabled(context.Background(), slog.LevelInfo))
+	require.False(t, handler.Enabled(context.Background(), slog.LevelWarn))
+	require.True(t, handler.Enabled(context.Background(), slog.LevelError))
+}
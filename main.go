@@ -2,13 +2,16 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"embed"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/QuantumNous/new-api/common"
@@ -17,6 +20,7 @@ import (
 	"github.com/QuantumNous/new-api/logger"
 	"github.com/QuantumNous/new-api/middleware"
 	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/pkg/tracing"
 	"github.com/QuantumNous/new-api/router"
 	"github.com/QuantumNous/new-api/service"
 	_ "github.com/QuantumNous/new-api/setting/performance_setting"
@@ -37,6 +41,11 @@ var buildFS embed.FS
 //go:embed web/dist/index.html
 var indexPage []byte
 
+// shutdownTracing 导出尚未发送的 span，退出前调用
+var shutdownTracing = func(context.Context) error { return nil }
+
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 	startTime := time.Now()
 
@@ -89,6 +98,7 @@ func main() {
 
 	// 热更新配置
 	go model.SyncOptions(common.SyncFrequency)
+	go model.SyncPriceOverrideCache(common.SyncFrequency)
 
 	// 数据看板
 	go model.UpdateQuotaData()
@@ -106,6 +116,39 @@ func main() {
 	// Codex credential auto-refresh check every 10 minutes, refresh when expires within 1 day
 	service.StartCodexCredentialAutoRefreshTask()
 
+	// Subscription renewal, expiry and reminder check every 5 minutes
+	service.StartSubscriptionTask()
+
+	// Expire time-limited quota lots every 10 minutes
+	service.StartQuotaLotExpiryTask()
+
+	// Write buffered consume/refund ledger entries and quota lot changes every second
+	model.StartLedgerBufferFlusher()
+
+	// Reconcile balances against the quota ledger every hour
+	service.StartLedgerReconcileTask()
+
+	// Generate last month's statements at the start of each month when enabled
+	service.StartStatementTask()
+
+	// Delete this node's request/response body captures past their retention every hour
+	service.StartBodyCaptureCleanupTask()
+
+	// Roll up consume/error logs into hourly and daily usage tables every minute
+	service.StartUsageRollupTask()
+
+	// Delete this node's finished log export files past their retention every hour
+	service.StartLogExportCleanupTask()
+
+	// Sync configured channels, models and groups into the allowed metrics labels
+	service.StartMetricsLabelSync()
+
+	// Receive relay events from other nodes for the admin traffic inspector
+	service.StartTrafficInspector()
+
+	// Query pending top-up orders from payment providers every 5 minutes when enabled
+	controller.StartPaymentReconcileTask()
+
 	if common.IsMasterNode && constant.UpdateTask {
 		gopool.Go(func() {
 			controller.UpdateMidjourneyTaskBulk()
@@ -147,6 +190,7 @@ func main() {
 	// This will cause SSE not to work!!!
 	//server.Use(gzip.Gzip(gzip.DefaultCompression))
 	server.Use(middleware.RequestId())
+	server.Use(middleware.Tracing())
 	server.Use(middleware.PoweredBy())
 	middleware.SetUpLogger(server)
 	// Initialize session store
@@ -173,9 +217,38 @@ func main() {
 	// Log startup success message
 	common.LogStartupSuccess(startTime, port)
 
-	err = server.Run(":" + port)
-	if err != nil {
+	httpServer := &http.Server{Addr: ":" + port, Handler: server}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- httpServer.ListenAndServe()
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err = <-serverErr:
 		common.FatalLog("failed to start HTTP server: " + err.Error())
+	case sig := <-quit:
+		common.SysLog(fmt.Sprintf("received signal %s, shutting down", sig))
+	}
+	gracefulShutdown(httpServer)
+}
+
+// gracefulShutdown 结束流量查看长连接并等待进行中的请求结束，依次写入批量更新与缓冲的账本记录并导出剩余的 span，
+// 数据库在 main 返回时关闭
+func gracefulShutdown(httpServer *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	service.CloseTrafficSubscriptions()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		common.SysError("failed to shut down HTTP server: " + err.Error())
+	}
+	model.FlushBatchUpdate()
+	if err := model.FlushLedgerBuffer(); err != nil {
+		common.SysError("failed to flush quota ledger buffer: " + err.Error())
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		common.SysError("failed to shut down tracing: " + err.Error())
 	}
 }
 
@@ -235,6 +308,18 @@ func InitResources() error {
 
 	logger.SetupLogger()
 
+	shutdownTracing, err = tracing.Init(context.Background(), tracing.Config{
+		Enabled:           common.TracingEnabled,
+		Exporter:          common.TracingExporter,
+		ServiceName:       common.TracingServiceName,
+		Version:           common.Version,
+		SampleRatio:       common.TracingSampleRatio,
+		PropagateUpstream: common.TracingPropagateUpstream,
+	})
+	if err != nil {
+		common.SysError("failed to initialize tracing: " + err.Error())
+	}
+
 	// Initialize model settings
 	ratio_setting.InitRatioSettings()
 
@@ -254,6 +339,14 @@ func InitResources() error {
 	// Initialize options, should after model.InitDB()
 	model.InitOptionMap()
 
+	model.InitPriceOverrideCache()
+
+	// Reconcile channels, models and options from the mounted config file
+	err = service.ReconcileConfigFromFile()
+	if err != nil {
+		return err
+	}
+
 	// 清理旧的磁盘缓存文件
 	common.CleanupOldCacheFiles()
 
@@ -236,6 +236,10 @@ func TokenAuth() func(c *gin.Context) {
 			key = parts[0]
 		}
 		token, err := model.ValidateUserToken(key)
+		// 令牌额度用尽时先尝试自动充值
+		if err != nil && token != nil && service.TryAutoRefillToken(token) > 0 {
+			token, err = model.ValidateUserToken(key)
+		}
 		if token != nil {
 			id := c.GetInt("id")
 			if id == 0 {
@@ -276,6 +280,13 @@ func TokenAuth() func(c *gin.Context) {
 
 		userCache.WriteContext(c)
 
+		if token.OrgId != 0 {
+			if err := model.CheckOrgTokenUsable(token.OrgId, token.UserId); err != nil {
+				abortWithOpenAiMessage(c, http.StatusForbidden, err.Error(), types.ErrorCodeAccessDenied)
+				return
+			}
+		}
+
 		userGroup := userCache.Group
 		tokenGroup := token.Group
 		if tokenGroup != "" {
@@ -323,6 +334,15 @@ func SetupContextForToken(c *gin.Context, token *model.Token, parts ...string) e
 	}
 	common.SetContextKey(c, constant.ContextKeyTokenGroup, token.Group)
 	common.SetContextKey(c, constant.ContextKeyTokenCrossGroupRetry, token.CrossGroupRetry)
+	if scopes := token.GetScopes(); !scopes.IsEmpty() {
+		common.SetContextKey(c, constant.ContextKeyTokenScopes, scopes)
+	}
+	if token.OrgId != 0 {
+		common.SetContextKey(c, constant.ContextKeyTokenOrgId, token.OrgId)
+	}
+	if token.AutoRefillEnabled && !token.UnlimitedQuota {
+		common.SetContextKey(c, constant.ContextKeyTokenAutoRefillThreshold, token.AutoRefillThreshold)
+	}
 	if len(parts) > 1 {
 		if model.IsAdmin(token.UserId) {
 			c.Set("specific_channel_id", parts[1])
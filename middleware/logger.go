@@ -2,12 +2,22 @@ package middleware
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/logger"
 	"github.com/gin-gonic/gin"
 )
 
 func SetUpLogger(server *gin.Engine) {
+	if logger.StructuredEnabled() {
+		server.Use(func(c *gin.Context) {
+			start := time.Now()
+			c.Next()
+			logger.LogAccess(c, time.Since(start))
+		})
+		return
+	}
 	server.Use(gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
 		var requestID string
 		if param.Keys != nil {
@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tokenScopeRequest 仅解析作用域校验所需的字段，兼容 OpenAI / Claude / Responses / Gemini 请求格式
+type tokenScopeRequest struct {
+	Stream              *bool            `json:"stream,omitempty"`
+	MaxTokens           uint             `json:"max_tokens,omitempty"`
+	MaxCompletionTokens uint             `json:"max_completion_tokens,omitempty"`
+	MaxOutputTokens     uint             `json:"max_output_tokens,omitempty"`
+	Tools               []map[string]any `json:"tools,omitempty"`
+	WebSearchOptions    any              `json:"web_search_options,omitempty"`
+	GenerationConfig    *struct {
+		MaxOutputTokens uint `json:"maxOutputTokens,omitempty"`
+	} `json:"generationConfig,omitempty"`
+}
+
+func (r *tokenScopeRequest) maxOutputTokens() int {
+	maxTokens := r.MaxTokens
+	if r.MaxCompletionTokens > maxTokens {
+		maxTokens = r.MaxCompletionTokens
+	}
+	if r.MaxOutputTokens > maxTokens {
+		maxTokens = r.MaxOutputTokens
+	}
+	if r.GenerationConfig != nil && r.GenerationConfig.MaxOutputTokens > maxTokens {
+		maxTokens = r.GenerationConfig.MaxOutputTokens
+	}
+	return int(maxTokens)
+}
+
+func (r *tokenScopeRequest) isStream(c *gin.Context) bool {
+	if r.Stream != nil && *r.Stream {
+		return true
+	}
+	// gemini 通过路径或 alt=sse 指定流式
+	return strings.Contains(c.Request.URL.Path, ":streamGenerateContent") || c.Query("alt") == "sse"
+}
+
+func (r *tokenScopeRequest) toolTypes() []string {
+	toolTypes := make([]string, 0, len(r.Tools)+1)
+	for _, tool := range r.Tools {
+		if toolType, ok := tool["type"].(string); ok {
+			toolTypes = append(toolTypes, dto.NormalizeScopeToolType(toolType))
+			continue
+		}
+		if _, ok := tool["name"]; ok {
+			// claude 自定义工具没有 type 字段
+			toolTypes = append(toolTypes, dto.TokenScopeToolFunction)
+			continue
+		}
+		// gemini 工具以 key 区分，如 functionDeclarations、googleSearch、codeExecution
+		for key := range tool {
+			switch key {
+			case "functionDeclarations", "function_declarations":
+				toolTypes = append(toolTypes, dto.TokenScopeToolFunction)
+			case "googleSearchRetrieval", "google_search_retrieval":
+				toolTypes = append(toolTypes, dto.TokenScopeToolWebSearch)
+			default:
+				toolTypes = append(toolTypes, dto.NormalizeScopeToolType(key))
+			}
+		}
+	}
+	if r.WebSearchOptions != nil {
+		toolTypes = append(toolTypes, dto.TokenScopeToolWebSearch)
+	}
+	return toolTypes
+}
+
+// TokenScope 校验令牌作用域（端点、max_tokens、流式、工具），需放在 TokenAuth 之后
+func TokenScope() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		scopes, ok := common.GetContextKeyType[*dto.TokenScopes](c, constant.ContextKeyTokenScopes)
+		if !ok || scopes.IsEmpty() {
+			c.Next()
+			return
+		}
+		if !scopes.IsEndpointAllowed(c.Request.URL.Path) {
+			abortWithOpenAiMessage(c, http.StatusForbidden, fmt.Sprintf("该令牌无权访问端点 %s", c.Request.URL.Path), types.ErrorCodeTokenScopeDenied)
+			return
+		}
+		if !scopes.NeedRequestBody() || c.Request.Method != http.MethodPost ||
+			!strings.HasPrefix(c.Request.Header.Get("Content-Type"), "application/json") {
+			c.Next()
+			return
+		}
+		var request tokenScopeRequest
+		if err := common.UnmarshalBodyReusable(c, &request); err != nil {
+			abortWithOpenAiMessage(c, http.StatusBadRequest, "Invalid request, "+err.Error())
+			return
+		}
+		if scopes.DisableStream && request.isStream(c) {
+			abortWithOpenAiMessage(c, http.StatusForbidden, "该令牌不允许流式请求", types.ErrorCodeTokenScopeDenied)
+			return
+		}
+		if scopes.MaxTokens > 0 {
+			maxTokens := request.maxOutputTokens()
+			if maxTokens > scopes.MaxTokens {
+				abortWithOpenAiMessage(c, http.StatusForbidden, fmt.Sprintf("请求的 max_tokens %d 超过令牌上限 %d", maxTokens, scopes.MaxTokens), types.ErrorCodeTokenScopeDenied)
+				return
+			}
+		}
+		for _, toolType := range request.toolTypes() {
+			if !scopes.IsToolAllowed(toolType) {
+				abortWithOpenAiMessage(c, http.StatusForbidden, fmt.Sprintf("该令牌无权使用工具 %s", toolType), types.ErrorCodeTokenScopeDenied)
+				return
+			}
+		}
+		c.Next()
+	}
+}
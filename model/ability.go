@@ -52,6 +52,18 @@ func GetEnabledModels() []string {
 	return models
 }
 
+// GetMetricsLabelValues 返回所有渠道 id 以及能力表中出现过的模型与分组，作为监控指标允许的标签取值
+func GetMetricsLabelValues() (channelIds []int, models []string, groups []string, err error) {
+	if err = DB.Model(&Channel{}).Pluck("id", &channelIds).Error; err != nil {
+		return
+	}
+	if err = DB.Table("abilities").Distinct("model").Pluck("model", &models).Error; err != nil {
+		return
+	}
+	err = DB.Table("abilities").Select("DISTINCT " + commonGroupCol).Scan(&groups).Error
+	return
+}
+
 func GetAllEnableAbilities() []Ability {
 	var abilities []Ability
 	DB.Find(&abilities, "enabled = ?", true)
@@ -0,0 +1,22 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetMetricsLabelValues(t *testing.T) {
+	setupTestDB(t)
+	channel := &Channel{Name: "c1", Key: "sk-test", Models: "gpt-4o,gpt-4o-mini", Group: "default,vip", Status: common.ChannelStatusEnabled}
+	require.NoError(t, DB.Create(channel).Error)
+	require.NoError(t, channel.AddAbilities(nil))
+
+	channelIds, models, groups, err := GetMetricsLabelValues()
+	require.NoError(t, err)
+	require.Equal(t, []int{channel.Id}, channelIds)
+	require.ElementsMatch(t, []string{"gpt-4o", "gpt-4o-mini"}, models)
+	require.ElementsMatch(t, []string{"default", "vip"}, groups)
+}
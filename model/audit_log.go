@@ -0,0 +1,219 @@
+package model
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	AuditTargetOption     = "option"
+	AuditTargetChannel    = "channel"
+	AuditTargetChannelTag = "channel_tag"
+	AuditTargetUser       = "user"
+	AuditTargetRedemption = "redemption"
+	AuditTargetRatioSync  = "ratio_sync"
+	AuditTargetConfig     = "config"
+
+	auditMaskedValue = "***"
+)
+
+// AuditLog 管理操作审计记录，Diff 为变更字段的 {"字段": {"before": 旧值, "after": 新值}} JSON，敏感字段已脱敏
+type AuditLog struct {
+	Id         int    `json:"id"`
+	CreatedAt  int64  `json:"created_at" gorm:"bigint;index"`
+	ActorId    int    `json:"actor_id" gorm:"index"`
+	ActorName  string `json:"actor_name" gorm:"type:varchar(64);default:''"`
+	Ip         string `json:"ip" gorm:"type:varchar(64);default:''"`
+	Action     string `json:"action" gorm:"type:varchar(64);index"`
+	TargetType string `json:"target_type" gorm:"type:varchar(32);index:idx_audit_target"`
+	TargetId   string `json:"target_id" gorm:"type:varchar(128);index:idx_audit_target"`
+	Diff       string `json:"diff" gorm:"type:text"`
+}
+
+type AuditLogQuery struct {
+	ActorId        int
+	ActorName      string
+	Action         string
+	TargetType     string
+	TargetId       string
+	StartTimestamp int64
+	EndTimestamp   int64
+}
+
+// FieldChange 单个字段的变更前后值
+type FieldChange struct {
+	Before any `json:"before"`
+	After  any `json:"after"`
+}
+
+// auditSensitiveFields 无论字段名后缀如何都需要脱敏的字段。
+// 渠道的 header_override 常带有上游鉴权头，setting 中可能包含带账号密码的代理地址
+var auditSensitiveFields = map[string]bool{
+	"key":               true,
+	"password":          true,
+	"original_password": true,
+	"access_token":      true,
+	"header_override":   true,
+	"setting":           true,
+}
+
+// isAuditSensitiveField 在隐藏配置项规则之外，另外覆盖渠道密钥、渠道请求头与设置以及用户凭据字段
+func isAuditSensitiveField(field string) bool {
+	return auditSensitiveFields[strings.ToLower(field)] ||
+		IsSensitiveOptionKey(field) ||
+		strings.HasSuffix(field, "_key") ||
+		strings.HasSuffix(field, "_token")
+}
+
+// auditFields 将对象转为顶层字段表，nil 表示对象不存在（新建或删除）
+func auditFields(v any) map[string]any {
+	if v == nil {
+		return nil
+	}
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return nil
+	}
+	data, err := common.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	fields := make(map[string]any)
+	if err := common.Unmarshal(data, &fields); err != nil {
+		return map[string]any{"value": string(data)}
+	}
+	return fields
+}
+
+// buildAuditDiff 比较前后两个对象的顶层字段，仅保留发生变化的字段，敏感字段的值以 *** 代替
+func buildAuditDiff(before any, after any) map[string]FieldChange {
+	diff := diffFields(auditFields(before), auditFields(after))
+	for field, change := range diff {
+		if !isAuditSensitiveField(field) {
+			continue
+		}
+		if change.Before != nil {
+			change.Before = auditMaskedValue
+		}
+		if change.After != nil {
+			change.After = auditMaskedValue
+		}
+		diff[field] = change
+	}
+	return diff
+}
+
+// DiffObjects 比较两个对象的顶层字段，不做脱敏，nil 表示对象不存在
+func DiffObjects(before any, after any) map[string]FieldChange {
+	return diffFields(auditFields(before), auditFields(after))
+}
+
+// diffFields 比较两个字段表，返回发生变化的字段，nil 字段表表示对象不存在
+func diffFields(beforeFields map[string]any, afterFields map[string]any) map[string]FieldChange {
+	diff := make(map[string]FieldChange)
+	for field, value := range beforeFields {
+		afterValue, ok := afterFields[field]
+		if ok && reflect.DeepEqual(value, afterValue) {
+			continue
+		}
+		diff[field] = FieldChange{Before: value, After: afterValue}
+	}
+	for field, value := range afterFields {
+		if _, ok := beforeFields[field]; ok || value == nil {
+			continue
+		}
+		diff[field] = FieldChange{After: value}
+	}
+	return diff
+}
+
+// RecordAudit 记录一次管理操作，before 与 after 分别为操作前后的对象，新建时 before 为 nil，删除时 after 为 nil。
+// 写入失败只记录系统日志，不影响操作本身。
+func RecordAudit(c *gin.Context, action string, targetType string, targetId any, before any, after any) {
+	diff := ""
+	if changes := buildAuditDiff(before, after); len(changes) > 0 {
+		data, err := common.Marshal(changes)
+		if err != nil {
+			common.SysError("failed to marshal audit diff: " + err.Error())
+		} else {
+			diff = string(data)
+		}
+	}
+	auditLog := &AuditLog{
+		CreatedAt:  common.GetTimestamp(),
+		ActorId:    c.GetInt("id"),
+		ActorName:  c.GetString("username"),
+		Ip:         c.ClientIP(),
+		Action:     action,
+		TargetType: targetType,
+		TargetId:   fmt.Sprint(targetId),
+		Diff:       diff,
+	}
+	if err := LOG_DB.Create(auditLog).Error; err != nil {
+		common.SysError("failed to record audit log: " + err.Error())
+	}
+}
+
+func (q *AuditLogQuery) apply(tx *gorm.DB) *gorm.DB {
+	if q.ActorId != 0 {
+		tx = tx.Where("actor_id = ?", q.ActorId)
+	}
+	if q.ActorName != "" {
+		tx = tx.Where("actor_name = ?", q.ActorName)
+	}
+	if q.Action != "" {
+		tx = tx.Where("action = ?", q.Action)
+	}
+	if q.TargetType != "" {
+		tx = tx.Where("target_type = ?", q.TargetType)
+	}
+	if q.TargetId != "" {
+		tx = tx.Where("target_id = ?", q.TargetId)
+	}
+	if q.StartTimestamp != 0 {
+		tx = tx.Where("created_at >= ?", q.StartTimestamp)
+	}
+	if q.EndTimestamp != 0 {
+		tx = tx.Where("created_at <= ?", q.EndTimestamp)
+	}
+	return tx
+}
+
+func SearchAuditLogs(query *AuditLogQuery, startIdx int, num int) (logs []*AuditLog, total int64, err error) {
+	tx := query.apply(LOG_DB.Model(&AuditLog{}))
+	if err = tx.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err = tx.Order("id desc").Limit(num).Offset(startIdx).Find(&logs).Error
+	return logs, total, err
+}
+
+// IterateAuditLogs 按 id 倒序分批读取符合条件的审计记录，fn 返回错误时停止
+func IterateAuditLogs(query *AuditLogQuery, batchSize int, fn func(logs []*AuditLog) error) error {
+	lastId := 0
+	for {
+		tx := query.apply(LOG_DB.Model(&AuditLog{}))
+		if lastId != 0 {
+			tx = tx.Where("id < ?", lastId)
+		}
+		var logs []*AuditLog
+		if err := tx.Order("id desc").Limit(batchSize).Find(&logs).Error; err != nil {
+			return err
+		}
+		if len(logs) == 0 {
+			return nil
+		}
+		if err := fn(logs); err != nil {
+			return err
+		}
+		if len(logs) < batchSize {
+			return nil
+		}
+		lastId = logs[len(logs)-1].Id
+	}
+}
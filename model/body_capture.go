@@ -0,0 +1,87 @@
+package model
+
+import (
+	"unicode/utf8"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BodyCapture 一次中继请求留存的请求体与响应体，按 request_id 与日志关联。
+// 存储方式为 disk 时内容写入 StoragePath 指向的文件，表中只保留索引字段。
+type BodyCapture struct {
+	Id                int    `json:"id"`
+	RequestId         string `json:"request_id" gorm:"type:varchar(64);uniqueIndex"`
+	CreatedAt         int64  `json:"created_at" gorm:"bigint;index"`
+	UserId            int    `json:"user_id" gorm:"index"`
+	TokenId           int    `json:"token_id" gorm:"default:0"`
+	Group             string `json:"group" gorm:"type:varchar(64);default:''"`
+	ModelName         string `json:"model_name" gorm:"default:''"`
+	ChannelId         int    `json:"channel_id" gorm:"default:0"`
+	StatusCode        int    `json:"status_code" gorm:"default:0"`
+	IsStream          bool   `json:"is_stream"`
+	RequestBody       string `json:"request_body,omitempty" gorm:"type:text"`
+	ResponseBody      string `json:"response_body,omitempty" gorm:"type:text"`
+	RequestTruncated  bool   `json:"request_truncated"`
+	ResponseTruncated bool   `json:"response_truncated"`
+	StoragePath       string `json:"-" gorm:"default:''"`
+	Node              string `json:"node" gorm:"type:varchar(128);index;default:''"` // 写入留存的节点，磁盘文件只在该节点上
+}
+
+// mysqlTextMaxBytes MySQL TEXT 列最多保存的字节数
+const mysqlTextMaxBytes = 65535
+
+func (capture *BodyCapture) Insert() error {
+	if LOG_DB.Dialector.Name() == "mysql" {
+		capture.RequestBody, capture.RequestTruncated = truncateCaptureText(capture.RequestBody, mysqlTextMaxBytes, capture.RequestTruncated)
+		capture.ResponseBody, capture.ResponseTruncated = truncateCaptureText(capture.ResponseBody, mysqlTextMaxBytes, capture.ResponseTruncated)
+	}
+	return LOG_DB.Create(capture).Error
+}
+
+// truncateCaptureText 按 UTF-8 字符边界截断到 maxBytes 以内
+func truncateCaptureText(text string, maxBytes int, truncated bool) (string, bool) {
+	if len(text) <= maxBytes {
+		return text, truncated
+	}
+	cut := maxBytes
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut], true
+}
+
+func GetBodyCaptureByRequestId(requestId string) (*BodyCapture, error) {
+	capture := &BodyCapture{}
+	err := LOG_DB.Where("request_id = ?", requestId).First(capture).Error
+	return capture, err
+}
+
+// GetExpiredBodyCaptures 返回节点 node 写入的、创建时间早于 before 的留存记录，用于按保留天数清理
+func GetExpiredBodyCaptures(node string, before int64, limit int) ([]*BodyCapture, error) {
+	var captures []*BodyCapture
+	err := LOG_DB.Select("id, storage_path").Where("node = ? AND created_at < ?", node, before).Order("id").Limit(limit).Find(&captures).Error
+	return captures, err
+}
+
+func DeleteBodyCapturesByIds(ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return LOG_DB.Where("id IN ?", ids).Delete(&BodyCapture{}).Error
+}
+
+// markBodyCaptured 请求开启了内容留存时在日志的 other 字段记录 request_id，供管理员查看留存内容
+func markBodyCaptured(c *gin.Context, other map[string]interface{}) map[string]interface{} {
+	if c == nil || !common.GetContextKeyBool(c, constant.ContextKeyBodyCapture) {
+		return other
+	}
+	if other == nil {
+		other = make(map[string]interface{})
+	}
+	other["request_id"] = c.GetString(common.RequestIdKey)
+	other["body_captured"] = true
+	return other
+}
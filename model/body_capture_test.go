@@ -0,0 +1,34 @@
+package model
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBodyCaptureInsert_TextColumns(t *testing.T) {
+	setupTestDB(t)
+	body := strings.Repeat("a", 70000)
+	capture := &BodyCapture{RequestId: "req-1", RequestBody: body, ResponseBody: "ok"}
+	require.NoError(t, capture.Insert())
+
+	saved, err := GetBodyCaptureByRequestId("req-1")
+	require.NoError(t, err)
+	require.Equal(t, body, saved.RequestBody)
+	require.False(t, saved.RequestTruncated)
+}
+
+func TestTruncateCaptureText(t *testing.T) {
+	text, truncated := truncateCaptureText("abc", 5, false)
+	require.Equal(t, "abc", text)
+	require.False(t, truncated)
+
+	// 不在多字节字符中间截断
+	text, truncated = truncateCaptureText("ab中文", 4, false)
+	require.Equal(t, "ab", text)
+	require.True(t, truncated)
+
+	_, truncated = truncateCaptureText("abc", 5, true)
+	require.True(t, truncated)
+}
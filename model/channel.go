@@ -456,6 +456,16 @@ func (channel *Channel) Insert() error {
 }
 
 func (channel *Channel) Update() error {
+	return channel.update(nil)
+}
+
+// UpdateColumns 按给定列更新渠道，零值同样写入，用于需要覆盖整份配置的场景
+func (channel *Channel) UpdateColumns(columns ...string) error {
+	return channel.update(columns)
+}
+
+// update 在 columns 为空时只更新非零值字段
+func (channel *Channel) update(columns []string) error {
 	// If this is a multi-key channel, recalculate MultiKeySize based on the current key list to avoid inconsistency after editing keys
 	if channel.ChannelInfo.IsMultiKey {
 		var keyStr string
@@ -494,8 +504,11 @@ func (channel *Channel) Update() error {
 			}
 		}
 	}
-	var err error
-	err = DB.Model(channel).Updates(channel).Error
+	tx := DB.Model(channel)
+	if len(columns) > 0 {
+		tx = tx.Select(columns)
+	}
+	err := tx.Updates(channel).Error
 	if err != nil {
 		return err
 	}
@@ -849,6 +862,15 @@ func (channel *Channel) ValidateSettings() error {
 			return err
 		}
 	}
+	if channel.OtherSettings != "" {
+		otherSettings := dto.ChannelOtherSettings{}
+		if err := common.UnmarshalJsonStr(channel.OtherSettings, &otherSettings); err != nil {
+			return err
+		}
+		if err := otherSettings.UpstreamCost.Validate(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,380 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+const (
+	CouponDiscountNone    = "none"    // 不减免支付金额，仅赠送额度
+	CouponDiscountPercent = "percent" // DiscountValue 为减免百分比，如 20 表示八折
+	CouponDiscountFixed   = "fixed"   // DiscountValue 为减免的支付金额
+)
+
+const (
+	CouponStatusEnabled  = 1
+	CouponStatusDisabled = 2
+)
+
+// Coupon 充值优惠码。下单时校验并计算优惠，订单支付成功后在入账事务中重新校验次数上限，
+// 核销成功才计入使用次数并发放赠送额度。支付前的减免无法撤回，因此并发下单时减免次数可能略微超出上限，
+// 但赠送额度不会超出。
+type Coupon struct {
+	Id            int     `json:"id"`
+	Code          string  `json:"code" gorm:"type:varchar(64);uniqueIndex"`
+	Name          string  `json:"name" gorm:"type:varchar(64)"`
+	DiscountType  string  `json:"discount_type" gorm:"type:varchar(16);default:'none'"`
+	DiscountValue float64 `json:"discount_value" gorm:"default:0"`
+	// 支付成功后额外赠送的额度
+	BonusQuota int `json:"bonus_quota" gorm:"type:int;default:0"`
+	// 赠送额度的有效天数，0 表示永不过期
+	BonusExpireDays int `json:"bonus_expire_days" gorm:"type:int;default:0"`
+	// 使用优惠码要求的最低支付金额（优惠前），0 表示不限
+	MinAmount float64 `json:"min_amount" gorm:"default:0"`
+	StartTime int64   `json:"start_time" gorm:"bigint;default:0"` // 0 表示立即生效
+	EndTime   int64   `json:"end_time" gorm:"bigint;default:0"`   // 0 表示永不过期
+	// 总使用次数上限与每个用户的使用次数上限，0 表示不限
+	MaxUses      int `json:"max_uses" gorm:"type:int;default:0"`
+	UsedCount    int `json:"used_count" gorm:"type:int;default:0"`
+	PerUserLimit int `json:"per_user_limit" gorm:"type:int;default:0"`
+	// 允许使用的用户分组，逗号分隔，为空表示不限
+	Groups      string `json:"groups" gorm:"column:allowed_groups;type:varchar(255);default:''"`
+	Status      int    `json:"status" gorm:"type:int;default:1"`
+	CreatedTime int64  `json:"created_time" gorm:"bigint"`
+}
+
+// CouponUsage 优惠码使用记录，每个已支付订单一条
+type CouponUsage struct {
+	Id          int     `json:"id"`
+	CouponId    int     `json:"coupon_id" gorm:"index"`
+	UserId      int     `json:"user_id" gorm:"index"`
+	OrgId       int     `json:"org_id" gorm:"default:0"`
+	TradeNo     string  `json:"trade_no" gorm:"type:varchar(255);uniqueIndex"`
+	Money       float64 `json:"money" gorm:"default:0"` // 同订单的 Money，即优惠后的支付金额
+	Discount    float64 `json:"discount" gorm:"default:0"`
+	BonusQuota  int     `json:"bonus_quota" gorm:"type:int;default:0"`
+	CreatedTime int64   `json:"created_time" gorm:"bigint"`
+}
+
+// CouponQuote 优惠码在某笔订单上的优惠结果
+type CouponQuote struct {
+	Coupon     *Coupon `json:"-"`
+	Code       string  `json:"code"`
+	Discount   float64 `json:"discount"`
+	BonusQuota int     `json:"bonus_quota"`
+	PayMoney   float64 `json:"pay_money"`
+}
+
+// ApplyTo 将优惠结果记录到充值订单，未使用优惠码时不做修改
+func (q *CouponQuote) ApplyTo(topUp *TopUp) {
+	if q == nil || q.Coupon == nil {
+		return
+	}
+	topUp.CouponId = q.Coupon.Id
+	topUp.CouponCode = q.Coupon.Code
+	topUp.CouponDiscount = q.Discount
+	topUp.CouponBonusQuota = q.BonusQuota
+}
+
+func (coupon *Coupon) Validate() error {
+	coupon.Code = strings.TrimSpace(coupon.Code)
+	if coupon.Code == "" || len(coupon.Code) > 64 {
+		return errors.New("优惠码长度必须在1-64之间")
+	}
+	switch coupon.DiscountType {
+	case "", CouponDiscountNone:
+		coupon.DiscountType = CouponDiscountNone
+		coupon.DiscountValue = 0
+	case CouponDiscountPercent:
+		if coupon.DiscountValue <= 0 || coupon.DiscountValue >= 100 {
+			return errors.New("折扣百分比必须在0-100之间")
+		}
+	case CouponDiscountFixed:
+		if coupon.DiscountValue <= 0 {
+			return errors.New("减免金额必须大于0")
+		}
+	default:
+		return errors.New("无效的优惠类型")
+	}
+	if coupon.DiscountType == CouponDiscountNone && coupon.BonusQuota <= 0 {
+		return errors.New("优惠码至少需要提供折扣或赠送额度")
+	}
+	if coupon.BonusQuota < 0 || coupon.BonusExpireDays < 0 || coupon.MinAmount < 0 ||
+		coupon.MaxUses < 0 || coupon.PerUserLimit < 0 {
+		return errors.New("优惠码参数不能为负数")
+	}
+	if coupon.EndTime != 0 && coupon.EndTime < coupon.StartTime {
+		return errors.New("结束时间不能早于开始时间")
+	}
+	return nil
+}
+
+func (coupon *Coupon) allowGroup(group string) bool {
+	if strings.TrimSpace(coupon.Groups) == "" {
+		return true
+	}
+	for _, g := range strings.Split(coupon.Groups, ",") {
+		if strings.TrimSpace(g) == group {
+			return true
+		}
+	}
+	return false
+}
+
+// HasDiscount 是否减免支付金额
+func (coupon *Coupon) HasDiscount() bool {
+	return coupon.DiscountType == CouponDiscountPercent || coupon.DiscountType == CouponDiscountFixed
+}
+
+// QuoteCoupon 校验优惠码对当前用户与订单是否可用，并按优惠前支付金额 payMoney 计算优惠。
+// 减免后的支付金额不低于 0.01。
+func QuoteCoupon(code string, userId int, group string, payMoney float64) (*CouponQuote, error) {
+	code = strings.TrimSpace(code)
+	coupon := &Coupon{}
+	if err := DB.Where("code = ?", code).First(coupon).Error; err != nil {
+		return nil, errors.New("优惠码不存在")
+	}
+	now := common.GetTimestamp()
+	if coupon.Status != CouponStatusEnabled {
+		return nil, errors.New("优惠码已停用")
+	}
+	if coupon.StartTime != 0 && now < coupon.StartTime {
+		return nil, errors.New("优惠码尚未生效")
+	}
+	if coupon.EndTime != 0 && now > coupon.EndTime {
+		return nil, errors.New("优惠码已过期")
+	}
+	if coupon.MaxUses > 0 && coupon.UsedCount >= coupon.MaxUses {
+		return nil, errors.New("优惠码已被领完")
+	}
+	if !coupon.allowGroup(group) {
+		return nil, errors.New("当前用户分组不可使用该优惠码")
+	}
+	if coupon.MinAmount > 0 && payMoney < coupon.MinAmount {
+		return nil, errors.New("订单金额未达到优惠码使用门槛")
+	}
+	if coupon.PerUserLimit > 0 {
+		var used int64
+		if err := DB.Model(&CouponUsage{}).Where("coupon_id = ? AND user_id = ?", coupon.Id, userId).Count(&used).Error; err != nil {
+			return nil, err
+		}
+		if used >= int64(coupon.PerUserLimit) {
+			return nil, errors.New("已达到该优惠码的使用次数上限")
+		}
+	}
+
+	dPayMoney := decimal.NewFromFloat(payMoney)
+	dDiscount := decimal.Zero
+	switch coupon.DiscountType {
+	case CouponDiscountPercent:
+		dDiscount = dPayMoney.Mul(decimal.NewFromFloat(coupon.DiscountValue)).Div(decimal.NewFromInt(100))
+	case CouponDiscountFixed:
+		dDiscount = decimal.NewFromFloat(coupon.DiscountValue)
+	}
+	dDiscount = dDiscount.Round(2)
+	if maxDiscount := dPayMoney.Sub(decimal.NewFromFloat(0.01)); dDiscount.GreaterThan(maxDiscount) {
+		dDiscount = decimal.Max(maxDiscount, decimal.Zero)
+	}
+	return &CouponQuote{
+		Coupon:     coupon,
+		Code:       coupon.Code,
+		Discount:   dDiscount.InexactFloat64(),
+		BonusQuota: coupon.BonusQuota,
+		PayMoney:   dPayMoney.Sub(dDiscount).InexactFloat64(),
+	}, nil
+}
+
+// redeemCouponTx 在事务中按总次数上限原子地计入一次使用，再按每用户次数上限校验，超出任一上限时返回 false。
+// 计入次数的更新同时锁住优惠码记录，使同一优惠码的每用户校验串行执行
+func redeemCouponTx(tx *gorm.DB, couponId int, userId int) (bool, error) {
+	result := tx.Model(&Coupon{}).Where("id = ? AND (max_uses = 0 OR used_count < max_uses)", couponId).
+		Update("used_count", gorm.Expr("used_count + ?", 1))
+	if result.Error != nil {
+		return false, result.Error
+	}
+	coupon := &Coupon{}
+	if err := tx.Select("id", "per_user_limit").Where("id = ?", couponId).Limit(1).Find(coupon).Error; err != nil {
+		return false, err
+	}
+	if coupon.Id == 0 {
+		// 下单后被删除的优惠码按下单时的校验结果核销
+		return true, nil
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	if coupon.PerUserLimit > 0 {
+		var used int64
+		if err := tx.Model(&CouponUsage{}).Where("coupon_id = ? AND user_id = ?", couponId, userId).Count(&used).Error; err != nil {
+			return false, err
+		}
+		if used >= int64(coupon.PerUserLimit) {
+			err := tx.Model(&Coupon{}).Where("id = ?", couponId).Update("used_count", gorm.Expr("used_count - ?", 1)).Error
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// completeTopUpCouponTx 在订单入账的事务中核销优惠码并发放赠送额度。
+// 下单后优惠码已达到次数上限时不再核销，订单的赠送额度清零
+func completeTopUpCouponTx(tx *gorm.DB, topUp *TopUp) error {
+	if topUp.CouponId == 0 {
+		return nil
+	}
+	redeemed, err := redeemCouponTx(tx, topUp.CouponId, topUp.UserId)
+	if err != nil {
+		return err
+	}
+	if !redeemed {
+		common.SysLog(fmt.Sprintf("coupon %s reached its usage limit before top-up %s was paid, bonus quota not granted", topUp.CouponCode, topUp.TradeNo))
+		topUp.CouponBonusQuota = 0
+		return tx.Model(&TopUp{}).Where("id = ?", topUp.Id).Update("coupon_bonus_quota", 0).Error
+	}
+	usage := &CouponUsage{
+		CouponId:    topUp.CouponId,
+		UserId:      topUp.UserId,
+		OrgId:       topUp.OrgId,
+		TradeNo:     topUp.TradeNo,
+		Money:       topUp.Money,
+		Discount:    topUp.CouponDiscount,
+		BonusQuota:  topUp.CouponBonusQuota,
+		CreatedTime: common.GetTimestamp(),
+	}
+	if err := tx.Create(usage).Error; err != nil {
+		return err
+	}
+	bonus := topUp.CouponBonusQuota
+	if bonus <= 0 {
+		return nil
+	}
+	if topUp.OrgId != 0 {
+		if err := increaseOrgQuota(tx, topUp.OrgId, bonus); err != nil {
+			return err
+		}
+		return recordOrgLedger(tx, topUp.OrgId, bonus, LedgerSourceCoupon, topUp.TradeNo)
+	}
+	expireDays := 0
+	coupon := &Coupon{}
+	if err := tx.Select("bonus_expire_days").Where("id = ?", topUp.CouponId).Limit(1).Find(coupon).Error; err == nil {
+		expireDays = coupon.BonusExpireDays
+	}
+	if err := tx.Model(&User{}).Where("id = ?", topUp.UserId).Update("quota", gorm.Expr("quota + ?", bonus)).Error; err != nil {
+		return err
+	}
+	if err := recordUserLedger(tx, topUp.UserId, bonus, LedgerSourceCoupon, topUp.TradeNo); err != nil {
+		return err
+	}
+	return RecordQuotaLot(tx, topUp.UserId, QuotaLotSourceCoupon, topUp.TradeNo, bonus, expireDays)
+}
+
+func GetAllCoupons(keyword string, pageInfo *common.PageInfo) (coupons []*Coupon, total int64, err error) {
+	tx := DB.Model(&Coupon{})
+	if keyword != "" {
+		tx = tx.Where("code LIKE ? OR name LIKE ?", "%"+keyword+"%", "%"+keyword+"%")
+	}
+	if err = tx.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err = tx.Order("id desc").Limit(pageInfo.GetPageSize()).Offset(pageInfo.GetStartIdx()).Find(&coupons).Error
+	return coupons, total, err
+}
+
+func GetCouponById(id int) (*Coupon, error) {
+	coupon := &Coupon{}
+	err := DB.First(coupon, "id = ?", id).Error
+	return coupon, err
+}
+
+func (coupon *Coupon) Insert() error {
+	coupon.CreatedTime = common.GetTimestamp()
+	return DB.Create(coupon).Error
+}
+
+// Update 更新优惠码配置，不修改已使用次数
+func (coupon *Coupon) Update() error {
+	return DB.Model(coupon).Select("code", "name", "discount_type", "discount_value", "bonus_quota", "bonus_expire_days",
+		"min_amount", "start_time", "end_time", "max_uses", "per_user_limit", "allowed_groups", "status").Updates(coupon).Error
+}
+
+// DeleteCouponById 删除优惠码，保留使用记录用于统计
+func DeleteCouponById(id int) error {
+	return DB.Delete(&Coupon{}, "id = ?", id).Error
+}
+
+func GetCouponUsages(couponId int, pageInfo *common.PageInfo) (usages []*CouponUsage, total int64, err error) {
+	tx := DB.Model(&CouponUsage{}).Where("coupon_id = ?", couponId)
+	if err = tx.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err = tx.Order("id desc").Limit(pageInfo.GetPageSize()).Offset(pageInfo.GetStartIdx()).Find(&usages).Error
+	return usages, total, err
+}
+
+// CouponStat 优惠码使用统计
+type CouponStat struct {
+	CouponId   int     `json:"coupon_id"`
+	Code       string  `json:"code"`
+	Name       string  `json:"name"`
+	Uses       int64   `json:"uses"`
+	Users      int64   `json:"users"`
+	Money      float64 `json:"money"`
+	Discount   float64 `json:"discount"`
+	BonusQuota int64   `json:"bonus_quota"`
+}
+
+// GetCouponStats 按优惠码汇总期间内的使用次数、用户数、实付金额、减免金额与赠送额度
+func GetCouponStats(startTimestamp int64, endTimestamp int64) (stats []*CouponStat, total *CouponStat, err error) {
+	scope := func() *gorm.DB {
+		tx := DB.Model(&CouponUsage{})
+		if startTimestamp != 0 {
+			tx = tx.Where("created_time >= ?", startTimestamp)
+		}
+		if endTimestamp != 0 {
+			tx = tx.Where("created_time <= ?", endTimestamp)
+		}
+		return tx
+	}
+	err = scope().Select("coupon_id, count(*) AS uses, count(DISTINCT user_id) AS users, sum(money) AS money, " +
+		"sum(discount) AS discount, sum(bonus_quota) AS bonus_quota").
+		Group("coupon_id").Order("uses desc").Scan(&stats).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	total = &CouponStat{Code: "total"}
+	ids := make([]int, 0, len(stats))
+	for _, stat := range stats {
+		ids = append(ids, stat.CouponId)
+		total.Uses += stat.Uses
+		total.Money += stat.Money
+		total.Discount += stat.Discount
+		total.BonusQuota += stat.BonusQuota
+	}
+	if len(ids) > 0 {
+		var coupons []*Coupon
+		if err = DB.Unscoped().Select("id, code, name").Where("id IN ?", ids).Find(&coupons).Error; err != nil {
+			return nil, nil, err
+		}
+		couponMap := make(map[int]*Coupon, len(coupons))
+		for _, coupon := range coupons {
+			couponMap[coupon.Id] = coupon
+		}
+		for _, stat := range stats {
+			if coupon, ok := couponMap[stat.CouponId]; ok {
+				stat.Code = coupon.Code
+				stat.Name = coupon.Name
+			}
+		}
+	}
+	// 总用户数需单独去重，不能由各优惠码的用户数相加
+	if err = scope().Distinct("user_id").Count(&total.Users).Error; err != nil {
+		return nil, nil, err
+	}
+	return stats, total, nil
+}
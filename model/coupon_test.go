@@ -0,0 +1,79 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+func createTestCouponTopUp(t *testing.T, userId int, coupon *Coupon) *TopUp {
+	t.Helper()
+	topUp := &TopUp{
+		UserId:        userId,
+		Amount:        1,
+		Money:         1,
+		TradeNo:       "trade-" + common.GetRandomString(8),
+		PaymentMethod: PaymentProviderAlipay,
+		Provider:      PaymentProviderAlipay,
+		CreateTime:    common.GetTimestamp(),
+		Status:        common.TopUpStatusPending,
+	}
+	quote, err := QuoteCoupon(coupon.Code, userId, "", 1)
+	require.NoError(t, err)
+	quote.ApplyTo(topUp)
+	require.NoError(t, topUp.Insert())
+	return topUp
+}
+
+func TestCompleteTopUp_CouponMaxUsesRecheckedAtCompletion(t *testing.T) {
+	setupTestDB(t)
+	coupon := &Coupon{Code: "ONCE", BonusQuota: 100, MaxUses: 1, Status: CouponStatusEnabled}
+	require.NoError(t, coupon.Insert())
+	first, second := createTestUser(t, 0), createTestUser(t, 0)
+	// 两笔订单都在优惠码用完前下单
+	firstTopUp := createTestCouponTopUp(t, first.Id, coupon)
+	secondTopUp := createTestCouponTopUp(t, second.Id, coupon)
+
+	_, err := CompleteTopUp(firstTopUp.TradeNo, "")
+	require.NoError(t, err)
+	completed, err := CompleteTopUp(secondTopUp.TradeNo, "")
+	require.NoError(t, err)
+	require.Equal(t, 0, completed.CouponBonusQuota)
+
+	quota := int(common.QuotaPerUnit)
+	require.Equal(t, quota+100, getTestUserQuota(t, first.Id))
+	require.Equal(t, quota, getTestUserQuota(t, second.Id))
+	coupon, err = GetCouponById(coupon.Id)
+	require.NoError(t, err)
+	require.Equal(t, 1, coupon.UsedCount)
+	var usages int64
+	require.NoError(t, DB.Model(&CouponUsage{}).Where("coupon_id = ?", coupon.Id).Count(&usages).Error)
+	require.Equal(t, int64(1), usages)
+	require.Equal(t, 0, GetTopUpByTradeNo(secondTopUp.TradeNo).CouponBonusQuota)
+	requireLedgerBalanced(t, userLedgerAccount(second.Id))
+}
+
+func TestCompleteTopUp_CouponPerUserLimitRecheckedAtCompletion(t *testing.T) {
+	setupTestDB(t)
+	coupon := &Coupon{Code: "PERUSER", BonusQuota: 100, PerUserLimit: 1, Status: CouponStatusEnabled}
+	require.NoError(t, coupon.Insert())
+	user := createTestUser(t, 0)
+	firstTopUp := createTestCouponTopUp(t, user.Id, coupon)
+	secondTopUp := createTestCouponTopUp(t, user.Id, coupon)
+
+	_, err := CompleteTopUp(firstTopUp.TradeNo, "")
+	require.NoError(t, err)
+	_, err = CompleteTopUp(secondTopUp.TradeNo, "")
+	require.NoError(t, err)
+
+	require.Equal(t, 2*int(common.QuotaPerUnit)+100, getTestUserQuota(t, user.Id))
+	coupon, err = GetCouponById(coupon.Id)
+	require.NoError(t, err)
+	require.Equal(t, 1, coupon.UsedCount)
+
+	// 已用完的优惠码下单时即被拒绝
+	_, err = QuoteCoupon(coupon.Code, user.Id, "", 1)
+	require.Error(t, err)
+}
@@ -0,0 +1,56 @@
+package model
+
+import (
+	"errors"
+
+	"github.com/QuantumNous/new-api/common"
+)
+
+// IsPostpaid 信用额度大于 0 的账户为后付费账户
+func IsPostpaid(creditLimit int) bool {
+	return creditLimit > 0
+}
+
+// GetUserCreditLimit 优先从用户缓存读取信用额度
+func GetUserCreditLimit(userId int) (int, error) {
+	userCache, err := GetUserCache(userId)
+	if err != nil {
+		return 0, err
+	}
+	return userCache.CreditLimit, nil
+}
+
+// GetOrgCreditLimit 优先从组织缓存读取信用额度
+func GetOrgCreditLimit(orgId int) (int, error) {
+	orgCache, err := GetOrgCache(orgId)
+	if err != nil {
+		return 0, err
+	}
+	return orgCache.CreditLimit, nil
+}
+
+// SetUserCreditLimit 设置用户信用额度，0 表示恢复为预付费
+func SetUserCreditLimit(userId int, creditLimit int) error {
+	if creditLimit < 0 {
+		return errors.New("信用额度不能为负数")
+	}
+	if err := DB.Model(&User{}).Where("id = ?", userId).Update("credit_limit", creditLimit).Error; err != nil {
+		return err
+	}
+	if err := invalidateUserCache(userId); err != nil {
+		common.SysLog("failed to invalidate user cache: " + err.Error())
+	}
+	return nil
+}
+
+// SetOrgCreditLimit 设置组织信用额度，0 表示恢复为预付费
+func SetOrgCreditLimit(orgId int, creditLimit int) error {
+	if creditLimit < 0 {
+		return errors.New("信用额度不能为负数")
+	}
+	if err := DB.Model(&Organization{}).Where("id = ?", orgId).Update("credit_limit", creditLimit).Error; err != nil {
+		return err
+	}
+	invalidateOrgCache(orgId)
+	return nil
+}
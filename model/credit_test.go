@@ -0,0 +1,37 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetOrgCreditLimit_ReadThroughOrgCache(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 0)
+	org := createTestOrg(t, user.Id)
+
+	creditLimit, err := GetOrgCreditLimit(org.Id)
+	require.NoError(t, err)
+	require.Equal(t, 0, creditLimit)
+
+	require.NoError(t, SetOrgCreditLimit(org.Id, 500))
+	orgCache, err := GetOrgCache(org.Id)
+	require.NoError(t, err)
+	require.Equal(t, 500, orgCache.CreditLimit)
+	creditLimit, err = GetOrgCreditLimit(org.Id)
+	require.NoError(t, err)
+	require.Equal(t, 500, creditLimit)
+
+	require.Error(t, SetOrgCreditLimit(org.Id, -1))
+}
+
+func TestSetUserCreditLimit_ReadThroughUserCache(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 0)
+
+	require.NoError(t, SetUserCreditLimit(user.Id, 300))
+	creditLimit, err := GetUserCreditLimit(user.Id)
+	require.NoError(t, err)
+	require.Equal(t, 300, creditLimit)
+}
@@ -8,7 +8,9 @@ import (
 	"time"
 
 	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
 	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/pkg/metrics"
 	"github.com/QuantumNous/new-api/types"
 
 	"github.com/gin-gonic/gin"
@@ -27,6 +29,7 @@ type Log struct {
 	TokenName        string `json:"token_name" gorm:"index;default:''"`
 	ModelName        string `json:"model_name" gorm:"index;index:index_username_model_name,priority:1;default:''"`
 	Quota            int    `json:"quota" gorm:"default:0"`
+	UpstreamCost     int    `json:"upstream_cost" gorm:"default:0"` // 上游成本，单位与 Quota 相同，仅管理员可见
 	PromptTokens     int    `json:"prompt_tokens" gorm:"default:0"`
 	CompletionTokens int    `json:"completion_tokens" gorm:"default:0"`
 	UseTime          int    `json:"use_time" gorm:"default:0"`
@@ -53,6 +56,7 @@ const (
 func formatUserLogs(logs []*Log) {
 	for i := range logs {
 		logs[i].ChannelName = ""
+		logs[i].UpstreamCost = 0
 		var otherMap map[string]interface{}
 		otherMap, _ = common.StrToMap(logs[i].Other)
 		if otherMap != nil {
@@ -60,6 +64,7 @@ func formatUserLogs(logs []*Log) {
 			delete(otherMap, "admin_info")
 			delete(otherMap, "request_conversion")
 			delete(otherMap, "reject_reason")
+			delete(otherMap, "body_captured")
 		}
 		logs[i].Other = common.MapToJsonStr(otherMap)
 		logs[i].Id = logs[i].Id % 1024
@@ -102,7 +107,7 @@ func RecordErrorLog(c *gin.Context, userId int, channelId int, modelName string,
 	isStream bool, group string, other map[string]interface{}) {
 	logger.LogInfo(c, fmt.Sprintf("record error log: userId=%d, channelId=%d, modelName=%s, tokenName=%s, content=%s", userId, channelId, modelName, tokenName, content))
 	username := c.GetString("username")
-	otherStr := common.MapToJsonStr(other)
+	otherStr := common.MapToJsonStr(markBodyCaptured(c, other))
 	// 判断是否需要记录 IP
 	needRecordIp := false
 	if settingMap, err := GetUserSetting(userId, false); err == nil {
@@ -147,6 +152,7 @@ type RecordConsumeLogParams struct {
 	ModelName        string                 `json:"model_name"`
 	TokenName        string                 `json:"token_name"`
 	Quota            int                    `json:"quota"`
+	UpstreamCost     int                    `json:"upstream_cost"`
 	Content          string                 `json:"content"`
 	TokenId          int                    `json:"token_id"`
 	UseTimeSeconds   int                    `json:"use_time_seconds"`
@@ -156,12 +162,14 @@ type RecordConsumeLogParams struct {
 }
 
 func RecordConsumeLog(c *gin.Context, userId int, params RecordConsumeLogParams) {
+	metrics.AddConsume(params.ChannelId, params.ModelName, params.Group, params.PromptTokens, params.CompletionTokens, params.Quota)
+	common.SetContextKey(c, constant.ContextKeyConsumeLogParams, params)
 	if !common.LogConsumeEnabled {
 		return
 	}
 	logger.LogInfo(c, fmt.Sprintf("record consume log: userId=%d, params=%s", userId, common.GetJsonString(params)))
 	username := c.GetString("username")
-	otherStr := common.MapToJsonStr(params.Other)
+	otherStr := common.MapToJsonStr(markBodyCaptured(c, params.Other))
 	// 判断是否需要记录 IP
 	needRecordIp := false
 	if settingMap, err := GetUserSetting(userId, false); err == nil {
@@ -180,6 +188,7 @@ func RecordConsumeLog(c *gin.Context, userId int, params RecordConsumeLogParams)
 		TokenName:        params.TokenName,
 		ModelName:        params.ModelName,
 		Quota:            params.Quota,
+		UpstreamCost:     params.UpstreamCost,
 		ChannelId:        params.ChannelId,
 		TokenId:          params.TokenId,
 		UseTime:          params.UseTimeSeconds,
@@ -193,7 +202,12 @@ func RecordConsumeLog(c *gin.Context, userId int, params RecordConsumeLogParams)
 		}(),
 		Other: otherStr,
 	}
-	err := LOG_DB.Create(log).Error
+	// 沿用请求上下文以便链路追踪记录日志写入耗时，请求结束后仍需写入，因此去掉取消信号
+	ctx := context.Background()
+	if c.Request != nil {
+		ctx = context.WithoutCancel(c.Request.Context())
+	}
+	err := LOG_DB.WithContext(ctx).Create(log).Error
 	if err != nil {
 		logger.LogError(c, "failed to record log: "+err.Error())
 	}
@@ -242,31 +256,36 @@ func GetAllLogs(logType int, startTimestamp int64, endTimestamp int64, modelName
 		return nil, 0, err
 	}
 
+	err = fillLogChannelNames(logs)
+	return logs, total, err
+}
+
+// fillLogChannelNames 按渠道 id 批量查询渠道名称，仅管理员视图使用
+func fillLogChannelNames(logs []*Log) error {
 	channelIds := types.NewSet[int]()
 	for _, log := range logs {
 		if log.ChannelId != 0 {
 			channelIds.Add(log.ChannelId)
 		}
 	}
-
-	if channelIds.Len() > 0 {
-		var channels []struct {
-			Id   int    `gorm:"column:id"`
-			Name string `gorm:"column:name"`
-		}
-		if err = DB.Table("channels").Select("id, name").Where("id IN ?", channelIds.Items()).Find(&channels).Error; err != nil {
-			return logs, total, err
-		}
-		channelMap := make(map[int]string, len(channels))
-		for _, channel := range channels {
-			channelMap[channel.Id] = channel.Name
-		}
-		for i := range logs {
-			logs[i].ChannelName = channelMap[logs[i].ChannelId]
-		}
+	if channelIds.Len() == 0 {
+		return nil
 	}
-
-	return logs, total, err
+	var channels []struct {
+		Id   int    `gorm:"column:id"`
+		Name string `gorm:"column:name"`
+	}
+	if err := DB.Table("channels").Select("id, name").Where("id IN ?", channelIds.Items()).Find(&channels).Error; err != nil {
+		return err
+	}
+	channelMap := make(map[int]string, len(channels))
+	for _, channel := range channels {
+		channelMap[channel.Id] = channel.Name
+	}
+	for i := range logs {
+		logs[i].ChannelName = channelMap[logs[i].ChannelId]
+	}
+	return nil
 }
 
 func GetUserLogs(userId int, logType int, startTimestamp int64, endTimestamp int64, modelName string, tokenName string, startIdx int, num int, group string) (logs []*Log, total int64, err error) {
@@ -305,6 +324,12 @@ func GetUserLogs(userId int, logType int, startTimestamp int64, endTimestamp int
 	return logs, total, err
 }
 
+func GetLogById(id int) (*Log, error) {
+	log := &Log{}
+	err := LOG_DB.Where("id = ?", id).First(log).Error
+	return log, err
+}
+
 func SearchAllLogs(keyword string) (logs []*Log, err error) {
 	err = LOG_DB.Where("type = ? or content LIKE ?", keyword, keyword+"%").Order("id desc").Limit(common.MaxRecentItems).Find(&logs).Error
 	return logs, err
@@ -362,12 +387,46 @@ func SumUsedQuota(logType int, startTimestamp int64, endTimestamp int64, modelNa
 	rpmTpmQuery = rpmTpmQuery.Where("created_at >= ?", time.Now().Add(-60*time.Second).Unix())
 
 	// 执行查询
-	tx.Scan(&stat)
+	if quota, ok := sumUsedQuotaFromRollups(startTimestamp, endTimestamp, usageRollupFilter{
+		Username:  username,
+		TokenName: tokenName,
+		ModelName: modelName,
+		ChannelId: channel,
+		Group:     group,
+	}, tx); ok {
+		stat.Quota = int(quota)
+	} else {
+		tx.Scan(&stat)
+	}
 	rpmTpmQuery.Scan(&stat)
 
 	return stat
 }
 
+// sumUsedQuotaFromRollups 开启用量汇总时，已汇总的整点区间读汇总表，其余部分仍由 logsQuery 统计原始日志
+func sumUsedQuotaFromRollups(startTimestamp int64, endTimestamp int64, filter usageRollupFilter, logsQuery *gorm.DB) (int64, bool) {
+	coveredUntil, ok := loadUsageRollupCoverage()
+	if !ok {
+		return 0, false
+	}
+	// 原始查询的时间条件为闭区间，这里统一换算为左闭右开
+	end := common.GetTimestamp() + 1
+	if endTimestamp != 0 {
+		end = endTimestamp + 1
+	}
+	const quotaSelect = "coalesce(sum(quota), 0) as quota"
+	rows, err := scanRolledUpUsage[struct{ Quota int64 }](startTimestamp, end, coveredUntil, filter, quotaSelect,
+		logsQuery, quotaSelect, "", "")
+	if err != nil {
+		return 0, false
+	}
+	var quota int64
+	for _, row := range rows {
+		quota += row.Quota
+	}
+	return quota, true
+}
+
 func SumUsedToken(logType int, startTimestamp int64, endTimestamp int64, modelName string, username string, tokenName string) (token int) {
 	tx := LOG_DB.Table("logs").Select("ifnull(sum(prompt_tokens),0) + ifnull(sum(completion_tokens),0)")
 	if username != "" {
@@ -390,14 +449,24 @@ func SumUsedToken(logType int, startTimestamp int64, endTimestamp int64, modelNa
 }
 
 func DeleteOldLog(ctx context.Context, targetTimestamp int64, limit int) (int64, error) {
+	return deleteOldLogs(ctx, LOG_DB.Where("created_at < ?", targetTimestamp), limit)
+}
+
+// DeleteOldLogByType 只删除指定类型的旧日志
+func DeleteOldLogByType(ctx context.Context, targetTimestamp int64, logType int, limit int) (int64, error) {
+	return deleteOldLogs(ctx, LOG_DB.Where("created_at < ? AND type = ?", targetTimestamp, logType), limit)
+}
+
+func deleteOldLogs(ctx context.Context, query *gorm.DB, limit int) (int64, error) {
 	var total int64 = 0
+	query = query.Session(&gorm.Session{})
 
 	for {
 		if nil != ctx.Err() {
 			return total, ctx.Err()
 		}
 
-		result := LOG_DB.Where("created_at < ?", targetTimestamp).Limit(limit).Delete(&Log{})
+		result := query.Limit(limit).Delete(&Log{})
 		if nil != result.Error {
 			return total, result.Error
 		}
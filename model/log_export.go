@@ -0,0 +1,173 @@
+package model
+
+import (
+	"errors"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"gorm.io/gorm"
+)
+
+const (
+	LogExportFormatCSV   = "csv"
+	LogExportFormatJSONL = "jsonl"
+
+	LogExportJobPending   = "pending"
+	LogExportJobRunning   = "running"
+	LogExportJobSucceeded = "succeeded"
+	LogExportJobFailed    = "failed"
+)
+
+// LogExportQuery 日志导出筛选条件，与日志列表接口一致；UserId 非 0 时为用户自助导出
+type LogExportQuery struct {
+	UserId         int    `json:"user_id,omitempty"`
+	LogType        int    `json:"type,omitempty"`
+	StartTimestamp int64  `json:"start_timestamp,omitempty"`
+	EndTimestamp   int64  `json:"end_timestamp,omitempty"`
+	ModelName      string `json:"model_name,omitempty"`
+	Username       string `json:"username,omitempty"`
+	TokenName      string `json:"token_name,omitempty"`
+	ChannelId      int    `json:"channel,omitempty"`
+	Group          string `json:"group,omitempty"`
+}
+
+func (q *LogExportQuery) apply(tx *gorm.DB) *gorm.DB {
+	if q.UserId != 0 {
+		tx = tx.Where("logs.user_id = ?", q.UserId)
+	}
+	if q.LogType != LogTypeUnknown {
+		tx = tx.Where("logs.type = ?", q.LogType)
+	}
+	if q.ModelName != "" {
+		tx = tx.Where("logs.model_name like ?", q.ModelName)
+	}
+	if q.Username != "" {
+		tx = tx.Where("logs.username = ?", q.Username)
+	}
+	if q.TokenName != "" {
+		tx = tx.Where("logs.token_name = ?", q.TokenName)
+	}
+	if q.StartTimestamp != 0 {
+		tx = tx.Where("logs.created_at >= ?", q.StartTimestamp)
+	}
+	if q.EndTimestamp != 0 {
+		tx = tx.Where("logs.created_at <= ?", q.EndTimestamp)
+	}
+	if q.ChannelId != 0 {
+		tx = tx.Where("logs.channel_id = ?", q.ChannelId)
+	}
+	if q.Group != "" {
+		tx = tx.Where("logs."+logGroupCol+" = ?", q.Group)
+	}
+	return tx
+}
+
+func CountExportLogs(query *LogExportQuery) (total int64, err error) {
+	err = query.apply(LOG_DB.Model(&Log{})).Count(&total).Error
+	return total, err
+}
+
+// IterateExportLogs 按 id 倒序分批读取日志，避免大范围导出时的深分页；
+// 用户自助导出与 GetUserLogs 一样去除管理员字段，管理员导出补充渠道名称
+func IterateExportLogs(query *LogExportQuery, batchSize int, fn func(logs []*Log) error) error {
+	lastId := 0
+	for {
+		tx := query.apply(LOG_DB.Model(&Log{}))
+		if lastId != 0 {
+			tx = tx.Where("logs.id < ?", lastId)
+		}
+		var logs []*Log
+		if err := tx.Order("logs.id desc").Limit(batchSize).Find(&logs).Error; err != nil {
+			return err
+		}
+		if len(logs) == 0 {
+			return nil
+		}
+		lastId = logs[len(logs)-1].Id
+		if query.UserId != 0 {
+			formatUserLogs(logs)
+		} else if err := fillLogChannelNames(logs); err != nil {
+			return err
+		}
+		if err := fn(logs); err != nil {
+			return err
+		}
+		if len(logs) < batchSize {
+			return nil
+		}
+	}
+}
+
+// LogExportJob 后台日志导出任务，文件写入导出目录，过期后连同记录一起删除
+type LogExportJob struct {
+	Id     int    `json:"id"`
+	UserId int    `json:"user_id" gorm:"index"`
+	Format string `json:"format" gorm:"type:varchar(16)"`
+	Query  string `json:"query" gorm:"type:text"`
+	Status string `json:"status" gorm:"type:varchar(16);index"`
+	// 执行任务并保存文件的节点，文件只由该节点清理
+	Node       string `json:"node" gorm:"type:varchar(128);index;default:''"`
+	RowCount   int64  `json:"row_count" gorm:"default:0"`
+	FileSize   int64  `json:"file_size" gorm:"default:0"`
+	FilePath   string `json:"-" gorm:"type:varchar(512);default:''"`
+	Error      string `json:"error,omitempty" gorm:"type:text"`
+	CreatedAt  int64  `json:"created_at" gorm:"bigint;index"`
+	FinishedAt int64  `json:"finished_at" gorm:"bigint;default:0"`
+	// 任务完成后由接口填充下载地址
+	DownloadUrl string `json:"download_url,omitempty" gorm:"-"`
+}
+
+func (job *LogExportJob) Insert() error {
+	job.CreatedAt = common.GetTimestamp()
+	return DB.Create(job).Error
+}
+
+// UpdateStatus 更新任务状态与结果字段
+func (job *LogExportJob) UpdateStatus() error {
+	return DB.Model(job).Select("status", "row_count", "file_size", "file_path", "error", "finished_at").Updates(job).Error
+}
+
+// GetLogExportJob 获取任务，userId 非 0 时只能获取自己的任务
+func GetLogExportJob(id int, userId int) (*LogExportJob, error) {
+	tx := DB.Where("id = ?", id)
+	if userId != 0 {
+		tx = tx.Where("user_id = ?", userId)
+	}
+	var job LogExportJob
+	err := tx.First(&job).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errors.New("导出任务不存在")
+	}
+	return &job, err
+}
+
+func GetLogExportJobs(userId int, startIdx int, num int) (jobs []*LogExportJob, total int64, err error) {
+	tx := DB.Model(&LogExportJob{}).Where("user_id = ?", userId)
+	if err = tx.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err = tx.Order("id desc").Limit(num).Offset(startIdx).Find(&jobs).Error
+	return jobs, total, err
+}
+
+// HasActiveLogExportJob 用户是否有 since 之后创建且尚未完成的导出任务，更早的视为节点重启遗留的任务
+func HasActiveLogExportJob(userId int, since int64) (bool, error) {
+	var count int64
+	err := DB.Model(&LogExportJob{}).
+		Where("user_id = ? AND status IN ? AND created_at >= ?", userId, []string{LogExportJobPending, LogExportJobRunning}, since).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// GetExpiredLogExportJobs 获取 node 节点上 before 之前创建的任务
+func GetExpiredLogExportJobs(node string, before int64, limit int) (jobs []*LogExportJob, err error) {
+	err = DB.Where("node = ? AND created_at < ?", node, before).Order("id asc").Limit(limit).Find(&jobs).Error
+	return jobs, err
+}
+
+func DeleteLogExportJobsByIds(ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return DB.Where("id IN ?", ids).Delete(&LogExportJob{}).Error
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/pkg/tracing"
 
 	"github.com/glebarez/sqlite"
 	"gorm.io/driver/mysql"
@@ -174,6 +175,17 @@ func chooseDB(envName string, isLog bool) (*gorm.DB, error) {
 	})
 }
 
+// mainDatabaseType 主数据库类型，与 common.LogSqlType 取值一致
+func mainDatabaseType() string {
+	if common.UsingMySQL {
+		return common.DatabaseTypeMySQL
+	}
+	if common.UsingPostgreSQL {
+		return common.DatabaseTypePostgreSQL
+	}
+	return common.DatabaseTypeSQLite
+}
+
 func InitDB() (err error) {
 	db, err := chooseDB("SQL_DSN", false)
 	if err == nil {
@@ -181,6 +193,11 @@ func InitDB() (err error) {
 			db = db.Debug()
 		}
 		DB = db
+		if tracing.Enabled() {
+			if err := DB.Use(&tracing.GormPlugin{System: mainDatabaseType()}); err != nil {
+				common.SysError("failed to register database tracing: " + err.Error())
+			}
+		}
 		// MySQL charset/collation startup check: ensure Chinese-capable charset
 		if common.UsingMySQL {
 			if err := checkMySQLChineseSupport(DB); err != nil {
@@ -221,6 +238,11 @@ func InitLogDB() (err error) {
 			db = db.Debug()
 		}
 		LOG_DB = db
+		if tracing.Enabled() {
+			if err := LOG_DB.Use(&tracing.GormPlugin{System: common.LogSqlType}); err != nil {
+				common.SysError("failed to register log database tracing: " + err.Error())
+			}
+		}
 		// If log DB is MySQL, also ensure Chinese-capable charset
 		if common.LogSqlType == common.DatabaseTypeMySQL {
 			if err := checkMySQLChineseSupport(LOG_DB); err != nil {
@@ -268,6 +290,24 @@ func migrateDB() error {
 		&TwoFA{},
 		&TwoFABackupCode{},
 		&Checkin{},
+		&Organization{},
+		&OrganizationMember{},
+		&SubscriptionPlan{},
+		&UserSubscription{},
+		&QuotaLot{},
+		&QuotaLedger{},
+		&PriceOverride{},
+		&Statement{},
+		&Coupon{},
+		&CouponUsage{},
+		&ReferralCommission{},
+		&BodyCapture{},
+		&AuditLog{},
+		&OptionVersion{},
+		&UsageRollupHourly{},
+		&UsageRollupDaily{},
+		&UsageRollupState{},
+		&LogExportJob{},
 	)
 	if err != nil {
 		return err
@@ -302,6 +342,24 @@ func migrateDBFast() error {
 		{&TwoFA{}, "TwoFA"},
 		{&TwoFABackupCode{}, "TwoFABackupCode"},
 		{&Checkin{}, "Checkin"},
+		{&Organization{}, "Organization"},
+		{&OrganizationMember{}, "OrganizationMember"},
+		{&SubscriptionPlan{}, "SubscriptionPlan"},
+		{&UserSubscription{}, "UserSubscription"},
+		{&QuotaLot{}, "QuotaLot"},
+		{&QuotaLedger{}, "QuotaLedger"},
+		{&PriceOverride{}, "PriceOverride"},
+		{&Statement{}, "Statement"},
+		{&Coupon{}, "Coupon"},
+		{&CouponUsage{}, "CouponUsage"},
+		{&ReferralCommission{}, "ReferralCommission"},
+		{&BodyCapture{}, "BodyCapture"},
+		{&AuditLog{}, "AuditLog"},
+		{&OptionVersion{}, "OptionVersion"},
+		{&UsageRollupHourly{}, "UsageRollupHourly"},
+		{&UsageRollupDaily{}, "UsageRollupDaily"},
+		{&UsageRollupState{}, "UsageRollupState"},
+		{&LogExportJob{}, "LogExportJob"},
 	}
 	// 动态计算migration数量，确保errChan缓冲区足够大
 	errChan := make(chan error, len(migrations))
@@ -332,7 +390,7 @@ func migrateDBFast() error {
 
 func migrateLOGDB() error {
 	var err error
-	if err = LOG_DB.AutoMigrate(&Log{}); err != nil {
+	if err = LOG_DB.AutoMigrate(&Log{}, &BodyCapture{}, &AuditLog{}, &UsageRollupHourly{}, &UsageRollupDaily{}, &UsageRollupState{}); err != nil {
 		return err
 	}
 	return nil
@@ -0,0 +1,79 @@
+package model
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// setupTestDB 使用临时 SQLite 数据库替换 DB 与 LOG_DB，并关闭 Redis 与批量更新
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.db") + "?_pragma=busy_timeout(5000)"
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	require.NoError(t, err)
+
+	oldDB, oldLogDB := DB, LOG_DB
+	oldRedis, oldBatch := common.RedisEnabled, common.BatchUpdateEnabled
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			_ = sqlDB.Close()
+		}
+		DB, LOG_DB = oldDB, oldLogDB
+		common.RedisEnabled, common.BatchUpdateEnabled = oldRedis, oldBatch
+	})
+
+	DB, LOG_DB = db, db
+	common.RedisEnabled = false
+	common.BatchUpdateEnabled = false
+	initCol()
+	ledgerBufferLock.Lock()
+	ledgerBuffer = nil
+	ledgerBufferLock.Unlock()
+	ledgerOpenedAccounts.Range(func(key, _ any) bool {
+		ledgerOpenedAccounts.Delete(key)
+		return true
+	})
+	require.NoError(t, migrateDB())
+}
+
+// createTestUser 创建指定余额的用户并记录对应的额度批次
+func createTestUser(t *testing.T, quota int) *User {
+	t.Helper()
+	user := &User{
+		Username: "user" + common.GetRandomString(8),
+		Password: "password123",
+		Quota:    quota,
+		Status:   common.UserStatusEnabled,
+		AffCode:  common.GetRandomString(8),
+	}
+	require.NoError(t, DB.Create(user).Error)
+	if quota > 0 {
+		require.NoError(t, RecordQuotaLot(DB, user.Id, QuotaLotSourceOther, "", quota, 0))
+	}
+	return user
+}
+
+func getTestUserQuota(t *testing.T, userId int) int {
+	t.Helper()
+	quota, err := getUserQuotaFromDB(DB, userId)
+	require.NoError(t, err)
+	return quota
+}
+
+// requireLedgerBalanced 写入缓冲的账本后校验科目余额与账本合计一致
+func requireLedgerBalanced(t *testing.T, account LedgerAccount) {
+	t.Helper()
+	require.NoError(t, FlushLedgerBuffer())
+	balance, err := getLedgerAccountBalance(DB, account)
+	require.NoError(t, err)
+	sum, err := sumLedger(DB, account)
+	require.NoError(t, err)
+	require.Equal(t, int64(balance), sum, "ledger of %s", account.key())
+}
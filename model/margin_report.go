@@ -0,0 +1,150 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	MarginGroupByChannel = "channel"
+	MarginGroupByModel   = "model"
+	MarginGroupByGroup   = "group"
+	MarginGroupByDay     = "day"
+)
+
+type MarginReportQuery struct {
+	GroupBy        string
+	StartTimestamp int64
+	EndTimestamp   int64
+	ChannelId      int
+	ModelName      string
+	Group          string
+}
+
+// MarginReportItem 收入、上游成本与毛利汇总，金额单位均为额度。
+// TrackedCount 为计入了上游成本的请求数，渠道未配置上游成本时成本记为 0。
+type MarginReportItem struct {
+	Key          string  `json:"key"`
+	Name         string  `json:"name,omitempty"`
+	RequestCount int64   `json:"request_count"`
+	TrackedCount int64   `json:"tracked_count"`
+	Revenue      int64   `json:"revenue"`
+	Cost         int64   `json:"cost"`
+	Margin       int64   `json:"margin"`
+	MarginRate   float64 `json:"margin_rate"`
+}
+
+func (item *MarginReportItem) fillMargin() {
+	item.Margin = item.Revenue - item.Cost
+	if item.Revenue != 0 {
+		item.MarginRate = float64(item.Margin) / float64(item.Revenue)
+	}
+}
+
+// GetMarginReport 按渠道、模型、分组或天汇总消费日志的收入与上游成本，按天汇总时使用服务器时区
+func GetMarginReport(query MarginReportQuery) (items []*MarginReportItem, total *MarginReportItem, err error) {
+	var keyExpr string
+	switch query.GroupBy {
+	case MarginGroupByChannel:
+		keyExpr = "channel_id"
+	case MarginGroupByModel:
+		keyExpr = "model_name"
+	case MarginGroupByGroup:
+		keyExpr = logGroupCol
+	case MarginGroupByDay:
+		_, offset := time.Now().Zone()
+		keyExpr = fmt.Sprintf("created_at - (created_at + %d) %% 86400", offset)
+	default:
+		return nil, nil, errors.New("不支持的汇总维度")
+	}
+	tx := LOG_DB.Table("logs").Where("type = ?", LogTypeConsume)
+	if query.StartTimestamp != 0 {
+		tx = tx.Where("created_at >= ?", query.StartTimestamp)
+	}
+	if query.EndTimestamp != 0 {
+		tx = tx.Where("created_at <= ?", query.EndTimestamp)
+	}
+	if query.ChannelId != 0 {
+		tx = tx.Where("channel_id = ?", query.ChannelId)
+	}
+	if query.ModelName != "" {
+		tx = tx.Where("model_name = ?", query.ModelName)
+	}
+	if query.Group != "" {
+		tx = tx.Where(logGroupCol+" = ?", query.Group)
+	}
+	var rows []struct {
+		GroupKey     string
+		RequestCount int64
+		TrackedCount int64
+		Revenue      int64
+		Cost         int64
+	}
+	err = tx.Select(keyExpr + " AS group_key, count(*) AS request_count, " +
+		"sum(CASE WHEN upstream_cost > 0 THEN 1 ELSE 0 END) AS tracked_count, " +
+		"sum(quota) AS revenue, sum(upstream_cost) AS cost").
+		Group("group_key").Scan(&rows).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	total = &MarginReportItem{Key: "total"}
+	items = make([]*MarginReportItem, 0, len(rows))
+	for _, row := range rows {
+		item := &MarginReportItem{
+			Key:          row.GroupKey,
+			RequestCount: row.RequestCount,
+			TrackedCount: row.TrackedCount,
+			Revenue:      row.Revenue,
+			Cost:         row.Cost,
+		}
+		if query.GroupBy == MarginGroupByDay {
+			if ts, err := strconv.ParseInt(row.GroupKey, 10, 64); err == nil {
+				item.Key = time.Unix(ts, 0).Format("2006-01-02")
+			}
+		}
+		item.fillMargin()
+		items = append(items, item)
+		total.RequestCount += item.RequestCount
+		total.TrackedCount += item.TrackedCount
+		total.Revenue += item.Revenue
+		total.Cost += item.Cost
+	}
+	total.fillMargin()
+
+	if query.GroupBy == MarginGroupByChannel {
+		fillMarginChannelNames(items)
+	}
+	if query.GroupBy == MarginGroupByDay {
+		sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+	} else {
+		sort.Slice(items, func(i, j int) bool { return items[i].Revenue > items[j].Revenue })
+	}
+	return items, total, nil
+}
+
+func fillMarginChannelNames(items []*MarginReportItem) {
+	ids := make([]int, 0, len(items))
+	for _, item := range items {
+		if id, err := strconv.Atoi(item.Key); err == nil && id != 0 {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	var channels []Channel
+	if err := DB.Model(&Channel{}).Select("id, name").Where("id IN ?", ids).Find(&channels).Error; err != nil {
+		return
+	}
+	names := make(map[string]string, len(channels))
+	for _, channel := range channels {
+		names[strconv.Itoa(channel.Id)] = channel.Name
+	}
+	for _, item := range items {
+		item.Name = names[item.Key]
+	}
+}
@@ -0,0 +1,96 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func createTestMarginLog(t *testing.T, channelId int, modelName string, group string, quota int, upstreamCost int, createdAt int64) {
+	t.Helper()
+	require.NoError(t, LOG_DB.Create(&Log{
+		Type:         LogTypeConsume,
+		ChannelId:    channelId,
+		ModelName:    modelName,
+		Group:        group,
+		Quota:        quota,
+		UpstreamCost: upstreamCost,
+		CreatedAt:    createdAt,
+	}).Error)
+}
+
+func getTestMarginItems(t *testing.T, query MarginReportQuery) (map[string]*MarginReportItem, *MarginReportItem) {
+	t.Helper()
+	items, total, err := GetMarginReport(query)
+	require.NoError(t, err)
+	byKey := make(map[string]*MarginReportItem, len(items))
+	for _, item := range items {
+		byKey[item.Key] = item
+	}
+	return byKey, total
+}
+
+func TestGetMarginReport_GroupBy(t *testing.T) {
+	setupTestDB(t)
+	require.NoError(t, DB.Create(&Channel{Id: 1, Name: "primary", Key: "k1"}).Error)
+	require.NoError(t, DB.Create(&Channel{Id: 2, Name: "backup", Key: "k2"}).Error)
+	day1 := time.Date(2026, 10, 18, 10, 0, 0, 0, time.Local).Unix()
+	day2 := time.Date(2026, 10, 19, 10, 0, 0, 0, time.Local).Unix()
+	createTestMarginLog(t, 1, "gpt-4o", "default", 1000, 600, day1)
+	createTestMarginLog(t, 1, "gpt-4o", "vip", 500, 0, day2)
+	createTestMarginLog(t, 2, "claude-3", "default", 2000, 1500, day2)
+	// 非消费日志不计入
+	require.NoError(t, LOG_DB.Create(&Log{Type: LogTypeTopup, ChannelId: 1, Quota: 9999, CreatedAt: day1}).Error)
+
+	byChannel, total := getTestMarginItems(t, MarginReportQuery{GroupBy: MarginGroupByChannel})
+	require.Len(t, byChannel, 2)
+	require.Equal(t, "primary", byChannel["1"].Name)
+	require.Equal(t, int64(2), byChannel["1"].RequestCount)
+	require.Equal(t, int64(1), byChannel["1"].TrackedCount)
+	require.Equal(t, int64(1500), byChannel["1"].Revenue)
+	require.Equal(t, int64(600), byChannel["1"].Cost)
+	require.Equal(t, int64(900), byChannel["1"].Margin)
+	require.InDelta(t, 0.6, byChannel["1"].MarginRate, 1e-9)
+	require.Equal(t, "backup", byChannel["2"].Name)
+	require.Equal(t, int64(3), total.RequestCount)
+	require.Equal(t, int64(3500), total.Revenue)
+	require.Equal(t, int64(2100), total.Cost)
+	require.Equal(t, int64(1400), total.Margin)
+
+	byModel, _ := getTestMarginItems(t, MarginReportQuery{GroupBy: MarginGroupByModel})
+	require.Equal(t, int64(1500), byModel["gpt-4o"].Revenue)
+	require.Equal(t, int64(500), byModel["claude-3"].Margin)
+
+	byGroup, _ := getTestMarginItems(t, MarginReportQuery{GroupBy: MarginGroupByGroup})
+	require.Equal(t, int64(3000), byGroup["default"].Revenue)
+	require.Equal(t, int64(2100), byGroup["default"].Cost)
+	require.Equal(t, int64(0), byGroup["vip"].TrackedCount)
+
+	items, _, err := GetMarginReport(MarginReportQuery{GroupBy: MarginGroupByDay})
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	require.Equal(t, "2026-10-18", items[0].Key)
+	require.Equal(t, int64(1000), items[0].Revenue)
+	require.Equal(t, "2026-10-19", items[1].Key)
+	require.Equal(t, int64(2500), items[1].Revenue)
+	require.Equal(t, int64(1500), items[1].Cost)
+
+	_, _, err = GetMarginReport(MarginReportQuery{GroupBy: "user"})
+	require.Error(t, err)
+}
+
+func TestGetMarginReport_Filters(t *testing.T) {
+	setupTestDB(t)
+	createTestMarginLog(t, 1, "gpt-4o", "default", 1000, 600, 100)
+	createTestMarginLog(t, 1, "gpt-4o", "vip", 500, 100, 200)
+	createTestMarginLog(t, 2, "claude-3", "default", 2000, 1500, 300)
+
+	_, total := getTestMarginItems(t, MarginReportQuery{GroupBy: MarginGroupByModel, StartTimestamp: 150, EndTimestamp: 300})
+	require.Equal(t, int64(2500), total.Revenue)
+	_, total = getTestMarginItems(t, MarginReportQuery{GroupBy: MarginGroupByModel, ChannelId: 1, Group: "vip"})
+	require.Equal(t, int64(500), total.Revenue)
+	require.Equal(t, int64(100), total.Cost)
+	_, total = getTestMarginItems(t, MarginReportQuery{GroupBy: MarginGroupByChannel, ModelName: "claude-3"})
+	require.Equal(t, int64(1), total.RequestCount)
+}
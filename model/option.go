@@ -13,6 +13,8 @@ import (
 	"github.com/QuantumNous/new-api/setting/performance_setting"
 	"github.com/QuantumNous/new-api/setting/ratio_setting"
 	"github.com/QuantumNous/new-api/setting/system_setting"
+
+	"gorm.io/gorm"
 )
 
 type Option struct {
@@ -133,6 +135,8 @@ func InitOptionMap() {
 	common.OptionMap["ImageRatio"] = ratio_setting.ImageRatio2JSONString()
 	common.OptionMap["AudioRatio"] = ratio_setting.AudioRatio2JSONString()
 	common.OptionMap["AudioCompletionRatio"] = ratio_setting.AudioCompletionRatio2JSONString()
+	common.OptionMap["ModelContextTiers"] = ratio_setting.ContextTiers2JSONString()
+	common.OptionMap["ModelPricingWindows"] = ratio_setting.PricingWindows2JSONString()
 	common.OptionMap["TopUpLink"] = common.TopUpLink
 	//common.OptionMap["ChatLink"] = common.ChatLink
 	//common.OptionMap["ChatLink2"] = common.ChatLink2
@@ -189,18 +193,58 @@ func SyncOptions(frequency int) {
 	}
 }
 
+// IsSensitiveOptionKey 密钥类配置项，不向前端返回其值
+func IsSensitiveOptionKey(key string) bool {
+	return strings.HasSuffix(key, "Token") ||
+		strings.HasSuffix(key, "Secret") ||
+		strings.HasSuffix(key, "Key") ||
+		strings.HasSuffix(key, "secret") ||
+		strings.HasSuffix(key, "api_key")
+}
+
+// UpdateOption 以系统身份写入配置项
 func UpdateOption(key string, value string) error {
+	return saveOption(key, value, 0, "system", OptionVersionSourceUpdate, 0)
+}
+
+// UpdateOptionByUser 校验并写入配置项，记录操作人
+func UpdateOptionByUser(key string, value string, userId int, username string) error {
+	if err := ValidateOptionValue(key, value); err != nil {
+		return err
+	}
+	return saveOption(key, value, userId, username, OptionVersionSourceUpdate, 0)
+}
+
+// saveOption 写入配置项并在同一事务内生成新版本，其他节点通过 SyncOptions 从数据库加载新值
+func saveOption(key string, value string, userId int, username string, source string, rollbackTo int) error {
 	// Save to database first
-	option := Option{
-		Key: key,
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		option := Option{
+			Key: key,
+		}
+		// https://gorm.io/docs/update.html#Save-All-Fields
+		if err := tx.FirstOrCreate(&option, Option{Key: key}).Error; err != nil {
+			return err
+		}
+		previous := option.Value
+		option.Value = value
+		// Save is a combination function.
+		// If save value does not contain primary key, it will execute Create,
+		// otherwise it will execute Update (with all fields).
+		if err := tx.Save(&option).Error; err != nil {
+			return err
+		}
+		return recordOptionVersion(tx, key, previous, &OptionVersion{
+			Value:      value,
+			AuthorId:   userId,
+			AuthorName: username,
+			Source:     source,
+			RollbackTo: rollbackTo,
+		})
+	})
+	if err != nil {
+		return err
 	}
-	// https://gorm.io/docs/update.html#Save-All-Fields
-	DB.FirstOrCreate(&option, Option{Key: key})
-	option.Value = value
-	// Save is a combination function.
-	// If save value does not contain primary key, it will execute Create,
-	// otherwise it will execute Update (with all fields).
-	DB.Save(&option)
 	// Update OptionMap
 	return updateOptionMap(key, value)
 }
@@ -464,6 +508,10 @@ func updateOptionMap(key string, value string) (err error) {
 		err = ratio_setting.UpdateAudioRatioByJSONString(value)
 	case "AudioCompletionRatio":
 		err = ratio_setting.UpdateAudioCompletionRatioByJSONString(value)
+	case "ModelPricingWindows":
+		err = ratio_setting.UpdatePricingWindowsByJSONString(value)
+	case "ModelContextTiers":
+		err = ratio_setting.UpdateContextTiersByJSONString(value)
 	case "TopUpLink":
 		common.TopUpLink = value
 	//case "ChatLink":
@@ -0,0 +1,86 @@
+package model
+
+import (
+	"errors"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/setting"
+	"github.com/QuantumNous/new-api/setting/console_setting"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/setting/ratio_setting"
+	"github.com/QuantumNous/new-api/setting/system_setting"
+)
+
+// ValidateOptionValue 写入配置项前的校验，管理员修改、版本回滚与配置导入共用，只校验不修改当前生效的配置
+func ValidateOptionValue(key string, value string) error {
+	switch key {
+	case "GitHubOAuthEnabled":
+		if value == "true" && common.GitHubClientId == "" {
+			return errors.New("无法启用 GitHub OAuth，请先填入 GitHub Client Id 以及 GitHub Client Secret！")
+		}
+	case "discord.enabled":
+		if value == "true" && system_setting.GetDiscordSettings().ClientId == "" {
+			return errors.New("无法启用 Discord OAuth，请先填入 Discord Client Id 以及 Discord Client Secret！")
+		}
+	case "oidc.enabled":
+		if value == "true" && system_setting.GetOIDCSettings().ClientId == "" {
+			return errors.New("无法启用 OIDC 登录，请先填入 OIDC Client Id 以及 OIDC Client Secret！")
+		}
+	case "LinuxDOOAuthEnabled":
+		if value == "true" && common.LinuxDOClientId == "" {
+			return errors.New("无法启用 LinuxDO OAuth，请先填入 LinuxDO Client Id 以及 LinuxDO Client Secret！")
+		}
+	case "EmailDomainRestrictionEnabled":
+		if value == "true" && len(common.EmailDomainWhitelist) == 0 {
+			return errors.New("无法启用邮箱域名限制，请先填入限制的邮箱域名！")
+		}
+	case "WeChatAuthEnabled":
+		if value == "true" && common.WeChatServerAddress == "" {
+			return errors.New("无法启用微信登录，请先填入微信登录相关配置信息！")
+		}
+	case "TurnstileCheckEnabled":
+		if value == "true" && common.TurnstileSiteKey == "" {
+			return errors.New("无法启用 Turnstile 校验，请先填入 Turnstile 校验相关配置信息！")
+		}
+	case "TelegramOAuthEnabled":
+		if value == "true" && common.TelegramBotToken == "" {
+			return errors.New("无法启用 Telegram OAuth，请先填入 Telegram Bot Token！")
+		}
+	case "GroupRatio":
+		return ratio_setting.CheckGroupRatio(value)
+	case "ImageRatio":
+		if err := common.UnmarshalJsonStr(value, &map[string]float64{}); err != nil {
+			return errors.New("图片倍率设置失败: " + err.Error())
+		}
+	case "AudioRatio":
+		if err := common.UnmarshalJsonStr(value, &map[string]float64{}); err != nil {
+			return errors.New("音频倍率设置失败: " + err.Error())
+		}
+	case "AudioCompletionRatio":
+		if err := common.UnmarshalJsonStr(value, &map[string]float64{}); err != nil {
+			return errors.New("音频补全倍率设置失败: " + err.Error())
+		}
+	case "ModelPricingWindows":
+		if err := ratio_setting.CheckPricingWindows(value); err != nil {
+			return errors.New("分时计价设置失败: " + err.Error())
+		}
+	case "ModelContextTiers":
+		if err := ratio_setting.CheckContextTiers(value); err != nil {
+			return errors.New("上下文分档倍率设置失败: " + err.Error())
+		}
+	case "ModelRequestRateLimitGroup":
+		return setting.CheckModelRequestRateLimitGroup(value)
+	case "AutomaticDisableStatusCodes", "AutomaticRetryStatusCodes":
+		_, err := operation_setting.ParseHTTPStatusCodeRanges(value)
+		return err
+	case "console_setting.api_info":
+		return console_setting.ValidateConsoleSettings(value, "ApiInfo")
+	case "console_setting.announcements":
+		return console_setting.ValidateConsoleSettings(value, "Announcements")
+	case "console_setting.faq":
+		return console_setting.ValidateConsoleSettings(value, "FAQ")
+	case "console_setting.uptime_kuma_groups":
+		return console_setting.ValidateConsoleSettings(value, "UptimeKumaGroups")
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+func setupTestOptionMap(t *testing.T) {
+	t.Helper()
+	common.OptionMapRWMutex.Lock()
+	old := common.OptionMap
+	common.OptionMap = make(map[string]string)
+	common.OptionMapRWMutex.Unlock()
+	t.Cleanup(func() {
+		common.OptionMapRWMutex.Lock()
+		common.OptionMap = old
+		common.OptionMapRWMutex.Unlock()
+	})
+}
+
+func TestUpdateOptionByUser_Validates(t *testing.T) {
+	setupTestDB(t)
+	setupTestOptionMap(t)
+
+	require.Error(t, UpdateOptionByUser("GroupRatio", `{"default":-1}`, 1, "root"))
+	require.Error(t, UpdateOptionByUser("ModelPricingWindows", `[{"name":"night","start":"25:00","end":"06:00"}]`, 1, "root"))
+	require.Error(t, UpdateOptionByUser("ModelContextTiers", `{"m":[]}`, 1, "root"))
+	require.Error(t, UpdateOptionByUser("ModelRequestRateLimitGroup", `{"default":[-1,1]}`, 1, "root"))
+	var count int64
+	require.NoError(t, DB.Model(&Option{}).Count(&count).Error)
+	require.Zero(t, count)
+
+	require.NoError(t, UpdateOptionByUser("GroupRatio", `{"default":1}`, 1, "root"))
+	versions, total, err := GetOptionVersions("GroupRatio", 0, 10)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), total)
+	require.Equal(t, `{"default":1}`, versions[0].Value)
+}
+
+func TestRollbackOption_RevalidatesTarget(t *testing.T) {
+	setupTestDB(t)
+	setupTestOptionMap(t)
+	oldClientId := common.GitHubClientId
+	t.Cleanup(func() { common.GitHubClientId = oldClientId })
+
+	common.GitHubClientId = "client"
+	require.NoError(t, UpdateOptionByUser("GitHubOAuthEnabled", "true", 1, "root"))
+	require.NoError(t, UpdateOptionByUser("GitHubOAuthEnabled", "false", 1, "root"))
+
+	// Client Id 清空后不能回滚到开启 OAuth 的版本
+	common.GitHubClientId = ""
+	_, err := RollbackOption("GitHubOAuthEnabled", 1, 1, "root")
+	require.Error(t, err)
+	latest, err := GetOptionVersion("GitHubOAuthEnabled", 0)
+	require.NoError(t, err)
+	require.Equal(t, "false", latest.Value)
+
+	// 版本表中的无效值同样不能回滚
+	require.NoError(t, DB.Create(&OptionVersion{Key: "GroupRatio", Version: 1, Value: `{"default":-1}`}).Error)
+	_, err = RollbackOption("GroupRatio", 1, 1, "root")
+	require.Error(t, err)
+}
+
+func TestSaveOption_SkipsVersionsForSecrets(t *testing.T) {
+	setupTestDB(t)
+	setupTestOptionMap(t)
+
+	require.NoError(t, UpdateOptionByUser("GitHubClientSecret", "secret-1", 1, "root"))
+	require.NoError(t, UpdateOptionByUser("GitHubClientSecret", "secret-2", 1, "root"))
+	var count int64
+	require.NoError(t, DB.Model(&OptionVersion{}).Where("option_key = ?", "GitHubClientSecret").Count(&count).Error)
+	require.Zero(t, count)
+}
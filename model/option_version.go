@@ -0,0 +1,152 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"gorm.io/gorm"
+)
+
+const (
+	OptionVersionSourceUpdate   = "update"
+	OptionVersionSourceRollback = "rollback"
+	// 首次为已有配置项生成版本时，先保存原值作为基线，保证可以回滚到启用版本记录之前的值
+	OptionVersionSourceBaseline = "baseline"
+)
+
+// OptionVersion 配置项的一次写入记录，Version 按配置项从 1 递增
+type OptionVersion struct {
+	Id         int    `json:"id"`
+	Key        string `json:"key" gorm:"column:option_key;type:varchar(191);uniqueIndex:idx_option_key_version,priority:1"`
+	Version    int    `json:"version" gorm:"uniqueIndex:idx_option_key_version,priority:2"`
+	Value      string `json:"value"`
+	AuthorId   int    `json:"author_id" gorm:"default:0"`
+	AuthorName string `json:"author_name" gorm:"type:varchar(64);default:''"`
+	Source     string `json:"source" gorm:"type:varchar(16);default:'update'"`
+	// 回滚操作的目标版本号
+	RollbackTo int   `json:"rollback_to,omitempty" gorm:"default:0"`
+	CreatedAt  int64 `json:"created_at" gorm:"bigint"`
+}
+
+// OptionVersionDiff 两个版本的差异，值为 JSON 对象时按顶层键比较，否则整体比较
+type OptionVersionDiff struct {
+	Key     string                 `json:"key"`
+	From    *OptionVersion         `json:"from"`
+	To      *OptionVersion         `json:"to"`
+	Changes map[string]FieldChange `json:"changes"`
+}
+
+func getLatestOptionVersion(tx *gorm.DB, key string) (*OptionVersion, error) {
+	var version OptionVersion
+	err := tx.Where("option_key = ?", key).Order("version desc").Limit(1).Find(&version).Error
+	if err != nil || version.Id == 0 {
+		return nil, err
+	}
+	return &version, nil
+}
+
+// recordOptionVersion 为配置项写入生成新版本，值未变化时不生成。
+// 密钥类配置项不保存历史版本，避免明文密钥留存在版本表中
+func recordOptionVersion(tx *gorm.DB, key string, previous string, version *OptionVersion) error {
+	if IsSensitiveOptionKey(key) {
+		return nil
+	}
+	latest, err := getLatestOptionVersion(tx, key)
+	if err != nil {
+		return err
+	}
+	next := 1
+	if latest != nil {
+		if latest.Value == version.Value && previous == version.Value {
+			return nil
+		}
+		next = latest.Version + 1
+	} else if previous != "" && previous != version.Value {
+		baseline := &OptionVersion{
+			Key:        key,
+			Version:    next,
+			Value:      previous,
+			AuthorName: "system",
+			Source:     OptionVersionSourceBaseline,
+			CreatedAt:  common.GetTimestamp(),
+		}
+		if err := tx.Create(baseline).Error; err != nil {
+			return err
+		}
+		next++
+	}
+	version.Key = key
+	version.Version = next
+	version.CreatedAt = common.GetTimestamp()
+	return tx.Create(version).Error
+}
+
+func GetOptionVersions(key string, startIdx int, num int) (versions []*OptionVersion, total int64, err error) {
+	tx := DB.Model(&OptionVersion{}).Where("option_key = ?", key)
+	if err = tx.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err = tx.Order("version desc").Limit(num).Offset(startIdx).Find(&versions).Error
+	return versions, total, err
+}
+
+// GetOptionVersion 获取指定版本，version 为 0 时返回最新版本
+func GetOptionVersion(key string, version int) (*OptionVersion, error) {
+	if version == 0 {
+		latest, err := getLatestOptionVersion(DB, key)
+		if err == nil && latest == nil {
+			err = fmt.Errorf("配置项 %s 没有历史版本", key)
+		}
+		return latest, err
+	}
+	var optionVersion OptionVersion
+	err := DB.Where("option_key = ? AND version = ?", key, version).First(&optionVersion).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("配置项 %s 的版本 %d 不存在", key, version)
+	}
+	return &optionVersion, err
+}
+
+func optionValueFields(value string) map[string]any {
+	fields := make(map[string]any)
+	if err := common.UnmarshalJsonStr(value, &fields); err != nil {
+		return map[string]any{"value": value}
+	}
+	return fields
+}
+
+// DiffOptionVersions 比较配置项的两个版本，to 为 0 时与最新版本比较
+func DiffOptionVersions(key string, from int, to int) (*OptionVersionDiff, error) {
+	fromVersion, err := GetOptionVersion(key, from)
+	if err != nil {
+		return nil, err
+	}
+	toVersion, err := GetOptionVersion(key, to)
+	if err != nil {
+		return nil, err
+	}
+	return &OptionVersionDiff{
+		Key:     key,
+		From:    fromVersion,
+		To:      toVersion,
+		Changes: diffFields(optionValueFields(fromVersion.Value), optionValueFields(toVersion.Value)),
+	}, nil
+}
+
+// RollbackOption 将配置项恢复为指定版本的值，回滚本身也会生成新版本。
+// 目标值按当前配置重新校验，例如回滚到开启 OAuth 的版本时需要已填写 Client Id
+func RollbackOption(key string, version int, userId int, username string) (*OptionVersion, error) {
+	target, err := GetOptionVersion(key, version)
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateOptionValue(key, target.Value); err != nil {
+		return nil, err
+	}
+	if err := saveOption(key, target.Value, userId, username, OptionVersionSourceRollback, target.Version); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
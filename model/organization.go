@@ -0,0 +1,470 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/logger"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	OrgRoleOwner   = "owner"
+	OrgRoleAdmin   = "admin"
+	OrgRoleMember  = "member"
+	OrgRoleBilling = "billing"
+)
+
+const (
+	OrgStatusEnabled  = 1
+	OrgStatusDisabled = 2
+)
+
+// Organization 组织，成员共享组织额度池，组织令牌从额度池扣费。
+// CreditLimit 大于 0 时为后付费组织，额度池可透支至 -CreditLimit，月末按账单结算。
+type Organization struct {
+	Id          int            `json:"id"`
+	Name        string         `json:"name" gorm:"type:varchar(64);index"`
+	OwnerId     int            `json:"owner_id" gorm:"index"`
+	Quota       int            `json:"quota" gorm:"type:int;default:0"`
+	UsedQuota   int            `json:"used_quota" gorm:"type:int;default:0"`
+	CreditLimit int            `json:"credit_limit" gorm:"type:int;default:0"`
+	Status      int            `json:"status" gorm:"type:int;default:1"`
+	CreatedTime int64          `json:"created_time" gorm:"bigint"`
+	DeletedAt   gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+// OrganizationMember 组织成员，SpendLimit 为该成员可从额度池消耗的上限，0 表示不限制
+type OrganizationMember struct {
+	Id          int    `json:"id"`
+	OrgId       int    `json:"org_id" gorm:"uniqueIndex:idx_org_member"`
+	UserId      int    `json:"user_id" gorm:"uniqueIndex:idx_org_member;index"`
+	Role        string `json:"role" gorm:"type:varchar(16);default:'member'"`
+	SpendLimit  int    `json:"spend_limit" gorm:"type:int;default:0"`
+	UsedQuota   int    `json:"used_quota" gorm:"type:int;default:0"`
+	CreatedTime int64  `json:"created_time" gorm:"bigint"`
+	Username    string `json:"username" gorm:"->;-:migration"`
+}
+
+// UserOrganization 用户所在组织及其角色
+type UserOrganization struct {
+	Organization
+	Role string `json:"role"`
+}
+
+// OrgUsageStat 组织用量统计，按成员与模型聚合
+type OrgUsageStat struct {
+	UserId           int    `json:"user_id"`
+	Username         string `json:"username"`
+	ModelName        string `json:"model_name"`
+	Count            int    `json:"count"`
+	Quota            int    `json:"quota"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+}
+
+func IsValidOrgRole(role string) bool {
+	switch role {
+	case OrgRoleOwner, OrgRoleAdmin, OrgRoleMember, OrgRoleBilling:
+		return true
+	}
+	return false
+}
+
+func (m *OrganizationMember) CanManageMembers() bool {
+	return m.Role == OrgRoleOwner || m.Role == OrgRoleAdmin
+}
+
+// CanAssignRole 只有所有者可以任免管理员，管理员只能管理普通成员与财务角色
+func (m *OrganizationMember) CanAssignRole(role string) bool {
+	if role == OrgRoleOwner {
+		return false
+	}
+	if role == OrgRoleAdmin {
+		return m.Role == OrgRoleOwner
+	}
+	return m.CanManageMembers()
+}
+
+func (m *OrganizationMember) CanManageBilling() bool {
+	return m.Role == OrgRoleOwner || m.Role == OrgRoleAdmin || m.Role == OrgRoleBilling
+}
+
+// CanUseTokens 财务角色仅负责充值与账单，不能创建或使用组织令牌
+func (m *OrganizationMember) CanUseTokens() bool {
+	return m.Role == OrgRoleOwner || m.Role == OrgRoleAdmin || m.Role == OrgRoleMember
+}
+
+// IsOverSpendLimit 判断成员再消耗 quota 后是否超出个人消费上限
+func (m *OrganizationMember) IsOverSpendLimit(quota int) bool {
+	return m.SpendLimit > 0 && m.UsedQuota+quota > m.SpendLimit
+}
+
+func CreateOrganization(org *Organization) error {
+	if org.Name == "" {
+		return errors.New("组织名称不能为空")
+	}
+	if org.OwnerId == 0 {
+		return errors.New("组织所有者不能为空")
+	}
+	org.CreatedTime = common.GetTimestamp()
+	if org.Status == 0 {
+		org.Status = OrgStatusEnabled
+	}
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(org).Error; err != nil {
+			return err
+		}
+		return tx.Create(&OrganizationMember{
+			OrgId:       org.Id,
+			UserId:      org.OwnerId,
+			Role:        OrgRoleOwner,
+			CreatedTime: org.CreatedTime,
+		}).Error
+	})
+}
+
+func GetOrganizationById(id int) (*Organization, error) {
+	if id == 0 {
+		return nil, errors.New("id 为空！")
+	}
+	org := &Organization{}
+	err := DB.First(org, "id = ?", id).Error
+	return org, err
+}
+
+func GetAllOrganizations(pageInfo *common.PageInfo) (orgs []*Organization, total int64, err error) {
+	if err = DB.Model(&Organization{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err = DB.Order("id desc").Limit(pageInfo.GetPageSize()).Offset(pageInfo.GetStartIdx()).Find(&orgs).Error
+	return orgs, total, err
+}
+
+func GetUserOrganizations(userId int) (orgs []*UserOrganization, err error) {
+	err = DB.Table("organizations").
+		Select("organizations.*, organization_members.role").
+		Joins("JOIN organization_members ON organization_members.org_id = organizations.id").
+		Where("organization_members.user_id = ? AND organizations.deleted_at IS NULL", userId).
+		Order("organizations.id desc").
+		Scan(&orgs).Error
+	return orgs, err
+}
+
+func (org *Organization) Update() error {
+	err := DB.Model(org).Select("name", "status").Updates(org).Error
+	if err == nil {
+		invalidateOrgCache(org.Id)
+	}
+	return err
+}
+
+// DeleteOrganizationById 删除组织及其成员关系，组织令牌将因组织不存在而无法继续使用。
+// 额度池剩余额度退回所有者个人余额；额度池为负（后付费未结清）时拒绝删除。
+func DeleteOrganizationById(id int) error {
+	var memberIds []int
+	var org Organization
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&org, "id = ?", id).Error; err != nil {
+			return err
+		}
+		if org.Quota < 0 {
+			return errors.New("组织额度池存在未结清的欠款，无法删除")
+		}
+		if org.Quota > 0 {
+			result := tx.Model(&Organization{}).Where("id = ? AND quota = ?", id, org.Quota).Update("quota", 0)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return errors.New("组织额度池已变动，请重试")
+			}
+			if err := tx.Model(&User{}).Where("id = ?", org.OwnerId).Update("quota", gorm.Expr("quota + ?", org.Quota)).Error; err != nil {
+				return err
+			}
+			if err := recordLedgerTransfer(tx, orgLedgerAccount(id), userLedgerAccount(org.OwnerId), org.Quota, LedgerSourceTransfer, fmt.Sprintf("org:%d", id)); err != nil {
+				return err
+			}
+			if err := RecordQuotaLot(tx, org.OwnerId, QuotaLotSourceOther, fmt.Sprintf("org:%d", id), org.Quota, 0); err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(&OrganizationMember{}).Where("org_id = ?", id).Pluck("user_id", &memberIds).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("org_id = ?", id).Delete(&OrganizationMember{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&Organization{}, "id = ?", id).Error
+	})
+	if err != nil {
+		return err
+	}
+	invalidateOrgCache(id)
+	for _, userId := range memberIds {
+		invalidateOrgMemberCache(id, userId)
+	}
+	if org.Quota > 0 {
+		if common.RedisEnabled {
+			if err := cacheIncrUserQuota(org.OwnerId, int64(org.Quota)); err != nil {
+				common.SysLog("failed to increase user quota cache: " + err.Error())
+			}
+		}
+		RecordLog(org.OwnerId, LogTypeManage, fmt.Sprintf("组织 %d 删除，额度池剩余 %s 退回个人余额", id, logger.LogQuota(org.Quota)))
+	}
+	return nil
+}
+
+func GetOrgMember(orgId int, userId int) (*OrganizationMember, error) {
+	member := &OrganizationMember{}
+	err := DB.Where("org_id = ? AND user_id = ?", orgId, userId).First(member).Error
+	return member, err
+}
+
+// GetOrgMemberUsedQuota 读取成员已从额度池消耗的额度，只在设置了个人消费上限时需要
+func GetOrgMemberUsedQuota(orgId int, userId int) (usedQuota int, err error) {
+	err = DB.Model(&OrganizationMember{}).Where("org_id = ? AND user_id = ?", orgId, userId).
+		Select("used_quota").Limit(1).Scan(&usedQuota).Error
+	return usedQuota, err
+}
+
+func GetOrgMembers(orgId int) (members []*OrganizationMember, err error) {
+	err = DB.Table("organization_members").
+		Select("organization_members.*, users.username").
+		Joins("LEFT JOIN users ON users.id = organization_members.user_id").
+		Where("organization_members.org_id = ?", orgId).
+		Order("organization_members.id asc").
+		Scan(&members).Error
+	return members, err
+}
+
+func (m *OrganizationMember) Insert() error {
+	if !IsValidOrgRole(m.Role) {
+		return errors.New("无效的组织角色")
+	}
+	if m.Role == OrgRoleOwner {
+		return errors.New("组织只能有一个所有者")
+	}
+	var count int64
+	if err := DB.Model(&OrganizationMember{}).Where("org_id = ? AND user_id = ?", m.OrgId, m.UserId).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return errors.New("该用户已是组织成员")
+	}
+	m.CreatedTime = common.GetTimestamp()
+	if err := DB.Create(m).Error; err != nil {
+		return err
+	}
+	invalidateOrgMemberCache(m.OrgId, m.UserId)
+	return nil
+}
+
+func (m *OrganizationMember) Update() error {
+	if !IsValidOrgRole(m.Role) {
+		return errors.New("无效的组织角色")
+	}
+	err := DB.Model(&OrganizationMember{}).Where("id = ?", m.Id).
+		Select("role", "spend_limit").
+		Updates(map[string]interface{}{"role": m.Role, "spend_limit": m.SpendLimit}).Error
+	if err == nil {
+		invalidateOrgMemberCache(m.OrgId, m.UserId)
+	}
+	return err
+}
+
+func RemoveOrgMember(orgId int, userId int) error {
+	member, err := GetOrgMember(orgId, userId)
+	if err != nil {
+		return err
+	}
+	if member.Role == OrgRoleOwner {
+		return errors.New("不能移除组织所有者")
+	}
+	if err := DB.Delete(member).Error; err != nil {
+		return err
+	}
+	invalidateOrgMemberCache(orgId, userId)
+	return nil
+}
+
+// CheckOrgTokenUsable 校验组织令牌当前是否可用：组织存在且启用，令牌所有者仍是可使用令牌的成员。
+// 每次中继请求都会调用，组织与成员角色均走缓存。
+func CheckOrgTokenUsable(orgId int, userId int) error {
+	org, err := GetOrgCache(orgId)
+	if err != nil {
+		return errors.New("令牌所属组织不存在")
+	}
+	if org.Status != OrgStatusEnabled {
+		return errors.New("令牌所属组织已被禁用")
+	}
+	member, err := GetOrgMemberCache(orgId, userId)
+	if err != nil || !(&OrganizationMember{Role: member.Role}).CanUseTokens() {
+		return errors.New("您已不是该组织的成员，无法使用组织令牌")
+	}
+	return nil
+}
+
+func GetOrgQuota(orgId int) (quota int, err error) {
+	err = DB.Model(&Organization{}).Where("id = ?", orgId).Select("quota").Find(&quota).Error
+	return quota, err
+}
+
+func IncreaseOrgQuota(orgId int, quota int, source string, reference string) error {
+	if quota < 0 {
+		return errors.New("quota 不能为负数！")
+	}
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := increaseOrgQuota(tx, orgId, quota); err != nil {
+			return err
+		}
+		return recordOrgLedger(tx, orgId, quota, source, reference)
+	})
+}
+
+func increaseOrgQuota(tx *gorm.DB, orgId int, quota int) error {
+	result := tx.Model(&Organization{}).Where("id = ?", orgId).Update("quota", gorm.Expr("quota + ?", quota))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("组织不存在")
+	}
+	return nil
+}
+
+// DeltaUpdateOrgQuota 从组织额度池扣除 delta（负数表示返还），并同步累计成员消费额度
+func DeltaUpdateOrgQuota(orgId int, userId int, delta int, reference string) error {
+	if delta == 0 {
+		return nil
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&Organization{}).Where("id = ?", orgId).Updates(map[string]interface{}{
+			"quota":      gorm.Expr("quota - ?", delta),
+			"used_quota": gorm.Expr("used_quota + ?", delta),
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&OrganizationMember{}).Where("org_id = ? AND user_id = ?", orgId, userId).
+			Update("used_quota", gorm.Expr("used_quota + ?", delta)).Error
+	})
+	if err != nil {
+		return err
+	}
+	source := LedgerSourceConsume
+	if delta < 0 {
+		source = LedgerSourceRefund
+	}
+	bufferLedgerEntry(orgLedgerAccount(orgId), -delta, source, reference)
+	return nil
+}
+
+// TransferUserQuotaToOrg 将用户个人额度划转到组织额度池
+func TransferUserQuotaToOrg(userId int, orgId int, quota int) error {
+	if quota <= 0 {
+		return errors.New("划转额度必须大于 0")
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		// 条件扣减保证并发划转不会透支个人余额
+		result := tx.Model(&User{}).Where("id = ? AND quota >= ?", userId, quota).Update("quota", gorm.Expr("quota - ?", quota))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("用户额度不足")
+		}
+		if err := debitQuotaLotsTx(tx, userId, quota); err != nil {
+			return err
+		}
+		if err := increaseOrgQuota(tx, orgId, quota); err != nil {
+			return err
+		}
+		return recordLedgerTransfer(tx, userLedgerAccount(userId), orgLedgerAccount(orgId), quota, LedgerSourceTransfer, "")
+	})
+	if err != nil {
+		return err
+	}
+	if common.RedisEnabled {
+		if err := cacheDecrUserQuota(userId, int64(quota)); err != nil {
+			common.SysLog("failed to decrease user quota cache: " + err.Error())
+		}
+	}
+	RecordLog(userId, LogTypeManage, fmt.Sprintf("划转 %s 到组织 %d 的额度池", logger.LogQuota(quota), orgId))
+	return nil
+}
+
+// GetOrgTokenIds 返回属于该组织的全部令牌 id（含已删除），用于用量统计
+func GetOrgTokenIds(orgId int) (ids []int, err error) {
+	err = DB.Unscoped().Model(&Token{}).Where("org_id = ?", orgId).Pluck("id", &ids).Error
+	return ids, err
+}
+
+func GetOrgUsageStats(orgId int, startTimestamp int64, endTimestamp int64) (stats []*OrgUsageStat, err error) {
+	tokenIds, err := GetOrgTokenIds(orgId)
+	if err != nil {
+		return nil, err
+	}
+	stats = make([]*OrgUsageStat, 0)
+	if len(tokenIds) == 0 {
+		return stats, nil
+	}
+	if coveredUntil, ok := loadUsageRollupCoverage(); ok {
+		return getOrgUsageStatsFromRollups(tokenIds, startTimestamp, endTimestamp, coveredUntil)
+	}
+	tx := LOG_DB.Table("logs").
+		Select("user_id, username, model_name, count(*) as count, sum(quota) as quota, sum(prompt_tokens) as prompt_tokens, sum(completion_tokens) as completion_tokens").
+		Where("type = ? AND token_id IN ?", LogTypeConsume, tokenIds)
+	if startTimestamp != 0 {
+		tx = tx.Where("created_at >= ?", startTimestamp)
+	}
+	if endTimestamp != 0 {
+		tx = tx.Where("created_at <= ?", endTimestamp)
+	}
+	err = tx.Group("user_id, username, model_name").Order("quota desc").Scan(&stats).Error
+	return stats, err
+}
+
+// getOrgUsageStatsFromRollups 已汇总的整点区间读汇总表，其余部分读原始日志，按用户和模型合并
+func getOrgUsageStatsFromRollups(tokenIds []int, startTimestamp int64, endTimestamp int64, coveredUntil int64) ([]*OrgUsageStat, error) {
+	// 原始查询的时间条件为闭区间，这里统一换算为左闭右开
+	end := common.GetTimestamp() + 1
+	if endTimestamp != 0 {
+		end = endTimestamp + 1
+	}
+	rows, err := scanRolledUpUsage[OrgUsageStat](startTimestamp, end, coveredUntil, usageRollupFilter{TokenIds: tokenIds},
+		"user_id, max(username) as username, model_name, sum(request_count) as count, sum(quota) as quota, sum(prompt_tokens) as prompt_tokens, sum(completion_tokens) as completion_tokens",
+		LOG_DB.Table("logs").Where("type = ? AND token_id IN ?", LogTypeConsume, tokenIds),
+		"user_id, max(username) as username, model_name, count(*) as count, sum(quota) as quota, sum(prompt_tokens) as prompt_tokens, sum(completion_tokens) as completion_tokens",
+		"user_id, model_name", "user_id, model_name")
+	if err != nil {
+		return nil, err
+	}
+	type statKey struct {
+		UserId    int
+		ModelName string
+	}
+	merged := make(map[statKey]*OrgUsageStat)
+	stats := make([]*OrgUsageStat, 0)
+	for _, row := range rows {
+		key := statKey{UserId: row.UserId, ModelName: row.ModelName}
+		stat, ok := merged[key]
+		if !ok {
+			merged[key] = row
+			stats = append(stats, row)
+			continue
+		}
+		stat.Count += row.Count
+		stat.Quota += row.Quota
+		stat.PromptTokens += row.PromptTokens
+		stat.CompletionTokens += row.CompletionTokens
+	}
+	sort.SliceStable(stats, func(i, j int) bool {
+		return stats[i].Quota > stats[j].Quota
+	})
+	return stats, nil
+}
@@ -0,0 +1,124 @@
+package model
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func createTestOrg(t *testing.T, ownerId int) *Organization {
+	t.Helper()
+	org := &Organization{Name: "org", OwnerId: ownerId}
+	require.NoError(t, CreateOrganization(org))
+	return org
+}
+
+func TestTransferUserQuotaToOrg_ConcurrentNoOverdraw(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 100)
+	org := createTestOrg(t, user.Id)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if TransferUserQuotaToOrg(user.Id, org.Id, 40) == nil {
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, 2, succeeded)
+	require.Equal(t, 20, getTestUserQuota(t, user.Id))
+	orgQuota, err := GetOrgQuota(org.Id)
+	require.NoError(t, err)
+	require.Equal(t, 80, orgQuota)
+	requireLedgerBalanced(t, userLedgerAccount(user.Id))
+	requireLedgerBalanced(t, orgLedgerAccount(org.Id))
+}
+
+func TestDeleteOrganizationById_RefundsPoolToOwner(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 100)
+	org := createTestOrg(t, user.Id)
+	require.NoError(t, TransferUserQuotaToOrg(user.Id, org.Id, 60))
+
+	require.NoError(t, DeleteOrganizationById(org.Id))
+
+	require.Equal(t, 100, getTestUserQuota(t, user.Id))
+	requireLedgerBalanced(t, userLedgerAccount(user.Id))
+	_, err := GetOrganizationById(org.Id)
+	require.Error(t, err)
+	require.Error(t, CheckOrgTokenUsable(org.Id, user.Id))
+}
+
+func TestDeleteOrganizationById_RefusesDebt(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 0)
+	org := createTestOrg(t, user.Id)
+	require.NoError(t, DeltaUpdateOrgQuota(org.Id, user.Id, 30, ""))
+
+	require.Error(t, DeleteOrganizationById(org.Id))
+	_, err := GetOrganizationById(org.Id)
+	require.NoError(t, err)
+}
+
+func TestOrganizationMemberCanAssignRole(t *testing.T) {
+	owner := &OrganizationMember{Role: OrgRoleOwner}
+	admin := &OrganizationMember{Role: OrgRoleAdmin}
+	member := &OrganizationMember{Role: OrgRoleMember}
+
+	require.True(t, owner.CanAssignRole(OrgRoleAdmin))
+	require.False(t, owner.CanAssignRole(OrgRoleOwner))
+	require.False(t, admin.CanAssignRole(OrgRoleAdmin))
+	require.True(t, admin.CanAssignRole(OrgRoleMember))
+	require.True(t, admin.CanAssignRole(OrgRoleBilling))
+	require.False(t, member.CanAssignRole(OrgRoleMember))
+}
+
+func TestCheckOrgTokenUsable(t *testing.T) {
+	setupTestDB(t)
+	owner := createTestUser(t, 0)
+	other := createTestUser(t, 0)
+	org := createTestOrg(t, owner.Id)
+
+	require.NoError(t, CheckOrgTokenUsable(org.Id, owner.Id))
+	require.Error(t, CheckOrgTokenUsable(org.Id, other.Id))
+
+	billing := &OrganizationMember{OrgId: org.Id, UserId: other.Id, Role: OrgRoleBilling}
+	require.NoError(t, billing.Insert())
+	require.Error(t, CheckOrgTokenUsable(org.Id, other.Id))
+
+	org.Status = OrgStatusDisabled
+	require.NoError(t, org.Update())
+	require.Error(t, CheckOrgTokenUsable(org.Id, owner.Id))
+}
+
+func TestGetOrgMemberCache_SpendLimitAndUsedQuota(t *testing.T) {
+	setupTestDB(t)
+	owner := createTestUser(t, 0)
+	other := createTestUser(t, 0)
+	org := createTestOrg(t, owner.Id)
+
+	memberCache, err := GetOrgMemberCache(org.Id, other.Id)
+	require.NoError(t, err)
+	require.Empty(t, memberCache.Role)
+
+	member := &OrganizationMember{OrgId: org.Id, UserId: other.Id, Role: OrgRoleMember, SpendLimit: 500, UsedQuota: 120}
+	require.NoError(t, member.Insert())
+	memberCache, err = GetOrgMemberCache(org.Id, other.Id)
+	require.NoError(t, err)
+	require.Equal(t, OrgRoleMember, memberCache.Role)
+	require.Equal(t, 500, memberCache.SpendLimit)
+
+	usedQuota, err := GetOrgMemberUsedQuota(org.Id, other.Id)
+	require.NoError(t, err)
+	require.Equal(t, 120, usedQuota)
+}
@@ -0,0 +1,205 @@
+package model
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+)
+
+const (
+	PriceOverrideStatusEnabled  = 1
+	PriceOverrideStatusDisabled = 2
+)
+
+// PriceOverride 用户或令牌级别的模型价格覆盖，优先于全局模型倍率与价格，分组倍率仍然生效。
+// TokenId 非 0 时仅对该令牌生效且优先于用户级别；ModelName 为精确名称或以 * 结尾的前缀。
+// ModelPrice 非空时按次计费，否则使用 ModelRatio（CompletionRatio 为空时沿用全局补全倍率）。
+type PriceOverride struct {
+	Id              int      `json:"id"`
+	UserId          int      `json:"user_id" gorm:"index"`
+	TokenId         int      `json:"token_id" gorm:"index;default:0"`
+	ModelName       string   `json:"model_name" gorm:"type:varchar(255)"`
+	ModelRatio      *float64 `json:"model_ratio"`
+	CompletionRatio *float64 `json:"completion_ratio"`
+	ModelPrice      *float64 `json:"model_price"`
+	Status          int      `json:"status" gorm:"type:int;default:1"`
+	ExpiredTime     int64    `json:"expired_time" gorm:"bigint;default:0"` // 0 表示永不过期
+	Remark          string   `json:"remark" gorm:"type:varchar(255)"`
+	CreatedTime     int64    `json:"created_time" gorm:"bigint"`
+	UpdatedTime     int64    `json:"updated_time" gorm:"bigint"`
+}
+
+func (o *PriceOverride) Validate() error {
+	o.ModelName = strings.TrimSpace(o.ModelName)
+	if o.UserId == 0 {
+		return errors.New("用户不能为空")
+	}
+	if o.ModelName == "" || o.ModelName == "*" {
+		return errors.New("模型名称不能为空")
+	}
+	if o.ModelRatio == nil && o.ModelPrice == nil {
+		return errors.New("模型倍率和模型价格至少设置一项")
+	}
+	for _, v := range []*float64{o.ModelRatio, o.CompletionRatio, o.ModelPrice} {
+		if v != nil && *v < 0 {
+			return errors.New("倍率和价格不能为负数")
+		}
+	}
+	if o.Status != PriceOverrideStatusEnabled && o.Status != PriceOverrideStatusDisabled {
+		o.Status = PriceOverrideStatusEnabled
+	}
+	if o.TokenId != 0 {
+		if _, err := GetTokenByIds(o.TokenId, o.UserId); err != nil {
+			return errors.New("令牌不存在或不属于该用户")
+		}
+	}
+	return nil
+}
+
+func (o *PriceOverride) IsActive(now int64) bool {
+	return o.Status == PriceOverrideStatusEnabled && (o.ExpiredTime == 0 || o.ExpiredTime > now)
+}
+
+func (o *PriceOverride) matchModel(modelName string) (matched bool, exact bool) {
+	if strings.HasSuffix(o.ModelName, "*") {
+		return strings.HasPrefix(modelName, strings.TrimSuffix(o.ModelName, "*")), false
+	}
+	return o.ModelName == modelName, true
+}
+
+func (o *PriceOverride) Insert() error {
+	now := common.GetTimestamp()
+	o.CreatedTime = now
+	o.UpdatedTime = now
+	if err := DB.Create(o).Error; err != nil {
+		return err
+	}
+	refreshPriceOverrideCache()
+	return nil
+}
+
+func (o *PriceOverride) Update() error {
+	o.UpdatedTime = common.GetTimestamp()
+	err := DB.Model(o).Select("token_id", "model_name", "model_ratio", "completion_ratio", "model_price",
+		"status", "expired_time", "remark", "updated_time").Updates(o).Error
+	if err != nil {
+		return err
+	}
+	refreshPriceOverrideCache()
+	return nil
+}
+
+func DeletePriceOverrideById(id int) error {
+	if err := DB.Delete(&PriceOverride{}, id).Error; err != nil {
+		return err
+	}
+	refreshPriceOverrideCache()
+	return nil
+}
+
+func GetPriceOverrideById(id int) (*PriceOverride, error) {
+	override := &PriceOverride{}
+	err := DB.First(override, "id = ?", id).Error
+	return override, err
+}
+
+// GetPriceOverrides 管理员分页查询价格覆盖，activeOnly 为 true 时仅返回当前生效的记录
+func GetPriceOverrides(userId int, activeOnly bool, pageInfo *common.PageInfo) (overrides []*PriceOverride, total int64, err error) {
+	tx := DB.Model(&PriceOverride{})
+	if userId != 0 {
+		tx = tx.Where("user_id = ?", userId)
+	}
+	if activeOnly {
+		tx = tx.Where("status = ? AND (expired_time = 0 OR expired_time > ?)", PriceOverrideStatusEnabled, common.GetTimestamp())
+	}
+	if err = tx.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err = tx.Order("user_id asc, token_id asc, id asc").Limit(pageInfo.GetPageSize()).Offset(pageInfo.GetStartIdx()).Find(&overrides).Error
+	return overrides, total, err
+}
+
+var (
+	priceOverrideCache     map[int][]*PriceOverride // user_id -> 覆盖记录
+	priceOverrideCacheLock sync.RWMutex
+)
+
+func refreshPriceOverrideCache() {
+	var overrides []*PriceOverride
+	if err := DB.Where("status = ?", PriceOverrideStatusEnabled).Find(&overrides).Error; err != nil {
+		common.SysLog("failed to load price overrides: " + err.Error())
+		return
+	}
+	cache := make(map[int][]*PriceOverride)
+	for _, o := range overrides {
+		cache[o.UserId] = append(cache[o.UserId], o)
+	}
+	priceOverrideCacheLock.Lock()
+	priceOverrideCache = cache
+	priceOverrideCacheLock.Unlock()
+}
+
+func InitPriceOverrideCache() {
+	refreshPriceOverrideCache()
+}
+
+func SyncPriceOverrideCache(frequency int) {
+	for {
+		time.Sleep(time.Duration(frequency) * time.Second)
+		refreshPriceOverrideCache()
+	}
+}
+
+// GetActivePriceOverride 返回请求适用的价格覆盖：令牌级别优先于用户级别，同级别精确名称优先于前缀，前缀越长越优先
+func GetActivePriceOverride(userId int, tokenId int, modelName string) *PriceOverride {
+	priceOverrideCacheLock.RLock()
+	overrides := priceOverrideCache[userId]
+	priceOverrideCacheLock.RUnlock()
+	if len(overrides) == 0 {
+		return nil
+	}
+	now := common.GetTimestamp()
+	var best *PriceOverride
+	bestScore := -1
+	for _, o := range overrides {
+		if o.TokenId != 0 && o.TokenId != tokenId {
+			continue
+		}
+		if !o.IsActive(now) {
+			continue
+		}
+		matched, exact := o.matchModel(modelName)
+		if !matched {
+			continue
+		}
+		score := len(o.ModelName)
+		if exact {
+			score += 1 << 16
+		}
+		if o.TokenId != 0 {
+			score += 1 << 20
+		}
+		if score > bestScore {
+			best, bestScore = o, score
+		}
+	}
+	return best
+}
+
+// GetUserActivePriceOverrides 返回用户当前生效的全部价格覆盖（含令牌级别）
+func GetUserActivePriceOverrides(userId int) []*PriceOverride {
+	priceOverrideCacheLock.RLock()
+	overrides := priceOverrideCache[userId]
+	priceOverrideCacheLock.RUnlock()
+	now := common.GetTimestamp()
+	result := make([]*PriceOverride, 0, len(overrides))
+	for _, o := range overrides {
+		if o.IsActive(now) {
+			result = append(result, o)
+		}
+	}
+	return result
+}
@@ -0,0 +1,69 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+func resetTestPriceOverrideCache() {
+	priceOverrideCacheLock.Lock()
+	priceOverrideCache = nil
+	priceOverrideCacheLock.Unlock()
+}
+
+func createTestPriceOverride(t *testing.T, userId int, tokenId int, modelName string, modelRatio float64) *PriceOverride {
+	t.Helper()
+	override := &PriceOverride{UserId: userId, TokenId: tokenId, ModelName: modelName, ModelRatio: &modelRatio, Status: PriceOverrideStatusEnabled}
+	require.NoError(t, override.Insert())
+	return override
+}
+
+func requireActivePriceOverrideRatio(t *testing.T, userId int, tokenId int, modelName string, expected float64) {
+	t.Helper()
+	override := GetActivePriceOverride(userId, tokenId, modelName)
+	require.NotNil(t, override, modelName)
+	require.Equal(t, expected, *override.ModelRatio, modelName)
+}
+
+func TestGetActivePriceOverride_Precedence(t *testing.T) {
+	setupTestDB(t)
+	t.Cleanup(resetTestPriceOverrideCache)
+	createTestPriceOverride(t, 1, 0, "gpt-4o", 1)
+	createTestPriceOverride(t, 1, 0, "gpt-*", 2)
+	createTestPriceOverride(t, 1, 0, "gpt-4*", 3)
+	createTestPriceOverride(t, 1, 7, "gpt-*", 4)
+
+	// 同级别精确名称优先于前缀，前缀越长越优先
+	requireActivePriceOverrideRatio(t, 1, 0, "gpt-4o", 1)
+	requireActivePriceOverrideRatio(t, 1, 0, "gpt-4-turbo", 3)
+	requireActivePriceOverrideRatio(t, 1, 0, "gpt-3.5-turbo", 2)
+	// 令牌级别优先于用户级别的精确名称，其他令牌不受影响
+	requireActivePriceOverrideRatio(t, 1, 7, "gpt-4o", 4)
+	requireActivePriceOverrideRatio(t, 1, 8, "gpt-4o", 1)
+
+	require.Nil(t, GetActivePriceOverride(1, 0, "claude-3"))
+	require.Nil(t, GetActivePriceOverride(2, 0, "gpt-4o"))
+}
+
+func TestGetActivePriceOverride_SkipsDisabledAndExpired(t *testing.T) {
+	setupTestDB(t)
+	t.Cleanup(resetTestPriceOverrideCache)
+	createTestPriceOverride(t, 1, 0, "gemini*", 2)
+	expired := createTestPriceOverride(t, 1, 0, "gemini-pro", 3)
+	expired.ExpiredTime = common.GetTimestamp() - 1
+	require.NoError(t, expired.Update())
+	disabled := createTestPriceOverride(t, 1, 0, "claude-3", 4)
+	disabled.Status = PriceOverrideStatusDisabled
+	require.NoError(t, disabled.Update())
+
+	requireActivePriceOverrideRatio(t, 1, 0, "gemini-pro", 2)
+	require.Nil(t, GetActivePriceOverride(1, 0, "claude-3"))
+	require.Len(t, GetUserActivePriceOverrides(1), 1)
+
+	expired.ExpiredTime = common.GetTimestamp() + 3600
+	require.NoError(t, expired.Update())
+	requireActivePriceOverrideRatio(t, 1, 0, "gemini-pro", 3)
+}
@@ -27,6 +27,8 @@ type Pricing struct {
 	CompletionRatio        float64                 `json:"completion_ratio"`
 	EnableGroup            []string                `json:"enable_groups"`
 	SupportedEndpointTypes []constant.EndpointType `json:"supported_endpoint_types"`
+	// 按提示 token 数分档计价时的各档倍率
+	ContextTiers []ratio_setting.ContextTier `json:"context_tiers,omitempty"`
 }
 
 type PricingVendor struct {
@@ -289,6 +291,7 @@ func updatePricing() {
 			modelRatio, _, _ := ratio_setting.GetModelRatio(model)
 			pricing.ModelRatio = modelRatio
 			pricing.CompletionRatio = ratio_setting.GetCompletionRatio(model)
+			pricing.ContextTiers = ratio_setting.GetContextTiersCopy(model)
 			pricing.QuotaType = 0
 		}
 		pricingMap = append(pricingMap, pricing)
@@ -0,0 +1,470 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"github.com/bytedance/gopkg/util/gopool"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 账本科目类型
+const (
+	LedgerAccountUser         = "user"
+	LedgerAccountOrg          = "org"
+	LedgerAccountSubscription = "subscription" // 订阅本周期剩余额度
+	LedgerAccountSystem       = "system"       // 平台侧对手科目，不维护余额
+)
+
+// 账本变动来源
+const (
+	LedgerSourceOpening      = "opening" // 启用账本前已有的余额
+	LedgerSourceRegister     = "register"
+	LedgerSourceTopup        = "topup"
+	LedgerSourceRedemption   = "redemption"
+	LedgerSourceCheckin      = "checkin"
+	LedgerSourceReferral     = "referral"
+	LedgerSourceAdmin        = "admin"
+	LedgerSourceConsume      = "consume"
+	LedgerSourceRefund       = "refund"
+	LedgerSourceBatch        = "batch" // 批量更新合并写入的消费与退款
+	LedgerSourceExpire       = "expire"
+	LedgerSourceSubscription = "subscription"
+	LedgerSourceTransfer     = "transfer"
+	LedgerSourceCoupon       = "coupon"       // 优惠码赠送额度
+	LedgerSourceTopupRefund  = "topup_refund" // 充值订单退款扣回
+)
+
+// QuotaLedger 额度账本，只追加不修改。每笔变动写入借贷两条记录（共享 EntryId，delta 之和为 0），
+// 一条记在用户或组织科目上，另一条记在对手科目上（system 科目或划转的另一方）。
+type QuotaLedger struct {
+	Id           int    `json:"id"`
+	EntryId      string `json:"entry_id" gorm:"type:varchar(36);index"`
+	AccountType  string `json:"account_type" gorm:"type:varchar(16);index:idx_quota_ledger_account,priority:1"`
+	AccountId    int    `json:"account_id" gorm:"index:idx_quota_ledger_account,priority:2"`
+	Delta        int    `json:"delta"`
+	BalanceAfter int    `json:"balance_after"` // system 科目恒为 0
+	SourceType   string `json:"source_type" gorm:"type:varchar(32);index"`
+	Reference    string `json:"reference" gorm:"type:varchar(255);index"`
+	CreatedAt    int64  `json:"created_at" gorm:"bigint;index"`
+}
+
+type LedgerAccount struct {
+	Type string
+	Id   int
+}
+
+func userLedgerAccount(id int) LedgerAccount {
+	return LedgerAccount{Type: LedgerAccountUser, Id: id}
+}
+
+func orgLedgerAccount(id int) LedgerAccount {
+	return LedgerAccount{Type: LedgerAccountOrg, Id: id}
+}
+
+func subscriptionLedgerAccount(id int) LedgerAccount {
+	return LedgerAccount{Type: LedgerAccountSubscription, Id: id}
+}
+
+var systemLedgerAccount = LedgerAccount{Type: LedgerAccountSystem}
+
+func (a LedgerAccount) key() string {
+	return fmt.Sprintf("%s:%d", a.Type, a.Id)
+}
+
+// 已确认存在账本记录的科目，避免每次记账都检查是否需要补记期初余额
+var ledgerOpenedAccounts sync.Map
+
+func getLedgerAccountBalance(tx *gorm.DB, account LedgerAccount) (balance int, err error) {
+	switch account.Type {
+	case LedgerAccountUser:
+		err = tx.Model(&User{}).Where("id = ?", account.Id).Select("quota").Find(&balance).Error
+	case LedgerAccountOrg:
+		err = tx.Model(&Organization{}).Where("id = ?", account.Id).Select("quota").Find(&balance).Error
+	case LedgerAccountSubscription:
+		err = tx.Model(&UserSubscription{}).Where("id = ?", account.Id).Select("remain_quota").Find(&balance).Error
+	}
+	return balance, err
+}
+
+// ensureLedgerOpening 科目首次记账时，将变动前的余额扣除尚未入账的缓冲变动后补记为期初余额，保证余额与账本合计一致
+func ensureLedgerOpening(tx *gorm.DB, account LedgerAccount, balanceBefore int, now int64) error {
+	if _, ok := ledgerOpenedAccounts.Load(account.key()); ok {
+		return nil
+	}
+	var count int64
+	err := tx.Model(&QuotaLedger{}).Where("account_type = ? AND account_id = ?", account.Type, account.Id).
+		Limit(1).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		ledgerOpenedAccounts.Store(account.key(), true)
+		return nil
+	}
+	balanceBefore -= unrecordedLedgerDelta(account)
+	if balanceBefore == 0 {
+		return nil
+	}
+	entryId := common.GetUUID()
+	return tx.Create([]*QuotaLedger{
+		{EntryId: entryId, AccountType: account.Type, AccountId: account.Id, Delta: balanceBefore, BalanceAfter: balanceBefore, SourceType: LedgerSourceOpening, CreatedAt: now},
+		{EntryId: entryId, AccountType: LedgerAccountSystem, Delta: -balanceBefore, SourceType: LedgerSourceOpening, CreatedAt: now},
+	}).Error
+}
+
+func newLedgerRow(tx *gorm.DB, entryId string, account LedgerAccount, delta int, source string, reference string, now int64) (*QuotaLedger, error) {
+	row := &QuotaLedger{
+		EntryId:     entryId,
+		AccountType: account.Type,
+		AccountId:   account.Id,
+		Delta:       delta,
+		SourceType:  source,
+		Reference:   reference,
+		CreatedAt:   now,
+	}
+	if account.Type == LedgerAccountSystem {
+		return row, nil
+	}
+	balance, err := getLedgerAccountBalance(tx, account)
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureLedgerOpening(tx, account, balance-delta, now); err != nil {
+		return nil, err
+	}
+	row.BalanceAfter = balance
+	return row, nil
+}
+
+// recordLedgerTransfer 记录一笔从 from 转入 to 的额度变动，须在余额写库之后于同一事务内调用
+func recordLedgerTransfer(tx *gorm.DB, from LedgerAccount, to LedgerAccount, amount int, source string, reference string) error {
+	if amount == 0 {
+		return nil
+	}
+	now := common.GetTimestamp()
+	entryId := common.GetUUID()
+	debit, err := newLedgerRow(tx, entryId, from, -amount, source, reference, now)
+	if err != nil {
+		return err
+	}
+	credit, err := newLedgerRow(tx, entryId, to, amount, source, reference, now)
+	if err != nil {
+		return err
+	}
+	return tx.Create([]*QuotaLedger{debit, credit}).Error
+}
+
+// recordUserLedger 记录用户额度变动，delta 为正表示增加，对手科目为 system
+func recordUserLedger(tx *gorm.DB, userId int, delta int, source string, reference string) error {
+	return recordLedgerTransfer(tx, systemLedgerAccount, userLedgerAccount(userId), delta, source, reference)
+}
+
+// recordOrgLedger 记录组织额度池变动，delta 为正表示增加，对手科目为 system
+func recordOrgLedger(tx *gorm.DB, orgId int, delta int, source string, reference string) error {
+	return recordLedgerTransfer(tx, systemLedgerAccount, orgLedgerAccount(orgId), delta, source, reference)
+}
+
+// RecordUserQuotaLedger 为已写库的用户额度变动补记账本，用于额度在模型层之外被直接修改的场景
+func RecordUserQuotaLedger(userId int, delta int, source string, reference string) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		return recordUserLedger(tx, userId, delta, source, reference)
+	})
+}
+
+// changeUserQuota 在事务中更新用户额度、记账并按变动方向增减额度批次
+func changeUserQuota(id int, delta int, source string, reference string) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&User{}).Where("id = ?", id).Update("quota", gorm.Expr("quota + ?", delta)).Error
+		if err != nil {
+			return err
+		}
+		if err := recordUserLedger(tx, id, delta, source, reference); err != nil {
+			return err
+		}
+		if delta > 0 {
+			return refillQuotaLotsTx(tx, id, delta, common.GetTimestamp())
+		}
+		return debitQuotaLotsTx(tx, id, -delta)
+	})
+}
+
+// UpdateUserQuotaWithLedger 按来源变更用户额度并记账，delta 为正表示增加（退款），发放额度请使用 GrantUserQuota。
+// allowBatch 为 true 时用于请求路径：余额立即更新，账本与额度批次缓冲后批量写入；
+// 开启批量更新时余额、账本与额度批次都合并到批量更新中一并写入。
+func UpdateUserQuotaWithLedger(id int, delta int, source string, reference string, allowBatch bool) error {
+	if delta == 0 {
+		return nil
+	}
+	gopool.Go(func() {
+		var err error
+		if delta > 0 {
+			err = cacheIncrUserQuota(id, int64(delta))
+		} else {
+			err = cacheDecrUserQuota(id, int64(-delta))
+		}
+		if err != nil {
+			common.SysLog("failed to update user quota cache: " + err.Error())
+		}
+	})
+	if !allowBatch {
+		return changeUserQuota(id, delta, source, reference)
+	}
+	// 余额合并到批量更新时，账本由批量更新在写入余额的同一事务内以 batch 来源记录，不再单独缓冲
+	if common.BatchUpdateEnabled {
+		addNewRecord(BatchUpdateTypeUserQuota, id, delta)
+		return nil
+	}
+	if err := increaseUserQuota(id, delta); err != nil {
+		return err
+	}
+	bufferLedgerEntry(userLedgerAccount(id), delta, source, reference)
+	return nil
+}
+
+// GrantUserQuota 为用户发放额度：在同一事务内增加余额、记账并记录额度批次，expireDays 为 0 表示永不过期
+func GrantUserQuota(userId int, quota int, ledgerSource string, lotSource string, reference string, expireDays int) error {
+	if quota <= 0 {
+		return nil
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&User{}).Where("id = ?", userId).Update("quota", gorm.Expr("quota + ?", quota)).Error; err != nil {
+			return err
+		}
+		if err := recordUserLedger(tx, userId, quota, ledgerSource, reference); err != nil {
+			return err
+		}
+		return RecordQuotaLot(tx, userId, lotSource, reference, quota, expireDays)
+	})
+	if err != nil {
+		return err
+	}
+	if common.RedisEnabled {
+		if err := cacheIncrUserQuota(userId, int64(quota)); err != nil {
+			common.SysLog("failed to increase user quota cache: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// AdminSetUserQuota 管理员将用户余额修改为 quota，按修改时的实际余额计算变动并记账，返回修改前的余额
+func AdminSetUserQuota(userId int, quota int) (oldQuota int, err error) {
+	if oldQuota, err = getUserQuotaFromDB(DB, userId); err != nil {
+		return 0, err
+	}
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		// 条件更新保证变动额基于写入时的余额，并发消耗导致余额变化时返回错误由管理员重试
+		result := tx.Model(&User{}).Where("id = ? AND quota = ?", userId, oldQuota).Update("quota", quota)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("用户额度已变动，请刷新后重试")
+		}
+		delta := quota - oldQuota
+		if err := recordUserLedger(tx, userId, delta, LedgerSourceAdmin, ""); err != nil {
+			return err
+		}
+		if delta > 0 {
+			return RecordQuotaLot(tx, userId, QuotaLotSourceAdmin, "", delta, 0)
+		}
+		return debitQuotaLotsTx(tx, userId, -delta)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := updateUserQuotaCache(userId, quota); err != nil {
+		common.SysLog("failed to update user quota cache: " + err.Error())
+	}
+	return oldQuota, nil
+}
+
+type LedgerQuery struct {
+	AccountType    string
+	AccountId      int
+	SourceType     string
+	StartTimestamp int64
+	EndTimestamp   int64
+}
+
+// GetLedgerEntries 按科目分页查询账本记录，按时间倒序
+func GetLedgerEntries(query LedgerQuery, pageInfo *common.PageInfo) (entries []*QuotaLedger, total int64, err error) {
+	tx := DB.Model(&QuotaLedger{}).Where("account_type = ? AND account_id = ?", query.AccountType, query.AccountId)
+	if query.SourceType != "" {
+		tx = tx.Where("source_type = ?", query.SourceType)
+	}
+	if query.StartTimestamp != 0 {
+		tx = tx.Where("created_at >= ?", query.StartTimestamp)
+	}
+	if query.EndTimestamp != 0 {
+		tx = tx.Where("created_at <= ?", query.EndTimestamp)
+	}
+	if err = tx.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err = tx.Order("id desc").Limit(pageInfo.GetPageSize()).Offset(pageInfo.GetStartIdx()).Find(&entries).Error
+	return entries, total, err
+}
+
+// LedgerStatementSummary 对账单期间汇总
+type LedgerStatementSummary struct {
+	OpeningBalance int            `json:"opening_balance"`
+	ClosingBalance int            `json:"closing_balance"`
+	Credit         int            `json:"credit"`
+	Debit          int            `json:"debit"`
+	BySource       map[string]int `json:"by_source"`
+}
+
+// GetLedgerStatementSummary 汇总科目在 [start, end] 期间的变动，期初余额为期间开始前的账本合计
+func GetLedgerStatementSummary(accountType string, accountId int, start int64, end int64) (*LedgerStatementSummary, error) {
+	summary := &LedgerStatementSummary{BySource: map[string]int{}}
+	base := DB.Model(&QuotaLedger{}).Where("account_type = ? AND account_id = ?", accountType, accountId)
+	if start != 0 {
+		var opening int64
+		if err := base.Session(&gorm.Session{}).Where("created_at < ?", start).
+			Select("COALESCE(SUM(delta), 0)").Scan(&opening).Error; err != nil {
+			return nil, err
+		}
+		summary.OpeningBalance = int(opening)
+	}
+	period := base.Session(&gorm.Session{})
+	if start != 0 {
+		period = period.Where("created_at >= ?", start)
+	}
+	if end != 0 {
+		period = period.Where("created_at <= ?", end)
+	}
+	var rows []struct {
+		SourceType string
+		Credit     int64
+		Debit      int64
+	}
+	err := period.Select("source_type, " +
+		"COALESCE(SUM(CASE WHEN delta > 0 THEN delta ELSE 0 END), 0) AS credit, " +
+		"COALESCE(SUM(CASE WHEN delta < 0 THEN -delta ELSE 0 END), 0) AS debit").
+		Group("source_type").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		summary.Credit += int(row.Credit)
+		summary.Debit += int(row.Debit)
+		summary.BySource[row.SourceType] = int(row.Credit - row.Debit)
+	}
+	summary.ClosingBalance = summary.OpeningBalance + summary.Credit - summary.Debit
+	return summary, nil
+}
+
+// LedgerMismatch 余额与账本合计不一致的科目
+type LedgerMismatch struct {
+	AccountType string `json:"account_type"`
+	AccountId   int    `json:"account_id"`
+	Balance     int    `json:"balance"`
+	LedgerSum   int    `json:"ledger_sum"`
+}
+
+func sumLedger(tx *gorm.DB, account LedgerAccount) (sum int64, err error) {
+	err = tx.Model(&QuotaLedger{}).Where("account_type = ? AND account_id = ?", account.Type, account.Id).
+		Select("COALESCE(SUM(delta), 0)").Scan(&sum).Error
+	return sum, err
+}
+
+// ReconcileLedgerAccounts 核对 id 大于 afterId 的至多 limit 个用户、组织或订阅的余额与账本合计，返回不一致的科目、本批最大 id 和核对数量。
+// 尚无账本记录的科目视为未启用账本，跳过核对；初次不一致的科目在缓冲账本写入后加锁复核，排除核对期间的并发变动。
+func ReconcileLedgerAccounts(accountType string, afterId int, limit int) (mismatches []*LedgerMismatch, lastId int, checked int, err error) {
+	var balances []struct {
+		Id    int
+		Quota int
+	}
+	var table interface{}
+	column := "quota"
+	switch accountType {
+	case LedgerAccountUser:
+		table = &User{}
+	case LedgerAccountOrg:
+		table = &Organization{}
+	case LedgerAccountSubscription:
+		table = &UserSubscription{}
+		column = "remain_quota"
+	default:
+		return nil, 0, 0, fmt.Errorf("unsupported ledger account type: %s", accountType)
+	}
+	err = DB.Model(table).Select("id", column+" AS quota").Where("id > ?", afterId).Order("id asc").Limit(limit).Scan(&balances).Error
+	if err != nil || len(balances) == 0 {
+		return nil, afterId, 0, err
+	}
+	lastId = balances[len(balances)-1].Id
+	ids := make([]int, 0, len(balances))
+	for _, b := range balances {
+		ids = append(ids, b.Id)
+	}
+	var sums []struct {
+		AccountId int
+		Total     int64
+	}
+	err = DB.Model(&QuotaLedger{}).Select("account_id, SUM(delta) AS total").
+		Where("account_type = ? AND account_id IN ?", accountType, ids).
+		Group("account_id").Scan(&sums).Error
+	if err != nil {
+		return nil, lastId, 0, err
+	}
+	sumMap := make(map[int]int64, len(sums))
+	for _, s := range sums {
+		sumMap[s.AccountId] = s.Total
+	}
+	var candidates []int
+	for _, b := range balances {
+		sum, ok := sumMap[b.Id]
+		if !ok || int64(b.Quota) == sum {
+			continue
+		}
+		candidates = append(candidates, b.Id)
+	}
+	if len(candidates) > 0 {
+		// 请求路径的账本记录缓冲写入（余额也可能在批量更新中），复核前写入本节点的缓冲并等待其他节点完成一次写入
+		if err := FlushLedgerBuffer(); err != nil {
+			return nil, lastId, 0, err
+		}
+		wait := 2 * ledgerFlushInterval
+		if common.BatchUpdateEnabled {
+			wait += time.Duration(common.BatchUpdateInterval) * time.Second
+		}
+		time.Sleep(wait)
+	}
+	for _, id := range candidates {
+		mismatch, err := recheckLedgerAccount(LedgerAccount{Type: accountType, Id: id}, table, column)
+		if err != nil {
+			return nil, lastId, 0, err
+		}
+		if mismatch != nil {
+			mismatches = append(mismatches, mismatch)
+		}
+	}
+	return mismatches, lastId, len(balances), nil
+}
+
+func recheckLedgerAccount(account LedgerAccount, table interface{}, column string) (mismatch *LedgerMismatch, err error) {
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		var balance struct {
+			Quota int
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Model(table).Select(column+" AS quota").
+			Where("id = ?", account.Id).Scan(&balance).Error; err != nil {
+			return err
+		}
+		sum, err := sumLedger(tx, account)
+		if err != nil {
+			return err
+		}
+		if int64(balance.Quota) != sum {
+			mismatch = &LedgerMismatch{AccountType: account.Type, AccountId: account.Id, Balance: balance.Quota, LedgerSum: int(sum)}
+		}
+		return nil
+	})
+	return mismatch, err
+}
@@ -0,0 +1,214 @@
+package model
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"github.com/bytedance/gopkg/util/gopool"
+	"gorm.io/gorm"
+)
+
+// 请求路径上的消费与退款不在请求内记账：余额仍在请求内实时更新，账本记录与用户额度批次的增减
+// 先缓冲在内存中，由后台每 ledgerFlushInterval 在一个事务内批量写入，避免每次消费额外的事务与查询。
+const (
+	ledgerFlushInterval = time.Second
+	// 写库持续失败时缓冲的上限，超出后丢弃最旧的记录，由对账任务发现差异
+	ledgerBufferMaxEntries = 100000
+	ledgerFlushBatchSize   = 500
+)
+
+type bufferedLedgerEntry struct {
+	account   LedgerAccount
+	delta     int
+	source    string
+	reference string
+	createdAt int64
+}
+
+var (
+	ledgerBufferLock sync.Mutex
+	ledgerBuffer     []bufferedLedgerEntry
+	// 正在写库的记录，与 ledgerBuffer 一起构成尚未入账的余额变动
+	ledgerInflight  []bufferedLedgerEntry
+	ledgerFlushLock sync.Mutex
+	ledgerFlushOnce sync.Once
+)
+
+// bufferLedgerEntry 缓冲一笔已写库的余额变动，delta 为正表示增加，对手科目为 system
+func bufferLedgerEntry(account LedgerAccount, delta int, source string, reference string) {
+	if delta == 0 {
+		return
+	}
+	ledgerBufferLock.Lock()
+	defer ledgerBufferLock.Unlock()
+	ledgerBuffer = append(ledgerBuffer, bufferedLedgerEntry{
+		account:   account,
+		delta:     delta,
+		source:    source,
+		reference: reference,
+		createdAt: common.GetTimestamp(),
+	})
+}
+
+// StartLedgerBufferFlusher 启动缓冲账本的定期写入，所有节点都需要启动
+func StartLedgerBufferFlusher() {
+	ledgerFlushOnce.Do(func() {
+		gopool.Go(func() {
+			ticker := time.NewTicker(ledgerFlushInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				if err := FlushLedgerBuffer(); err != nil {
+					common.SysError("failed to flush quota ledger buffer: " + err.Error())
+				}
+			}
+		})
+	})
+}
+
+// FlushLedgerBuffer 将缓冲的账本记录写库并按用户的净变动增减额度批次，失败时放回缓冲等待下次写入
+func FlushLedgerBuffer() error {
+	ledgerFlushLock.Lock()
+	defer ledgerFlushLock.Unlock()
+
+	ledgerBufferLock.Lock()
+	entries := ledgerBuffer
+	ledgerBuffer = nil
+	ledgerInflight = entries
+	ledgerBufferLock.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		return writeBufferedLedgerEntries(tx, entries)
+	})
+	ledgerBufferLock.Lock()
+	ledgerInflight = nil
+	if err == nil {
+		ledgerBufferLock.Unlock()
+		return nil
+	}
+	ledgerBuffer = append(entries, ledgerBuffer...)
+	if dropped := len(ledgerBuffer) - ledgerBufferMaxEntries; dropped > 0 {
+		ledgerBuffer = ledgerBuffer[dropped:]
+		common.SysError(fmt.Sprintf("quota ledger buffer is full, dropped %d entries", dropped))
+	}
+	ledgerBufferLock.Unlock()
+	return err
+}
+
+func writeBufferedLedgerEntries(tx *gorm.DB, entries []bufferedLedgerEntry) error {
+	// 按科目汇总本批净变动，用于补记期初余额、推算每条记录的变动后余额以及增减用户额度批次
+	// 同时记录每个科目最早一笔变动的时间，批次按消耗发生时是否已到期扣减
+	netDeltas := make(map[LedgerAccount]int)
+	firstAt := make(map[LedgerAccount]int64)
+	idsByType := make(map[string][]int)
+	for _, entry := range entries {
+		if _, ok := netDeltas[entry.account]; !ok {
+			idsByType[entry.account.Type] = append(idsByType[entry.account.Type], entry.account.Id)
+			firstAt[entry.account] = entry.createdAt
+		}
+		netDeltas[entry.account] += entry.delta
+	}
+	balances, err := getLedgerAccountBalances(tx, idsByType)
+	if err != nil {
+		return err
+	}
+
+	now := common.GetTimestamp()
+	for account, delta := range netDeltas {
+		if err := ensureLedgerOpening(tx, account, balances[account], now); err != nil {
+			return err
+		}
+		if account.Type != LedgerAccountUser || delta == 0 {
+			continue
+		}
+		if delta > 0 {
+			err = refillQuotaLotsTx(tx, account.Id, delta, now)
+		} else {
+			err = debitQuotaLotsAtTx(tx, account.Id, -delta, firstAt[account])
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// 倒序推算变动后余额：本批最后一条记录的余额为当前余额
+	running := make(map[LedgerAccount]int, len(balances))
+	for account, balance := range balances {
+		running[account] = balance
+	}
+	rows := make([]*QuotaLedger, len(entries)*2)
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		entryId := common.GetUUID()
+		rows[i*2] = &QuotaLedger{
+			EntryId:      entryId,
+			AccountType:  entry.account.Type,
+			AccountId:    entry.account.Id,
+			Delta:        entry.delta,
+			BalanceAfter: running[entry.account],
+			SourceType:   entry.source,
+			Reference:    entry.reference,
+			CreatedAt:    entry.createdAt,
+		}
+		rows[i*2+1] = &QuotaLedger{
+			EntryId:     entryId,
+			AccountType: LedgerAccountSystem,
+			Delta:       -entry.delta,
+			SourceType:  entry.source,
+			Reference:   entry.reference,
+			CreatedAt:   entry.createdAt,
+		}
+		running[entry.account] -= entry.delta
+	}
+	return tx.CreateInBatches(rows, ledgerFlushBatchSize).Error
+}
+
+// unrecordedLedgerDelta 返回本节点已更新余额但尚未写入账本的变动合计
+func unrecordedLedgerDelta(account LedgerAccount) int {
+	ledgerBufferLock.Lock()
+	defer ledgerBufferLock.Unlock()
+	delta := 0
+	for _, entries := range [][]bufferedLedgerEntry{ledgerInflight, ledgerBuffer} {
+		for _, entry := range entries {
+			if entry.account == account {
+				delta += entry.delta
+			}
+		}
+	}
+	return delta
+}
+
+func getLedgerAccountBalances(tx *gorm.DB, idsByType map[string][]int) (map[LedgerAccount]int, error) {
+	balances := make(map[LedgerAccount]int)
+	for accountType, ids := range idsByType {
+		var table interface{}
+		column := "quota"
+		switch accountType {
+		case LedgerAccountUser:
+			table = &User{}
+		case LedgerAccountOrg:
+			table = &Organization{}
+		case LedgerAccountSubscription:
+			table = &UserSubscription{}
+			column = "remain_quota"
+		default:
+			continue
+		}
+		var rows []struct {
+			Id    int
+			Quota int
+		}
+		if err := tx.Model(table).Select("id", column+" AS quota").Where("id IN ?", ids).Scan(&rows).Error; err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			balances[LedgerAccount{Type: accountType, Id: row.Id}] = row.Quota
+		}
+	}
+	return balances, nil
+}
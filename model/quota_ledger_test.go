@@ -0,0 +1,91 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateUserQuotaWithLedger_BufferedEntries(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 100)
+
+	require.NoError(t, DeltaUpdateUserQuota(user.Id, -30, "r1"))
+	require.NoError(t, DeltaUpdateUserQuota(user.Id, 10, "r1"))
+	// 余额立即更新，账本在缓冲写入后追上
+	require.Equal(t, 80, getTestUserQuota(t, user.Id))
+	require.NoError(t, FlushLedgerBuffer())
+
+	var rows []*QuotaLedger
+	require.NoError(t, DB.Where("account_type = ? AND account_id = ? AND reference = ?", LedgerAccountUser, user.Id, "r1").
+		Order("id asc").Find(&rows).Error)
+	require.Len(t, rows, 2)
+	require.Equal(t, LedgerSourceConsume, rows[0].SourceType)
+	require.Equal(t, -30, rows[0].Delta)
+	require.Equal(t, 70, rows[0].BalanceAfter)
+	require.Equal(t, LedgerSourceRefund, rows[1].SourceType)
+	require.Equal(t, 80, rows[1].BalanceAfter)
+	requireLedgerBalanced(t, userLedgerAccount(user.Id))
+}
+
+func TestUpdateUserQuotaWithLedger_BatchUpdate(t *testing.T) {
+	setupTestDB(t)
+	common.BatchUpdateEnabled = true
+	user := createTestUser(t, 100)
+
+	require.NoError(t, DeltaUpdateUserQuota(user.Id, -30, "r1"))
+	batchUpdate()
+	require.Equal(t, 70, getTestUserQuota(t, user.Id))
+	requireLedgerBalanced(t, userLedgerAccount(user.Id))
+}
+
+func TestUpdateUserQuotaWithLedger_BatchUpdateFlushLedgerFirst(t *testing.T) {
+	setupTestDB(t)
+	common.BatchUpdateEnabled = true
+	user := createTestUser(t, 1000)
+
+	// 缓冲账本先于批量更新写入时，期初余额不能按尚未扣减的余额补记
+	require.NoError(t, DeltaUpdateUserQuota(user.Id, -100, "r1"))
+	require.NoError(t, FlushLedgerBuffer())
+	batchUpdate()
+	require.Equal(t, 900, getTestUserQuota(t, user.Id))
+	requireLedgerBalanced(t, userLedgerAccount(user.Id))
+
+	var row QuotaLedger
+	require.NoError(t, DB.Where("account_type = ? AND account_id = ?", LedgerAccountUser, user.Id).Order("id desc").First(&row).Error)
+	require.Equal(t, LedgerSourceBatch, row.SourceType)
+	require.Equal(t, -100, row.Delta)
+	require.Equal(t, 900, row.BalanceAfter)
+	require.Equal(t, map[string]int{QuotaLotSourceOther: 900}, getTestLotRemains(t, user.Id))
+}
+
+func TestIncreaseUserQuota_RecordsSource(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 0)
+
+	require.NoError(t, IncreaseUserQuota(user.Id, 50, true, LedgerSourceTopup, "trade-1"))
+	var row QuotaLedger
+	require.NoError(t, DB.Where("account_type = ? AND account_id = ? AND reference = ?", LedgerAccountUser, user.Id, "trade-1").First(&row).Error)
+	require.Equal(t, LedgerSourceTopup, row.SourceType)
+	require.Equal(t, 50, row.Delta)
+}
+
+func TestAdminSetUserQuota(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 100)
+	require.NoError(t, DeltaUpdateUserQuota(user.Id, -40, "r1"))
+
+	oldQuota, err := AdminSetUserQuota(user.Id, 200)
+	require.NoError(t, err)
+	require.Equal(t, 60, oldQuota)
+	require.Equal(t, 200, getTestUserQuota(t, user.Id))
+	requireLedgerBalanced(t, userLedgerAccount(user.Id))
+
+	var adminDelta int
+	require.NoError(t, DB.Model(&QuotaLedger{}).Where("account_type = ? AND account_id = ? AND source_type = ?", LedgerAccountUser, user.Id, LedgerSourceAdmin).
+		Select("SUM(delta)").Scan(&adminDelta).Error)
+	require.Equal(t, 140, adminDelta)
+	require.Equal(t, map[string]int{QuotaLotSourceOther: 60, QuotaLotSourceAdmin: 140}, getTestLotRemains(t, user.Id))
+}
@@ -0,0 +1,332 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/logger"
+
+	"gorm.io/gorm"
+)
+
+const (
+	QuotaLotSourceTopup      = "topup"
+	QuotaLotSourceRedemption = "redemption"
+	QuotaLotSourceCheckin    = "checkin"
+	QuotaLotSourceReferral   = "referral"
+	QuotaLotSourceAdmin      = "admin"
+	QuotaLotSourceCoupon     = "coupon"
+	QuotaLotSourceOther      = "other" // 历史余额、退款等无法归属到具体发放来源的额度
+)
+
+const (
+	QuotaLotStatusActive    = 1
+	QuotaLotStatusExhausted = 2
+	QuotaLotStatusExpired   = 3
+)
+
+// QuotaLot 额度批次。User.Quota 仍是余额的唯一来源，批次记录余额的构成与有效期，
+// 各批次剩余额度之和等于非负部分的余额：发放时新增批次，消耗时按过期时间先到先扣（永不过期的批次最后扣），
+// 退款时按同样的顺序退回尚未过期的批次。请求路径上的消耗与退款随账本缓冲批量计入批次。
+type QuotaLot struct {
+	Id          int    `json:"id"`
+	UserId      int    `json:"user_id" gorm:"index:idx_quota_lot_user_status"`
+	Source      string `json:"source" gorm:"type:varchar(16)"`
+	Reference   string `json:"reference" gorm:"type:varchar(255)"`
+	Amount      int    `json:"amount" gorm:"type:int;default:0"`
+	Remain      int    `json:"remain" gorm:"type:int;default:0"`
+	ExpiresAt   int64  `json:"expires_at" gorm:"bigint;index;default:0"` // 0 表示永不过期
+	Status      int    `json:"status" gorm:"type:int;default:1;index:idx_quota_lot_user_status"`
+	CreatedTime int64  `json:"created_time" gorm:"bigint"`
+}
+
+// QuotaBreakdown 用户余额构成
+type QuotaBreakdown struct {
+	Quota         int            `json:"quota"`
+	BySource      map[string]int `json:"by_source"`
+	ExpiringQuota int            `json:"expiring_quota"` // 有过期时间的额度合计
+	NextExpiresAt int64          `json:"next_expires_at"`
+	Lots          []*QuotaLot    `json:"lots"`
+}
+
+func (lot *QuotaLot) expiresBefore(other *QuotaLot) bool {
+	if lot.ExpiresAt != other.ExpiresAt {
+		if lot.ExpiresAt == 0 {
+			return false
+		}
+		if other.ExpiresAt == 0 {
+			return true
+		}
+		return lot.ExpiresAt < other.ExpiresAt
+	}
+	return lot.Id < other.Id
+}
+
+func getActiveQuotaLots(tx *gorm.DB, userId int) (lots []*QuotaLot, err error) {
+	err = tx.Where("user_id = ? AND status = ?", userId, QuotaLotStatusActive).Find(&lots).Error
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(lots, func(i, j int) bool {
+		return lots[i].expiresBefore(lots[j])
+	})
+	return lots, nil
+}
+
+func getUserQuotaFromDB(tx *gorm.DB, userId int) (quota int, err error) {
+	err = tx.Model(&User{}).Where("id = ?", userId).Select("quota").Find(&quota).Error
+	return quota, err
+}
+
+func updateQuotaLotRemain(tx *gorm.DB, lot *QuotaLot, remain int) error {
+	lot.Remain = remain
+	lot.Status = QuotaLotStatusActive
+	if remain == 0 {
+		lot.Status = QuotaLotStatusExhausted
+	}
+	return tx.Model(&QuotaLot{}).Where("id = ?", lot.Id).
+		Updates(map[string]interface{}{"remain": lot.Remain, "status": lot.Status}).Error
+}
+
+// debitQuotaLotsTx 余额减少 amount 后按过期顺序扣减批次，批次不足（余额透支）时扣完为止
+func debitQuotaLotsTx(tx *gorm.DB, userId int, amount int) error {
+	return debitQuotaLotsAtTx(tx, userId, amount, common.GetTimestamp())
+}
+
+// debitQuotaLotsAtTx 按消耗发生的时间 at 扣减批次：at 时已到期的批次不再参与扣减，
+// 其剩余额度由过期任务扣除，因此缓冲的消耗晚于过期任务写入时也不会重复扣减
+func debitQuotaLotsAtTx(tx *gorm.DB, userId int, amount int, at int64) error {
+	if amount <= 0 {
+		return nil
+	}
+	lots, err := getActiveQuotaLots(tx, userId)
+	if err != nil {
+		return err
+	}
+	for _, lot := range lots {
+		if amount == 0 {
+			break
+		}
+		if lot.ExpiresAt > 0 && lot.ExpiresAt <= at {
+			continue
+		}
+		take := min(lot.Remain, amount)
+		if take == 0 {
+			continue
+		}
+		amount -= take
+		if err := updateQuotaLotRemain(tx, lot, lot.Remain-take); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refillQuotaLotsTx 余额因退款增加 amount 后，按扣减时的顺序退回尚未过期的批次；
+// 用于抵扣透支的部分不计入批次，批次都已退满时计入永不过期的 other 批次
+func refillQuotaLotsTx(tx *gorm.DB, userId int, amount int, now int64) error {
+	if amount <= 0 {
+		return nil
+	}
+	quota, err := getUserQuotaFromDB(tx, userId)
+	if err != nil {
+		return err
+	}
+	var lots []*QuotaLot
+	err = tx.Where("user_id = ? AND status IN ? AND (expires_at = 0 OR expires_at > ?)",
+		userId, []int{QuotaLotStatusActive, QuotaLotStatusExhausted}, now).Find(&lots).Error
+	if err != nil {
+		return err
+	}
+	total := 0
+	for _, lot := range lots {
+		if lot.Status == QuotaLotStatusActive {
+			total += lot.Remain
+		}
+	}
+	amount = min(amount, max(quota, 0)-total)
+	if amount <= 0 {
+		return nil
+	}
+	sort.Slice(lots, func(i, j int) bool {
+		return lots[i].expiresBefore(lots[j])
+	})
+	var other *QuotaLot
+	for _, lot := range lots {
+		if lot.Source == QuotaLotSourceOther && lot.ExpiresAt == 0 && other == nil {
+			other = lot
+		}
+		if amount == 0 {
+			break
+		}
+		fill := min(lot.Amount-lot.Remain, amount)
+		if fill <= 0 {
+			continue
+		}
+		amount -= fill
+		if err := updateQuotaLotRemain(tx, lot, lot.Remain+fill); err != nil {
+			return err
+		}
+	}
+	if amount == 0 {
+		return nil
+	}
+	if other != nil {
+		return tx.Model(&QuotaLot{}).Where("id = ?", other.Id).Updates(map[string]interface{}{
+			"amount": gorm.Expr("amount + ?", amount),
+			"remain": gorm.Expr("remain + ?", amount),
+			"status": QuotaLotStatusActive,
+		}).Error
+	}
+	return tx.Create(&QuotaLot{
+		UserId:      userId,
+		Source:      QuotaLotSourceOther,
+		Amount:      amount,
+		Remain:      amount,
+		Status:      QuotaLotStatusActive,
+		CreatedTime: now,
+	}).Error
+}
+
+// RecordQuotaLot 记录一笔已计入 User.Quota 的额度发放，须在额度写库之后调用（可在同一事务内）。
+// 用于抵扣透支的部分不计入批次。expireDays 为 0 表示永不过期。
+func RecordQuotaLot(tx *gorm.DB, userId int, source string, reference string, amount int, expireDays int) error {
+	if amount <= 0 {
+		return nil
+	}
+	quota, err := getUserQuotaFromDB(tx, userId)
+	if err != nil {
+		return err
+	}
+	amount = min(amount, quota)
+	if amount <= 0 {
+		return nil
+	}
+	now := common.GetTimestamp()
+	lot := &QuotaLot{
+		UserId:      userId,
+		Source:      source,
+		Reference:   reference,
+		Amount:      amount,
+		Remain:      amount,
+		Status:      QuotaLotStatusActive,
+		CreatedTime: now,
+	}
+	if expireDays > 0 {
+		lot.ExpiresAt = now + int64(expireDays)*86400
+	}
+	return tx.Create(lot).Error
+}
+
+// GetUserQuotaBreakdown 返回用户余额构成，没有批次记录的余额（如启用批次前的历史余额）计入 other
+func GetUserQuotaBreakdown(userId int) (*QuotaBreakdown, error) {
+	breakdown := &QuotaBreakdown{BySource: map[string]int{}}
+	quota, err := getUserQuotaFromDB(DB, userId)
+	if err != nil {
+		return nil, err
+	}
+	lots, err := getActiveQuotaLots(DB, userId)
+	if err != nil {
+		return nil, err
+	}
+	breakdown.Quota = quota
+	breakdown.Lots = lots
+	tracked := 0
+	for _, lot := range lots {
+		tracked += lot.Remain
+		breakdown.BySource[lot.Source] += lot.Remain
+		if lot.ExpiresAt > 0 {
+			breakdown.ExpiringQuota += lot.Remain
+			if breakdown.NextExpiresAt == 0 || lot.ExpiresAt < breakdown.NextExpiresAt {
+				breakdown.NextExpiresAt = lot.ExpiresAt
+			}
+		}
+	}
+	if untracked := quota - tracked; untracked > 0 {
+		breakdown.BySource[QuotaLotSourceOther] += untracked
+	}
+	return breakdown, nil
+}
+
+// quotaLotExpireDelaySeconds 批次到期后延迟处理的时间，需大于各节点缓冲账本的写入周期与批量更新间隔，
+// 保证到期前发生的消耗都已从批次中扣减
+const quotaLotExpireDelaySeconds = 300
+
+// GetUsersWithExpiredQuotaLots 返回存在已到期（超过处理延迟）但仍有剩余额度批次的用户
+func GetUsersWithExpiredQuotaLots(now int64, limit int) (userIds []int, err error) {
+	err = DB.Model(&QuotaLot{}).
+		Where("status = ? AND expires_at > 0 AND expires_at <= ?", QuotaLotStatusActive, now-quotaLotExpireDelaySeconds).
+		Distinct("user_id").Limit(limit).Pluck("user_id", &userIds).Error
+	return userIds, err
+}
+
+// ExpireUserQuotaLots 扣除已到期批次的剩余额度，返回扣除的额度。
+// 只处理到期超过 quotaLotExpireDelaySeconds 的批次：到期前的消耗此时已由各节点写入批次，
+// 到期后的消耗不会再扣减这些批次。余额不足批次剩余额度（余额透支）时最多扣至 0。
+func ExpireUserQuotaLots(userId int, now int64) (expired int, err error) {
+	// 本节点写库失败而仍在缓冲中的消耗先尝试写入
+	if err := FlushLedgerBuffer(); err != nil {
+		return 0, err
+	}
+	var expiredLots []*QuotaLot
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ? AND status = ? AND expires_at > 0 AND expires_at <= ?", userId, QuotaLotStatusActive, now-quotaLotExpireDelaySeconds).
+			Find(&expiredLots).Error; err != nil {
+			return err
+		}
+		ids := make([]int, 0, len(expiredLots))
+		for _, lot := range expiredLots {
+			ids = append(ids, lot.Id)
+			expired += lot.Remain
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		if err := tx.Model(&QuotaLot{}).Where("id IN ?", ids).Update("status", QuotaLotStatusExpired).Error; err != nil {
+			return err
+		}
+		quota, err := getUserQuotaFromDB(tx, userId)
+		if err != nil {
+			return err
+		}
+		expired = min(expired, max(quota, 0))
+		if expired == 0 {
+			return nil
+		}
+		result := tx.Model(&User{}).Where("id = ? AND quota >= ?", userId, expired).Update("quota", gorm.Expr("quota - ?", expired))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("用户额度已变动，请重试")
+		}
+		return recordUserLedger(tx, userId, -expired, LedgerSourceExpire, "")
+	})
+	if err != nil {
+		return 0, err
+	}
+	if expired > 0 && common.RedisEnabled {
+		if err := cacheDecrUserQuota(userId, int64(expired)); err != nil {
+			common.SysLog("failed to decrease user quota cache: " + err.Error())
+		}
+	}
+	for _, lot := range expiredLots {
+		if lot.Remain > 0 {
+			RecordLog(userId, LogTypeSystem, fmt.Sprintf("额度批次 #%d（来源：%s）已过期，扣除剩余额度 %s", lot.Id, lot.Source, logger.LogQuota(lot.Remain)))
+		}
+	}
+	return expired, nil
+}
+
+// AdminGrantQuota 管理员为用户发放额度，可设置有效天数
+func AdminGrantQuota(userId int, quota int, expireDays int) error {
+	if quota <= 0 {
+		return errors.New("额度必须大于 0")
+	}
+	if expireDays < 0 {
+		return errors.New("有效天数不能为负数")
+	}
+	return GrantUserQuota(userId, quota, LedgerSourceAdmin, QuotaLotSourceAdmin, "", expireDays)
+}
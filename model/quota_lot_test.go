@@ -0,0 +1,158 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+func getTestLotRemains(t *testing.T, userId int) map[string]int {
+	t.Helper()
+	require.NoError(t, FlushLedgerBuffer())
+	lots, err := getActiveQuotaLots(DB, userId)
+	require.NoError(t, err)
+	remains := make(map[string]int)
+	for _, lot := range lots {
+		remains[lot.Source] += lot.Remain
+	}
+	return remains
+}
+
+func TestQuotaLots_ConsumeExpiringFirstAndRefundBack(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 100)
+	require.NoError(t, GrantUserQuota(user.Id, 50, LedgerSourceCheckin, QuotaLotSourceCheckin, "d1", 7))
+
+	require.NoError(t, DeltaUpdateUserQuota(user.Id, -80, "r1"))
+	require.Equal(t, map[string]int{QuotaLotSourceOther: 70}, getTestLotRemains(t, user.Id))
+
+	// 退款先退回即将过期的批次，不会变成永不过期的额度
+	require.NoError(t, DeltaUpdateUserQuota(user.Id, 60, "r1"))
+	require.Equal(t, map[string]int{QuotaLotSourceCheckin: 50, QuotaLotSourceOther: 80}, getTestLotRemains(t, user.Id))
+	require.Equal(t, 130, getTestUserQuota(t, user.Id))
+	requireLedgerBalanced(t, userLedgerAccount(user.Id))
+}
+
+func TestQuotaLots_NetDeltaWithinFlush(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 0)
+	require.NoError(t, GrantUserQuota(user.Id, 100, LedgerSourceCheckin, QuotaLotSourceCheckin, "d1", 7))
+
+	require.NoError(t, DeltaUpdateUserQuota(user.Id, -100, "r1"))
+	require.NoError(t, DeltaUpdateUserQuota(user.Id, 40, "r1"))
+	require.Equal(t, map[string]int{QuotaLotSourceCheckin: 40}, getTestLotRemains(t, user.Id))
+	requireLedgerBalanced(t, userLedgerAccount(user.Id))
+}
+
+func TestQuotaLots_OverdraftNotTracked(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 30)
+
+	require.NoError(t, DeltaUpdateUserQuota(user.Id, -50, "r1"))
+	require.Empty(t, getTestLotRemains(t, user.Id))
+
+	// 发放先抵扣透支的 20，批次只记录剩余的 30
+	require.NoError(t, GrantUserQuota(user.Id, 50, LedgerSourceAdmin, QuotaLotSourceAdmin, "", 0))
+	require.Equal(t, map[string]int{QuotaLotSourceAdmin: 30}, getTestLotRemains(t, user.Id))
+	requireLedgerBalanced(t, userLedgerAccount(user.Id))
+}
+
+func TestExpireUserQuotaLots(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 100)
+	require.NoError(t, GrantUserQuota(user.Id, 50, LedgerSourceCheckin, QuotaLotSourceCheckin, "d1", 1))
+	require.NoError(t, DeltaUpdateUserQuota(user.Id, -20, "r1"))
+
+	expired, err := ExpireUserQuotaLots(user.Id, common.GetTimestamp()+2*86400)
+	require.NoError(t, err)
+	require.Equal(t, 30, expired)
+	require.Equal(t, 100, getTestUserQuota(t, user.Id))
+	require.Equal(t, map[string]int{QuotaLotSourceOther: 100}, getTestLotRemains(t, user.Id))
+	requireLedgerBalanced(t, userLedgerAccount(user.Id))
+}
+
+func TestGetUserQuotaBreakdown_ReadOnly(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 0)
+	require.NoError(t, DB.Model(&User{}).Where("id = ?", user.Id).Update("quota", 70).Error)
+	require.NoError(t, GrantUserQuota(user.Id, 30, LedgerSourceCheckin, QuotaLotSourceCheckin, "d1", 7))
+
+	breakdown, err := GetUserQuotaBreakdown(user.Id)
+	require.NoError(t, err)
+	require.Equal(t, 100, breakdown.Quota)
+	require.Equal(t, map[string]int{QuotaLotSourceCheckin: 30, QuotaLotSourceOther: 70}, breakdown.BySource)
+	require.Equal(t, 30, breakdown.ExpiringQuota)
+
+	var count int64
+	require.NoError(t, DB.Model(&QuotaLot{}).Where("user_id = ?", user.Id).Count(&count).Error)
+	require.Equal(t, int64(1), count)
+}
+
+func TestExpireUserQuotaLots_BufferedConsumeOnOtherNode(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 100)
+	require.NoError(t, GrantUserQuota(user.Id, 50, LedgerSourceCheckin, QuotaLotSourceCheckin, "d1", 1))
+	expiresAt := common.GetTimestamp() + 86400
+
+	// 到期前的消耗仍缓冲在其他节点时过期任务运行，不能先扣掉批次的全部剩余额度
+	require.NoError(t, DeltaUpdateUserQuota(user.Id, -30, "r1"))
+	ledgerBufferLock.Lock()
+	pending := ledgerBuffer
+	ledgerBuffer = nil
+	ledgerBufferLock.Unlock()
+
+	expired, err := ExpireUserQuotaLots(user.Id, expiresAt+1)
+	require.NoError(t, err)
+	require.Zero(t, expired)
+
+	ledgerBufferLock.Lock()
+	ledgerBuffer = append(pending, ledgerBuffer...)
+	ledgerBufferLock.Unlock()
+	require.NoError(t, FlushLedgerBuffer())
+
+	expired, err = ExpireUserQuotaLots(user.Id, expiresAt+quotaLotExpireDelaySeconds)
+	require.NoError(t, err)
+	require.Equal(t, 20, expired)
+	require.Equal(t, map[string]int{QuotaLotSourceOther: 100}, getTestLotRemains(t, user.Id))
+	require.Equal(t, 100, getTestUserQuota(t, user.Id))
+	requireLedgerBalanced(t, userLedgerAccount(user.Id))
+}
+
+func TestQuotaLots_ConsumeAfterExpirySkipsExpiredLot(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 100)
+	require.NoError(t, GrantUserQuota(user.Id, 50, LedgerSourceCheckin, QuotaLotSourceCheckin, "d1", 7))
+	now := common.GetTimestamp()
+	require.NoError(t, DB.Model(&QuotaLot{}).Where("user_id = ? AND source = ?", user.Id, QuotaLotSourceCheckin).
+		Update("expires_at", now-10).Error)
+
+	// 到期后、过期任务处理前的消耗从未到期的批次扣减
+	require.NoError(t, DeltaUpdateUserQuota(user.Id, -30, "r1"))
+	require.Equal(t, map[string]int{QuotaLotSourceCheckin: 50, QuotaLotSourceOther: 70}, getTestLotRemains(t, user.Id))
+
+	expired, err := ExpireUserQuotaLots(user.Id, now+quotaLotExpireDelaySeconds)
+	require.NoError(t, err)
+	require.Equal(t, 50, expired)
+	require.Equal(t, 70, getTestUserQuota(t, user.Id))
+	requireLedgerBalanced(t, userLedgerAccount(user.Id))
+}
+
+func TestExpireUserQuotaLots_WaitsForFlushDelay(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 0)
+	require.NoError(t, GrantUserQuota(user.Id, 50, LedgerSourceCheckin, QuotaLotSourceCheckin, "d1", 1))
+	expiresAt := common.GetTimestamp() + 86400
+
+	expired, err := ExpireUserQuotaLots(user.Id, expiresAt)
+	require.NoError(t, err)
+	require.Zero(t, expired)
+	userIds, err := GetUsersWithExpiredQuotaLots(expiresAt, 10)
+	require.NoError(t, err)
+	require.Empty(t, userIds)
+
+	expired, err = ExpireUserQuotaLots(user.Id, expiresAt+quotaLotExpireDelaySeconds)
+	require.NoError(t, err)
+	require.Equal(t, 50, expired)
+}
@@ -24,6 +24,8 @@ type Redemption struct {
 	UsedUserId   int            `json:"used_user_id"`
 	DeletedAt    gorm.DeletedAt `gorm:"index"`
 	ExpiredTime  int64          `json:"expired_time" gorm:"bigint"` // 过期时间，0 表示不过期
+	// 兑换所得额度的有效天数，0 表示永不过期
+	QuotaExpireDays int `json:"quota_expire_days" gorm:"type:int;default:0"`
 }
 
 func GetAllRedemptions(startIdx int, num int) (redemptions []*Redemption, total int64, err error) {
@@ -112,7 +114,8 @@ func GetRedemptionById(id int) (*Redemption, error) {
 	return &redemption, err
 }
 
-func Redeem(key string, userId int) (quota int, err error) {
+// Redeem 使用兑换码充值，orgId 不为 0 时额度计入组织额度池
+func Redeem(key string, userId int, orgId int) (quota int, err error) {
 	if key == "" {
 		return 0, errors.New("未提供兑换码")
 	}
@@ -137,7 +140,20 @@ func Redeem(key string, userId int) (quota int, err error) {
 		if redemption.ExpiredTime != 0 && redemption.ExpiredTime < common.GetTimestamp() {
 			return errors.New("该兑换码已过期")
 		}
-		err = tx.Model(&User{}).Where("id = ?", userId).Update("quota", gorm.Expr("quota + ?", redemption.Quota)).Error
+		if orgId != 0 {
+			err = increaseOrgQuota(tx, orgId, redemption.Quota)
+			if err == nil {
+				err = recordOrgLedger(tx, orgId, redemption.Quota, LedgerSourceRedemption, fmt.Sprintf("%d", redemption.Id))
+			}
+		} else {
+			err = tx.Model(&User{}).Where("id = ?", userId).Update("quota", gorm.Expr("quota + ?", redemption.Quota)).Error
+			if err == nil {
+				err = recordUserLedger(tx, userId, redemption.Quota, LedgerSourceRedemption, fmt.Sprintf("%d", redemption.Id))
+			}
+			if err == nil {
+				err = RecordQuotaLot(tx, userId, QuotaLotSourceRedemption, fmt.Sprintf("%d", redemption.Id), redemption.Quota, redemption.QuotaExpireDays)
+			}
+		}
 		if err != nil {
 			return err
 		}
@@ -150,7 +166,11 @@ func Redeem(key string, userId int) (quota int, err error) {
 	if err != nil {
 		return 0, errors.New("兑换失败，" + err.Error())
 	}
-	RecordLog(userId, LogTypeTopup, fmt.Sprintf("通过兑换码充值 %s，兑换码ID %d", logger.LogQuota(redemption.Quota), redemption.Id))
+	if orgId != 0 {
+		RecordLog(userId, LogTypeTopup, fmt.Sprintf("通过兑换码为组织 %d 充值 %s，兑换码ID %d", orgId, logger.LogQuota(redemption.Quota), redemption.Id))
+	} else {
+		RecordLog(userId, LogTypeTopup, fmt.Sprintf("通过兑换码充值 %s，兑换码ID %d", logger.LogQuota(redemption.Quota), redemption.Id))
+	}
 	return redemption.Quota, nil
 }
 
@@ -168,7 +188,7 @@ func (redemption *Redemption) SelectUpdate() error {
 // Update Make sure your token's fields is completed, because this will update non-zero values
 func (redemption *Redemption) Update() error {
 	var err error
-	err = DB.Model(redemption).Select("name", "status", "quota", "redeemed_time", "expired_time").Updates(redemption).Error
+	err = DB.Model(redemption).Select("name", "status", "quota", "redeemed_time", "expired_time", "quota_expire_days").Updates(redemption).Error
 	return err
 }
 
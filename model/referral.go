@@ -0,0 +1,230 @@
+package model
+
+import (
+	"errors"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	ReferralCommissionStatusCredited = 1
+	ReferralCommissionStatusRevoked  = 2
+)
+
+// ReferralCommission 邀请返佣记录。被邀请人充值成功时按层级向上级邀请人发放，计入邀请人的 AffQuota，
+// 同一订单对同一邀请人只发放一次。为组织充值时付款成员视为被邀请人，返佣发放给付款成员的邀请人，
+// 与个人充值使用同一套上限。
+type ReferralCommission struct {
+	Id         int     `json:"id"`
+	InviterId  int     `json:"inviter_id" gorm:"uniqueIndex:idx_referral_inviter_trade,priority:1;index:idx_referral_inviter_time,priority:1"`
+	InviteeId  int     `json:"invitee_id" gorm:"index"`
+	Level      int     `json:"level" gorm:"type:int;default:1"`
+	TradeNo    string  `json:"trade_no" gorm:"type:varchar(255);uniqueIndex:idx_referral_inviter_trade,priority:2"`
+	TopupQuota int     `json:"topup_quota" gorm:"type:int;default:0"`
+	Rate       float64 `json:"rate" gorm:"default:0"` // 返佣百分比
+	Quota      int     `json:"quota" gorm:"type:int;default:0"`
+	Status     int     `json:"status" gorm:"type:int;default:1"`
+	// 撤销时实际从邀请额度中扣回的额度，邀请额度已被划转时可能小于 Quota
+	RevokedQuota int   `json:"revoked_quota" gorm:"type:int;default:0"`
+	CreatedTime  int64 `json:"created_time" gorm:"bigint;index:idx_referral_inviter_time,priority:2"`
+}
+
+// ReferralCommissionSummary 邀请人的返佣汇总
+type ReferralCommissionSummary struct {
+	Count    int64 `json:"count"`
+	Invitees int64 `json:"invitees"`
+	Quota    int64 `json:"quota"`
+}
+
+// creditReferralCommissionTx 在充值入账的事务中为付款用户的各级邀请人发放返佣，quota 为订单充值额度（不含优惠码赠送）。
+// 组织充值同样按付款成员（topUp.UserId）的邀请链发放
+func creditReferralCommissionTx(tx *gorm.DB, topUp *TopUp, quota int) error {
+	setting := operation_setting.GetReferralSetting()
+	if !setting.CommissionEnabled || len(setting.CommissionRates) == 0 || quota <= 0 {
+		return nil
+	}
+	if setting.MinTopupMoney > 0 && topUp.Money < setting.MinTopupMoney {
+		return nil
+	}
+	inviteeId := topUp.UserId
+	now := common.GetTimestamp()
+	if setting.CommissionDays > 0 {
+		var firstTopupTime int64
+		err := tx.Model(&TopUp{}).Where("user_id = ? AND status = ?", inviteeId, common.TopUpStatusSuccess).
+			Select("COALESCE(MIN(complete_time), 0)").Scan(&firstTopupTime).Error
+		if err != nil {
+			return err
+		}
+		if firstTopupTime != 0 && now > firstTopupTime+int64(setting.CommissionDays)*86400 {
+			return nil
+		}
+	}
+
+	visited := map[int]bool{inviteeId: true}
+	current := inviteeId
+	for i, rate := range setting.CommissionRates {
+		var inviterId int
+		if err := tx.Model(&User{}).Where("id = ?", current).Select("inviter_id").Scan(&inviterId).Error; err != nil {
+			return err
+		}
+		// 邀请链断开或出现环时停止
+		if inviterId == 0 || visited[inviterId] {
+			return nil
+		}
+		visited[inviterId] = true
+		current = inviterId
+		if rate <= 0 || operation_setting.IsReferralBlocked(inviterId) {
+			continue
+		}
+		amount := int(decimal.NewFromInt(int64(quota)).Mul(decimal.NewFromFloat(rate)).Div(decimal.NewFromInt(100)).IntPart())
+		amount, err := capReferralCommission(tx, setting, inviterId, inviteeId, amount)
+		if err != nil {
+			return err
+		}
+		if amount <= 0 {
+			continue
+		}
+		commission := &ReferralCommission{
+			InviterId:   inviterId,
+			InviteeId:   inviteeId,
+			Level:       i + 1,
+			TradeNo:     topUp.TradeNo,
+			TopupQuota:  quota,
+			Rate:        rate,
+			Quota:       amount,
+			Status:      ReferralCommissionStatusCredited,
+			CreatedTime: now,
+		}
+		if err := tx.Create(commission).Error; err != nil {
+			return err
+		}
+		err = tx.Model(&User{}).Where("id = ?", inviterId).Updates(map[string]interface{}{
+			"aff_quota":   gorm.Expr("aff_quota + ?", amount),
+			"aff_history": gorm.Expr("aff_history + ?", amount),
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// capReferralCommission 按单个被邀请人上限与每日上限裁剪返佣额度
+func capReferralCommission(tx *gorm.DB, setting *operation_setting.ReferralSetting, inviterId int, inviteeId int, amount int) (int, error) {
+	if setting.MaxQuotaPerInvitee > 0 {
+		var credited int64
+		err := tx.Model(&ReferralCommission{}).
+			Where("inviter_id = ? AND invitee_id = ? AND status = ?", inviterId, inviteeId, ReferralCommissionStatusCredited).
+			Select("COALESCE(SUM(quota), 0)").Scan(&credited).Error
+		if err != nil {
+			return 0, err
+		}
+		amount = min(amount, setting.MaxQuotaPerInvitee-int(credited))
+	}
+	if setting.MaxDailyQuota > 0 {
+		now := time.Now()
+		dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local).Unix()
+		var credited int64
+		err := tx.Model(&ReferralCommission{}).
+			Where("inviter_id = ? AND created_time >= ? AND status = ?", inviterId, dayStart, ReferralCommissionStatusCredited).
+			Select("COALESCE(SUM(quota), 0)").Scan(&credited).Error
+		if err != nil {
+			return 0, err
+		}
+		amount = min(amount, setting.MaxDailyQuota-int(credited))
+	}
+	return amount, nil
+}
+
+// GetReferralCommissions 查询返佣记录，inviterId 或 inviteeId 为 0 时不按该条件过滤
+func GetReferralCommissions(inviterId int, inviteeId int, pageInfo *common.PageInfo) (commissions []*ReferralCommission, total int64, err error) {
+	tx := DB.Model(&ReferralCommission{})
+	if inviterId != 0 {
+		tx = tx.Where("inviter_id = ?", inviterId)
+	}
+	if inviteeId != 0 {
+		tx = tx.Where("invitee_id = ?", inviteeId)
+	}
+	if err = tx.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err = tx.Order("id desc").Limit(pageInfo.GetPageSize()).Offset(pageInfo.GetStartIdx()).Find(&commissions).Error
+	return commissions, total, err
+}
+
+func GetReferralCommissionSummary(inviterId int) (*ReferralCommissionSummary, error) {
+	summary := &ReferralCommissionSummary{}
+	err := DB.Model(&ReferralCommission{}).
+		Where("inviter_id = ? AND status = ?", inviterId, ReferralCommissionStatusCredited).
+		Select("count(*) AS count, count(DISTINCT invitee_id) AS invitees, COALESCE(SUM(quota), 0) AS quota").
+		Scan(summary).Error
+	return summary, err
+}
+
+// RevokeReferralCommission 撤销一笔返佣并从邀请人的邀请额度中扣回，邀请额度不足时只扣回剩余部分
+func RevokeReferralCommission(id int) (*ReferralCommission, error) {
+	commission := &ReferralCommission{}
+	if err := DB.First(commission, "id = ?", id).Error; err != nil {
+		return nil, errors.New("返佣记录不存在")
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		return revokeReferralCommissionTx(tx, commission)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return commission, nil
+}
+
+// revokeTopUpReferralCommissionsTx 撤销充值订单产生的全部返佣，用于订单退款
+func revokeTopUpReferralCommissionsTx(tx *gorm.DB, tradeNo string) error {
+	var commissions []*ReferralCommission
+	err := tx.Where("trade_no = ? AND status = ?", tradeNo, ReferralCommissionStatusCredited).Find(&commissions).Error
+	if err != nil {
+		return err
+	}
+	for _, commission := range commissions {
+		if err := revokeReferralCommissionTx(tx, commission); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revokeReferralCommissionTx 将返佣置为已撤销并扣回邀请额度。状态按条件更新，重复撤销返回错误；
+// 邀请额度按相对值扣减，不会覆盖并发发放的返佣
+func revokeReferralCommissionTx(tx *gorm.DB, commission *ReferralCommission) error {
+	result := tx.Model(&ReferralCommission{}).Where("id = ? AND status = ?", commission.Id, ReferralCommissionStatusCredited).
+		Update("status", ReferralCommissionStatusRevoked)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("返佣记录已撤销")
+	}
+	user := &User{}
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id, aff_quota").
+		First(user, "id = ?", commission.InviterId).Error; err != nil {
+		return err
+	}
+	revoked := min(commission.Quota, max(user.AffQuota, 0))
+	result = tx.Model(&User{}).Where("id = ? AND aff_quota >= ?", user.Id, revoked).Updates(map[string]interface{}{
+		"aff_quota":   gorm.Expr("aff_quota - ?", revoked),
+		"aff_history": gorm.Expr("CASE WHEN aff_history > ? THEN aff_history - ? ELSE 0 END", commission.Quota, commission.Quota),
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("邀请额度已变动，请重试")
+	}
+	commission.Status = ReferralCommissionStatusRevoked
+	commission.RevokedQuota = revoked
+	return tx.Model(&ReferralCommission{}).Where("id = ?", commission.Id).Update("revoked_quota", revoked).Error
+}
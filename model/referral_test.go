@@ -0,0 +1,76 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+
+	"github.com/stretchr/testify/require"
+)
+
+func getTestAffQuota(t *testing.T, userId int) (affQuota int, affHistory int) {
+	t.Helper()
+	user := &User{}
+	require.NoError(t, DB.Select("aff_quota", "aff_history").First(user, "id = ?", userId).Error)
+	return user.AffQuota, user.AffHistoryQuota
+}
+
+func TestRevokeReferralCommission_RelativeAndOnce(t *testing.T) {
+	setupTestDB(t)
+	inviter := createTestUser(t, 0)
+	// 返佣 100 中已有 70 被划转，另有其他返佣 20
+	require.NoError(t, DB.Model(&User{}).Where("id = ?", inviter.Id).
+		Updates(map[string]interface{}{"aff_quota": 50, "aff_history": 120}).Error)
+	commission := &ReferralCommission{InviterId: inviter.Id, TradeNo: "t1", Quota: 100, Status: ReferralCommissionStatusCredited}
+	require.NoError(t, DB.Create(commission).Error)
+
+	revoked, err := RevokeReferralCommission(commission.Id)
+	require.NoError(t, err)
+	require.Equal(t, 50, revoked.RevokedQuota)
+	affQuota, affHistory := getTestAffQuota(t, inviter.Id)
+	require.Equal(t, 0, affQuota)
+	require.Equal(t, 20, affHistory)
+
+	_, err = RevokeReferralCommission(commission.Id)
+	require.Error(t, err)
+	affQuota, _ = getTestAffQuota(t, inviter.Id)
+	require.Equal(t, 0, affQuota)
+}
+
+func TestCompleteTopUp_OrgTopUpPaysPayerInviter(t *testing.T) {
+	setupTestDB(t)
+	setting := operation_setting.GetReferralSetting()
+	oldSetting := *setting
+	t.Cleanup(func() { *setting = oldSetting })
+	setting.CommissionEnabled = true
+	setting.CommissionRates = []float64{10}
+
+	inviter := createTestUser(t, 0)
+	member := createTestUser(t, 0)
+	require.NoError(t, DB.Model(&User{}).Where("id = ?", member.Id).Update("inviter_id", inviter.Id).Error)
+	org := &Organization{Name: "org", OwnerId: member.Id, Status: common.UserStatusEnabled}
+	require.NoError(t, DB.Create(org).Error)
+	topUp := &TopUp{UserId: member.Id, OrgId: org.Id, Amount: 1, Money: 1, TradeNo: "org-trade",
+		PaymentMethod: PaymentProviderAlipay, Provider: PaymentProviderAlipay, Status: common.TopUpStatusPending}
+	require.NoError(t, topUp.Insert())
+
+	_, err := CompleteTopUp(topUp.TradeNo, "")
+	require.NoError(t, err)
+	affQuota, _ := getTestAffQuota(t, inviter.Id)
+	require.Equal(t, int(common.QuotaPerUnit)/10, affQuota)
+}
+
+func TestTransferAffQuotaToQuota(t *testing.T) {
+	setupTestDB(t)
+	quota := int(common.QuotaPerUnit)
+	user := createTestUser(t, 0)
+	require.NoError(t, DB.Model(&User{}).Where("id = ?", user.Id).Update("aff_quota", quota).Error)
+
+	require.Error(t, user.TransferAffQuotaToQuota(quota+1))
+	require.NoError(t, user.TransferAffQuotaToQuota(quota))
+	affQuota, _ := getTestAffQuota(t, user.Id)
+	require.Equal(t, 0, affQuota)
+	require.Equal(t, quota, getTestUserQuota(t, user.Id))
+	requireLedgerBalanced(t, userLedgerAccount(user.Id))
+}
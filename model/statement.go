@@ -0,0 +1,280 @@
+package model
+
+import (
+	"errors"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"gorm.io/gorm"
+)
+
+const StatementPeriodLayout = "2006-01"
+
+// Statement 用户或组织的月度账单，OwnerType 与账本科目类型一致（user / org），
+// 同一主体同一月份只保留一份，重新生成时覆盖。明细以 JSON 存储在 Data 中。
+// AmountOwed 为后付费主体期末透支的额度，即月末应结算的欠款。
+type Statement struct {
+	Id           int     `json:"id"`
+	OwnerType    string  `json:"owner_type" gorm:"type:varchar(16);uniqueIndex:idx_statement_owner_period,priority:1"`
+	OwnerId      int     `json:"owner_id" gorm:"uniqueIndex:idx_statement_owner_period,priority:2"`
+	Period       string  `json:"period" gorm:"type:varchar(7);uniqueIndex:idx_statement_owner_period,priority:3"`
+	StartTime    int64   `json:"start_time" gorm:"bigint"`
+	EndTime      int64   `json:"end_time" gorm:"bigint"`
+	RequestCount int64   `json:"request_count" gorm:"bigint;default:0"`
+	UsageQuota   int64   `json:"usage_quota" gorm:"bigint;default:0"`
+	TopupQuota   int64   `json:"topup_quota" gorm:"bigint;default:0"`
+	TopupMoney   float64 `json:"topup_money" gorm:"default:0"`
+	AmountOwed   int64   `json:"amount_owed" gorm:"bigint;default:0"`
+	Data         string  `json:"-" gorm:"type:text"`
+	CreatedTime  int64   `json:"created_time" gorm:"bigint"`
+}
+
+// StatementLine 按模型与令牌汇总的用量
+type StatementLine struct {
+	ModelName        string `json:"model_name"`
+	TokenName        string `json:"token_name"`
+	RequestCount     int64  `json:"request_count"`
+	PromptTokens     int64  `json:"prompt_tokens"`
+	CompletionTokens int64  `json:"completion_tokens"`
+	Quota            int64  `json:"quota"`
+}
+
+// StatementTopup 账单期间完成的充值订单，Quota 取自账本入账金额
+type StatementTopup struct {
+	TradeNo       string  `json:"trade_no"`
+	PaymentMethod string  `json:"payment_method"`
+	Money         float64 `json:"money"`
+	Quota         int64   `json:"quota"`
+	CompleteTime  int64   `json:"complete_time"`
+}
+
+type StatementData struct {
+	OwnerName string `json:"owner_name"`
+	// 生成账单时主体的信用额度，大于 0 表示后付费
+	CreditLimit int                     `json:"credit_limit"`
+	Lines       []*StatementLine        `json:"lines"`
+	Topups      []*StatementTopup       `json:"topups"`
+	Summary     *LedgerStatementSummary `json:"summary"`
+}
+
+func (s *Statement) GetData() (*StatementData, error) {
+	data := &StatementData{}
+	if s.Data == "" {
+		return data, nil
+	}
+	err := common.UnmarshalJsonStr(s.Data, data)
+	return data, err
+}
+
+// IsFinal 账单是否在账单月份结束后生成，月中生成的账单只包含部分数据
+func (s *Statement) IsFinal() bool {
+	return s.CreatedTime > s.EndTime
+}
+
+// StatementPeriodRange 返回账单月份在服务器时区下的起止时间戳（含）
+func StatementPeriodRange(period string) (start int64, end int64, err error) {
+	t, err := time.ParseInLocation(StatementPeriodLayout, period, time.Local)
+	if err != nil {
+		return 0, 0, errors.New("账单月份格式应为 YYYY-MM")
+	}
+	return t.Unix(), t.AddDate(0, 1, 0).Unix() - 1, nil
+}
+
+// IsStatementPeriodClosed 账单月份是否已经结束
+func IsStatementPeriodClosed(period string) (bool, error) {
+	_, end, err := StatementPeriodRange(period)
+	if err != nil {
+		return false, err
+	}
+	return end < common.GetTimestamp(), nil
+}
+
+// statementLogScope 账单主体的消费日志范围：组织为组织令牌产生的消费，用户为个人令牌产生的消费
+func statementLogScope(ownerType string, ownerId int) (*gorm.DB, error) {
+	tx := LOG_DB.Table("logs").Where("type = ?", LogTypeConsume)
+	if ownerType == LedgerAccountOrg {
+		tokenIds, err := GetOrgTokenIds(ownerId)
+		if err != nil {
+			return nil, err
+		}
+		if len(tokenIds) == 0 {
+			return nil, nil
+		}
+		return tx.Where("token_id IN ?", tokenIds), nil
+	}
+	var orgTokenIds []int
+	if err := DB.Unscoped().Model(&Token{}).Where("user_id = ? AND org_id <> 0", ownerId).Pluck("id", &orgTokenIds).Error; err != nil {
+		return nil, err
+	}
+	tx = tx.Where("user_id = ?", ownerId)
+	if len(orgTokenIds) > 0 {
+		tx = tx.Where("token_id NOT IN ?", orgTokenIds)
+	}
+	return tx, nil
+}
+
+// getStatementOwner 返回账单主体的名称与信用额度
+func getStatementOwner(ownerType string, ownerId int) (string, int, error) {
+	if ownerType == LedgerAccountOrg {
+		org, err := GetOrganizationById(ownerId)
+		if err != nil {
+			return "", 0, err
+		}
+		return org.Name, org.CreditLimit, nil
+	}
+	user, err := GetUserById(ownerId, false)
+	if err != nil {
+		return "", 0, err
+	}
+	return user.Username, user.CreditLimit, nil
+}
+
+// GenerateStatement 汇总主体在账单月份的消费日志、充值订单与账本变动，生成或覆盖该月账单。
+// 未结束的月份生成的账单不是最终账单，月末自动生成时会重新生成
+func GenerateStatement(ownerType string, ownerId int, period string) (*Statement, error) {
+	if ownerType != LedgerAccountUser && ownerType != LedgerAccountOrg {
+		return nil, errors.New("无效的账单主体类型")
+	}
+	start, end, err := StatementPeriodRange(period)
+	if err != nil {
+		return nil, err
+	}
+	if start > common.GetTimestamp() {
+		return nil, errors.New("不能生成未来月份的账单")
+	}
+	data := &StatementData{Lines: []*StatementLine{}, Topups: []*StatementTopup{}}
+	if data.OwnerName, data.CreditLimit, err = getStatementOwner(ownerType, ownerId); err != nil {
+		return nil, err
+	}
+
+	statement := &Statement{OwnerType: ownerType, OwnerId: ownerId, Period: period, StartTime: start, EndTime: end}
+	scope, err := statementLogScope(ownerType, ownerId)
+	if err != nil {
+		return nil, err
+	}
+	if scope != nil {
+		err = scope.Where("created_at >= ? AND created_at <= ?", start, end).
+			Select("model_name, token_name, count(*) AS request_count, sum(prompt_tokens) AS prompt_tokens, " +
+				"sum(completion_tokens) AS completion_tokens, sum(quota) AS quota").
+			Group("model_name, token_name").Order("quota desc").Scan(&data.Lines).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, line := range data.Lines {
+		statement.RequestCount += line.RequestCount
+		statement.UsageQuota += line.Quota
+	}
+
+	var topups []*TopUp
+	topupQuery := DB.Where("status = ? AND complete_time >= ? AND complete_time <= ?", common.TopUpStatusSuccess, start, end)
+	if ownerType == LedgerAccountOrg {
+		topupQuery = topupQuery.Where("org_id = ?", ownerId)
+	} else {
+		topupQuery = topupQuery.Where("user_id = ? AND org_id = 0", ownerId)
+	}
+	if err = topupQuery.Order("complete_time asc").Find(&topups).Error; err != nil {
+		return nil, err
+	}
+	if len(topups) > 0 {
+		tradeNos := make([]string, 0, len(topups))
+		for _, topup := range topups {
+			tradeNos = append(tradeNos, topup.TradeNo)
+		}
+		var credited []struct {
+			Reference string
+			Quota     int64
+		}
+		err = DB.Model(&QuotaLedger{}).Select("reference, sum(delta) AS quota").
+			Where("account_type = ? AND account_id = ? AND source_type = ? AND reference IN ?", ownerType, ownerId, LedgerSourceTopup, tradeNos).
+			Group("reference").Scan(&credited).Error
+		if err != nil {
+			return nil, err
+		}
+		creditedMap := make(map[string]int64, len(credited))
+		for _, c := range credited {
+			creditedMap[c.Reference] = c.Quota
+		}
+		for _, topup := range topups {
+			item := &StatementTopup{
+				TradeNo:       topup.TradeNo,
+				PaymentMethod: topup.PaymentMethod,
+				Money:         topup.Money,
+				Quota:         creditedMap[topup.TradeNo],
+				CompleteTime:  topup.CompleteTime,
+			}
+			data.Topups = append(data.Topups, item)
+			statement.TopupQuota += item.Quota
+			statement.TopupMoney += item.Money
+		}
+	}
+
+	if data.Summary, err = GetLedgerStatementSummary(ownerType, ownerId, start, end); err != nil {
+		return nil, err
+	}
+	if data.Summary.ClosingBalance < 0 {
+		statement.AmountOwed = int64(-data.Summary.ClosingBalance)
+	}
+	dataBytes, err := common.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	statement.Data = string(dataBytes)
+	statement.CreatedTime = common.GetTimestamp()
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		existing := &Statement{}
+		err := tx.Where("owner_type = ? AND owner_id = ? AND period = ?", ownerType, ownerId, period).Limit(1).Find(existing).Error
+		if err != nil {
+			return err
+		}
+		if existing.Id != 0 {
+			statement.Id = existing.Id
+			return tx.Save(statement).Error
+		}
+		return tx.Create(statement).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return statement, nil
+}
+
+func GetStatements(ownerType string, ownerId int, pageInfo *common.PageInfo) (statements []*Statement, total int64, err error) {
+	tx := DB.Model(&Statement{}).Where("owner_type = ? AND owner_id = ?", ownerType, ownerId)
+	if err = tx.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err = tx.Order("period desc").Limit(pageInfo.GetPageSize()).Offset(pageInfo.GetStartIdx()).Find(&statements).Error
+	return statements, total, err
+}
+
+func GetStatementById(id int) (*Statement, error) {
+	statement := &Statement{}
+	err := DB.First(statement, "id = ?", id).Error
+	return statement, err
+}
+
+func GetStatementByPeriod(ownerType string, ownerId int, period string) (*Statement, error) {
+	statement := &Statement{}
+	err := DB.Where("owner_type = ? AND owner_id = ? AND period = ?", ownerType, ownerId, period).First(statement).Error
+	return statement, err
+}
+
+// GetStatementCandidates 返回期间内有消费日志的用户 id 与有组织令牌消费的组织 id，用于自动生成账单
+func GetStatementCandidates(start int64, end int64) (userIds []int, orgIds []int, err error) {
+	err = LOG_DB.Table("logs").Where("type = ? AND created_at >= ? AND created_at <= ?", LogTypeConsume, start, end).
+		Distinct("user_id").Pluck("user_id", &userIds).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	var tokenIds []int
+	err = LOG_DB.Table("logs").Where("type = ? AND created_at >= ? AND created_at <= ?", LogTypeConsume, start, end).
+		Distinct("token_id").Pluck("token_id", &tokenIds).Error
+	if err != nil || len(tokenIds) == 0 {
+		return userIds, nil, err
+	}
+	err = DB.Unscoped().Model(&Token{}).Where("id IN ? AND org_id <> 0", tokenIds).Distinct("org_id").Pluck("org_id", &orgIds).Error
+	return userIds, orgIds, err
+}
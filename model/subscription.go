@@ -0,0 +1,615 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/logger"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	SubscriptionOverageBlock   = "block"   // 订阅额度用尽后拒绝请求
+	SubscriptionOverageBalance = "balance" // 订阅额度用尽后从用户余额扣费
+)
+
+const (
+	SubscriptionStatusPending = "pending"
+	SubscriptionStatusActive  = "active"
+	SubscriptionStatusExpired = "expired"
+)
+
+const (
+	SubscriptionProviderBalance = "balance"
+	SubscriptionProviderStripe  = "stripe"
+	SubscriptionProviderCreem   = "creem"
+	SubscriptionProviderAdmin   = "admin"
+)
+
+// SubscriptionPlan 订阅套餐，每个计费周期发放 IncludedQuota，周期结束未用完的额度作废
+type SubscriptionPlan struct {
+	Id             int     `json:"id"`
+	Name           string  `json:"name" gorm:"type:varchar(64)"`
+	Description    string  `json:"description" gorm:"type:text"`
+	Price          float64 `json:"price"`
+	Currency       string  `json:"currency" gorm:"type:varchar(8);default:'USD'"`
+	PeriodDays     int     `json:"period_days" gorm:"type:int;default:30"`
+	IncludedQuota  int     `json:"included_quota" gorm:"type:int;default:0"`
+	Group          string  `json:"group" gorm:"type:varchar(64);default:''"` // 订阅期间用户所在分组，为空则不变更
+	Overage        string  `json:"overage" gorm:"type:varchar(16);default:'balance'"`
+	StripePriceId  string  `json:"stripe_price_id" gorm:"type:varchar(128)"`
+	CreemProductId string  `json:"creem_product_id" gorm:"type:varchar(128)"`
+	Enabled        bool    `json:"enabled" gorm:"default:true"`
+	CreatedTime    int64   `json:"created_time" gorm:"bigint"`
+}
+
+// UserSubscription 用户订阅记录，RemainQuota 为本周期剩余的订阅额度
+type UserSubscription struct {
+	Id                     int               `json:"id"`
+	UserId                 int               `json:"user_id" gorm:"index"`
+	PlanId                 int               `json:"plan_id" gorm:"index"`
+	Status                 string            `json:"status" gorm:"type:varchar(16);index"`
+	Provider               string            `json:"provider" gorm:"type:varchar(16)"`
+	TradeNo                string            `json:"trade_no" gorm:"type:varchar(255);index"`
+	ProviderSubscriptionId string            `json:"provider_subscription_id" gorm:"type:varchar(128);index"`
+	AutoRenew              bool              `json:"auto_renew"`
+	PeriodStart            int64             `json:"period_start" gorm:"bigint"`
+	PeriodEnd              int64             `json:"period_end" gorm:"bigint;index"`
+	RemainQuota            int               `json:"remain_quota" gorm:"type:int;default:0"`
+	UsedQuota              int               `json:"used_quota" gorm:"type:int;default:0"`
+	PreviousGroup          string            `json:"-" gorm:"type:varchar(64)"`
+	RenewNotified          bool              `json:"-"` // 本周期是否已发送到期提醒
+	CreatedTime            int64             `json:"created_time" gorm:"bigint"`
+	Plan                   *SubscriptionPlan `json:"plan,omitempty" gorm:"-"`
+}
+
+func (plan *SubscriptionPlan) Validate() error {
+	if plan.Name == "" {
+		return errors.New("套餐名称不能为空")
+	}
+	if plan.PeriodDays <= 0 {
+		return errors.New("计费周期必须大于 0 天")
+	}
+	if plan.IncludedQuota < 0 || plan.Price < 0 {
+		return errors.New("套餐价格与额度不能为负数")
+	}
+	if plan.Overage == "" {
+		plan.Overage = SubscriptionOverageBalance
+	}
+	if plan.Overage != SubscriptionOverageBlock && plan.Overage != SubscriptionOverageBalance {
+		return errors.New("无效的超额处理方式")
+	}
+	return nil
+}
+
+// BalanceCost 使用账户余额购买或续订该套餐需要消耗的额度
+func (plan *SubscriptionPlan) BalanceCost() int {
+	return int(plan.Price * common.QuotaPerUnit)
+}
+
+func (plan *SubscriptionPlan) AllowOverage() bool {
+	return plan.Overage != SubscriptionOverageBlock
+}
+
+func (plan *SubscriptionPlan) Insert() error {
+	if err := plan.Validate(); err != nil {
+		return err
+	}
+	plan.CreatedTime = common.GetTimestamp()
+	return DB.Create(plan).Error
+}
+
+func (plan *SubscriptionPlan) Update() error {
+	if err := plan.Validate(); err != nil {
+		return err
+	}
+	return DB.Model(plan).Select("name", "description", "price", "currency", "period_days", "included_quota",
+		"group", "overage", "stripe_price_id", "creem_product_id", "enabled").Updates(plan).Error
+}
+
+func DeleteSubscriptionPlanById(id int) error {
+	var count int64
+	err := DB.Model(&UserSubscription{}).Where("plan_id = ? AND status = ?", id, SubscriptionStatusActive).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errors.New("该套餐存在生效中的订阅，请先停用套餐")
+	}
+	return DB.Delete(&SubscriptionPlan{}, "id = ?", id).Error
+}
+
+func GetSubscriptionPlanById(id int) (*SubscriptionPlan, error) {
+	if id == 0 {
+		return nil, errors.New("id 为空！")
+	}
+	plan := &SubscriptionPlan{}
+	err := DB.First(plan, "id = ?", id).Error
+	return plan, err
+}
+
+func GetSubscriptionPlans(enabledOnly bool) (plans []*SubscriptionPlan, err error) {
+	tx := DB.Order("price asc, id asc")
+	if enabledOnly {
+		tx = tx.Where("enabled = ?", true)
+	}
+	err = tx.Find(&plans).Error
+	return plans, err
+}
+
+func (sub *UserSubscription) fillPlan() {
+	if plan, err := GetSubscriptionPlanById(sub.PlanId); err == nil {
+		sub.Plan = plan
+	}
+}
+
+// GetActiveUserSubscription 返回用户当前生效的订阅，没有则返回 nil
+func GetActiveUserSubscription(userId int) (*UserSubscription, error) {
+	sub := &UserSubscription{}
+	err := DB.Where("user_id = ? AND status = ? AND period_end > ?", userId, SubscriptionStatusActive, common.GetTimestamp()).
+		Order("id desc").First(sub).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sub.fillPlan()
+	if sub.Plan == nil {
+		return nil, nil
+	}
+	return sub, nil
+}
+
+func GetUserSubscriptions(userId int) (subs []*UserSubscription, err error) {
+	err = DB.Where("user_id = ? AND status <> ?", userId, SubscriptionStatusPending).Order("id desc").Find(&subs).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range subs {
+		sub.fillPlan()
+	}
+	return subs, nil
+}
+
+func GetAllUserSubscriptions(status string, pageInfo *common.PageInfo) (subs []*UserSubscription, total int64, err error) {
+	tx := DB.Model(&UserSubscription{})
+	if status != "" {
+		tx = tx.Where("status = ?", status)
+	}
+	if err = tx.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err = tx.Order("id desc").Limit(pageInfo.GetPageSize()).Offset(pageInfo.GetStartIdx()).Find(&subs).Error
+	return subs, total, err
+}
+
+func GetUserSubscriptionById(id int) (*UserSubscription, error) {
+	sub := &UserSubscription{}
+	err := DB.First(sub, "id = ?", id).Error
+	return sub, err
+}
+
+// CreatePendingSubscription 为第三方支付创建待支付的订阅订单，支付回调后通过 tradeNo 激活
+func CreatePendingSubscription(userId int, plan *SubscriptionPlan, provider string, tradeNo string) error {
+	return DB.Create(&UserSubscription{
+		UserId:      userId,
+		PlanId:      plan.Id,
+		Status:      SubscriptionStatusPending,
+		Provider:    provider,
+		TradeNo:     tradeNo,
+		AutoRenew:   true,
+		CreatedTime: common.GetTimestamp(),
+	}).Error
+}
+
+// activateSubscriptionTx 开启新的订阅周期：替换用户已有的订阅、切换分组并发放订阅额度
+func activateSubscriptionTx(tx *gorm.DB, sub *UserSubscription, plan *SubscriptionPlan) error {
+	now := common.GetTimestamp()
+	user := &User{}
+	if err := tx.First(user, "id = ?", sub.UserId).Error; err != nil {
+		return err
+	}
+	previousGroup := user.Group
+	var actives []*UserSubscription
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("user_id = ? AND status = ? AND id <> ?", sub.UserId, SubscriptionStatusActive, sub.Id).Find(&actives).Error; err != nil {
+		return err
+	}
+	for _, old := range actives {
+		if old.PreviousGroup != "" {
+			previousGroup = old.PreviousGroup
+		}
+		if _, err := expireSubscriptionQuotaTx(tx, old.Id); err != nil {
+			return err
+		}
+	}
+	sub.PreviousGroup = ""
+	if plan.Group != "" {
+		sub.PreviousGroup = previousGroup
+		if err := tx.Model(&User{}).Where("id = ?", sub.UserId).Update("group", plan.Group).Error; err != nil {
+			return err
+		}
+	} else if previousGroup != user.Group {
+		// 旧订阅变更过分组，新套餐不指定分组时恢复原分组
+		if err := tx.Model(&User{}).Where("id = ?", sub.UserId).Update("group", previousGroup).Error; err != nil {
+			return err
+		}
+	}
+	sub.Status = SubscriptionStatusActive
+	sub.PeriodStart = now
+	sub.PeriodEnd = now + int64(plan.PeriodDays)*86400
+	return startSubscriptionPeriodTx(tx, sub, plan)
+}
+
+// startSubscriptionPeriodTx 重置本周期订阅额度并记账，上一周期未用完的额度作废
+func startSubscriptionPeriodTx(tx *gorm.DB, sub *UserSubscription, plan *SubscriptionPlan) error {
+	var remains []int
+	if sub.Id != 0 {
+		if err := tx.Model(&UserSubscription{}).Where("id = ?", sub.Id).Pluck("remain_quota", &remains).Error; err != nil {
+			return err
+		}
+	}
+	sub.RemainQuota = plan.IncludedQuota
+	sub.UsedQuota = 0
+	sub.RenewNotified = false
+	if err := tx.Save(sub).Error; err != nil {
+		return err
+	}
+	reference := fmt.Sprintf("%d", plan.Id)
+	if len(remains) > 0 && remains[0] != 0 {
+		if err := recordLedgerTransfer(tx, subscriptionLedgerAccount(sub.Id), systemLedgerAccount, remains[0], LedgerSourceExpire, reference); err != nil {
+			return err
+		}
+	}
+	return recordLedgerTransfer(tx, systemLedgerAccount, subscriptionLedgerAccount(sub.Id), plan.IncludedQuota, LedgerSourceSubscription, reference)
+}
+
+// renewSubscriptionTx 续订：从当前周期结束时间开始新的周期并重置订阅额度
+func renewSubscriptionTx(tx *gorm.DB, sub *UserSubscription, plan *SubscriptionPlan) error {
+	if sub.Status != SubscriptionStatusActive {
+		return activateSubscriptionTx(tx, sub, plan)
+	}
+	start := common.GetTimestamp()
+	if sub.PeriodEnd > start {
+		start = sub.PeriodEnd
+	}
+	sub.PeriodStart = start
+	sub.PeriodEnd = start + int64(plan.PeriodDays)*86400
+	return startSubscriptionPeriodTx(tx, sub, plan)
+}
+
+// syncSubscriptionGroupCache 订阅变更后刷新用户分组缓存并清除订阅缓存
+func syncSubscriptionGroupCache(userId int) {
+	invalidateSubscriptionCache(userId)
+	group, err := GetUserGroup(userId, true)
+	if err != nil {
+		return
+	}
+	if err := updateUserGroupCache(userId, group); err != nil {
+		common.SysLog("failed to update user group cache: " + err.Error())
+	}
+}
+
+// ActivateSubscriptionByTradeNo 第三方支付成功后激活待支付的订阅
+func ActivateSubscriptionByTradeNo(tradeNo string, providerSubscriptionId string) (*UserSubscription, error) {
+	if tradeNo == "" {
+		return nil, errors.New("未提供支付单号")
+	}
+	sub := &UserSubscription{}
+	var plan *SubscriptionPlan
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("trade_no = ?", tradeNo).First(sub).Error; err != nil {
+			return errors.New("订阅订单不存在")
+		}
+		if sub.Status != SubscriptionStatusPending {
+			return errors.New("订阅订单状态错误")
+		}
+		var err error
+		plan, err = GetSubscriptionPlanById(sub.PlanId)
+		if err != nil {
+			return errors.New("订阅套餐不存在")
+		}
+		sub.ProviderSubscriptionId = providerSubscriptionId
+		return activateSubscriptionTx(tx, sub, plan)
+	})
+	if err != nil {
+		return nil, errors.New("订阅失败，" + err.Error())
+	}
+	syncSubscriptionGroupCache(sub.UserId)
+	RecordLog(sub.UserId, LogTypeTopup, fmt.Sprintf("订阅套餐 %s 成功，本周期额度: %s", plan.Name, logger.LogQuota(plan.IncludedQuota)))
+	sub.Plan = plan
+	return sub, nil
+}
+
+// RenewSubscriptionByProviderId 第三方支付续费成功后开启新的订阅周期，重复回调时返回 nil
+func RenewSubscriptionByProviderId(provider string, providerSubscriptionId string) (*UserSubscription, error) {
+	if providerSubscriptionId == "" {
+		return nil, errors.New("未提供订阅 id")
+	}
+	sub := &UserSubscription{}
+	var plan *SubscriptionPlan
+	renewed := false
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("provider = ? AND provider_subscription_id = ? AND status <> ?", provider, providerSubscriptionId, SubscriptionStatusPending).
+			Order("id desc").First(sub).Error
+		if err != nil {
+			return errors.New("订阅不存在")
+		}
+		plan, err = GetSubscriptionPlanById(sub.PlanId)
+		if err != nil {
+			return errors.New("订阅套餐不存在")
+		}
+		// 首期支付与重复回调：当前周期剩余时间超过一半说明本周期已发放，直接忽略
+		if sub.Status == SubscriptionStatusActive && sub.PeriodEnd-common.GetTimestamp() > int64(plan.PeriodDays)*86400/2 {
+			return nil
+		}
+		renewed = true
+		return renewSubscriptionTx(tx, sub, plan)
+	})
+	if err != nil {
+		return nil, errors.New("续订失败，" + err.Error())
+	}
+	if !renewed {
+		return nil, nil
+	}
+	syncSubscriptionGroupCache(sub.UserId)
+	RecordLog(sub.UserId, LogTypeTopup, fmt.Sprintf("套餐 %s 续订成功，本周期额度: %s", plan.Name, logger.LogQuota(plan.IncludedQuota)))
+	sub.Plan = plan
+	return sub, nil
+}
+
+// CancelSubscriptionByProviderId 第三方订阅被取消，当前周期结束后不再续订
+func CancelSubscriptionByProviderId(provider string, providerSubscriptionId string) error {
+	if providerSubscriptionId == "" {
+		return errors.New("未提供订阅 id")
+	}
+	return DB.Model(&UserSubscription{}).
+		Where("provider = ? AND provider_subscription_id = ?", provider, providerSubscriptionId).
+		Update("auto_renew", false).Error
+}
+
+func (sub *UserSubscription) SetAutoRenew(autoRenew bool) error {
+	sub.AutoRenew = autoRenew
+	return DB.Model(sub).Update("auto_renew", autoRenew).Error
+}
+
+// SubscribeWithBalance 使用账户余额购买套餐
+func SubscribeWithBalance(userId int, planId int) (*UserSubscription, error) {
+	plan, err := GetSubscriptionPlanById(planId)
+	if err != nil || !plan.Enabled {
+		return nil, errors.New("订阅套餐不存在")
+	}
+	cost := plan.BalanceCost()
+	sub := &UserSubscription{
+		UserId:      userId,
+		PlanId:      plan.Id,
+		Provider:    SubscriptionProviderBalance,
+		AutoRenew:   true,
+		CreatedTime: common.GetTimestamp(),
+	}
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := chargeSubscriptionTx(tx, userId, cost, plan.Id); err != nil {
+			return err
+		}
+		if err := tx.Create(sub).Error; err != nil {
+			return err
+		}
+		return activateSubscriptionTx(tx, sub, plan)
+	})
+	if err != nil {
+		return nil, err
+	}
+	afterSubscriptionCharge(userId, cost)
+	syncSubscriptionGroupCache(userId)
+	RecordLog(userId, LogTypeConsume, fmt.Sprintf("使用余额订阅套餐 %s，花费 %s，本周期额度: %s", plan.Name, logger.LogQuota(cost), logger.LogQuota(plan.IncludedQuota)))
+	sub.Plan = plan
+	return sub, nil
+}
+
+// GrantSubscription 管理员直接为用户开通一个周期的套餐，到期不自动续订
+func GrantSubscription(userId int, planId int) (*UserSubscription, error) {
+	plan, err := GetSubscriptionPlanById(planId)
+	if err != nil {
+		return nil, errors.New("订阅套餐不存在")
+	}
+	sub := &UserSubscription{
+		UserId:      userId,
+		PlanId:      plan.Id,
+		Provider:    SubscriptionProviderAdmin,
+		CreatedTime: common.GetTimestamp(),
+	}
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(sub).Error; err != nil {
+			return err
+		}
+		return activateSubscriptionTx(tx, sub, plan)
+	})
+	if err != nil {
+		return nil, err
+	}
+	syncSubscriptionGroupCache(userId)
+	RecordLog(userId, LogTypeManage, fmt.Sprintf("管理员为用户开通套餐 %s，本周期额度: %s", plan.Name, logger.LogQuota(plan.IncludedQuota)))
+	sub.Plan = plan
+	return sub, nil
+}
+
+func chargeSubscriptionTx(tx *gorm.DB, userId int, cost int, planId int) error {
+	if cost <= 0 {
+		return nil
+	}
+	result := tx.Model(&User{}).Where("id = ? AND quota >= ?", userId, cost).Update("quota", gorm.Expr("quota - ?", cost))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("余额不足，需要 %s", logger.LogQuota(cost))
+	}
+	if err := debitQuotaLotsTx(tx, userId, cost); err != nil {
+		return err
+	}
+	return recordUserLedger(tx, userId, -cost, LedgerSourceSubscription, fmt.Sprintf("%d", planId))
+}
+
+func afterSubscriptionCharge(userId int, cost int) {
+	if cost <= 0 || !common.RedisEnabled {
+		return
+	}
+	if err := cacheDecrUserQuota(userId, int64(cost)); err != nil {
+		common.SysLog("failed to decrease user quota cache: " + err.Error())
+	}
+}
+
+// RenewSubscriptionWithBalance 到期时使用账户余额自动续订
+func RenewSubscriptionWithBalance(sub *UserSubscription, plan *SubscriptionPlan) error {
+	cost := plan.BalanceCost()
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := chargeSubscriptionTx(tx, sub.UserId, cost, plan.Id); err != nil {
+			return err
+		}
+		return renewSubscriptionTx(tx, sub, plan)
+	})
+	if err != nil {
+		return err
+	}
+	afterSubscriptionCharge(sub.UserId, cost)
+	invalidateSubscriptionCache(sub.UserId)
+	RecordLog(sub.UserId, LogTypeConsume, fmt.Sprintf("使用余额续订套餐 %s，花费 %s，本周期额度: %s", plan.Name, logger.LogQuota(cost), logger.LogQuota(plan.IncludedQuota)))
+	return nil
+}
+
+// ExpireSubscription 订阅到期：标记为已过期并恢复订阅前的分组
+func ExpireSubscription(sub *UserSubscription) error {
+	plan, _ := GetSubscriptionPlanById(sub.PlanId)
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		expired, err := expireSubscriptionQuotaTx(tx, sub.Id)
+		if err != nil || !expired {
+			return err
+		}
+		if sub.PreviousGroup == "" || plan == nil || plan.Group == "" {
+			return nil
+		}
+		// 仅当用户仍处于套餐分组时恢复，避免覆盖管理员的手动调整
+		return tx.Model(&User{}).Where("id = ? AND "+commonGroupCol+" = ?", sub.UserId, plan.Group).
+			Update("group", sub.PreviousGroup).Error
+	})
+	if err != nil {
+		return err
+	}
+	sub.Status = SubscriptionStatusExpired
+	syncSubscriptionGroupCache(sub.UserId)
+	return nil
+}
+
+// expireSubscriptionQuotaTx 将生效中的订阅标记为过期，本周期剩余的订阅额度作废，订阅已不是生效状态时返回 false
+func expireSubscriptionQuotaTx(tx *gorm.DB, subId int) (bool, error) {
+	var subs []*UserSubscription
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "plan_id", "remain_quota").
+		Where("id = ? AND status = ?", subId, SubscriptionStatusActive).Limit(1).Find(&subs).Error
+	if err != nil || len(subs) == 0 {
+		return false, err
+	}
+	result := tx.Model(&UserSubscription{}).Where("id = ? AND status = ? AND remain_quota = ?", subId, SubscriptionStatusActive, subs[0].RemainQuota).
+		Updates(map[string]interface{}{"status": SubscriptionStatusExpired, "remain_quota": 0})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, errors.New("订阅额度已变动，请重试")
+	}
+	err = recordLedgerTransfer(tx, subscriptionLedgerAccount(subId), systemLedgerAccount, subs[0].RemainQuota, LedgerSourceExpire, fmt.Sprintf("%d", subs[0].PlanId))
+	return err == nil, err
+}
+
+// ExpirePendingSubscriptions 清理超时未支付的订阅订单
+func ExpirePendingSubscriptions(before int64) error {
+	return DB.Model(&UserSubscription{}).Where("status = ? AND created_time < ?", SubscriptionStatusPending, before).
+		Update("status", SubscriptionStatusExpired).Error
+}
+
+// GetDueSubscriptions 返回周期已结束、需要续订或过期处理的生效订阅。
+// 第三方自动续费的订阅在 providerCutoff 之前结束才返回，给支付回调留出宽限期。
+func GetDueSubscriptions(now int64, providerCutoff int64, limit int) (subs []*UserSubscription, err error) {
+	providers := []string{SubscriptionProviderStripe, SubscriptionProviderCreem}
+	err = DB.Where("status = ?", SubscriptionStatusActive).
+		Where(DB.Where("provider IN ? AND auto_renew = ? AND period_end <= ?", providers, true, providerCutoff).
+			Or("(provider NOT IN ? OR auto_renew = ?) AND period_end <= ?", providers, false, now)).
+		Order("period_end asc").Limit(limit).Find(&subs).Error
+	return subs, err
+}
+
+// GetSubscriptionsToRemind 返回即将到期且本周期尚未提醒的订阅
+func GetSubscriptionsToRemind(before int64, limit int) (subs []*UserSubscription, err error) {
+	err = DB.Where("status = ? AND renew_notified = ? AND period_end <= ?", SubscriptionStatusActive, false, before).
+		Order("period_end asc").Limit(limit).Find(&subs).Error
+	return subs, err
+}
+
+func (sub *UserSubscription) MarkRenewNotified() error {
+	return DB.Model(sub).Update("renew_notified", true).Error
+}
+
+// ConsumeSubscriptionQuota 从订阅额度扣除 quota，periodStart 为预扣费时的周期，订阅已过期或周期已变更时不扣除。
+// allowOverage 为 true 时订阅额度最多扣至 0，返回实际从订阅扣除的额度，其余由调用方从用户余额扣除；
+// 否则全部从订阅扣除，订阅额度可能为负。
+func ConsumeSubscriptionQuota(subId int, userId int, periodStart int64, quota int, allowOverage bool, reference string) (consumed int, err error) {
+	if quota <= 0 {
+		return 0, nil
+	}
+	activePeriod := func() *gorm.DB {
+		return DB.Model(&UserSubscription{}).Where("id = ? AND status = ? AND period_start = ?", subId, SubscriptionStatusActive, periodStart)
+	}
+	for {
+		consumed = quota
+		query := activePeriod()
+		if allowOverage {
+			var remains []int
+			if err := activePeriod().Pluck("remain_quota", &remains).Error; err != nil {
+				return 0, err
+			}
+			if len(remains) == 0 || remains[0] <= 0 {
+				return 0, nil
+			}
+			consumed = min(quota, remains[0])
+			// 条件扣减，并发请求先扣走额度时重新读取剩余额度
+			query = query.Where("remain_quota >= ?", consumed)
+		}
+		result := query.Updates(map[string]interface{}{
+			"remain_quota": gorm.Expr("remain_quota - ?", consumed),
+			"used_quota":   gorm.Expr("used_quota + ?", consumed),
+		})
+		if result.Error != nil {
+			return 0, result.Error
+		}
+		if result.RowsAffected == 1 {
+			break
+		}
+		if !allowOverage {
+			return 0, nil
+		}
+	}
+	bufferLedgerEntry(subscriptionLedgerAccount(subId), -consumed, LedgerSourceConsume, reference)
+	cacheIncrSubscriptionQuota(userId, -consumed)
+	return consumed, nil
+}
+
+// RefundSubscriptionQuota 向订阅返还 quota，订阅已过期或进入新周期时上一周期的额度作废，不再返还，返回实际返还的额度
+func RefundSubscriptionQuota(subId int, userId int, periodStart int64, quota int, reference string) (refunded int, err error) {
+	if quota <= 0 {
+		return 0, nil
+	}
+	result := DB.Model(&UserSubscription{}).Where("id = ? AND status = ? AND period_start = ?", subId, SubscriptionStatusActive, periodStart).Updates(map[string]interface{}{
+		"remain_quota": gorm.Expr("remain_quota + ?", quota),
+		"used_quota":   gorm.Expr("used_quota - ?", quota),
+	})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return 0, result.Error
+	}
+	bufferLedgerEntry(subscriptionLedgerAccount(subId), quota, LedgerSourceRefund, reference)
+	cacheIncrSubscriptionQuota(userId, quota)
+	return quota, nil
+}
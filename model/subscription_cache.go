@@ -0,0 +1,89 @@
+package model
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/pkg/metrics"
+
+	"github.com/bytedance/gopkg/util/gopool"
+)
+
+// SubscriptionBase 用户当前生效订阅在缓存中的字段，Id 为 0 表示没有生效订阅
+type SubscriptionBase struct {
+	Id          int    `json:"id"`
+	PlanName    string `json:"plan_name"`
+	Overage     string `json:"overage"`
+	PeriodStart int64  `json:"period_start"`
+	PeriodEnd   int64  `json:"period_end"`
+	RemainQuota int    `json:"remain_quota"`
+}
+
+func (sub *SubscriptionBase) AllowOverage() bool {
+	return sub.Overage != SubscriptionOverageBlock
+}
+
+func getSubscriptionCacheKey(userId int) string {
+	return fmt.Sprintf("user_subscription:%d", userId)
+}
+
+func invalidateSubscriptionCache(userId int) {
+	if !common.RedisEnabled {
+		return
+	}
+	if err := common.RedisDelKey(getSubscriptionCacheKey(userId)); err != nil {
+		common.SysLog("failed to invalidate subscription cache: " + err.Error())
+	}
+}
+
+func cacheIncrSubscriptionQuota(userId int, delta int) {
+	if !common.RedisEnabled {
+		return
+	}
+	gopool.Go(func() {
+		if err := common.RedisHIncrBy(getSubscriptionCacheKey(userId), "RemainQuota", int64(delta)); err != nil {
+			common.SysLog("failed to update subscription quota cache: " + err.Error())
+		}
+	})
+}
+
+// GetActiveSubscriptionCache 返回用户当前生效的订阅，没有则返回 nil。
+// 每次预扣费都会调用，没有订阅的用户同样缓存，订阅变更时清除缓存。
+func GetActiveSubscriptionCache(userId int) (*SubscriptionBase, error) {
+	subCache := &SubscriptionBase{}
+	var err error
+	if common.RedisEnabled {
+		err = common.RedisHGetObj(getSubscriptionCacheKey(userId), subCache)
+		metrics.ObserveCache("subscription", err == nil)
+	}
+	if !common.RedisEnabled || err != nil {
+		sub, err := GetActiveUserSubscription(userId)
+		if err != nil {
+			return nil, err
+		}
+		subCache = &SubscriptionBase{}
+		if sub != nil {
+			subCache = &SubscriptionBase{
+				Id:          sub.Id,
+				PlanName:    sub.Plan.Name,
+				Overage:     sub.Plan.Overage,
+				PeriodStart: sub.PeriodStart,
+				PeriodEnd:   sub.PeriodEnd,
+				RemainQuota: sub.RemainQuota,
+			}
+		}
+		if common.RedisEnabled {
+			cached := *subCache
+			gopool.Go(func() {
+				if err := common.RedisHSetObj(getSubscriptionCacheKey(userId), &cached, time.Duration(common.RedisKeyCacheSeconds())*time.Second); err != nil {
+					common.SysLog("failed to update subscription cache: " + err.Error())
+				}
+			})
+		}
+	}
+	if subCache.Id == 0 || subCache.PeriodEnd <= common.GetTimestamp() {
+		return nil, nil
+	}
+	return subCache, nil
+}
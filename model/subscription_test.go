@@ -0,0 +1,120 @@
+package model
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func createTestSubscription(t *testing.T, userId int, includedQuota int, overage string) (*UserSubscription, *SubscriptionPlan) {
+	t.Helper()
+	plan := &SubscriptionPlan{Name: "plan", PeriodDays: 30, IncludedQuota: includedQuota, Overage: overage, Enabled: true}
+	require.NoError(t, plan.Insert())
+	sub, err := GrantSubscription(userId, plan.Id)
+	require.NoError(t, err)
+	return sub, plan
+}
+
+func getTestSubscription(t *testing.T, id int) *UserSubscription {
+	t.Helper()
+	sub, err := GetUserSubscriptionById(id)
+	require.NoError(t, err)
+	return sub
+}
+
+func TestConsumeSubscriptionQuota_OverageStopsAtZero(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 0)
+	sub, _ := createTestSubscription(t, user.Id, 100, SubscriptionOverageBalance)
+
+	consumed, err := ConsumeSubscriptionQuota(sub.Id, user.Id, sub.PeriodStart, 70, true, "r1")
+	require.NoError(t, err)
+	require.Equal(t, 70, consumed)
+	consumed, err = ConsumeSubscriptionQuota(sub.Id, user.Id, sub.PeriodStart, 70, true, "r2")
+	require.NoError(t, err)
+	require.Equal(t, 30, consumed)
+	require.Equal(t, 0, getTestSubscription(t, sub.Id).RemainQuota)
+	requireLedgerBalanced(t, subscriptionLedgerAccount(sub.Id))
+}
+
+func TestConsumeSubscriptionQuota_ConcurrentOverage(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 0)
+	sub, _ := createTestSubscription(t, user.Id, 100, SubscriptionOverageBalance)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	total := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			consumed, err := ConsumeSubscriptionQuota(sub.Id, user.Id, sub.PeriodStart, 30, true, "")
+			require.NoError(t, err)
+			mu.Lock()
+			total += consumed
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, 100, total)
+	require.Equal(t, 0, getTestSubscription(t, sub.Id).RemainQuota)
+	requireLedgerBalanced(t, subscriptionLedgerAccount(sub.Id))
+}
+
+func TestRefundSubscriptionQuota_SkipsRenewedPeriod(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 0)
+	sub, plan := createTestSubscription(t, user.Id, 100, SubscriptionOverageBalance)
+	periodStart := sub.PeriodStart
+
+	_, err := ConsumeSubscriptionQuota(sub.Id, user.Id, periodStart, 40, true, "r1")
+	require.NoError(t, err)
+
+	renewed := getTestSubscription(t, sub.Id)
+	renewed.PeriodEnd = periodStart + 1
+	require.NoError(t, DB.Transaction(func(tx *gorm.DB) error {
+		return renewSubscriptionTx(tx, renewed, plan)
+	}))
+	require.NotEqual(t, periodStart, renewed.PeriodStart)
+
+	refunded, err := RefundSubscriptionQuota(sub.Id, user.Id, periodStart, 40, "r1")
+	require.NoError(t, err)
+	require.Equal(t, 0, refunded)
+	require.Equal(t, 100, getTestSubscription(t, sub.Id).RemainQuota)
+	requireLedgerBalanced(t, subscriptionLedgerAccount(sub.Id))
+
+	refunded, err = RefundSubscriptionQuota(sub.Id, user.Id, renewed.PeriodStart, 10, "r2")
+	require.NoError(t, err)
+	require.Equal(t, 10, refunded)
+}
+
+func TestExpireSubscription_VoidsRemainingQuota(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 0)
+	sub, _ := createTestSubscription(t, user.Id, 100, SubscriptionOverageBlock)
+
+	require.NoError(t, ExpireSubscription(sub))
+	expired := getTestSubscription(t, sub.Id)
+	require.Equal(t, SubscriptionStatusExpired, expired.Status)
+	require.Equal(t, 0, expired.RemainQuota)
+	requireLedgerBalanced(t, subscriptionLedgerAccount(sub.Id))
+
+	consumed, err := ConsumeSubscriptionQuota(sub.Id, user.Id, sub.PeriodStart, 10, false, "")
+	require.NoError(t, err)
+	require.Equal(t, 0, consumed)
+}
+
+func TestSubscribeWithBalance_InsufficientQuota(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 10)
+	plan := &SubscriptionPlan{Name: "plan", PeriodDays: 30, IncludedQuota: 100, Price: 1, Enabled: true}
+	require.NoError(t, plan.Insert())
+
+	_, err := SubscribeWithBalance(user.Id, plan.Id)
+	require.Error(t, err)
+	require.Equal(t, 10, getTestUserQuota(t, user.Id))
+}
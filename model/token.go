@@ -6,28 +6,39 @@ import (
 	"strings"
 
 	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/pkg/metrics"
 	"github.com/bytedance/gopkg/util/gopool"
 	"gorm.io/gorm"
 )
 
 type Token struct {
-	Id                 int            `json:"id"`
-	UserId             int            `json:"user_id" gorm:"index"`
-	Key                string         `json:"key" gorm:"type:char(48);uniqueIndex"`
-	Status             int            `json:"status" gorm:"default:1"`
-	Name               string         `json:"name" gorm:"index" `
-	CreatedTime        int64          `json:"created_time" gorm:"bigint"`
-	AccessedTime       int64          `json:"accessed_time" gorm:"bigint"`
-	ExpiredTime        int64          `json:"expired_time" gorm:"bigint;default:-1"` // -1 means never expired
-	RemainQuota        int            `json:"remain_quota" gorm:"default:0"`
-	UnlimitedQuota     bool           `json:"unlimited_quota"`
-	ModelLimitsEnabled bool           `json:"model_limits_enabled"`
-	ModelLimits        string         `json:"model_limits" gorm:"type:varchar(1024);default:''"`
-	AllowIps           *string        `json:"allow_ips" gorm:"default:''"`
-	UsedQuota          int            `json:"used_quota" gorm:"default:0"` // used quota
-	Group              string         `json:"group" gorm:"default:''"`
-	CrossGroupRetry    bool           `json:"cross_group_retry"` // 跨分组重试，仅auto分组有效
-	DeletedAt          gorm.DeletedAt `gorm:"index"`
+	Id                 int     `json:"id"`
+	UserId             int     `json:"user_id" gorm:"index"`
+	Key                string  `json:"key" gorm:"type:char(48);uniqueIndex"`
+	Status             int     `json:"status" gorm:"default:1"`
+	Name               string  `json:"name" gorm:"index" `
+	CreatedTime        int64   `json:"created_time" gorm:"bigint"`
+	AccessedTime       int64   `json:"accessed_time" gorm:"bigint"`
+	ExpiredTime        int64   `json:"expired_time" gorm:"bigint;default:-1"` // -1 means never expired
+	RemainQuota        int     `json:"remain_quota" gorm:"default:0"`
+	UnlimitedQuota     bool    `json:"unlimited_quota"`
+	ModelLimitsEnabled bool    `json:"model_limits_enabled"`
+	ModelLimits        string  `json:"model_limits" gorm:"type:varchar(1024);default:''"`
+	AllowIps           *string `json:"allow_ips" gorm:"default:''"`
+	UsedQuota          int     `json:"used_quota" gorm:"default:0"` // used quota
+	Group              string  `json:"group" gorm:"default:''"`
+	CrossGroupRetry    bool    `json:"cross_group_retry"`             // 跨分组重试，仅auto分组有效
+	Scopes             string  `json:"scopes" gorm:"type:text"`       // 令牌作用域，详见 dto.TokenScopes
+	OrgId              int     `json:"org_id" gorm:"index;default:0"` // 组织令牌，从组织额度池扣费
+	// 自动充值：剩余额度低于阈值时从余额为令牌补充额度，每日补充总额不超过上限
+	AutoRefillEnabled   bool           `json:"auto_refill_enabled"`
+	AutoRefillThreshold int            `json:"auto_refill_threshold" gorm:"default:0"`
+	AutoRefillAmount    int            `json:"auto_refill_amount" gorm:"default:0"`
+	AutoRefillDailyMax  int            `json:"auto_refill_daily_max" gorm:"default:0"`
+	AutoRefillDate      string         `json:"auto_refill_date" gorm:"type:varchar(10);default:''"` // 最近一次自动充值的日期
+	AutoRefillDateQuota int            `json:"auto_refill_date_quota" gorm:"default:0"`             // AutoRefillDate 当日已自动充值的额度
+	DeletedAt           gorm.DeletedAt `gorm:"index"`
 }
 
 func (token *Token) Clean() {
@@ -56,6 +67,41 @@ func (token *Token) GetIpLimits() []string {
 	return ipLimits
 }
 
+func (token *Token) GetScopes() *dto.TokenScopes {
+	scopes := &dto.TokenScopes{}
+	if token.Scopes != "" {
+		if err := common.UnmarshalJsonStr(token.Scopes, scopes); err != nil {
+			common.SysLog("failed to unmarshal token scopes: " + err.Error())
+		}
+	}
+	return scopes
+}
+
+// ValidateScopes 校验作用域 JSON 格式，并将空作用域规范化为空字符串
+func (token *Token) ValidateScopes() error {
+	if strings.TrimSpace(token.Scopes) == "" {
+		token.Scopes = ""
+		return nil
+	}
+	scopes := &dto.TokenScopes{}
+	if err := common.UnmarshalJsonStr(token.Scopes, scopes); err != nil {
+		return fmt.Errorf("令牌作用域格式错误: %w", err)
+	}
+	if scopes.MaxTokens < 0 || scopes.MaxInputTokens < 0 {
+		return errors.New("令牌作用域的 token 上限不能为负数")
+	}
+	if scopes.IsEmpty() {
+		token.Scopes = ""
+		return nil
+	}
+	scopesBytes, err := common.Marshal(scopes)
+	if err != nil {
+		return err
+	}
+	token.Scopes = string(scopesBytes)
+	return nil
+}
+
 func GetAllUserTokens(userId int, startIdx int, num int) ([]*Token, error) {
 	var tokens []*Token
 	var err error
@@ -161,6 +207,7 @@ func GetTokenByKey(key string, fromDB bool) (token *Token, err error) {
 	if !fromDB && common.RedisEnabled {
 		// Try Redis first
 		token, err := cacheGetTokenByKey(key)
+		metrics.ObserveCache("token", err == nil)
 		if err == nil {
 			return token, nil
 		}
@@ -190,7 +237,8 @@ func (token *Token) Update() (err error) {
 		}
 	}()
 	err = DB.Model(token).Select("name", "status", "expired_time", "remain_quota", "unlimited_quota",
-		"model_limits_enabled", "model_limits", "allow_ips", "group", "cross_group_retry").Updates(token).Error
+		"model_limits_enabled", "model_limits", "allow_ips", "group", "cross_group_retry", "scopes", "org_id",
+		"auto_refill_enabled", "auto_refill_threshold", "auto_refill_amount", "auto_refill_daily_max").Updates(token).Error
 	return err
 }
 
@@ -0,0 +1,118 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/logger"
+
+	"gorm.io/gorm"
+)
+
+const tokenAutoRefillDateLayout = "2006-01-02"
+
+// ValidateAutoRefill 校验令牌自动充值规则，未开启时清空规则
+func (token *Token) ValidateAutoRefill() error {
+	if !token.AutoRefillEnabled {
+		token.AutoRefillThreshold = 0
+		token.AutoRefillAmount = 0
+		token.AutoRefillDailyMax = 0
+		return nil
+	}
+	if token.UnlimitedQuota {
+		return errors.New("无限额度令牌无需开启自动充值")
+	}
+	if token.AutoRefillThreshold <= 0 || token.AutoRefillAmount <= 0 {
+		return errors.New("自动充值阈值与单次充值额度必须大于 0")
+	}
+	if token.AutoRefillDailyMax < token.AutoRefillAmount {
+		return errors.New("每日自动充值上限不能小于单次充值额度")
+	}
+	return nil
+}
+
+// getPayerAvailableQuota 令牌扣费方的可用额度，包含后付费信用额度
+func getPayerAvailableQuota(token *Token) (int, error) {
+	var payer struct {
+		Quota       int
+		CreditLimit int
+	}
+	var err error
+	if token.OrgId != 0 {
+		err = DB.Model(&Organization{}).Where("id = ?", token.OrgId).Select("quota, credit_limit").Scan(&payer).Error
+	} else {
+		err = DB.Model(&User{}).Where("id = ?", token.UserId).Select("quota, credit_limit").Scan(&payer).Error
+	}
+	return payer.Quota + payer.CreditLimit, err
+}
+
+// AutoRefillToken 令牌剩余额度低于阈值时按规则自动补充额度，返回补充的额度，未触发时返回 0。
+// 令牌额度只是余额的分配上限，实际扣费仍从用户或组织余额扣除，因此补充额度不超过扣费方的可用额度。
+// 补充通过带条件的相对更新完成：仅在令牌剩余额度仍低于阈值且当日累计不超过每日上限时生效，
+// 并发请求不会使当日自动充值额度超过上限。
+func AutoRefillToken(tokenId int) (int, *Token, error) {
+	token := &Token{}
+	if err := DB.Where("id = ?", tokenId).First(token).Error; err != nil {
+		return 0, token, err
+	}
+	if !token.AutoRefillEnabled || token.UnlimitedQuota || token.RemainQuota >= token.AutoRefillThreshold {
+		return 0, token, nil
+	}
+	if token.Status != common.TokenStatusEnabled && token.Status != common.TokenStatusExhausted {
+		return 0, token, nil
+	}
+	if token.ExpiredTime != -1 && token.ExpiredTime < common.GetTimestamp() {
+		return 0, token, nil
+	}
+	today := time.Now().Format(tokenAutoRefillDateLayout)
+	dateQuota := token.AutoRefillDateQuota
+	if token.AutoRefillDate != today {
+		dateQuota = 0
+	}
+	available, err := getPayerAvailableQuota(token)
+	if err != nil {
+		return 0, token, err
+	}
+	amount := min(token.AutoRefillAmount, token.AutoRefillDailyMax-dateQuota, available)
+	if amount <= 0 {
+		return 0, token, nil
+	}
+
+	updates := map[string]interface{}{
+		"remain_quota": gorm.Expr("remain_quota + ?", amount),
+		"status":       common.TokenStatusEnabled,
+	}
+	query := DB.Model(&Token{}).
+		Where("id = ? AND auto_refill_enabled = ? AND remain_quota < auto_refill_threshold", token.Id, true).
+		Where("status IN ?", []int{common.TokenStatusEnabled, common.TokenStatusExhausted})
+	if token.AutoRefillDate == today {
+		query = query.Where("auto_refill_date = ? AND auto_refill_date_quota + ? <= auto_refill_daily_max", today, amount)
+		updates["auto_refill_date_quota"] = gorm.Expr("auto_refill_date_quota + ?", amount)
+	} else {
+		// 当日首次充值，其他请求已抢先开始新的一天时放弃本次充值
+		query = query.Where("auto_refill_date = ?", token.AutoRefillDate)
+		updates["auto_refill_date"] = today
+		updates["auto_refill_date_quota"] = amount
+	}
+	result := query.Updates(updates)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return 0, token, result.Error
+	}
+	if err := DB.Where("id = ?", token.Id).First(token).Error; err != nil {
+		return 0, token, err
+	}
+	if common.RedisEnabled {
+		if err := cacheIncrTokenQuota(token.Key, int64(amount)); err != nil {
+			common.SysLog("failed to increase token quota cache: " + err.Error())
+		}
+		if err := cacheSetTokenField(token.Key, "Status", strconv.Itoa(token.Status)); err != nil {
+			common.SysLog("failed to update token status cache: " + err.Error())
+		}
+	}
+	RecordLog(token.UserId, LogTypeSystem, fmt.Sprintf("令牌 %s 剩余额度低于 %s，自动充值 %s，今日已自动充值 %s",
+		token.Name, logger.LogQuota(token.AutoRefillThreshold), logger.LogQuota(amount), logger.LogQuota(token.AutoRefillDateQuota)))
+	return amount, token, nil
+}
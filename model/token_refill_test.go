@@ -0,0 +1,102 @@
+package model
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+func createTestRefillToken(t *testing.T, userId int, remain int) *Token {
+	t.Helper()
+	token := &Token{
+		UserId:              userId,
+		Key:                 common.GetRandomString(48),
+		Name:                "refill",
+		Status:              common.TokenStatusEnabled,
+		ExpiredTime:         -1,
+		RemainQuota:         remain,
+		AutoRefillEnabled:   true,
+		AutoRefillThreshold: 100,
+		AutoRefillAmount:    200,
+		AutoRefillDailyMax:  500,
+	}
+	require.NoError(t, DB.Create(token).Error)
+	return token
+}
+
+func getTestToken(t *testing.T, id int) *Token {
+	t.Helper()
+	token := &Token{}
+	require.NoError(t, DB.First(token, "id = ?", id).Error)
+	return token
+}
+
+func TestAutoRefillToken_BelowThreshold(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 1000)
+	token := createTestRefillToken(t, user.Id, 150)
+
+	refilled, _, err := AutoRefillToken(token.Id)
+	require.NoError(t, err)
+	require.Equal(t, 0, refilled)
+
+	require.NoError(t, DB.Model(token).Update("remain_quota", 50).Error)
+	refilled, refilledToken, err := AutoRefillToken(token.Id)
+	require.NoError(t, err)
+	require.Equal(t, 200, refilled)
+	require.Equal(t, 250, refilledToken.RemainQuota)
+	require.Equal(t, 200, refilledToken.AutoRefillDateQuota)
+	require.Equal(t, time.Now().Format(tokenAutoRefillDateLayout), refilledToken.AutoRefillDate)
+}
+
+func TestAutoRefillToken_NewDayResetsDailyQuota(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 1000)
+	token := createTestRefillToken(t, user.Id, 0)
+	require.NoError(t, DB.Model(token).Updates(map[string]interface{}{
+		"auto_refill_date": "2000-01-01", "auto_refill_date_quota": 500,
+	}).Error)
+
+	refilled, refilledToken, err := AutoRefillToken(token.Id)
+	require.NoError(t, err)
+	require.Equal(t, 200, refilled)
+	require.Equal(t, 200, refilledToken.AutoRefillDateQuota)
+}
+
+func TestAutoRefillToken_ConcurrentWithinDailyMax(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 10000)
+	token := createTestRefillToken(t, user.Id, 0)
+	// 单次充值额度仍低于阈值，每次充值后令牌都满足再次充值的条件
+	require.NoError(t, DB.Model(token).Updates(map[string]interface{}{
+		"auto_refill_threshold": 1000, "auto_refill_amount": 200,
+	}).Error)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, _ = AutoRefillToken(token.Id)
+		}()
+	}
+	wg.Wait()
+
+	token = getTestToken(t, token.Id)
+	require.LessOrEqual(t, token.AutoRefillDateQuota, 500)
+	require.Equal(t, token.AutoRefillDateQuota, token.RemainQuota)
+}
+
+func TestAutoRefillToken_LimitedByPayerQuota(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 80)
+	token := createTestRefillToken(t, user.Id, 0)
+
+	refilled, _, err := AutoRefillToken(token.Id)
+	require.NoError(t, err)
+	require.Equal(t, 80, refilled)
+}
@@ -3,12 +3,15 @@ package model
 import (
 	"errors"
 	"fmt"
+	"slices"
+	"strings"
 
 	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/logger"
 
 	"github.com/shopspring/decimal"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type TopUp struct {
@@ -21,6 +24,98 @@ type TopUp struct {
 	CreateTime    int64   `json:"create_time"`
 	CompleteTime  int64   `json:"complete_time"`
 	Status        string  `json:"status"`
+	OrgId         int     `json:"org_id" gorm:"index;default:0"` // 为组织充值时记录组织 id
+	// 下单时使用的优惠码，CouponDiscount 为减免的支付金额，CouponBonusQuota 为支付成功后赠送的额度
+	CouponId         int     `json:"coupon_id" gorm:"default:0"`
+	CouponCode       string  `json:"coupon_code" gorm:"type:varchar(64);default:''"`
+	CouponDiscount   float64 `json:"coupon_discount" gorm:"default:0"`
+	CouponBonusQuota int     `json:"coupon_bonus_quota" gorm:"type:int;default:0"`
+	// 订单所属的支付平台，为空的历史订单由 GetProvider 按订单号与支付方式推断
+	Provider string `json:"provider" gorm:"type:varchar(32);default:''"`
+	// 支付平台侧的交易号：Stripe 为 Checkout Session id，Creem 为 checkout id，其余为支付成功后的平台流水号
+	ProviderTradeNo string `json:"provider_trade_no" gorm:"type:varchar(255);default:''"`
+	// 支付成功时计入的充值额度（不含优惠码赠送），退款时据此扣回
+	CreditedQuota int    `json:"credited_quota" gorm:"type:int;default:0"`
+	RefundTime    int64  `json:"refund_time" gorm:"bigint;default:0"`
+	RefundedQuota int    `json:"refunded_quota" gorm:"type:int;default:0"` // 退款时实际扣回的额度
+	RefundReason  string `json:"refund_reason" gorm:"type:varchar(255);default:''"`
+}
+
+// 支付平台
+const (
+	PaymentProviderEpay   = "epay"
+	PaymentProviderStripe = "stripe"
+	PaymentProviderCreem  = "creem"
+	PaymentProviderWechat = "wechat"
+	PaymentProviderAlipay = "alipay"
+)
+
+var ErrTopUpNotPending = errors.New("充值订单状态错误")
+
+// topUpTransitions 订单状态机：待支付订单可支付成功或过期，已过期订单在支付平台确认到账后（用户延迟支付）
+// 或管理员补单时仍可完成。已支付订单线下退款时直接置为已退款；原路退款时先置为退款中，
+// 支付平台退款成功后置为已退款，失败时恢复为已支付
+var topUpTransitions = map[string][]string{
+	common.TopUpStatusPending:   {common.TopUpStatusSuccess, common.TopUpStatusExpired},
+	common.TopUpStatusExpired:   {common.TopUpStatusSuccess},
+	common.TopUpStatusSuccess:   {common.TopUpStatusRefunding, common.TopUpStatusRefunded},
+	common.TopUpStatusRefunding: {common.TopUpStatusRefunded, common.TopUpStatusSuccess},
+}
+
+func (topUp *TopUp) CanTransitionTo(status string) bool {
+	return slices.Contains(topUpTransitions[topUp.Status], status)
+}
+
+// transitionTopUpTx 按条件将订单从当前状态改为 status 并更新 columns 中的其余字段，
+// 订单状态已被并发修改时返回 ErrTopUpNotPending，不依赖行锁也不会重复入账或退款
+func transitionTopUpTx(tx *gorm.DB, topUp *TopUp, status string, columns ...string) error {
+	if !topUp.CanTransitionTo(status) {
+		return ErrTopUpNotPending
+	}
+	from := topUp.Status
+	topUp.Status = status
+	result := tx.Model(&TopUp{}).Where("id = ? AND status = ?", topUp.Id, from).
+		Select(append([]string{"status"}, columns...)).Updates(topUp)
+	if result.Error != nil {
+		topUp.Status = from
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		topUp.Status = from
+		return ErrTopUpNotPending
+	}
+	return nil
+}
+
+// GetProvider 返回订单所属的支付平台。易支付订单号以 USR 开头，
+// 早期 Creem 订单未记录支付方式
+func (topUp *TopUp) GetProvider() string {
+	if topUp.Provider != "" {
+		return topUp.Provider
+	}
+	if strings.HasPrefix(topUp.TradeNo, "USR") {
+		return PaymentProviderEpay
+	}
+	switch topUp.PaymentMethod {
+	case PaymentProviderStripe, PaymentProviderWechat, PaymentProviderAlipay, PaymentProviderCreem:
+		return topUp.PaymentMethod
+	case "":
+		return PaymentProviderCreem
+	}
+	return PaymentProviderEpay
+}
+
+// TopUpQuota 订单支付成功后应计入的充值额度：
+// Stripe 订单的 Money 为经分组倍率换算后的美元数量，Creem 订单的 Amount 即为额度，其余订单的 Amount 为美元数量
+func TopUpQuota(topUp *TopUp) int {
+	dQuotaPerUnit := decimal.NewFromFloat(common.QuotaPerUnit)
+	switch topUp.GetProvider() {
+	case PaymentProviderStripe:
+		return int(decimal.NewFromFloat(topUp.Money).Mul(dQuotaPerUnit).IntPart())
+	case PaymentProviderCreem:
+		return int(topUp.Amount)
+	}
+	return int(decimal.NewFromInt(topUp.Amount).Mul(dQuotaPerUnit).IntPart())
 }
 
 func (topUp *TopUp) Insert() error {
@@ -60,47 +155,140 @@ func Recharge(referenceId string, customerId string) (err error) {
 		return errors.New("未提供支付单号")
 	}
 
-	var quota float64
-	topUp := &TopUp{}
+	var topUp *TopUp
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if topUp, err = lockTopUpTx(tx, referenceId); err != nil {
+			return err
+		}
+		if err := completeTopUpTx(tx, topUp, TopUpQuota(topUp), ""); err != nil {
+			return err
+		}
+		return tx.Model(&User{}).Where("id = ?", topUp.UserId).Update("stripe_customer", customerId).Error
+	})
 
+	if err != nil {
+		return errors.New("充值失败，" + err.Error())
+	}
+	refreshTopUpUserCache(topUp)
+
+	RecordLog(topUp.UserId, LogTypeTopup, fmt.Sprintf("使用在线充值成功，充值金额: %v，支付金额：%d", logger.FormatQuota(topUp.CreditedQuota), topUp.Amount))
+
+	return nil
+}
+
+// lockTopUpTx 在事务中按订单号加行锁读取订单
+func lockTopUpTx(tx *gorm.DB, tradeNo string) (*TopUp, error) {
 	refCol := "`trade_no`"
 	if common.UsingPostgreSQL {
 		refCol = `"trade_no"`
 	}
+	topUp := &TopUp{}
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where(refCol+" = ?", tradeNo).First(topUp).Error; err != nil {
+		return nil, errors.New("充值订单不存在")
+	}
+	return topUp, nil
+}
 
-	err = DB.Transaction(func(tx *gorm.DB) error {
-		err := tx.Set("gorm:query_option", "FOR UPDATE").Where(refCol+" = ?", referenceId).First(topUp).Error
-		if err != nil {
-			return errors.New("充值订单不存在")
-		}
+// completeTopUpTx 在事务中将订单置为支付成功并入账，providerTradeNo 为空时保留原值
+func completeTopUpTx(tx *gorm.DB, topUp *TopUp, quota int, providerTradeNo string) error {
+	if !topUp.CanTransitionTo(common.TopUpStatusSuccess) {
+		return ErrTopUpNotPending
+	}
+	if quota <= 0 {
+		return errors.New("无效的充值额度")
+	}
+	topUp.CompleteTime = common.GetTimestamp()
+	topUp.CreditedQuota = quota
+	if providerTradeNo != "" {
+		topUp.ProviderTradeNo = providerTradeNo
+	}
+	if err := transitionTopUpTx(tx, topUp, common.TopUpStatusSuccess, "complete_time", "credited_quota", "provider_trade_no"); err != nil {
+		return err
+	}
+	return creditTopUpTx(tx, topUp, quota)
+}
 
-		if topUp.Status != common.TopUpStatusPending {
-			return errors.New("充值订单状态错误")
-		}
+// refreshTopUpUserCache 订单入账或退款后清理用户缓存，使缓存中的额度重新从数据库加载
+func refreshTopUpUserCache(topUp *TopUp) {
+	if topUp.OrgId != 0 {
+		return
+	}
+	if err := invalidateUserCache(topUp.UserId); err != nil {
+		common.SysLog("failed to invalidate user cache: " + err.Error())
+	}
+}
 
-		topUp.CompleteTime = common.GetTimestamp()
-		topUp.Status = common.TopUpStatusSuccess
-		err = tx.Save(topUp).Error
-		if err != nil {
+// CompleteTopUp 支付回调或对账确认支付成功后完成订单并入账。
+// 订单已不是待支付状态时返回 ErrTopUpNotPending，回调方可据此做幂等处理。
+func CompleteTopUp(tradeNo string, providerTradeNo string) (*TopUp, error) {
+	var topUp *TopUp
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if topUp, err = lockTopUpTx(tx, tradeNo); err != nil {
 			return err
 		}
+		return completeTopUpTx(tx, topUp, TopUpQuota(topUp), providerTradeNo)
+	})
+	if err != nil {
+		return topUp, err
+	}
+	refreshTopUpUserCache(topUp)
+	return topUp, nil
+}
 
-		quota = topUp.Money * common.QuotaPerUnit
-		err = tx.Model(&User{}).Where("id = ?", topUp.UserId).Updates(map[string]interface{}{"stripe_customer": customerId, "quota": gorm.Expr("quota + ?", quota)}).Error
+// ExpireTopUp 将待支付订单置为过期
+func ExpireTopUp(tradeNo string) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		topUp, err := lockTopUpTx(tx, tradeNo)
 		if err != nil {
 			return err
 		}
-
-		return nil
+		return transitionTopUpTx(tx, topUp, common.TopUpStatusExpired)
 	})
+}
 
-	if err != nil {
-		return errors.New("充值失败，" + err.Error())
-	}
+// SetTopUpProviderTradeNo 记录下单后支付平台返回的交易号
+func SetTopUpProviderTradeNo(tradeNo string, providerTradeNo string) error {
+	return DB.Model(&TopUp{}).Where("trade_no = ?", tradeNo).Update("provider_trade_no", providerTradeNo).Error
+}
 
-	RecordLog(topUp.UserId, LogTypeTopup, fmt.Sprintf("使用在线充值成功，充值金额: %v，支付金额：%d", logger.FormatQuota(int(quota)), topUp.Amount))
+// GetPendingTopUps 按 id 顺序查询 afterId 之后、创建时间早于 before 的待支付订单，用于对账分页
+func GetPendingTopUps(before int64, afterId int, limit int) (topups []*TopUp, err error) {
+	err = DB.Where("status = ? AND create_time < ? AND id > ?", common.TopUpStatusPending, before, afterId).
+		Order("id asc").Limit(limit).Find(&topups).Error
+	return topups, err
+}
 
-	return nil
+// creditTopUpTx 在事务中将充值额度计入组织额度池或用户额度
+func creditTopUpTx(tx *gorm.DB, topUp *TopUp, quota int) error {
+	if topUp.OrgId != 0 {
+		if err := increaseOrgQuota(tx, topUp.OrgId, quota); err != nil {
+			return err
+		}
+		if err := recordOrgLedger(tx, topUp.OrgId, quota, LedgerSourceTopup, topUp.TradeNo); err != nil {
+			return err
+		}
+		return afterTopUpCreditedTx(tx, topUp, quota)
+	}
+	if err := tx.Model(&User{}).Where("id = ?", topUp.UserId).Update("quota", gorm.Expr("quota + ?", quota)).Error; err != nil {
+		return err
+	}
+	if err := recordUserLedger(tx, topUp.UserId, quota, LedgerSourceTopup, topUp.TradeNo); err != nil {
+		return err
+	}
+	if err := RecordQuotaLot(tx, topUp.UserId, QuotaLotSourceTopup, topUp.TradeNo, quota, 0); err != nil {
+		return err
+	}
+	return afterTopUpCreditedTx(tx, topUp, quota)
+}
+
+// afterTopUpCreditedTx 充值额度入账后的后续处理：核销优惠码并发放邀请返佣
+func afterTopUpCreditedTx(tx *gorm.DB, topUp *TopUp, quota int) error {
+	if err := completeTopUpCouponTx(tx, topUp); err != nil {
+		return err
+	}
+	return creditReferralCommissionTx(tx, topUp, quota)
 }
 
 func GetUserTopUps(userId int, pageInfo *common.PageInfo) (topups []*TopUp, total int64, err error) {
@@ -240,20 +428,12 @@ func ManualCompleteTopUp(tradeNo string) error {
 		return errors.New("未提供订单号")
 	}
 
-	refCol := "`trade_no`"
-	if common.UsingPostgreSQL {
-		refCol = `"trade_no"`
-	}
-
-	var userId int
-	var quotaToAdd int
-	var payMoney float64
-
+	var topUp *TopUp
 	err := DB.Transaction(func(tx *gorm.DB) error {
-		topUp := &TopUp{}
+		var err error
 		// 行级锁，避免并发补单
-		if err := tx.Set("gorm:query_option", "FOR UPDATE").Where(refCol+" = ?", tradeNo).First(topUp).Error; err != nil {
-			return errors.New("充值订单不存在")
+		if topUp, err = lockTopUpTx(tx, tradeNo); err != nil {
+			return err
 		}
 
 		// 幂等处理：已成功直接返回
@@ -261,116 +441,188 @@ func ManualCompleteTopUp(tradeNo string) error {
 			return nil
 		}
 
-		if topUp.Status != common.TopUpStatusPending {
-			return errors.New("订单状态不是待支付，无法补单")
-		}
-
-		// 计算应充值额度：
-		// - Stripe 订单：Money 代表经分组倍率换算后的美元数量，直接 * QuotaPerUnit
-		// - 其他订单（如易支付）：Amount 为美元数量，* QuotaPerUnit
-		if topUp.PaymentMethod == "stripe" {
-			dQuotaPerUnit := decimal.NewFromFloat(common.QuotaPerUnit)
-			quotaToAdd = int(decimal.NewFromFloat(topUp.Money).Mul(dQuotaPerUnit).IntPart())
-		} else {
-			dAmount := decimal.NewFromInt(topUp.Amount)
-			dQuotaPerUnit := decimal.NewFromFloat(common.QuotaPerUnit)
-			quotaToAdd = int(dAmount.Mul(dQuotaPerUnit).IntPart())
-		}
-		if quotaToAdd <= 0 {
-			return errors.New("无效的充值额度")
+		// 已过期订单同样可以补单，与状态机一致
+		if !topUp.CanTransitionTo(common.TopUpStatusSuccess) {
+			return errors.New("订单状态不是待支付或已过期，无法补单")
 		}
 
-		// 标记完成
-		topUp.CompleteTime = common.GetTimestamp()
-		topUp.Status = common.TopUpStatusSuccess
-		if err := tx.Save(topUp).Error; err != nil {
-			return err
-		}
-
-		// 增加用户额度（立即写库，保持一致性）
-		if err := tx.Model(&User{}).Where("id = ?", topUp.UserId).Update("quota", gorm.Expr("quota + ?", quotaToAdd)).Error; err != nil {
-			return err
-		}
-
-		userId = topUp.UserId
-		payMoney = topUp.Money
-		return nil
+		return completeTopUpTx(tx, topUp, TopUpQuota(topUp), "")
 	})
 
 	if err != nil {
 		return err
 	}
+	refreshTopUpUserCache(topUp)
 
 	// 事务外记录日志，避免阻塞
-	RecordLog(userId, LogTypeTopup, fmt.Sprintf("管理员补单成功，充值金额: %v，支付金额：%f", logger.FormatQuota(quotaToAdd), payMoney))
+	RecordLog(topUp.UserId, LogTypeTopup, fmt.Sprintf("管理员补单成功，充值金额: %v，支付金额：%f", logger.FormatQuota(topUp.CreditedQuota), topUp.Money))
 	return nil
 }
+
 func RechargeCreem(referenceId string, customerEmail string, customerName string) (err error) {
 	if referenceId == "" {
 		return errors.New("未提供支付单号")
 	}
 
-	var quota int64
-	topUp := &TopUp{}
-
-	refCol := "`trade_no`"
-	if common.UsingPostgreSQL {
-		refCol = `"trade_no"`
-	}
-
+	var topUp *TopUp
 	err = DB.Transaction(func(tx *gorm.DB) error {
-		err := tx.Set("gorm:query_option", "FOR UPDATE").Where(refCol+" = ?", referenceId).First(topUp).Error
-		if err != nil {
-			return errors.New("充值订单不存在")
+		var err error
+		if topUp, err = lockTopUpTx(tx, referenceId); err != nil {
+			return err
 		}
 
-		if topUp.Status != common.TopUpStatusPending {
-			return errors.New("充值订单状态错误")
+		// Creem 直接使用 Amount 作为充值额度（整数）
+		if err := completeTopUpTx(tx, topUp, int(topUp.Amount), ""); err != nil {
+			return err
 		}
 
-		topUp.CompleteTime = common.GetTimestamp()
-		topUp.Status = common.TopUpStatusSuccess
-		err = tx.Save(topUp).Error
-		if err != nil {
-			return err
+		// 如果有客户邮箱，且用户邮箱为空，则更新为支付时使用的邮箱
+		if customerEmail != "" && topUp.OrgId == 0 {
+			return tx.Model(&User{}).Where("id = ? AND (email = '' OR email IS NULL)", topUp.UserId).
+				Update("email", customerEmail).Error
 		}
+		return nil
+	})
 
-		// Creem 直接使用 Amount 作为充值额度（整数）
-		quota = topUp.Amount
+	if err != nil {
+		return errors.New("充值失败，" + err.Error())
+	}
+	refreshTopUpUserCache(topUp)
+
+	RecordLog(topUp.UserId, LogTypeTopup, fmt.Sprintf("使用Creem充值成功，充值额度: %v，支付金额：%.2f", topUp.CreditedQuota, topUp.Money))
+
+	return nil
+}
+
+// RefundTopUp 为已支付订单办理退款：扣回订单入账的额度与优惠码赠送额度（余额不足时只扣回剩余部分），
+// 撤销该订单产生的邀请返佣，并将订单置为已退款。refundFn 为空时为线下退款，直接完成退款；
+// 不为空时用于原路退款：先将订单置为退款中并提交，在事务外调用支付平台退款，成功后再扣回额度并置为已退款，
+// 失败时恢复为已支付。原路退款已成功但未能完成扣回的退款中订单，可再以线下退款完成。
+func RefundTopUp(tradeNo string, reason string, refundFn func(topUp *TopUp) error) (*TopUp, error) {
+	if refundFn == nil {
+		return finishTopUpRefund(tradeNo, reason, common.TopUpStatusSuccess, common.TopUpStatusRefunding)
+	}
 
-		// 构建更新字段，优先使用邮箱，如果邮箱为空则使用用户名
-		updateFields := map[string]interface{}{
-			"quota": gorm.Expr("quota + ?", quota),
+	var topUp *TopUp
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if topUp, err = lockTopUpTx(tx, tradeNo); err != nil {
+			return err
 		}
+		if topUp.Status != common.TopUpStatusSuccess {
+			return errors.New("只有已支付的订单可以退款")
+		}
+		return transitionTopUpTx(tx, topUp, common.TopUpStatusRefunding)
+	})
+	if errors.Is(err, ErrTopUpNotPending) {
+		return nil, errors.New("只有已支付的订单可以退款")
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		// 如果有客户邮箱，尝试更新用户邮箱（仅当用户邮箱为空时）
-		if customerEmail != "" {
-			// 先检查用户当前邮箱是否为空
-			var user User
-			err = tx.Where("id = ?", topUp.UserId).First(&user).Error
-			if err != nil {
-				return err
-			}
-
-			// 如果用户邮箱为空，则更新为支付时使用的邮箱
-			if user.Email == "" {
-				updateFields["email"] = customerEmail
-			}
+	if err := refundFn(topUp); err != nil {
+		rollbackErr := DB.Transaction(func(tx *gorm.DB) error {
+			return transitionTopUpTx(tx, topUp, common.TopUpStatusSuccess)
+		})
+		if rollbackErr != nil {
+			common.SysError(fmt.Sprintf("failed to restore top-up %s after refund failure: %s", tradeNo, rollbackErr.Error()))
 		}
+		return nil, err
+	}
+	return finishTopUpRefund(tradeNo, reason, common.TopUpStatusRefunding)
+}
 
-		err = tx.Model(&User{}).Where("id = ?", topUp.UserId).Updates(updateFields).Error
+// finishTopUpRefund 将处于 fromStatuses 之一的订单置为已退款，扣回额度并撤销返佣
+func finishTopUpRefund(tradeNo string, reason string, fromStatuses ...string) (*TopUp, error) {
+	var topUp *TopUp
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if topUp, err = lockTopUpTx(tx, tradeNo); err != nil {
+			return err
+		}
+		if !slices.Contains(fromStatuses, topUp.Status) {
+			return errors.New("只有已支付的订单可以退款")
+		}
+		topUp.RefundTime = common.GetTimestamp()
+		topUp.RefundReason = reason
+		if err := transitionTopUpTx(tx, topUp, common.TopUpStatusRefunded, "refund_time", "refund_reason"); err != nil {
+			return err
+		}
+		quota := topUp.CreditedQuota
+		if quota == 0 {
+			// 早期订单未记录入账额度，按订单信息重新计算
+			quota = TopUpQuota(topUp)
+		}
+		quota += topUp.CouponBonusQuota
+		refunded, err := clawBackTopUpQuotaTx(tx, topUp, quota)
 		if err != nil {
 			return err
 		}
-
-		return nil
+		if err := revokeTopUpReferralCommissionsTx(tx, topUp.TradeNo); err != nil {
+			return err
+		}
+		topUp.RefundedQuota = refunded
+		return tx.Model(&TopUp{}).Where("id = ?", topUp.Id).Update("refunded_quota", refunded).Error
 	})
-
+	if errors.Is(err, ErrTopUpNotPending) {
+		return nil, errors.New("只有已支付的订单可以退款")
+	}
 	if err != nil {
-		return errors.New("充值失败，" + err.Error())
+		return nil, err
 	}
+	refreshTopUpUserCache(topUp)
 
-	RecordLog(topUp.UserId, LogTypeTopup, fmt.Sprintf("使用Creem充值成功，充值额度: %v，支付金额：%.2f", quota, topUp.Money))
+	content := fmt.Sprintf("充值订单 %s 已退款，扣回额度: %v，退款金额：%.2f", topUp.TradeNo, logger.LogQuota(topUp.RefundedQuota), topUp.Money)
+	if reason != "" {
+		content += "，原因：" + reason
+	}
+	RecordLog(topUp.UserId, LogTypeRefund, content)
+	return topUp, nil
+}
 
+// clawBackTopUpQuotaTx 从订单入账的用户或组织余额中扣回额度，最多扣至 0，返回实际扣回的额度。
+// 用户额度按到期时间从额度批次中扣减
+func clawBackTopUpQuotaTx(tx *gorm.DB, topUp *TopUp, quota int) (int, error) {
+	if topUp.OrgId != 0 {
+		org := &Organization{}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "quota").First(org, "id = ?", topUp.OrgId).Error; err != nil {
+			return 0, err
+		}
+		refunded := min(quota, max(org.Quota, 0))
+		if refunded == 0 {
+			return 0, nil
+		}
+		result := tx.Model(&Organization{}).Where("id = ? AND quota >= ?", org.Id, refunded).Update("quota", gorm.Expr("quota - ?", refunded))
+		if err := checkClawBackResult(result); err != nil {
+			return 0, err
+		}
+		return refunded, recordOrgLedger(tx, org.Id, -refunded, LedgerSourceTopupRefund, topUp.TradeNo)
+	}
+	user := &User{}
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "quota").First(user, "id = ?", topUp.UserId).Error; err != nil {
+		return 0, err
+	}
+	refunded := min(quota, max(user.Quota, 0))
+	if refunded == 0 {
+		return 0, nil
+	}
+	result := tx.Model(&User{}).Where("id = ? AND quota >= ?", user.Id, refunded).Update("quota", gorm.Expr("quota - ?", refunded))
+	if err := checkClawBackResult(result); err != nil {
+		return 0, err
+	}
+	if err := debitQuotaLotsTx(tx, user.Id, refunded); err != nil {
+		return 0, err
+	}
+	return refunded, recordUserLedger(tx, user.Id, -refunded, LedgerSourceTopupRefund, topUp.TradeNo)
+}
+
+func checkClawBackResult(result *gorm.DB) error {
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("余额已变动，请重试")
+	}
 	return nil
 }
@@ -0,0 +1,169 @@
+package model
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+func createTestTopUp(t *testing.T, userId int, status string) *TopUp {
+	t.Helper()
+	topUp := &TopUp{
+		UserId:        userId,
+		Amount:        1,
+		Money:         1,
+		TradeNo:       "trade-" + common.GetRandomString(8),
+		PaymentMethod: PaymentProviderAlipay,
+		Provider:      PaymentProviderAlipay,
+		CreateTime:    common.GetTimestamp(),
+		Status:        status,
+	}
+	require.NoError(t, topUp.Insert())
+	return topUp
+}
+
+func TestCompleteTopUp_CreditsOnce(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 0)
+	topUp := createTestTopUp(t, user.Id, common.TopUpStatusPending)
+
+	_, err := CompleteTopUp(topUp.TradeNo, "p1")
+	require.NoError(t, err)
+	_, err = CompleteTopUp(topUp.TradeNo, "p1")
+	require.ErrorIs(t, err, ErrTopUpNotPending)
+	require.Equal(t, int(common.QuotaPerUnit), getTestUserQuota(t, user.Id))
+	requireLedgerBalanced(t, userLedgerAccount(user.Id))
+}
+
+func TestCompleteTopUp_ConcurrentCreditsOnce(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 0)
+	topUp := createTestTopUp(t, user.Id, common.TopUpStatusPending)
+
+	// 模拟支付回调与主节点对账同时完成同一订单
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = CompleteTopUp(topUp.TradeNo, "")
+		}(i)
+	}
+	wg.Wait()
+	succeeded := 0
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+		}
+	}
+	require.Equal(t, 1, succeeded)
+	require.Equal(t, int(common.QuotaPerUnit), getTestUserQuota(t, user.Id))
+	requireLedgerBalanced(t, userLedgerAccount(user.Id))
+}
+
+func TestManualCompleteTopUp_Expired(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 0)
+	topUp := createTestTopUp(t, user.Id, common.TopUpStatusPending)
+	require.NoError(t, ExpireTopUp(topUp.TradeNo))
+
+	require.NoError(t, ManualCompleteTopUp(topUp.TradeNo))
+	require.Equal(t, common.TopUpStatusSuccess, GetTopUpByTradeNo(topUp.TradeNo).Status)
+	require.Equal(t, int(common.QuotaPerUnit), getTestUserQuota(t, user.Id))
+	require.ErrorIs(t, ExpireTopUp(topUp.TradeNo), ErrTopUpNotPending)
+}
+
+func TestRefundTopUp_ProviderFailureRestoresSuccess(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 0)
+	topUp := createTestTopUp(t, user.Id, common.TopUpStatusPending)
+	_, err := CompleteTopUp(topUp.TradeNo, "")
+	require.NoError(t, err)
+
+	_, err = RefundTopUp(topUp.TradeNo, "", func(topUp *TopUp) error {
+		// 调用支付平台时订单已提交为退款中
+		require.Equal(t, common.TopUpStatusRefunding, GetTopUpByTradeNo(topUp.TradeNo).Status)
+		return errors.New("provider down")
+	})
+	require.EqualError(t, err, "provider down")
+	require.Equal(t, common.TopUpStatusSuccess, GetTopUpByTradeNo(topUp.TradeNo).Status)
+	require.Equal(t, int(common.QuotaPerUnit), getTestUserQuota(t, user.Id))
+}
+
+func TestRefundTopUp_ClawsBackFromLots(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 30)
+	topUp := createTestTopUp(t, user.Id, common.TopUpStatusPending)
+	_, err := CompleteTopUp(topUp.TradeNo, "")
+	require.NoError(t, err)
+	require.NoError(t, DeltaUpdateUserQuota(user.Id, -20, "r1"))
+
+	calls := 0
+	refunded, err := RefundTopUp(topUp.TradeNo, "test", func(*TopUp) error {
+		calls++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, calls)
+	require.Equal(t, common.TopUpStatusRefunded, refunded.Status)
+	require.Equal(t, int(common.QuotaPerUnit), refunded.RefundedQuota)
+	require.Equal(t, common.TopUpStatusRefunded, GetTopUpByTradeNo(topUp.TradeNo).Status)
+
+	// 余额与额度批次同步扣减
+	remain := 30 - 20
+	require.Equal(t, remain, getTestUserQuota(t, user.Id))
+	total := 0
+	for _, amount := range getTestLotRemains(t, user.Id) {
+		total += amount
+	}
+	require.Equal(t, remain, total)
+	requireLedgerBalanced(t, userLedgerAccount(user.Id))
+
+	_, err = RefundTopUp(topUp.TradeNo, "", nil)
+	require.Error(t, err)
+}
+
+func TestRefundTopUp_OfflineFinishesRefunding(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 0)
+	topUp := createTestTopUp(t, user.Id, common.TopUpStatusPending)
+	_, err := CompleteTopUp(topUp.TradeNo, "")
+	require.NoError(t, err)
+	// 支付平台已退款但进程在扣回额度前退出，订单停留在退款中
+	require.NoError(t, DB.Model(&TopUp{}).Where("id = ?", topUp.Id).Update("status", common.TopUpStatusRefunding).Error)
+
+	_, err = RefundTopUp(topUp.TradeNo, "", func(*TopUp) error { return nil })
+	require.Error(t, err)
+	refunded, err := RefundTopUp(topUp.TradeNo, "", nil)
+	require.NoError(t, err)
+	require.Equal(t, common.TopUpStatusRefunded, refunded.Status)
+	require.Equal(t, 0, getTestUserQuota(t, user.Id))
+}
+
+func TestGetPendingTopUps_Cursor(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 0)
+	first := createTestTopUp(t, user.Id, common.TopUpStatusPending)
+	createTestTopUp(t, user.Id, common.TopUpStatusSuccess)
+	third := createTestTopUp(t, user.Id, common.TopUpStatusPending)
+	before := common.GetTimestamp() + 1
+
+	topUps, err := GetPendingTopUps(before, 0, 1)
+	require.NoError(t, err)
+	require.Len(t, topUps, 1)
+	require.Equal(t, first.Id, topUps[0].Id)
+
+	topUps, err = GetPendingTopUps(before, first.Id, 10)
+	require.NoError(t, err)
+	require.Len(t, topUps, 1)
+	require.Equal(t, third.Id, topUps[0].Id)
+
+	topUps, err = GetPendingTopUps(first.CreateTime, 0, 10)
+	require.NoError(t, err)
+	require.Empty(t, topUps)
+}
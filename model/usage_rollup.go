@@ -0,0 +1,402 @@
+package model
+
+import (
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+
+	"github.com/samber/lo"
+	"gorm.io/gorm"
+)
+
+const (
+	UsageRollupGranularityHour = "hour"
+	UsageRollupGranularityDay  = "day"
+
+	usageRollupHourSeconds = 3600
+	usageRollupDaySeconds  = 86400
+	// 只汇总一分钟之前写入的日志，减少并发写入尚未提交造成的遗漏
+	usageRollupLagSeconds = 60
+	// 每轮重新汇总 CoveredUntil 之前这段时间所在的小时桶，补上晚于上一轮提交的日志
+	usageRollupRescanSeconds = 600
+)
+
+// UsageRollup 按用户、令牌、渠道、模型和分组聚合的用量，BucketStart 为 UTC 整点或零点
+type UsageRollup struct {
+	Id          int    `json:"-"`
+	BucketStart int64  `json:"bucket_start" gorm:"bigint;uniqueIndex:,composite:rollup_key,priority:1"`
+	UserId      int    `json:"user_id" gorm:"uniqueIndex:,composite:rollup_key,priority:2"`
+	TokenId     int    `json:"token_id" gorm:"uniqueIndex:,composite:rollup_key,priority:3"`
+	ChannelId   int    `json:"channel_id" gorm:"uniqueIndex:,composite:rollup_key,priority:4"`
+	ModelName   string `json:"model_name" gorm:"type:varchar(255);uniqueIndex:,composite:rollup_key,priority:5"`
+	Group       string `json:"group" gorm:"column:group_name;type:varchar(64);uniqueIndex:,composite:rollup_key,priority:6"`
+	// 用户名和令牌名不参与聚合，保存桶内字典序最大的名称，用于按名称筛选
+	Username         string `json:"username" gorm:"type:varchar(64);index;default:''"`
+	TokenName        string `json:"token_name" gorm:"type:varchar(255);default:''"`
+	RequestCount     int64  `json:"request_count" gorm:"default:0"`
+	ErrorCount       int64  `json:"error_count" gorm:"default:0"`
+	PromptTokens     int64  `json:"prompt_tokens" gorm:"default:0"`
+	CompletionTokens int64  `json:"completion_tokens" gorm:"default:0"`
+	Quota            int64  `json:"quota" gorm:"default:0"`
+	// 消费请求耗时之和（秒），除以 RequestCount 即平均耗时
+	UseTimeSum int64 `json:"use_time_sum" gorm:"default:0"`
+}
+
+type UsageRollupHourly struct {
+	UsageRollup
+}
+
+func (UsageRollupHourly) TableName() string {
+	return "usage_rollups_hourly"
+}
+
+type UsageRollupDaily struct {
+	UsageRollup
+}
+
+func (UsageRollupDaily) TableName() string {
+	return "usage_rollups_daily"
+}
+
+// UsageRollupState 汇总进度，只有一行，CoveredUntil 之前的日志均已汇总
+type UsageRollupState struct {
+	Id           int   `json:"id"`
+	CoveredUntil int64 `json:"covered_until" gorm:"bigint;default:0"`
+	UpdatedAt    int64 `json:"updated_at" gorm:"bigint"`
+}
+
+const usageRollupStateId = 1
+
+func GetUsageRollupState() (*UsageRollupState, error) {
+	var state UsageRollupState
+	err := LOG_DB.Where("id = ?", usageRollupStateId).Limit(1).Find(&state).Error
+	return &state, err
+}
+
+// RollupUsageLogs 从重扫窗口起逐小时重新聚合消费与错误日志，覆盖写入小时表并由小时表重算所涉及的天，
+// 最多处理 maxHours 个小时桶，返回处理的小时桶数。覆盖写入是幂等的，重复执行或日志晚于上一轮提交都不会重复累加。
+func RollupUsageLogs(maxHours int) (int, error) {
+	state, err := GetUsageRollupState()
+	if err != nil {
+		return 0, err
+	}
+	cutoff := common.GetTimestamp() - usageRollupLagSeconds
+	start := state.CoveredUntil - usageRollupRescanSeconds
+	if state.CoveredUntil == 0 {
+		// 首次汇总从最早的日志开始
+		start = cutoff
+		var first int64
+		err = LOG_DB.Table("logs").Select("coalesce(min(created_at), 0)").
+			Where("type IN ?", []int{LogTypeConsume, LogTypeError}).Scan(&first).Error
+		if err != nil {
+			return 0, err
+		}
+		if first > 0 {
+			start = first
+		}
+	}
+
+	hours := 0
+	err = LOG_DB.Transaction(func(tx *gorm.DB) error {
+		days := make([]int64, 0, 2)
+		for from := floorUsageBucket(start, usageRollupHourSeconds); from < cutoff && hours < maxHours; from += usageRollupHourSeconds {
+			to := min(from+usageRollupHourSeconds, cutoff)
+			if err := rollupUsageHour(tx, from, to); err != nil {
+				return err
+			}
+			if day := floorUsageBucket(from, usageRollupDaySeconds); len(days) == 0 || days[len(days)-1] != day {
+				days = append(days, day)
+			}
+			state.CoveredUntil = max(state.CoveredUntil, to)
+			hours++
+		}
+		for _, day := range days {
+			if err := rollupUsageDay(tx, day); err != nil {
+				return err
+			}
+		}
+		state.UpdatedAt = common.GetTimestamp()
+		return saveUsageRollupState(tx, state)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return hours, nil
+}
+
+// rollupUsageHour 聚合 [from, to) 内的日志，替换 from 所在小时桶的全部汇总行
+func rollupUsageHour(tx *gorm.DB, from int64, to int64) error {
+	var rollups []*UsageRollup
+	err := tx.Table("logs").
+		Select("user_id, token_id, channel_id, model_name, "+logGroupCol+" as group_name, "+
+			"max(username) as username, max(token_name) as token_name, "+
+			"sum(CASE WHEN type = ? THEN 1 ELSE 0 END) as request_count, "+
+			"sum(CASE WHEN type = ? THEN 1 ELSE 0 END) as error_count, "+
+			"sum(CASE WHEN type = ? THEN prompt_tokens ELSE 0 END) as prompt_tokens, "+
+			"sum(CASE WHEN type = ? THEN completion_tokens ELSE 0 END) as completion_tokens, "+
+			"sum(CASE WHEN type = ? THEN quota ELSE 0 END) as quota, "+
+			"sum(CASE WHEN type = ? THEN use_time ELSE 0 END) as use_time_sum",
+			LogTypeConsume, LogTypeError, LogTypeConsume, LogTypeConsume, LogTypeConsume, LogTypeConsume).
+		Where("created_at >= ? AND created_at < ? AND type IN ?", from, to, []int{LogTypeConsume, LogTypeError}).
+		Group("user_id, token_id, channel_id, model_name, " + logGroupCol).
+		Scan(&rollups).Error
+	if err != nil {
+		return err
+	}
+	if err := tx.Where("bucket_start = ?", from).Delete(&UsageRollupHourly{}).Error; err != nil {
+		return err
+	}
+	if len(rollups) == 0 {
+		return nil
+	}
+	rows := make([]*UsageRollupHourly, len(rollups))
+	for i, rollup := range rollups {
+		rollup.BucketStart = from
+		rows[i] = &UsageRollupHourly{UsageRollup: *rollup}
+	}
+	return tx.CreateInBatches(rows, 100).Error
+}
+
+// rollupUsageDay 由小时表重算 day 当天的天汇总行
+func rollupUsageDay(tx *gorm.DB, day int64) error {
+	var rollups []*UsageRollup
+	err := tx.Table(UsageRollupHourly{}.TableName()).
+		Select("user_id, token_id, channel_id, model_name, group_name, "+
+			"max(username) as username, max(token_name) as token_name, "+
+			"sum(request_count) as request_count, sum(error_count) as error_count, "+
+			"sum(prompt_tokens) as prompt_tokens, sum(completion_tokens) as completion_tokens, "+
+			"sum(quota) as quota, sum(use_time_sum) as use_time_sum").
+		Where("bucket_start >= ? AND bucket_start < ?", day, day+usageRollupDaySeconds).
+		Group("user_id, token_id, channel_id, model_name, group_name").
+		Scan(&rollups).Error
+	if err != nil {
+		return err
+	}
+	if err := tx.Where("bucket_start = ?", day).Delete(&UsageRollupDaily{}).Error; err != nil {
+		return err
+	}
+	if len(rollups) == 0 {
+		return nil
+	}
+	rows := make([]*UsageRollupDaily, len(rollups))
+	for i, rollup := range rollups {
+		rollup.BucketStart = day
+		rows[i] = &UsageRollupDaily{UsageRollup: *rollup}
+	}
+	return tx.CreateInBatches(rows, 100).Error
+}
+
+func saveUsageRollupState(tx *gorm.DB, state *UsageRollupState) error {
+	if state.Id == 0 {
+		state.Id = usageRollupStateId
+		return tx.Create(state).Error
+	}
+	return tx.Model(&UsageRollupState{}).Where("id = ?", state.Id).Updates(map[string]interface{}{
+		"covered_until": state.CoveredUntil,
+		"updated_at":    state.UpdatedAt,
+	}).Error
+}
+
+// DeleteOldUsageRollups 删除 bucket_start 早于 targetTimestamp 的汇总行
+func DeleteOldUsageRollups(granularity string, targetTimestamp int64) (int64, error) {
+	var result *gorm.DB
+	if granularity == UsageRollupGranularityDay {
+		result = LOG_DB.Where("bucket_start < ?", targetTimestamp).Delete(&UsageRollupDaily{})
+	} else {
+		// 重扫窗口所在的天仍需由小时表重算，这些小时行暂不删除
+		state, err := GetUsageRollupState()
+		if err != nil {
+			return 0, err
+		}
+		targetTimestamp = min(targetTimestamp, floorUsageBucket(state.CoveredUntil-usageRollupRescanSeconds, usageRollupDaySeconds))
+		result = LOG_DB.Where("bucket_start < ?", targetTimestamp).Delete(&UsageRollupHourly{})
+	}
+	return result.RowsAffected, result.Error
+}
+
+type usageRollupFilter struct {
+	UserId    int
+	TokenIds  []int
+	Username  string
+	TokenName string
+	ModelName string
+	ChannelId int
+	Group     string
+}
+
+func (f usageRollupFilter) apply(tx *gorm.DB) *gorm.DB {
+	if f.UserId != 0 {
+		tx = tx.Where("user_id = ?", f.UserId)
+	}
+	if f.TokenIds != nil {
+		tx = tx.Where("token_id IN ?", f.TokenIds)
+	}
+	if f.Username != "" {
+		tx = tx.Where("username = ?", f.Username)
+	}
+	if f.TokenName != "" {
+		tx = tx.Where("token_name = ?", f.TokenName)
+	}
+	if f.ModelName != "" {
+		tx = tx.Where("model_name like ?", f.ModelName)
+	}
+	if f.ChannelId != 0 {
+		tx = tx.Where("channel_id = ?", f.ChannelId)
+	}
+	if f.Group != "" {
+		tx = tx.Where("group_name = ?", f.Group)
+	}
+	return tx
+}
+
+func floorUsageBucket(timestamp int64, size int64) int64 {
+	return timestamp - timestamp%size
+}
+
+func ceilUsageBucket(timestamp int64, size int64) int64 {
+	return floorUsageBucket(timestamp+size-1, size)
+}
+
+// usageRollupRange 左闭右开的时间区间，Table 为空表示读原始日志
+type usageRollupRange struct {
+	Table string
+	Start int64
+	End   int64
+}
+
+// splitUsageRollupRanges 拆分 [start, end)：整天读天表，剩余整点读小时表，两端不足一小时的部分以及尚未汇总的部分读原始日志
+func splitUsageRollupRanges(start int64, end int64, coveredUntil int64) []usageRollupRange {
+	rollStart := ceilUsageBucket(start, usageRollupHourSeconds)
+	rollEnd := min(floorUsageBucket(end, usageRollupHourSeconds), floorUsageBucket(coveredUntil, usageRollupHourSeconds))
+	if rollStart >= rollEnd {
+		return []usageRollupRange{{Start: start, End: end}}
+	}
+	hourly := UsageRollupHourly{}.TableName()
+	ranges := []usageRollupRange{{Start: start, End: rollStart}}
+	dayStart := ceilUsageBucket(rollStart, usageRollupDaySeconds)
+	dayEnd := floorUsageBucket(rollEnd, usageRollupDaySeconds)
+	if dayStart < dayEnd {
+		ranges = append(ranges,
+			usageRollupRange{Table: hourly, Start: rollStart, End: dayStart},
+			usageRollupRange{Table: UsageRollupDaily{}.TableName(), Start: dayStart, End: dayEnd},
+			usageRollupRange{Table: hourly, Start: dayEnd, End: rollEnd})
+	} else {
+		ranges = append(ranges, usageRollupRange{Table: hourly, Start: rollStart, End: rollEnd})
+	}
+	ranges = append(ranges, usageRollupRange{Start: rollEnd, End: end})
+	return lo.Filter(ranges, func(r usageRollupRange, _ int) bool {
+		return r.Start < r.End
+	})
+}
+
+// scanRolledUpUsage 对 [start, end) 的每个区间分别查询：汇总表区间以 rollupSelect 查询并套用 filter，
+// 原始日志区间以 logsSelect 在 logsQuery 上查询，两者须产出相同的列，结果按区间依次追加到 dest，由调用方合并
+func scanRolledUpUsage[T any](start int64, end int64, coveredUntil int64, filter usageRollupFilter, rollupSelect string,
+	logsQuery *gorm.DB, logsSelect string, groupBy string, logsGroupBy string) ([]*T, error) {
+	var rows []*T
+	for _, r := range splitUsageRollupRanges(start, end, coveredUntil) {
+		var part []*T
+		var tx *gorm.DB
+		if r.Table == "" {
+			tx = logsQuery.Session(&gorm.Session{}).Select(logsSelect).
+				Where("created_at >= ? AND created_at < ?", r.Start, r.End)
+			if logsGroupBy != "" {
+				tx = tx.Group(logsGroupBy)
+			}
+		} else {
+			tx = filter.apply(LOG_DB.Table(r.Table).Select(rollupSelect).
+				Where("bucket_start >= ? AND bucket_start < ?", r.Start, r.End))
+			if groupBy != "" {
+				tx = tx.Group(groupBy)
+			}
+		}
+		if err := tx.Scan(&part).Error; err != nil {
+			return nil, err
+		}
+		rows = append(rows, part...)
+	}
+	return rows, nil
+}
+
+// loadUsageRollupCoverage 开启用量汇总且已有汇总进度时返回 CoveredUntil，否则统计接口应直接查询原始日志
+func loadUsageRollupCoverage() (int64, bool) {
+	if !operation_setting.GetUsageRollupSetting().Enabled {
+		return 0, false
+	}
+	state, err := GetUsageRollupState()
+	if err != nil || state.CoveredUntil == 0 {
+		return 0, false
+	}
+	return state.CoveredUntil, true
+}
+
+// UsageRollupQuery 汇总时间序列查询条件，GroupBy 为空时只按时间桶聚合
+type UsageRollupQuery struct {
+	Granularity    string
+	StartTimestamp int64
+	EndTimestamp   int64
+	UserId         int
+	Username       string
+	TokenName      string
+	ModelName      string
+	ChannelId      int
+	Group          string
+	GroupBy        string
+}
+
+type UsageRollupPoint struct {
+	BucketStart      int64  `json:"bucket_start"`
+	Dimension        string `json:"key"`
+	RequestCount     int64  `json:"request_count"`
+	ErrorCount       int64  `json:"error_count"`
+	PromptTokens     int64  `json:"prompt_tokens"`
+	CompletionTokens int64  `json:"completion_tokens"`
+	Quota            int64  `json:"quota"`
+	UseTimeSum       int64  `json:"use_time_sum"`
+}
+
+var usageRollupGroupByColumns = map[string]string{
+	"model":   "model_name",
+	"channel": "channel_id",
+	"user":    "username",
+	"token":   "token_name",
+	"group":   "group_name",
+}
+
+// IsValidUsageRollupGroupBy 判断聚合维度是否受支持，空字符串表示不分维度
+func IsValidUsageRollupGroupBy(groupBy string) bool {
+	_, ok := usageRollupGroupByColumns[groupBy]
+	return ok || groupBy == ""
+}
+
+// GetUsageRollups 按时间桶和可选维度返回汇总数据，最多返回 limit 行
+func GetUsageRollups(query UsageRollupQuery, limit int) (points []*UsageRollupPoint, err error) {
+	table := UsageRollupHourly{}.TableName()
+	if query.Granularity == UsageRollupGranularityDay {
+		table = UsageRollupDaily{}.TableName()
+	}
+	keyColumn := "''"
+	groupBy := "bucket_start"
+	if column, ok := usageRollupGroupByColumns[query.GroupBy]; ok {
+		keyColumn = column
+		groupBy += ", " + column
+	}
+	tx := LOG_DB.Table(table).Select("bucket_start, " + keyColumn + " as dimension" +
+		", sum(request_count) request_count, sum(error_count) error_count, sum(prompt_tokens) prompt_tokens" +
+		", sum(completion_tokens) completion_tokens, sum(quota) quota, sum(use_time_sum) use_time_sum")
+	if query.StartTimestamp != 0 {
+		tx = tx.Where("bucket_start >= ?", query.StartTimestamp)
+	}
+	if query.EndTimestamp != 0 {
+		tx = tx.Where("bucket_start <= ?", query.EndTimestamp)
+	}
+	tx = usageRollupFilter{
+		UserId:    query.UserId,
+		Username:  query.Username,
+		TokenName: query.TokenName,
+		ModelName: query.ModelName,
+		ChannelId: query.ChannelId,
+		Group:     query.Group,
+	}.apply(tx)
+	err = tx.Group(groupBy).Order("bucket_start asc").Limit(limit).Scan(&points).Error
+	return points, err
+}
@@ -0,0 +1,195 @@
+package model
+
+import (
+	"context"
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+func createTestUsageLog(t *testing.T, userId int, tokenId int, logType int, quota int, createdAt int64) {
+	t.Helper()
+	require.NoError(t, LOG_DB.Create(&Log{
+		UserId:           userId,
+		Username:         "user",
+		TokenId:          tokenId,
+		TokenName:        "token",
+		ModelName:        "gpt-4o",
+		Group:            "default",
+		Type:             logType,
+		Quota:            quota,
+		PromptTokens:     quota,
+		CompletionTokens: 1,
+		CreatedAt:        createdAt,
+	}).Error)
+}
+
+func sumTestRollups(t *testing.T, table string) (requests int64, errors int64, quota int64) {
+	t.Helper()
+	var row struct {
+		RequestCount int64
+		ErrorCount   int64
+		Quota        int64
+	}
+	require.NoError(t, LOG_DB.Table(table).
+		Select("coalesce(sum(request_count), 0) as request_count, coalesce(sum(error_count), 0) as error_count, coalesce(sum(quota), 0) as quota").
+		Scan(&row).Error)
+	return row.RequestCount, row.ErrorCount, row.Quota
+}
+
+func TestRollupUsageLogs_IdempotentAndRescansLateLogs(t *testing.T) {
+	setupTestDB(t)
+	now := common.GetTimestamp()
+	createTestUsageLog(t, 1, 1, LogTypeConsume, 10, now-2*usageRollupHourSeconds)
+	createTestUsageLog(t, 1, 1, LogTypeError, 0, now-2*usageRollupHourSeconds)
+	createTestUsageLog(t, 1, 1, LogTypeTopup, 1000, now-2*usageRollupHourSeconds)
+
+	_, err := RollupUsageLogs(100)
+	require.NoError(t, err)
+	state, err := GetUsageRollupState()
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, state.CoveredUntil, now-usageRollupLagSeconds)
+
+	// 日志的 created_at 早于 CoveredUntil，但在上一轮之后才提交
+	createTestUsageLog(t, 1, 1, LogTypeConsume, 5, state.CoveredUntil-120)
+	for i := 0; i < 2; i++ {
+		_, err = RollupUsageLogs(100)
+		require.NoError(t, err)
+	}
+
+	for _, table := range []string{UsageRollupHourly{}.TableName(), UsageRollupDaily{}.TableName()} {
+		requests, errorCount, quota := sumTestRollups(t, table)
+		require.Equal(t, int64(2), requests, table)
+		require.Equal(t, int64(1), errorCount, table)
+		require.Equal(t, int64(15), quota, table)
+	}
+}
+
+func TestRollupUsageLogs_BatchesByHour(t *testing.T) {
+	setupTestDB(t)
+	now := common.GetTimestamp()
+	for i := 1; i <= 5; i++ {
+		createTestUsageLog(t, 1, 1, LogTypeConsume, 1, now-int64(i)*usageRollupHourSeconds)
+	}
+
+	hours, err := RollupUsageLogs(2)
+	require.NoError(t, err)
+	require.Equal(t, 2, hours)
+	state, err := GetUsageRollupState()
+	require.NoError(t, err)
+	require.LessOrEqual(t, state.CoveredUntil, now-3*usageRollupHourSeconds)
+
+	for i := 0; i < 5; i++ {
+		_, err = RollupUsageLogs(2)
+		require.NoError(t, err)
+	}
+	requests, _, quota := sumTestRollups(t, UsageRollupHourly{}.TableName())
+	require.Equal(t, int64(5), requests)
+	require.Equal(t, int64(5), quota)
+}
+
+func TestDeleteOldLogByType_KeepsOtherTypes(t *testing.T) {
+	setupTestDB(t)
+	now := common.GetTimestamp()
+	createTestUsageLog(t, 1, 1, LogTypeConsume, 10, now-3*usageRollupDaySeconds)
+	createTestUsageLog(t, 1, 1, LogTypeConsume, 10, now)
+	createTestUsageLog(t, 1, 1, LogTypeError, 0, now-3*usageRollupDaySeconds)
+	createTestUsageLog(t, 1, 1, LogTypeTopup, 1000, now-3*usageRollupDaySeconds)
+
+	deleted, err := DeleteOldLogByType(context.Background(), now-usageRollupDaySeconds, LogTypeConsume, 1)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), deleted)
+	var types []int
+	require.NoError(t, LOG_DB.Model(&Log{}).Order("type").Pluck("type", &types).Error)
+	require.Equal(t, []int{LogTypeTopup, LogTypeConsume, LogTypeError}, types)
+}
+
+func TestGetQuotaDataByUserId_FromRollups(t *testing.T) {
+	setupTestDB(t)
+	now := common.GetTimestamp()
+	hour := floorUsageBucket(now, usageRollupHourSeconds) - 2*usageRollupHourSeconds
+	createTestUsageLog(t, 1, 1, LogTypeConsume, 10, hour+10)
+	createTestUsageLog(t, 1, 1, LogTypeConsume, 20, hour+20)
+	createTestUsageLog(t, 2, 2, LogTypeConsume, 40, hour+30)
+	_, err := RollupUsageLogs(100)
+	require.NoError(t, err)
+	// 尚未汇总的日志从原始日志补齐
+	createTestUsageLog(t, 1, 1, LogTypeConsume, 5, now)
+
+	quotaData, err := GetQuotaDataByUserId(1, hour, now)
+	require.NoError(t, err)
+	require.Len(t, quotaData, 2)
+	total := 0
+	for _, data := range quotaData {
+		require.Equal(t, 1, data.UserID)
+		require.Equal(t, "gpt-4o", data.ModelName)
+		require.Zero(t, data.CreatedAt%usageRollupHourSeconds)
+		total += data.Quota
+	}
+	require.Equal(t, 35, total)
+	require.Equal(t, hour, quotaData[0].CreatedAt)
+	require.Equal(t, 2, quotaData[0].Count)
+	require.Equal(t, 32, quotaData[0].TokenUsed)
+
+	all, err := GetAllQuotaDates(hour, now, "")
+	require.NoError(t, err)
+	require.Equal(t, 70, all[0].Quota)
+	require.Equal(t, 3, all[0].Count)
+}
+
+func TestGetOrgUsageStats_FromRollupsMatchesLogs(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 0)
+	org := createTestOrg(t, user.Id)
+	token := &Token{UserId: user.Id, OrgId: org.Id, Key: common.GetRandomString(48), Name: "org"}
+	require.NoError(t, DB.Create(token).Error)
+
+	now := common.GetTimestamp()
+	start := now - 3*usageRollupDaySeconds
+	for _, createdAt := range []int64{start + 100, now - usageRollupDaySeconds, now - 1800, now} {
+		createTestUsageLog(t, user.Id, token.Id, LogTypeConsume, 10, createdAt)
+	}
+	createTestUsageLog(t, user.Id, token.Id+1, LogTypeConsume, 99, now-1800)
+	for i := 0; i < 10; i++ {
+		hours, err := RollupUsageLogs(24)
+		require.NoError(t, err)
+		if hours < 24 {
+			break
+		}
+	}
+
+	stats, err := getOrgUsageStatsFromRollups([]int{token.Id}, start, now, now-usageRollupLagSeconds)
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	require.Equal(t, 4, stats[0].Count)
+	require.Equal(t, 40, stats[0].Quota)
+	require.Equal(t, 44, stats[0].CompletionTokens+stats[0].PromptTokens)
+
+	viaApi, err := GetOrgUsageStats(org.Id, start, now)
+	require.NoError(t, err)
+	require.Equal(t, stats, viaApi)
+}
+
+func TestDeleteOldUsageRollups_KeepsHoursOfRescannedDay(t *testing.T) {
+	setupTestDB(t)
+	now := common.GetTimestamp()
+	latest := now - usageRollupLagSeconds - 1
+	day := floorUsageBucket(latest, usageRollupDaySeconds)
+	createTestUsageLog(t, 1, 1, LogTypeConsume, 10, day-usageRollupHourSeconds)
+	createTestUsageLog(t, 1, 1, LogTypeConsume, 10, latest)
+	for i := 0; i < 5; i++ {
+		_, err := RollupUsageLogs(24)
+		require.NoError(t, err)
+	}
+
+	// 重扫窗口所在当天的小时行需保留，才能由小时表重算当天汇总
+	_, err := DeleteOldUsageRollups(UsageRollupGranularityHour, now)
+	require.NoError(t, err)
+	_, err = RollupUsageLogs(24)
+	require.NoError(t, err)
+	var daily UsageRollupDaily
+	require.NoError(t, LOG_DB.Where("bucket_start = ?", day).First(&daily).Error)
+	require.Equal(t, int64(10), daily.Quota)
+}
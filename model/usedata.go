@@ -6,6 +6,8 @@ import (
 	"time"
 
 	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+
 	"gorm.io/gorm"
 )
 
@@ -102,6 +104,9 @@ func increaseQuotaData(userId int, username string, modelName string, count int,
 }
 
 func GetQuotaDataByUsername(username string, startTime int64, endTime int64) (quotaData []*QuotaData, err error) {
+	if quotaData, ok := getQuotaDataFromRollups(startTime, endTime, usageRollupFilter{Username: username}, true); ok {
+		return quotaData, nil
+	}
 	var quotaDatas []*QuotaData
 	// 从quota_data表中查询数据
 	err = DB.Table("quota_data").Where("username = ? and created_at >= ? and created_at <= ?", username, startTime, endTime).Find(&quotaDatas).Error
@@ -109,6 +114,9 @@ func GetQuotaDataByUsername(username string, startTime int64, endTime int64) (qu
 }
 
 func GetQuotaDataByUserId(userId int, startTime int64, endTime int64) (quotaData []*QuotaData, err error) {
+	if quotaData, ok := getQuotaDataFromRollups(startTime, endTime, usageRollupFilter{UserId: userId}, true); ok {
+		return quotaData, nil
+	}
 	var quotaDatas []*QuotaData
 	// 从quota_data表中查询数据
 	err = DB.Table("quota_data").Where("user_id = ? and created_at >= ? and created_at <= ?", userId, startTime, endTime).Find(&quotaDatas).Error
@@ -119,6 +127,9 @@ func GetAllQuotaDates(startTime int64, endTime int64, username string) (quotaDat
 	if username != "" {
 		return GetQuotaDataByUsername(username, startTime, endTime)
 	}
+	if quotaData, ok := getQuotaDataFromRollups(startTime, endTime, usageRollupFilter{}, false); ok {
+		return quotaData, nil
+	}
 	var quotaDatas []*QuotaData
 	// 从quota_data表中查询数据
 	// only select model_name, sum(count) as count, sum(quota) as quota, model_name, created_at from quota_data group by model_name, created_at;
@@ -126,3 +137,60 @@ func GetAllQuotaDates(startTime int64, endTime int64, username string) (quotaDat
 	err = DB.Table("quota_data").Select("model_name, sum(count) as count, sum(quota) as quota, sum(token_used) as token_used, created_at").Where("created_at >= ? and created_at <= ?", startTime, endTime).Group("model_name, created_at").Find(&quotaDatas).Error
 	return quotaDatas, err
 }
+
+// getQuotaDataFromRollups 开启用量汇总且所查区间的小时汇总仍在保留期内时，由小时汇总表与尚未汇总的原始消费日志生成看板数据，
+// 与 quota_data 一样按整点桶的起始时间筛选；byUser 为 false 时各用户的数据按模型合并
+func getQuotaDataFromRollups(startTime int64, endTime int64, filter usageRollupFilter, byUser bool) ([]*QuotaData, bool) {
+	coveredUntil, ok := loadUsageRollupCoverage()
+	if !ok {
+		return nil, false
+	}
+	setting := operation_setting.GetUsageRollupSetting()
+	if setting.HourlyRetentionDays > 0 && startTime < common.GetTimestamp()-int64(setting.HourlyRetentionDays)*86400 {
+		return nil, false
+	}
+	columns, groupBy := "model_name", "model_name"
+	if byUser {
+		columns, groupBy = "user_id, max(username) as username, model_name", "user_id, model_name"
+	}
+	var rows []*struct {
+		QuotaData
+		BucketStart int64
+	}
+	coveredHour := floorUsageBucket(coveredUntil, usageRollupHourSeconds)
+	err := filter.apply(LOG_DB.Table(UsageRollupHourly{}.TableName()).
+		Select(columns+", bucket_start, sum(request_count) as count, sum(quota) as quota, sum(prompt_tokens) + sum(completion_tokens) as token_used").
+		Where("bucket_start >= ? AND bucket_start <= ? AND bucket_start < ?", startTime, endTime, coveredHour)).
+		Group(groupBy + ", bucket_start").Scan(&rows).Error
+	if err != nil {
+		return nil, false
+	}
+
+	// 尚未汇总的整点桶读原始日志
+	bucketExpr := fmt.Sprintf("created_at - created_at %% %d", usageRollupHourSeconds)
+	logsQuery := LOG_DB.Table("logs").
+		Select(columns+", "+bucketExpr+" as bucket_start, count(*) as count, sum(quota) as quota, sum(prompt_tokens) + sum(completion_tokens) as token_used").
+		Where("type = ? AND created_at >= ? AND created_at < ?", LogTypeConsume,
+			max(ceilUsageBucket(startTime, usageRollupHourSeconds), coveredHour),
+			floorUsageBucket(endTime, usageRollupHourSeconds)+usageRollupHourSeconds)
+	if filter.UserId != 0 {
+		logsQuery = logsQuery.Where("user_id = ?", filter.UserId)
+	}
+	if filter.Username != "" {
+		logsQuery = logsQuery.Where("username = ?", filter.Username)
+	}
+	var tail []*struct {
+		QuotaData
+		BucketStart int64
+	}
+	if err := logsQuery.Group(groupBy + ", " + bucketExpr).Scan(&tail).Error; err != nil {
+		return nil, false
+	}
+
+	quotaData := make([]*QuotaData, 0, len(rows)+len(tail))
+	for _, row := range append(rows, tail...) {
+		row.QuotaData.CreatedAt = row.BucketStart
+		quotaData = append(quotaData, &row.QuotaData)
+	}
+	return quotaData, true
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/dto"
 	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
 
 	"github.com/bytedance/gopkg/util/gopool"
 	"gorm.io/gorm"
@@ -47,17 +48,19 @@ type User struct {
 	Setting          string         `json:"setting" gorm:"type:text;column:setting"`
 	Remark           string         `json:"remark,omitempty" gorm:"type:varchar(255)" validate:"max=255"`
 	StripeCustomer   string         `json:"stripe_customer" gorm:"type:varchar(64);column:stripe_customer;index"`
+	CreditLimit      int            `json:"credit_limit" gorm:"type:int;default:0"` // 后付费信用额度，大于 0 时余额可透支至 -CreditLimit
 }
 
 func (user *User) ToBaseUser() *UserBase {
 	cache := &UserBase{
-		Id:       user.Id,
-		Group:    user.Group,
-		Quota:    user.Quota,
-		Status:   user.Status,
-		Username: user.Username,
-		Setting:  user.Setting,
-		Email:    user.Email,
+		Id:          user.Id,
+		Group:       user.Group,
+		Quota:       user.Quota,
+		Status:      user.Status,
+		Username:    user.Username,
+		Setting:     user.Setting,
+		Email:       user.Email,
+		CreditLimit: user.CreditLimit,
 	}
 	return cache
 }
@@ -325,15 +328,13 @@ func HardDeleteUserById(id int) error {
 	return err
 }
 
+// inviteUser 增加邀请人的邀请人数与邀请额度，按相对值更新，不覆盖并发发放的返佣与其余字段
 func inviteUser(inviterId int) (err error) {
-	user, err := GetUserById(inviterId, true)
-	if err != nil {
-		return err
-	}
-	user.AffCount++
-	user.AffQuota += common.QuotaForInviter
-	user.AffHistoryQuota += common.QuotaForInviter
-	return DB.Save(user).Error
+	return DB.Model(&User{}).Where("id = ?", inviterId).Updates(map[string]interface{}{
+		"aff_count":   gorm.Expr("aff_count + ?", 1),
+		"aff_quota":   gorm.Expr("aff_quota + ?", common.QuotaForInviter),
+		"aff_history": gorm.Expr("aff_history + ?", common.QuotaForInviter),
+	}).Error
 }
 
 func (user *User) TransferAffQuotaToQuota(quota int) error {
@@ -349,23 +350,21 @@ func (user *User) TransferAffQuotaToQuota(quota int) error {
 	}
 	defer tx.Rollback() // 确保在函数退出时事务能回滚
 
-	// 加锁查询用户以确保数据一致性
-	err := tx.Set("gorm:query_option", "FOR UPDATE").First(&user, user.Id).Error
-	if err != nil {
-		return err
+	// 按条件相对更新，避免覆盖并发发放的返佣与并发消费的额度
+	result := tx.Model(&User{}).Where("id = ? AND aff_quota >= ?", user.Id, quota).Updates(map[string]interface{}{
+		"aff_quota": gorm.Expr("aff_quota - ?", quota),
+		"quota":     gorm.Expr("quota + ?", quota),
+	})
+	if result.Error != nil {
+		return result.Error
 	}
-
-	// 再次检查用户的AffQuota是否足够
-	if user.AffQuota < quota {
+	if result.RowsAffected == 0 {
 		return errors.New("邀请额度不足！")
 	}
-
-	// 更新用户额度
-	user.AffQuota -= quota
-	user.Quota += quota
-
-	// 保存用户状态
-	if err := tx.Save(user).Error; err != nil {
+	if err := recordUserLedger(tx, user.Id, quota, LedgerSourceReferral, "aff"); err != nil {
+		return err
+	}
+	if err := RecordQuotaLot(tx, user.Id, QuotaLotSourceReferral, "aff", quota, operation_setting.GetQuotaSetting().ReferralQuotaExpireDays); err != nil {
 		return err
 	}
 
@@ -413,11 +412,16 @@ func (user *User) Insert(inviterId int) error {
 	}
 
 	if common.QuotaForNewUser > 0 {
+		if err := RecordUserQuotaLedger(user.Id, common.QuotaForNewUser, LedgerSourceRegister, ""); err != nil {
+			common.SysLog(fmt.Sprintf("failed to record quota ledger for user %d: %s", user.Id, err.Error()))
+		}
 		RecordLog(user.Id, LogTypeSystem, fmt.Sprintf("新用户注册赠送 %s", logger.LogQuota(common.QuotaForNewUser)))
 	}
 	if inviterId != 0 {
 		if common.QuotaForInvitee > 0 {
-			_ = IncreaseUserQuota(user.Id, common.QuotaForInvitee, true)
+			if err := GrantUserQuota(user.Id, common.QuotaForInvitee, LedgerSourceReferral, QuotaLotSourceReferral, "invitee", operation_setting.GetQuotaSetting().ReferralQuotaExpireDays); err != nil {
+				common.SysLog(fmt.Sprintf("failed to grant invitee quota for user %d: %s", user.Id, err.Error()))
+			}
 			RecordLog(user.Id, LogTypeSystem, fmt.Sprintf("使用邀请码赠送 %s", logger.LogQuota(common.QuotaForInvitee)))
 		}
 		if common.QuotaForInviter > 0 {
@@ -447,6 +451,7 @@ func (user *User) Update(updatePassword bool) error {
 	return updateUserCache(*user)
 }
 
+// Edit 管理员编辑用户信息，余额修改需通过 AdminSetUserQuota 记账
 func (user *User) Edit(updatePassword bool) error {
 	var err error
 	if updatePassword {
@@ -461,7 +466,6 @@ func (user *User) Edit(updatePassword bool) error {
 		"username":     newUser.Username,
 		"display_name": newUser.DisplayName,
 		"group":        newUser.Group,
-		"quota":        newUser.Quota,
 		"remark":       newUser.Remark,
 	}
 	if updatePassword {
@@ -763,64 +767,35 @@ func GetUserSetting(id int, fromDB bool) (settingMap dto.UserSetting, err error)
 	return userBase.GetSetting(), nil
 }
 
-func IncreaseUserQuota(id int, quota int, db bool) (err error) {
+// IncreaseUserQuota 按来源增加用户额度并记账，db 为 false 时按请求路径处理（见 UpdateUserQuotaWithLedger）
+func IncreaseUserQuota(id int, quota int, db bool, source string, reference string) (err error) {
 	if quota < 0 {
 		return errors.New("quota 不能为负数！")
 	}
-	gopool.Go(func() {
-		err := cacheIncrUserQuota(id, int64(quota))
-		if err != nil {
-			common.SysLog("failed to increase user quota: " + err.Error())
-		}
-	})
-	if !db && common.BatchUpdateEnabled {
-		addNewRecord(BatchUpdateTypeUserQuota, id, quota)
-		return nil
-	}
-	return increaseUserQuota(id, quota)
+	return UpdateUserQuotaWithLedger(id, quota, source, reference, !db)
 }
 
 func increaseUserQuota(id int, quota int) (err error) {
-	err = DB.Model(&User{}).Where("id = ?", id).Update("quota", gorm.Expr("quota + ?", quota)).Error
-	if err != nil {
-		return err
-	}
-	return err
+	return DB.Model(&User{}).Where("id = ?", id).Update("quota", gorm.Expr("quota + ?", quota)).Error
 }
 
-func DecreaseUserQuota(id int, quota int) (err error) {
+// DecreaseUserQuota 按来源扣除用户额度并记账
+func DecreaseUserQuota(id int, quota int, source string, reference string) (err error) {
 	if quota < 0 {
 		return errors.New("quota 不能为负数！")
 	}
-	gopool.Go(func() {
-		err := cacheDecrUserQuota(id, int64(quota))
-		if err != nil {
-			common.SysLog("failed to decrease user quota: " + err.Error())
-		}
-	})
-	if common.BatchUpdateEnabled {
-		addNewRecord(BatchUpdateTypeUserQuota, id, -quota)
-		return nil
-	}
-	return decreaseUserQuota(id, quota)
+	return UpdateUserQuotaWithLedger(id, -quota, source, reference, true)
 }
 
-func decreaseUserQuota(id int, quota int) (err error) {
-	err = DB.Model(&User{}).Where("id = ?", id).Update("quota", gorm.Expr("quota - ?", quota)).Error
-	if err != nil {
-		return err
-	}
-	return err
-}
-
-func DeltaUpdateUserQuota(id int, delta int) (err error) {
+// DeltaUpdateUserQuota 按请求退款（delta 为正）或消耗（delta 为负）更新用户额度
+func DeltaUpdateUserQuota(id int, delta int, reference string) (err error) {
 	if delta == 0 {
 		return nil
 	}
 	if delta > 0 {
-		return IncreaseUserQuota(id, delta, false)
+		return IncreaseUserQuota(id, delta, false, LedgerSourceRefund, reference)
 	} else {
-		return DecreaseUserQuota(id, -delta)
+		return DecreaseUserQuota(id, -delta, LedgerSourceConsume, reference)
 	}
 }
 
@@ -929,3 +904,11 @@ func RootUserExists() bool {
 	}
 	return true
 }
+
+func GetUserIdByUsername(username string) (id int, err error) {
+	if username == "" {
+		return 0, errors.New("用户名为空！")
+	}
+	err = DB.Model(&User{}).Where("username = ?", username).Select("id").First(&id).Error
+	return id, err
+}
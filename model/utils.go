@@ -49,6 +49,11 @@ func addNewRecord(type_ int, id int, value int) {
 	}
 }
 
+// FlushBatchUpdate 立即写入批量更新中缓冲的数据，用于服务退出前
+func FlushBatchUpdate() {
+	batchUpdate()
+}
+
 func batchUpdate() {
 	// check if there's any data to update
 	hasData := false
@@ -76,7 +81,7 @@ func batchUpdate() {
 		for key, value := range store {
 			switch i {
 			case BatchUpdateTypeUserQuota:
-				err := increaseUserQuota(key, value)
+				err := changeUserQuota(key, value, LedgerSourceBatch, "")
 				if err != nil {
 					common.SysLog("failed to batch update user quota: " + err.Error())
 				}
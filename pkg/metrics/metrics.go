@@ -0,0 +1,272 @@
+// Package metrics 以 Prometheus 格式暴露中继流量指标。
+//
+// 标签取值来自渠道、模型、分组等配置，为防止异常请求撑爆时间序列，
+// 只记录通过 SetKnownLabelValues 设置的已配置取值，其余取值统一记为 "other"。
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	namespace  = "newapi"
+	otherLabel = "other"
+)
+
+var (
+	registry = prometheus.NewRegistry()
+
+	relayRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "relay_requests_total",
+		Help:      "Relay requests by channel, model, group, relay format and status class.",
+	}, []string{"channel", "model", "group", "relay_format", "status_class"})
+
+	relayDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "relay_request_duration_seconds",
+		Help:      "End-to-end relay request latency, including retries.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 40, 80, 160, 320},
+	}, []string{"channel", "model", "group", "relay_format", "status_class"})
+
+	relayTTFT = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "relay_time_to_first_token_seconds",
+		Help:      "Time from request start to the first streamed response chunk.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2, 4, 8, 16, 32, 64},
+	}, []string{"channel", "model", "group", "relay_format"})
+
+	relayRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "relay_retries_total",
+		Help:      "Relay retries on another channel after an upstream failure.",
+	}, []string{"model", "group", "relay_format"})
+
+	relayTokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "relay_tokens_total",
+		Help:      "Billed tokens by direction (prompt or completion).",
+	}, []string{"channel", "model", "group", "direction"})
+
+	quotaConsumed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "quota_consumed_total",
+		Help:      "Quota consumed by relay requests.",
+	}, []string{"channel", "model", "group"})
+
+	preConsumeRefunds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pre_consume_refunds_total",
+		Help:      "Pre-consumed quota returned after failed relay requests.",
+	}, []string{"group"})
+
+	preConsumeRefundQuota = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pre_consume_refund_quota_total",
+		Help:      "Amount of pre-consumed quota returned after failed relay requests.",
+	}, []string{"group"})
+
+	channelAutoDisabled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "channel_auto_disabled_total",
+		Help:      "Channels (or multi-key channel keys) disabled automatically after upstream errors.",
+	}, []string{"channel"})
+
+	taskQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "task_queue_depth",
+		Help:      "Unfinished async tasks seen by the last polling round.",
+	}, []string{"platform"})
+
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "Cache lookups by cache name and result (hit or miss).",
+	}, []string{"cache", "result"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		relayRequests,
+		relayDuration,
+		relayTTFT,
+		relayRetries,
+		relayTokens,
+		quotaConsumed,
+		preConsumeRefunds,
+		preConsumeRefundQuota,
+		channelAutoDisabled,
+		taskQueueDepth,
+		cacheRequests,
+	)
+}
+
+// Handler 返回 /metrics 的 HTTP 处理器
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// labelLimiter 记录某个标签允许的取值，未配置的取值统一归为 other
+type labelLimiter struct {
+	mu    sync.RWMutex
+	known map[string]struct{}
+}
+
+var (
+	channelLabels = &labelLimiter{}
+	modelLabels   = &labelLimiter{}
+	groupLabels   = &labelLimiter{}
+)
+
+func (l *labelLimiter) bound(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if _, ok := l.known[value]; ok {
+		return value
+	}
+	return otherLabel
+}
+
+func (l *labelLimiter) set(values []string) {
+	known := make(map[string]struct{}, len(values))
+	for _, value := range values {
+		known[value] = struct{}{}
+	}
+	l.mu.Lock()
+	l.known = known
+	l.mu.Unlock()
+}
+
+// SetKnownLabelValues 设置已配置的渠道、模型与分组，只有这些取值会作为标签记录。
+// 请求中任意填写的模型名、分组名不会占用时间序列
+func SetKnownLabelValues(channelIds []int, models []string, groups []string) {
+	channels := make([]string, 0, len(channelIds))
+	for _, id := range channelIds {
+		channels = append(channels, strconv.Itoa(id))
+	}
+	channelLabels.set(channels)
+	modelLabels.set(models)
+	groupLabels.set(groups)
+}
+
+func channelLabel(channelId int) string {
+	if channelId == 0 {
+		return "unknown"
+	}
+	return channelLabels.bound(strconv.Itoa(channelId))
+}
+
+func statusClass(statusCode int) string {
+	if statusCode < 100 || statusCode > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(statusCode/100) + "xx"
+}
+
+// RelayObservation 一次中继请求的最终结果
+type RelayObservation struct {
+	ChannelId   int
+	Model       string
+	Group       string
+	RelayFormat string
+	StatusCode  int
+	Duration    time.Duration
+	// 首个响应分片的耗时，未返回流式内容时为 0
+	TTFT time.Duration
+	// 因上游失败切换渠道重试的次数
+	Retries int
+}
+
+// ObserveRelay 记录一次中继请求的次数、耗时、首字耗时与重试次数
+func ObserveRelay(o RelayObservation) {
+	channel := channelLabel(o.ChannelId)
+	model := modelLabels.bound(o.Model)
+	group := groupLabels.bound(o.Group)
+	format := o.RelayFormat
+	if format == "" {
+		format = "unknown"
+	}
+	class := statusClass(o.StatusCode)
+	relayRequests.WithLabelValues(channel, model, group, format, class).Inc()
+	relayDuration.WithLabelValues(channel, model, group, format, class).Observe(o.Duration.Seconds())
+	if o.TTFT > 0 {
+		relayTTFT.WithLabelValues(channel, model, group, format).Observe(o.TTFT.Seconds())
+	}
+	if o.Retries > 0 {
+		relayRetries.WithLabelValues(model, group, format).Add(float64(o.Retries))
+	}
+}
+
+// AddConsume 记录一次计费的 token 数与消耗额度
+func AddConsume(channelId int, modelName string, group string, promptTokens int, completionTokens int, quota int) {
+	channel := channelLabel(channelId)
+	model := modelLabels.bound(modelName)
+	group = groupLabels.bound(group)
+	if promptTokens > 0 {
+		relayTokens.WithLabelValues(channel, model, group, "prompt").Add(float64(promptTokens))
+	}
+	if completionTokens > 0 {
+		relayTokens.WithLabelValues(channel, model, group, "completion").Add(float64(completionTokens))
+	}
+	if quota > 0 {
+		quotaConsumed.WithLabelValues(channel, model, group).Add(float64(quota))
+	}
+}
+
+// AddPreConsumeRefund 记录一次失败请求的预扣费返还
+func AddPreConsumeRefund(group string, quota int) {
+	group = groupLabels.bound(group)
+	preConsumeRefunds.WithLabelValues(group).Inc()
+	if quota > 0 {
+		preConsumeRefundQuota.WithLabelValues(group).Add(float64(quota))
+	}
+}
+
+// IncChannelAutoDisabled 记录一次渠道自动禁用
+func IncChannelAutoDisabled(channelId int) {
+	channelAutoDisabled.WithLabelValues(channelLabel(channelId)).Inc()
+}
+
+var (
+	taskQueueMu        sync.Mutex
+	taskQueuePlatforms = map[string]map[string]struct{}{}
+)
+
+// SetTaskQueueDepths 记录一轮任务轮询看到的各平台未完成任务数。source 为轮询来源，
+// 该来源上一轮上报过、本轮没有未完成任务的平台置为 0。
+func SetTaskQueueDepths(source string, depths map[string]int) {
+	taskQueueMu.Lock()
+	defer taskQueueMu.Unlock()
+	for platform := range taskQueuePlatforms[source] {
+		if _, ok := depths[platform]; !ok {
+			taskQueueDepth.WithLabelValues(platform).Set(0)
+		}
+	}
+	platforms := make(map[string]struct{}, len(depths))
+	for platform, depth := range depths {
+		taskQueueDepth.WithLabelValues(platform).Set(float64(depth))
+		platforms[platform] = struct{}{}
+	}
+	taskQueuePlatforms[source] = platforms
+}
+
+// ObserveCache 记录一次缓存查询是否命中
+func ObserveCache(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheRequests.WithLabelValues(cache, result).Inc()
+}
@@ -0,0 +1,26 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetKnownLabelValues(t *testing.T) {
+	// 同步前不记录任何请求中出现的取值
+	require.Equal(t, otherLabel, modelLabels.bound("gpt-4o"))
+
+	SetKnownLabelValues([]int{1}, []string{"gpt-4o"}, []string{"default"})
+	require.Equal(t, "1", channelLabel(1))
+	require.Equal(t, otherLabel, channelLabel(2))
+	require.Equal(t, "gpt-4o", modelLabels.bound("gpt-4o"))
+	require.Equal(t, otherLabel, modelLabels.bound("junk-model-name"))
+	require.Equal(t, "default", groupLabels.bound("default"))
+	require.Equal(t, otherLabel, groupLabels.bound("junk"))
+	require.Equal(t, "unknown", modelLabels.bound(""))
+
+	// 重新同步后移除的取值不再记录
+	SetKnownLabelValues(nil, []string{"claude"}, nil)
+	require.Equal(t, otherLabel, modelLabels.bound("gpt-4o"))
+	require.Equal(t, "claude", modelLabels.bound("claude"))
+}
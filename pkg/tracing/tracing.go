@@ -0,0 +1,125 @@
+// Package tracing 基于 OpenTelemetry 的链路追踪，默认关闭。
+//
+// 开启后由 HTTP 中间件为每个请求创建根 span，中继流程、数据库与 Redis 调用在其下创建子 span，
+// 通过 OTLP 导出。只有上下文中已存在 span 时才会创建数据库与 Redis 的子 span，避免后台任务产生大量孤立 span。
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName = "github.com/QuantumNous/new-api"
+
+	ExporterOTLPHTTP = "otlphttp"
+	ExporterOTLPGRPC = "otlpgrpc"
+)
+
+// Config 链路追踪配置。导出地址、请求头等沿用 OTEL_EXPORTER_OTLP_* 标准环境变量。
+type Config struct {
+	Enabled     bool
+	Exporter    string
+	ServiceName string
+	Version     string
+	// 采样比例，0~1，对带有上游采样决定的请求沿用上游决定
+	SampleRatio float64
+	// 是否将 traceparent 传递给上游渠道
+	PropagateUpstream bool
+}
+
+var (
+	enabled           bool
+	propagateUpstream bool
+	tracer            = otel.Tracer(tracerName)
+)
+
+// Init 初始化全局 TracerProvider 与传播器，未开启时不做任何事。
+// 返回的 shutdown 在进程退出前调用，导出尚未发送的 span 并关闭导出器
+func Init(ctx context.Context, cfg Config) (shutdown func(context.Context) error, err error) {
+	shutdown = func(context.Context) error { return nil }
+	if !cfg.Enabled {
+		return shutdown, nil
+	}
+	var exporter sdktrace.SpanExporter
+	switch cfg.Exporter {
+	case "", ExporterOTLPHTTP:
+		exporter, err = otlptracehttp.New(ctx)
+	case ExporterOTLPGRPC:
+		exporter, err = otlptracegrpc.New(ctx)
+	default:
+		return shutdown, fmt.Errorf("unsupported tracing exporter: %s", cfg.Exporter)
+	}
+	if err != nil {
+		return shutdown, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName(cfg.ServiceName),
+		semconv.ServiceVersion(cfg.Version),
+	))
+	if err != nil {
+		return shutdown, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	tracer = provider.Tracer(tracerName)
+	enabled = true
+	propagateUpstream = cfg.PropagateUpstream
+	return provider.Shutdown, nil
+}
+
+func Enabled() bool {
+	return enabled
+}
+
+// Start 在 ctx 下创建子 span，未开启追踪时返回的 span 不做任何事
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartServer 从请求头提取上游 trace 上下文并创建服务端根 span
+func StartServer(r *http.Request, name string) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		semconv.HTTPRequestMethodKey.String(r.Method),
+		semconv.URLPath(r.URL.Path),
+	))
+}
+
+// InjectUpstream 开启上游传递时将当前 trace 上下文写入发往上游的请求头
+func InjectUpstream(ctx context.Context, header http.Header) {
+	if !enabled || !propagateUpstream {
+		return
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// EndWithError 记录错误并结束 span，err 为 nil 时直接结束
+func EndWithError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func hasParent(ctx context.Context) bool {
+	return enabled && trace.SpanContextFromContext(ctx).IsValid()
+}
@@ -0,0 +1,25 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInitReturnsShutdown(t *testing.T) {
+	t.Cleanup(func() { enabled = false })
+	shutdown, err := Init(context.Background(), Config{})
+	require.NoError(t, err)
+	require.NoError(t, shutdown(context.Background()))
+	require.False(t, Enabled())
+
+	_, err = Init(context.Background(), Config{Enabled: true, Exporter: "unknown"})
+	require.Error(t, err)
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://127.0.0.1:1")
+	shutdown, err = Init(context.Background(), Config{Enabled: true, ServiceName: "test", SampleRatio: 1})
+	require.NoError(t, err)
+	require.True(t, Enabled())
+	require.NoError(t, shutdown(context.Background()))
+}
@@ -12,6 +12,7 @@ import (
 
 	common2 "github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/pkg/tracing"
 	"github.com/QuantumNous/new-api/relay/common"
 	"github.com/QuantumNous/new-api/relay/constant"
 	"github.com/QuantumNous/new-api/relay/helper"
@@ -22,6 +23,7 @@ import (
 	"github.com/bytedance/gopkg/util/gopool"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func SetupApiRequestHeader(info *common.RelayInfo, c *gin.Context, req *http.Header) {
@@ -339,14 +341,24 @@ func doRequest(c *gin.Context, req *http.Request, info *common.RelayInfo) (*http
 		}
 	}
 
+	// 上游 span 只覆盖到收到响应头，流式内容的转发耗时体现在外层的尝试 span 中
+	ctx, span := tracing.Start(c.Request.Context(), "relay.upstream",
+		attribute.String("http.request.method", req.Method),
+		attribute.String("server.address", req.URL.Host),
+	)
+	tracing.InjectUpstream(ctx, req.Header)
 	resp, err := client.Do(req)
 	if err != nil {
+		tracing.EndWithError(span, err)
 		logger.LogError(c, "do request failed: "+err.Error())
 		return nil, types.NewError(err, types.ErrorCodeDoRequestFailed, types.ErrOptionWithHideErrMsg("upstream error: do request failed"))
 	}
 	if resp == nil {
+		span.End()
 		return nil, errors.New("resp is nil")
 	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	span.End()
 
 	_ = req.Body.Close()
 	_ = c.Request.Body.Close()
@@ -80,10 +80,24 @@ type TokenCountMeta struct {
 }
 
 type RelayInfo struct {
-	TokenId           int
-	TokenKey          string
-	TokenGroup        string
+	TokenId    int
+	TokenKey   string
+	TokenGroup string
+	OrgId      int // 组织令牌所属组织，非 0 时从组织额度池扣费
+	// 预扣费时命中的生效订阅，非 0 时优先从订阅额度扣费
+	SubscriptionId          int
+	SubscriptionOverage     bool
+	SubscriptionPeriodStart int64 // 预扣费时订阅所在的周期，周期变更后不再向订阅返还
+	// 本次请求已从订阅额度和用户余额扣除的额度，返还时按扣除来源原路退回
+	SubscriptionConsumed int
+	BalanceConsumed      int
+
+	// 鉴权时令牌的剩余额度与自动充值阈值，阈值为 0 表示未开启自动充值
+	TokenRemainQuota         int
+	TokenAutoRefillThreshold int
+
 	UserId            int
+	RequestId         string // 用于账本关联本次请求
 	UsingGroup        string // 使用的分组，当auto跨分组重试时，会变动
 	UserGroup         string // 用户所在分组
 	TokenUnlimited    bool
@@ -111,6 +125,7 @@ type RelayInfo struct {
 	UserSetting            dto.UserSetting
 	UserEmail              string
 	UserQuota              int
+	CreditLimit            int // 扣费方的后付费信用额度，UserQuota 已包含该额度
 	RelayFormat            types.RelayFormat
 	SendResponseCount      int
 	FinalPreConsumedQuota  int  // 最终预消耗的配额
@@ -404,6 +419,7 @@ func genBaseRelayInfo(c *gin.Context, request dto.Request) *RelayInfo {
 		Request: request,
 
 		UserId:     common.GetContextKeyInt(c, constant.ContextKeyUserId),
+		RequestId:  c.GetString(common.RequestIdKey),
 		UsingGroup: common.GetContextKeyString(c, constant.ContextKeyUsingGroup),
 		UserGroup:  common.GetContextKeyString(c, constant.ContextKeyUserGroup),
 		UserQuota:  common.GetContextKeyInt(c, constant.ContextKeyUserQuota),
@@ -415,6 +431,10 @@ func genBaseRelayInfo(c *gin.Context, request dto.Request) *RelayInfo {
 		TokenKey:       common.GetContextKeyString(c, constant.ContextKeyTokenKey),
 		TokenUnlimited: common.GetContextKeyBool(c, constant.ContextKeyTokenUnlimited),
 		TokenGroup:     tokenGroup,
+		OrgId:          common.GetContextKeyInt(c, constant.ContextKeyTokenOrgId),
+
+		TokenRemainQuota:         c.GetInt("token_quota"),
+		TokenAutoRefillThreshold: common.GetContextKeyInt(c, constant.ContextKeyTokenAutoRefillThreshold),
 
 		isFirstResponse: true,
 		RelayMode:       relayconstant.Path2RelayMode(c.Request.URL.Path),
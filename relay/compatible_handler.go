@@ -245,6 +245,13 @@ func postConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, usage
 
 	modelName := relayInfo.OriginModelName
 
+	// 按实际提示 token 数重新选择上下文分档，Anthropic 的 input_tokens 不含缓存 tokens
+	contextTokens := promptTokens
+	if relayInfo.ChannelType == constant.ChannelTypeAnthropic {
+		contextTokens += cacheTokens + cachedCreationTokens
+	}
+	ratio_setting.ApplyContextTier(modelName, contextTokens, &relayInfo.PriceData)
+
 	tokenName := ctx.GetString("token_name")
 	completionRatio := relayInfo.PriceData.CompletionRatio
 	cacheRatio := relayInfo.PriceData.CacheRatio
@@ -386,11 +393,18 @@ func postConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, usage
 	} else {
 		quotaCalculateDecimal = dModelPrice.Mul(dQuotaPerUnit).Mul(dGroupRatio)
 	}
+	// 添加 audio input 独立计费
+	quotaCalculateDecimal = quotaCalculateDecimal.Add(audioInputQuota)
+
+	// 分时计价只作用于模型用量，不作用于工具调用的固定费用
+	if relayInfo.PriceData.PricingWindow != "" {
+		quotaCalculateDecimal = quotaCalculateDecimal.Mul(decimal.NewFromFloat(relayInfo.PriceData.PricingWindowRatio))
+		extraContent = append(extraContent, fmt.Sprintf("分时计价 %s: %f", relayInfo.PriceData.PricingWindow, relayInfo.PriceData.PricingWindowRatio))
+	}
+
 	// 添加 responses tools call 调用的配额
 	quotaCalculateDecimal = quotaCalculateDecimal.Add(dWebSearchQuota)
 	quotaCalculateDecimal = quotaCalculateDecimal.Add(dFileSearchQuota)
-	// 添加 audio input 独立计费
-	quotaCalculateDecimal = quotaCalculateDecimal.Add(audioInputQuota)
 	// 添加 image generation call 计费
 	quotaCalculateDecimal = quotaCalculateDecimal.Add(dImageGenerationCallQuota)
 
@@ -509,6 +523,19 @@ func postConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, usage
 		other["image_generation_call"] = true
 		other["image_generation_call_price"] = imageGenerationCallPrice
 	}
+	upstreamCost := 0
+	if totalTokens != 0 {
+		upstreamInputTokens := promptTokens
+		if !isClaudeUsageSemantic {
+			upstreamInputTokens -= cacheTokens + cachedCreationTokens
+		}
+		upstreamCost = service.CalculateUpstreamCost(relayInfo, service.UpstreamUsage{
+			InputTokens:      upstreamInputTokens,
+			OutputTokens:     completionTokens,
+			CacheReadTokens:  cacheTokens,
+			CacheWriteTokens: cachedCreationTokens,
+		})
+	}
 	model.RecordConsumeLog(ctx, relayInfo.UserId, model.RecordConsumeLogParams{
 		ChannelId:        relayInfo.ChannelId,
 		PromptTokens:     promptTokens,
@@ -516,6 +543,7 @@ func postConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, usage
 		ModelName:        logModel,
 		TokenName:        tokenName,
 		Quota:            quota,
+		UpstreamCost:     upstreamCost,
 		Content:          logContent,
 		TokenId:          relayInfo.TokenId,
 		UseTimeSeconds:   int(useTimeSeconds),
@@ -5,6 +5,7 @@ import (
 
 	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
 	relaycommon "github.com/QuantumNous/new-api/relay/common"
 	"github.com/QuantumNous/new-api/setting/operation_setting"
 	"github.com/QuantumNous/new-api/setting/ratio_setting"
@@ -13,9 +14,6 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-// https://docs.claude.com/en/docs/build-with-claude/prompt-caching#1-hour-cache-duration
-const claudeCacheCreation1hMultiplier = 6 / 3.75
-
 // HandleGroupRatio checks for "auto_group" in the context and updates the group ratio and relayInfo.UsingGroup if present
 func HandleGroupRatio(ctx *gin.Context, relayInfo *relaycommon.RelayInfo) types.GroupRatioInfo {
 	groupRatioInfo := types.GroupRatioInfo{
@@ -47,10 +45,20 @@ func HandleGroupRatio(ctx *gin.Context, relayInfo *relaycommon.RelayInfo) types.
 
 func ModelPriceHelper(c *gin.Context, info *relaycommon.RelayInfo, promptTokens int, meta *types.TokenCountMeta) (types.PriceData, error) {
 	modelPrice, usePrice := ratio_setting.GetModelPrice(info.OriginModelName, false)
+	// 用户或令牌级别的价格覆盖优先于全局配置
+	override := model.GetActivePriceOverride(info.UserId, info.TokenId, info.OriginModelName)
+	if override != nil {
+		if override.ModelPrice != nil {
+			modelPrice, usePrice = *override.ModelPrice, true
+		} else {
+			usePrice = false
+		}
+	}
 
 	groupRatioInfo := HandleGroupRatio(c, info)
 
 	var preConsumedQuota int
+	var preConsumedTokens int
 	var modelRatio float64
 	var completionRatio float64
 	var cacheRatio float64
@@ -62,13 +70,16 @@ func ModelPriceHelper(c *gin.Context, info *relaycommon.RelayInfo, promptTokens
 	var audioCompletionRatio float64
 	var freeModel bool
 	if !usePrice {
-		preConsumedTokens := common.Max(promptTokens, common.PreConsumedQuota)
+		preConsumedTokens = common.Max(promptTokens, common.PreConsumedQuota)
 		if meta.MaxTokens != 0 {
 			preConsumedTokens += meta.MaxTokens
 		}
 		var success bool
 		var matchName string
 		modelRatio, success, matchName = ratio_setting.GetModelRatio(info.OriginModelName)
+		if override != nil && override.ModelRatio != nil {
+			modelRatio, success = *override.ModelRatio, true
+		}
 		if !success {
 			acceptUnsetRatio := false
 			if info.UserSetting.AcceptUnsetRatioModel {
@@ -79,11 +90,14 @@ func ModelPriceHelper(c *gin.Context, info *relaycommon.RelayInfo, promptTokens
 			}
 		}
 		completionRatio = ratio_setting.GetCompletionRatio(info.OriginModelName)
+		if override != nil && override.CompletionRatio != nil {
+			completionRatio = *override.CompletionRatio
+		}
 		cacheRatio, _ = ratio_setting.GetCacheRatio(info.OriginModelName)
 		cacheCreationRatio, _ = ratio_setting.GetCreateCacheRatio(info.OriginModelName)
 		cacheCreationRatio5m = cacheCreationRatio
 		// 固定1h和5min缓存写入价格的比例
-		cacheCreationRatio1h = cacheCreationRatio * claudeCacheCreation1hMultiplier
+		cacheCreationRatio1h = cacheCreationRatio * ratio_setting.ClaudeCacheCreation1hMultiplier
 		imageRatio, _ = ratio_setting.GetImageRatio(info.OriginModelName)
 		audioRatio = ratio_setting.GetAudioRatio(info.OriginModelName)
 		audioCompletionRatio = ratio_setting.GetAudioCompletionRatio(info.OriginModelName)
@@ -131,6 +145,17 @@ func ModelPriceHelper(c *gin.Context, info *relaycommon.RelayInfo, promptTokens
 		CacheCreation1hRatio: cacheCreationRatio1h,
 		QuotaToPreConsume:    preConsumedQuota,
 	}
+	if override != nil {
+		priceData.PriceOverrideId = override.Id
+	}
+	// 按预估提示 token 数选择上下文分档，结算时再按实际提示 token 数重新选择
+	if ratio_setting.ApplyContextTier(info.OriginModelName, promptTokens, &priceData) && !freeModel {
+		priceData.QuotaToPreConsume = int(float64(preConsumedTokens) * priceData.ModelRatio * groupRatioInfo.GroupRatio)
+	}
+	// 分时计价按请求开始时刻确定，结算时沿用同一时段
+	if ratio_setting.ApplyPricingWindow(info.OriginModelName, info.UsingGroup, info.StartTime, &priceData) {
+		priceData.QuotaToPreConsume = int(float64(priceData.QuotaToPreConsume) * priceData.PricingWindowRatio)
+	}
 
 	if common.DebugEnabled {
 		println(fmt.Sprintf("model_price_helper result: %s", priceData.ToSetting()))
@@ -144,6 +169,9 @@ func ModelPriceHelperPerCall(c *gin.Context, info *relaycommon.RelayInfo) types.
 	groupRatioInfo := HandleGroupRatio(c, info)
 
 	modelPrice, success := ratio_setting.GetModelPrice(info.OriginModelName, true)
+	if override := model.GetActivePriceOverride(info.UserId, info.TokenId, info.OriginModelName); override != nil && override.ModelPrice != nil {
+		modelPrice, success = *override.ModelPrice, true
+	}
 	// 如果没有配置价格，则使用默认价格
 	if !success {
 		defaultPrice, ok := ratio_setting.GetDefaultModelPriceMap()[info.OriginModelName]
@@ -159,6 +187,12 @@ func ModelPriceHelperPerCall(c *gin.Context, info *relaycommon.RelayInfo) types.
 		Quota:          quota,
 		GroupRatioInfo: groupRatioInfo,
 	}
+	// 分时计价按请求开始时刻确定
+	if w := ratio_setting.GetActivePricingWindow(info.OriginModelName, info.UsingGroup, info.StartTime); w != nil {
+		priceData.PricingWindow = w.Name
+		priceData.PricingWindowRatio = w.Multiplier
+		priceData.Quota = int(float64(quota) * w.Multiplier)
+	}
 	return priceData
 }
 
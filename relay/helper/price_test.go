@@ -0,0 +1,98 @@
+package helper
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/model"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/setting/ratio_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestModelPriceHelperPerCall_AppliesPricingWindow(t *testing.T) {
+	oldWindows := ratio_setting.PricingWindows2JSONString()
+	t.Cleanup(func() {
+		require.NoError(t, ratio_setting.UpdatePricingWindowsByJSONString(oldWindows))
+	})
+	require.NoError(t, ratio_setting.UpdatePricingWindowsByJSONString(
+		`[{"name":"peak","start":"09:00","end":"18:00","models":["test-per-call-*"],"multiplier":2}]`))
+
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	day := time.Date(2026, 10, 19, 0, 0, 0, 0, time.Local)
+	info := &relaycommon.RelayInfo{OriginModelName: "test-per-call-model", UsingGroup: "default"}
+
+	info.StartTime = day.Add(8 * time.Hour)
+	offPeak := ModelPriceHelperPerCall(ctx, info)
+	require.Empty(t, offPeak.PricingWindow)
+
+	info.StartTime = day.Add(12 * time.Hour)
+	peak := ModelPriceHelperPerCall(ctx, info)
+	require.Equal(t, "peak", peak.PricingWindow)
+	require.Equal(t, offPeak.Quota*2, peak.Quota)
+}
+
+// setupTestPriceOverrides 使用临时 SQLite 数据库写入价格覆盖，结束时删除以清空覆盖缓存
+func setupTestPriceOverrides(t *testing.T, overrides ...*model.PriceOverride) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&model.PriceOverride{}))
+	oldDB := model.DB
+	t.Cleanup(func() {
+		model.DB = oldDB
+		if sqlDB, err := db.DB(); err == nil {
+			_ = sqlDB.Close()
+		}
+	})
+	model.DB = db
+	for _, override := range overrides {
+		require.NoError(t, override.Insert())
+	}
+	t.Cleanup(func() {
+		for _, override := range overrides {
+			require.NoError(t, model.DeletePriceOverrideById(override.Id))
+		}
+	})
+}
+
+func TestModelPriceHelper_AppliesPriceOverride(t *testing.T) {
+	ratio, price := 2.0, 0.1
+	setupTestPriceOverrides(t,
+		&model.PriceOverride{UserId: 1, ModelName: "test-override-*", ModelRatio: &ratio, Status: model.PriceOverrideStatusEnabled},
+		&model.PriceOverride{UserId: 1, TokenId: 7, ModelName: "test-override-model", ModelPrice: &price, Status: model.PriceOverrideStatusEnabled},
+	)
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	newInfo := func(userId int, tokenId int) *relaycommon.RelayInfo {
+		return &relaycommon.RelayInfo{UserId: userId, TokenId: tokenId, OriginModelName: "test-override-model", UsingGroup: "default"}
+	}
+
+	// 未配置倍率的模型没有覆盖时拒绝请求
+	_, err := ModelPriceHelper(ctx, newInfo(2, 0), 10, &types.TokenCountMeta{})
+	require.Error(t, err)
+
+	// 用户级别倍率覆盖，按倍率预扣
+	priceData, err := ModelPriceHelper(ctx, newInfo(1, 0), 10, &types.TokenCountMeta{})
+	require.NoError(t, err)
+	require.False(t, priceData.UsePrice)
+	require.Equal(t, ratio, priceData.ModelRatio)
+	require.NotZero(t, priceData.PriceOverrideId)
+	require.Equal(t, int(float64(max(10, common.PreConsumedQuota))*ratio*priceData.GroupRatioInfo.GroupRatio), priceData.QuotaToPreConsume)
+
+	// 令牌级别按次价格覆盖优先于用户级别
+	priceData, err = ModelPriceHelper(ctx, newInfo(1, 7), 10, &types.TokenCountMeta{})
+	require.NoError(t, err)
+	require.True(t, priceData.UsePrice)
+	require.Equal(t, price, priceData.ModelPrice)
+	require.Equal(t, int(price*common.QuotaPerUnit*priceData.GroupRatioInfo.GroupRatio), priceData.QuotaToPreConsume)
+}
@@ -177,8 +177,13 @@ func RelayTaskSubmit(c *gin.Context, info *relaycommon.RelayInfo) (taskErr *dto.
 			}
 		}
 	}
+	// 分时计价按请求开始时刻确定
+	pricingWindow := ratio_setting.GetActivePricingWindow(modelName, info.UsingGroup, info.StartTime)
+	if pricingWindow != nil {
+		ratio *= pricingWindow.Multiplier
+	}
 	println(fmt.Sprintf("model: %s, model_price: %.4f, group: %s, group_ratio: %.4f, final_ratio: %.4f", modelName, modelPrice, info.UsingGroup, groupRatio, ratio))
-	userQuota, err := model.GetUserQuota(info.UserId, false)
+	userQuota, err := service.GetPayerQuota(info)
 	if err != nil {
 		taskErr = service.TaskErrorWrapper(err, "get_user_quota_failed", http.StatusInternalServerError)
 		return
@@ -239,6 +244,9 @@ func RelayTaskSubmit(c *gin.Context, info *relaycommon.RelayInfo) (taskErr *dto.
 						}
 					}
 				}
+				if pricingWindow != nil {
+					logContent = fmt.Sprintf("%s，分时计价 %s: %.2f", logContent, pricingWindow.Name, pricingWindow.Multiplier)
+				}
 				other := make(map[string]interface{})
 				if c != nil && c.Request != nil && c.Request.URL != nil {
 					other["request_path"] = c.Request.URL.Path
@@ -248,15 +256,21 @@ func RelayTaskSubmit(c *gin.Context, info *relaycommon.RelayInfo) (taskErr *dto.
 				if hasUserGroupRatio {
 					other["user_group_ratio"] = userGroupRatio
 				}
+				if pricingWindow != nil {
+					other["pricing_window"] = pricingWindow.Name
+					other["pricing_window_ratio"] = pricingWindow.Multiplier
+				}
+				// 按次计费的任务没有 token 用量，仅显式按次价格或官方模型价格可计入上游成本
 				model.RecordConsumeLog(c, info.UserId, model.RecordConsumeLogParams{
-					ChannelId: info.ChannelId,
-					ModelName: modelName,
-					TokenName: tokenName,
-					Quota:     quota,
-					Content:   logContent,
-					TokenId:   info.TokenId,
-					Group:     info.UsingGroup,
-					Other:     other,
+					ChannelId:    info.ChannelId,
+					ModelName:    modelName,
+					TokenName:    tokenName,
+					Quota:        quota,
+					UpstreamCost: service.CalculateUpstreamCost(info, service.UpstreamUsage{}),
+					Content:      logContent,
+					TokenId:      info.TokenId,
+					Group:        info.UsingGroup,
+					Other:        other,
 				})
 				model.UpdateUserUsedQuotaAndRequestCount(info.UserId, quota)
 				model.UpdateChannelUsedQuota(info.ChannelId, quota)
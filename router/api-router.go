@@ -81,6 +81,7 @@ func SetApiRouter(router *gin.Engine) {
 				selfRoute.GET("/aff", controller.GetAffCode)
 				selfRoute.GET("/topup/info", controller.GetTopUpInfo)
 				selfRoute.GET("/topup/self", controller.GetUserTopUps)
+				selfRoute.GET("/self/ledger", controller.GetSelfLedger)
 				selfRoute.GET("/topup/status", controller.GetTopUpStatus)
 				selfRoute.POST("/topup", middleware.CriticalRateLimit(), controller.TopUp)
 				selfRoute.POST("/pay", middleware.CriticalRateLimit(), controller.RequestEpay)
@@ -93,6 +94,7 @@ func SetApiRouter(router *gin.Engine) {
 				selfRoute.POST("/alipay/pay", middleware.CriticalRateLimit(), controller.RequestAlipayPay)
 				selfRoute.POST("/alipay/amount", controller.RequestAlipayAmount)
 				selfRoute.POST("/aff_transfer", controller.TransferAffQuota)
+				selfRoute.GET("/aff/commissions", controller.GetSelfReferralCommissions)
 				selfRoute.PUT("/setting", controller.UpdateUserSetting)
 
 				// 2FA routes
@@ -113,10 +115,14 @@ func SetApiRouter(router *gin.Engine) {
 				adminRoute.GET("/", controller.GetAllUsers)
 				adminRoute.GET("/topup", controller.GetAllTopUps)
 				adminRoute.POST("/topup/complete", controller.AdminCompleteTopUp)
+				adminRoute.POST("/topup/refund", controller.RefundTopUp)
 				adminRoute.GET("/search", controller.SearchUsers)
 				adminRoute.GET("/:id", controller.GetUser)
+				adminRoute.GET("/:id/ledger", controller.GetUserLedger)
 				adminRoute.POST("/", controller.CreateUser)
 				adminRoute.POST("/manage", controller.ManageUser)
+				adminRoute.POST("/grant_quota", controller.AdminGrantUserQuota)
+				adminRoute.PUT("/credit_limit", controller.AdminSetUserCreditLimit)
 				adminRoute.PUT("/", controller.UpdateUser)
 				adminRoute.DELETE("/:id", controller.DeleteUser)
 				adminRoute.DELETE("/:id/reset_passkey", controller.AdminResetPasskey)
@@ -131,6 +137,9 @@ func SetApiRouter(router *gin.Engine) {
 		{
 			optionRoute.GET("/", controller.GetOptions)
 			optionRoute.PUT("/", controller.UpdateOption)
+			optionRoute.GET("/versions", controller.GetOptionVersions)
+			optionRoute.GET("/versions/diff", controller.DiffOptionVersions)
+			optionRoute.POST("/versions/rollback", controller.RollbackOptionVersion)
 			optionRoute.GET("/channel_affinity_cache", controller.GetChannelAffinityCacheStats)
 			optionRoute.DELETE("/channel_affinity_cache", controller.ClearChannelAffinityCache)
 			optionRoute.POST("/rest_model_ratio", controller.ResetModelRatio)
@@ -150,6 +159,18 @@ func SetApiRouter(router *gin.Engine) {
 			ratioSyncRoute.GET("/channels", controller.GetSyncableChannels)
 			ratioSyncRoute.POST("/fetch", controller.FetchUpstreamRatios)
 		}
+		configRoute := apiRouter.Group("/config")
+		configRoute.Use(middleware.RootAuth())
+		{
+			configRoute.GET("/export", controller.ExportConfig)
+			configRoute.POST("/import", controller.ImportConfig)
+		}
+		auditRoute := apiRouter.Group("/audit")
+		auditRoute.Use(middleware.RootAuth())
+		{
+			auditRoute.GET("/", controller.GetAuditLogs)
+			auditRoute.GET("/export", controller.ExportAuditLogs)
+		}
 		channelRoute := apiRouter.Group("/channel")
 		channelRoute.Use(middleware.AdminAuth())
 		{
@@ -201,6 +222,77 @@ func SetApiRouter(router *gin.Engine) {
 			tokenRoute.POST("/batch", controller.DeleteTokenBatch)
 		}
 
+		ledgerRoute := apiRouter.Group("/ledger")
+		ledgerRoute.Use(middleware.AdminAuth())
+		{
+			ledgerRoute.GET("/reconcile", controller.GetLedgerReconcileReport)
+			ledgerRoute.POST("/reconcile", controller.RunLedgerReconcile)
+		}
+
+		statementRoute := apiRouter.Group("/statement")
+		{
+			statementRoute.GET("/self", middleware.UserAuth(), controller.GetSelfStatements)
+			statementRoute.POST("/self", middleware.UserAuth(), controller.GenerateSelfStatement)
+			statementRoute.GET("/self/:id/download", middleware.UserAuth(), controller.DownloadSelfStatement)
+			statementRoute.POST("/self/:id/email", middleware.UserAuth(), middleware.CriticalRateLimit(), controller.EmailSelfStatement)
+			statementRoute.GET("/", middleware.AdminAuth(), controller.GetStatements)
+			statementRoute.POST("/generate", middleware.AdminAuth(), controller.AdminGenerateStatement)
+			statementRoute.GET("/download/:id", middleware.AdminAuth(), controller.AdminDownloadStatement)
+		}
+
+		priceOverrideRoute := apiRouter.Group("/price_override")
+		priceOverrideRoute.Use(middleware.AdminAuth())
+		{
+			priceOverrideRoute.GET("/", controller.GetPriceOverrides)
+			priceOverrideRoute.POST("/", controller.AddPriceOverride)
+			priceOverrideRoute.PUT("/", controller.UpdatePriceOverride)
+			priceOverrideRoute.DELETE("/:id", controller.DeletePriceOverride)
+		}
+
+		organizationRoute := apiRouter.Group("/organization")
+		{
+			organizationRoute.GET("/", middleware.AdminAuth(), controller.GetAllOrganizations)
+			organizationRoute.POST("/:id/quota", middleware.AdminAuth(), controller.AdminAddOrganizationQuota)
+			organizationRoute.PUT("/:id/credit_limit", middleware.AdminAuth(), controller.AdminSetOrganizationCreditLimit)
+			organizationRoute.GET("/:id/ledger", middleware.AdminAuth(), controller.GetOrganizationLedger)
+
+			orgSelfRoute := organizationRoute.Group("/")
+			orgSelfRoute.Use(middleware.UserAuth())
+			{
+				orgSelfRoute.GET("/self", controller.GetSelfOrganizations)
+				orgSelfRoute.POST("/", controller.CreateOrganization)
+				orgSelfRoute.GET("/:id", controller.GetOrganization)
+				orgSelfRoute.PUT("/:id", controller.UpdateOrganization)
+				orgSelfRoute.DELETE("/:id", controller.DeleteOrganization)
+				orgSelfRoute.GET("/:id/members", controller.GetOrganizationMembers)
+				orgSelfRoute.POST("/:id/members", controller.AddOrganizationMember)
+				orgSelfRoute.PUT("/:id/members", controller.UpdateOrganizationMember)
+				orgSelfRoute.DELETE("/:id/members/:user_id", controller.RemoveOrganizationMember)
+				orgSelfRoute.GET("/:id/usage", controller.GetOrganizationUsage)
+				orgSelfRoute.POST("/:id/transfer", controller.TransferQuotaToOrganization)
+			}
+		}
+
+		subscriptionRoute := apiRouter.Group("/subscription")
+		{
+			subscriptionRoute.GET("/plans", middleware.UserAuth(), controller.GetSubscriptionPlans)
+			subscriptionRoute.GET("/self", middleware.UserAuth(), controller.GetSelfSubscription)
+			subscriptionRoute.POST("/subscribe", middleware.UserAuth(), middleware.CriticalRateLimit(), controller.Subscribe)
+			subscriptionRoute.PUT("/self/renew", middleware.UserAuth(), controller.UpdateSubscriptionRenew)
+
+			subscriptionAdminRoute := subscriptionRoute.Group("/")
+			subscriptionAdminRoute.Use(middleware.AdminAuth())
+			{
+				subscriptionAdminRoute.GET("/", controller.GetAllSubscriptions)
+				subscriptionAdminRoute.POST("/grant", controller.GrantSubscription)
+				subscriptionAdminRoute.POST("/:id/expire", controller.ExpireSubscription)
+				subscriptionAdminRoute.GET("/plan/", controller.GetAllSubscriptionPlans)
+				subscriptionAdminRoute.POST("/plan/", controller.AddSubscriptionPlan)
+				subscriptionAdminRoute.PUT("/plan/", controller.UpdateSubscriptionPlan)
+				subscriptionAdminRoute.DELETE("/plan/:id", controller.DeleteSubscriptionPlan)
+			}
+		}
+
 		usageRoute := apiRouter.Group("/usage")
 		usageRoute.Use(middleware.CriticalRateLimit())
 		{
@@ -222,11 +314,38 @@ func SetApiRouter(router *gin.Engine) {
 			redemptionRoute.DELETE("/invalid", controller.DeleteInvalidRedemption)
 			redemptionRoute.DELETE("/:id", controller.DeleteRedemption)
 		}
+		referralRoute := apiRouter.Group("/referral")
+		referralRoute.Use(middleware.AdminAuth())
+		{
+			referralRoute.GET("/commission", controller.GetReferralCommissions)
+			referralRoute.POST("/commission/:id/revoke", controller.RevokeReferralCommission)
+		}
+		couponRoute := apiRouter.Group("/coupon")
+		couponRoute.Use(middleware.AdminAuth())
+		{
+			couponRoute.GET("/", controller.GetCoupons)
+			couponRoute.GET("/stats", controller.GetCouponStats)
+			couponRoute.GET("/:id/usages", controller.GetCouponUsages)
+			couponRoute.POST("/", controller.AddCoupon)
+			couponRoute.PUT("/", controller.UpdateCoupon)
+			couponRoute.DELETE("/:id", controller.DeleteCoupon)
+		}
 		logRoute := apiRouter.Group("/log")
 		logRoute.GET("/", middleware.AdminAuth(), controller.GetAllLogs)
 		logRoute.DELETE("/", middleware.AdminAuth(), controller.DeleteHistoryLogs)
 		logRoute.GET("/stat", middleware.AdminAuth(), controller.GetLogsStat)
+		logRoute.GET("/margin", middleware.AdminAuth(), controller.GetMarginReport)
+		logRoute.GET("/body/:id", middleware.AdminAuth(), controller.GetLogBodyCapture)
+		logRoute.GET("/rollup", middleware.AdminAuth(), controller.GetUsageRollups)
 		logRoute.GET("/self/stat", middleware.UserAuth(), controller.GetLogsSelfStat)
+		logRoute.GET("/self/rollup", middleware.UserAuth(), controller.GetSelfUsageRollups)
+		logRoute.GET("/export", middleware.AdminAuth(), controller.ExportLogs)
+		logRoute.POST("/export/jobs", middleware.AdminAuth(), controller.CreateLogExportJob)
+		logRoute.GET("/export/jobs", middleware.UserAuth(), controller.GetLogExportJobs)
+		logRoute.GET("/export/jobs/:id", middleware.UserAuth(), controller.GetLogExportJob)
+		logRoute.GET("/export/jobs/:id/download", middleware.UserAuth(), controller.DownloadLogExportJob)
+		logRoute.GET("/self/export", middleware.UserAuth(), controller.ExportSelfLogs)
+		logRoute.POST("/self/export/jobs", middleware.UserAuth(), controller.CreateSelfLogExportJob)
 		logRoute.GET("/channel_affinity_usage_cache", middleware.AdminAuth(), controller.GetChannelAffinityUsageCacheStats)
 		logRoute.GET("/search", middleware.AdminAuth(), controller.SearchAllLogs)
 		logRoute.GET("/self", middleware.UserAuth(), controller.GetUserLogs)
@@ -316,4 +435,12 @@ func SetApiRouter(router *gin.Engine) {
 			deploymentsRoute.DELETE("/:id", controller.DeleteDeployment)
 		}
 	}
+
+	// 流量实时查看为长连接，不经过 gzip 压缩
+	trafficRoute := router.Group("/api/traffic")
+	trafficRoute.Use(middleware.AdminAuth())
+	{
+		trafficRoute.GET("/stream", controller.StreamTraffic)
+		trafficRoute.GET("/ws", controller.TrafficWebSocket)
+	}
 }
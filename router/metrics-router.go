@@ -0,0 +1,16 @@
+package router
+
+import (
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/middleware"
+	"github.com/QuantumNous/new-api/pkg/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+func SetMetricsRouter(router *gin.Engine) {
+	if !common.MetricsEnabled {
+		return
+	}
+	router.GET("/metrics", middleware.MetricsAuth(), gin.WrapH(metrics.Handler()))
+}
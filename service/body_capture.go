@@ -0,0 +1,434 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/bytedance/gopkg/util/gopool"
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	bodyCaptureDefaultMaxBytes = 64 * 1024
+	// 流式响应先按原始 SSE 留存，拼接正文后再截断，因此原始内容多留几倍
+	bodyCaptureStreamFactor = 8
+	bodyCaptureRedacted     = "[REDACTED]"
+
+	bodyCaptureCleanupTickInterval = time.Hour
+	bodyCaptureCleanupBatchSize    = 500
+)
+
+// BodyCapture 一次请求的内容留存状态，未命中留存规则时为 nil，方法可在 nil 上调用
+type BodyCapture struct {
+	writer   *bodyCaptureWriter
+	maxBytes int
+	userId   int
+	tokenId  int
+	group    string
+}
+
+// bodyCaptureWriter 在写出响应的同时保留前 limit 字节
+type bodyCaptureWriter struct {
+	gin.ResponseWriter
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (w *bodyCaptureWriter) capture(b []byte) {
+	remaining := w.limit - w.buf.Len()
+	if len(b) > remaining {
+		w.truncated = true
+		b = b[:max(remaining, 0)]
+	}
+	w.buf.Write(b)
+}
+
+func (w *bodyCaptureWriter) Write(b []byte) (int, error) {
+	w.capture(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *bodyCaptureWriter) WriteString(s string) (int, error) {
+	w.capture([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+// StartBodyCapture 请求方开启了内容留存且命中采样时开始记录响应，需在写出任何响应前调用
+func StartBodyCapture(c *gin.Context, relayFormat types.RelayFormat) *BodyCapture {
+	if relayFormat == types.RelayFormatOpenAIRealtime {
+		return nil
+	}
+	setting := operation_setting.GetBodyCaptureSetting()
+	userId := common.GetContextKeyInt(c, constant.ContextKeyUserId)
+	tokenId := common.GetContextKeyInt(c, constant.ContextKeyTokenId)
+	group := common.GetContextKeyString(c, constant.ContextKeyUsingGroup)
+	if !setting.Matches(userId, tokenId, group) {
+		return nil
+	}
+	if setting.SampleRate < 1 && rand.Float64() >= setting.SampleRate {
+		return nil
+	}
+	maxBytes := setting.MaxBodyBytes
+	if maxBytes <= 0 {
+		maxBytes = bodyCaptureDefaultMaxBytes
+	}
+	writer := &bodyCaptureWriter{ResponseWriter: c.Writer, limit: maxBytes * bodyCaptureStreamFactor}
+	c.Writer = writer
+	common.SetContextKey(c, constant.ContextKeyBodyCapture, true)
+	return &BodyCapture{
+		writer:   writer,
+		maxBytes: maxBytes,
+		userId:   userId,
+		tokenId:  tokenId,
+		group:    group,
+	}
+}
+
+// Finish 在响应写完后脱敏、截断并异步保存留存内容
+func (capture *BodyCapture) Finish(c *gin.Context) {
+	if capture == nil {
+		return
+	}
+	setting := operation_setting.GetBodyCaptureSetting()
+	record := &model.BodyCapture{
+		RequestId:  c.GetString(common.RequestIdKey),
+		CreatedAt:  common.GetTimestamp(),
+		UserId:     capture.userId,
+		TokenId:    capture.tokenId,
+		Group:      capture.group,
+		ModelName:  common.GetContextKeyString(c, constant.ContextKeyOriginalModel),
+		ChannelId:  common.GetContextKeyInt(c, constant.ContextKeyChannelId),
+		StatusCode: capture.writer.Status(),
+		Node:       localNodeName,
+	}
+
+	requestBody, err := common.GetRequestBody(c)
+	if err != nil {
+		requestBody = []byte(fmt.Sprintf("[request body unavailable: %s]", err.Error()))
+	}
+	record.RequestBody, record.RequestTruncated = prepareCaptureBody(requestBody, c.Request.Header.Get("Content-Type"), capture.maxBytes, setting)
+
+	responseType := capture.writer.Header().Get("Content-Type")
+	responseBody := capture.writer.buf.Bytes()
+	if strings.HasPrefix(responseType, "text/event-stream") {
+		record.IsStream = true
+		if assembled := assembleStreamResponse(responseBody); assembled != "" {
+			responseBody = []byte(assembled)
+			responseType = "text/plain"
+		}
+	}
+	record.ResponseBody, record.ResponseTruncated = prepareCaptureBody(responseBody, responseType, capture.maxBytes, setting)
+	record.ResponseTruncated = record.ResponseTruncated || capture.writer.truncated
+
+	storage := setting.Storage
+	dir := setting.DiskDir
+	gopool.Go(func() {
+		if err := saveBodyCapture(record, storage, dir); err != nil {
+			common.SysError(fmt.Sprintf("failed to save body capture %s: %s", record.RequestId, err.Error()))
+		}
+	})
+}
+
+// prepareCaptureBody 按内容类型决定是否留存，依次执行 JSON 路径脱敏、正则脱敏与截断
+func prepareCaptureBody(body []byte, contentType string, maxBytes int, setting *operation_setting.BodyCaptureSetting) (string, bool) {
+	if len(body) == 0 {
+		return "", false
+	}
+	if !isCaptureTextContent(body, contentType) {
+		return fmt.Sprintf("[binary body omitted: %d bytes, %s]", len(body), contentType), false
+	}
+	body = redactJSONPaths(body, setting.RedactJSONPaths)
+	text := redactPatterns(string(body), setting.RedactPatterns)
+	if len(text) <= maxBytes {
+		return text, false
+	}
+	cut := maxBytes
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut], true
+}
+
+func isCaptureTextContent(body []byte, contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	if contentType == "" {
+		return utf8.Valid(body)
+	}
+	if strings.HasPrefix(contentType, "multipart/") {
+		return false
+	}
+	return strings.Contains(contentType, "json") ||
+		strings.HasPrefix(contentType, "text/") ||
+		strings.Contains(contentType, "xml") ||
+		strings.Contains(contentType, "x-www-form-urlencoded")
+}
+
+// redactJSONPaths 将 JSON 中指定路径的值替换为 [REDACTED]，路径以 . 分隔，# 或 * 表示全部数组元素或对象字段
+func redactJSONPaths(body []byte, paths []string) []byte {
+	if len(paths) == 0 || !gjson.ValidBytes(body) {
+		return body
+	}
+	for _, path := range paths {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		for _, concrete := range expandJSONPath(body, "", strings.Split(path, ".")) {
+			if !gjson.GetBytes(body, concrete).Exists() {
+				continue
+			}
+			if redacted, err := sjson.SetBytes(body, concrete, bodyCaptureRedacted); err == nil {
+				body = redacted
+			}
+		}
+	}
+	return body
+}
+
+func expandJSONPath(body []byte, prefix string, segments []string) []string {
+	if len(segments) == 0 {
+		if prefix == "" {
+			return nil
+		}
+		return []string{prefix}
+	}
+	segment, rest := segments[0], segments[1:]
+	if segment != "#" && segment != "*" {
+		return expandJSONPath(body, joinJSONPath(prefix, segment), rest)
+	}
+	value := gjson.ParseBytes(body)
+	if prefix != "" {
+		value = gjson.GetBytes(body, prefix)
+	}
+	var paths []string
+	if value.IsArray() {
+		for i := range value.Array() {
+			paths = append(paths, expandJSONPath(body, joinJSONPath(prefix, strconv.Itoa(i)), rest)...)
+		}
+	} else if value.IsObject() {
+		value.ForEach(func(key, _ gjson.Result) bool {
+			paths = append(paths, expandJSONPath(body, joinJSONPath(prefix, escapeJSONPathKey(key.String())), rest)...)
+			return true
+		})
+	}
+	return paths
+}
+
+func joinJSONPath(prefix string, segment string) string {
+	if prefix == "" {
+		return segment
+	}
+	return prefix + "." + segment
+}
+
+var jsonPathKeyEscaper = strings.NewReplacer(`\`, `\\`, ".", `\.`, "*", `\*`, "?", `\?`, "#", `\#`, "|", `\|`)
+
+func escapeJSONPathKey(key string) string {
+	return jsonPathKeyEscaper.Replace(key)
+}
+
+var bodyCaptureRegexCache sync.Map // map[string]*regexp.Regexp
+
+func redactPatterns(text string, patterns []string) string {
+	for _, pattern := range patterns {
+		if pattern == "" {
+			continue
+		}
+		re, ok := bodyCaptureRegexCache.Load(pattern)
+		if !ok {
+			compiled, err := regexp.Compile(pattern)
+			if err != nil {
+				continue
+			}
+			re = compiled
+			bodyCaptureRegexCache.Store(pattern, re)
+		}
+		text = re.(*regexp.Regexp).ReplaceAllString(text, bodyCaptureRedacted)
+	}
+	return text
+}
+
+// 流式响应各格式中增量正文所在的路径：OpenAI Chat、OpenAI Completions、Responses、Claude、Gemini
+var streamTextPaths = []string{
+	"choices.0.delta.content",
+	"choices.0.text",
+	"delta",
+	"delta.text",
+	"candidates.0.content.parts.#.text",
+}
+
+// assembleStreamResponse 将 SSE 响应中的增量正文拼接为完整回复，无法识别时返回空字符串
+func assembleStreamResponse(raw []byte) string {
+	var sb strings.Builder
+	for _, line := range bytes.Split(raw, []byte("\n")) {
+		data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+		if !ok {
+			continue
+		}
+		data = bytes.TrimSpace(data)
+		if len(data) == 0 || !gjson.ValidBytes(data) {
+			continue
+		}
+		for _, path := range streamTextPaths {
+			value := gjson.GetBytes(data, path)
+			if value.IsArray() {
+				for _, item := range value.Array() {
+					if item.Type == gjson.String {
+						sb.WriteString(item.String())
+					}
+				}
+			} else if value.Type == gjson.String {
+				sb.WriteString(value.String())
+			}
+		}
+	}
+	return sb.String()
+}
+
+type bodyCaptureFile struct {
+	RequestBody  string `json:"request_body"`
+	ResponseBody string `json:"response_body"`
+}
+
+// saveBodyCapture 保存留存内容，磁盘写入失败时退回存入数据库
+func saveBodyCapture(record *model.BodyCapture, storage string, dir string) error {
+	if storage == operation_setting.BodyCaptureStorageDisk {
+		path, err := writeBodyCaptureFile(record, dir)
+		if err == nil {
+			record.StoragePath = path
+			record.RequestBody = ""
+			record.ResponseBody = ""
+		} else {
+			common.SysError(fmt.Sprintf("failed to write body capture file, storing in database: %s", err.Error()))
+		}
+	}
+	return record.Insert()
+}
+
+func writeBodyCaptureFile(record *model.BodyCapture, dir string) (string, error) {
+	day := time.Unix(record.CreatedAt, 0).Format("20060102")
+	dayDir := filepath.Join(dir, day)
+	if err := os.MkdirAll(dayDir, 0750); err != nil {
+		return "", err
+	}
+	data, err := common.Marshal(bodyCaptureFile{RequestBody: record.RequestBody, ResponseBody: record.ResponseBody})
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dayDir, filepath.Base(record.RequestId)+".json")
+	return path, os.WriteFile(path, data, 0640)
+}
+
+// GetBodyCapture 读取留存内容，存储在磁盘上的内容会一并读出
+func GetBodyCapture(requestId string) (*model.BodyCapture, error) {
+	record, err := model.GetBodyCaptureByRequestId(requestId)
+	if err != nil {
+		return nil, err
+	}
+	if record.StoragePath == "" {
+		return record, nil
+	}
+	data, err := os.ReadFile(record.StoragePath)
+	if err != nil {
+		return nil, fmt.Errorf("读取留存内容失败，内容可能已过期或保存在节点 %s: %w", record.Node, err)
+	}
+	var file bodyCaptureFile
+	if err := common.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	record.RequestBody = file.RequestBody
+	record.ResponseBody = file.ResponseBody
+	return record, nil
+}
+
+var (
+	bodyCaptureCleanupOnce    sync.Once
+	bodyCaptureCleanupRunning atomic.Bool
+)
+
+// StartBodyCaptureCleanupTask 定期删除本节点写入的、超过保留天数的留存内容。
+// 磁盘存储的文件只在写入的节点上，因此所有节点都需要启动
+func StartBodyCaptureCleanupTask() {
+	bodyCaptureCleanupOnce.Do(func() {
+		gopool.Go(func() {
+			logger.LogInfo(context.Background(), fmt.Sprintf("body capture cleanup task started: node=%s, tick=%s", localNodeName, bodyCaptureCleanupTickInterval))
+
+			ticker := time.NewTicker(bodyCaptureCleanupTickInterval)
+			defer ticker.Stop()
+
+			runBodyCaptureCleanupOnce()
+			for range ticker.C {
+				runBodyCaptureCleanupOnce()
+			}
+		})
+	})
+}
+
+func runBodyCaptureCleanupOnce() {
+	if !bodyCaptureCleanupRunning.CompareAndSwap(false, true) {
+		return
+	}
+	defer bodyCaptureCleanupRunning.Store(false)
+
+	retentionDays := operation_setting.GetBodyCaptureSetting().RetentionDays
+	if retentionDays <= 0 {
+		return
+	}
+	ctx := context.Background()
+	before := common.GetTimestamp() - int64(retentionDays)*86400
+	deleted := 0
+	for {
+		captures, err := model.GetExpiredBodyCaptures(localNodeName, before, bodyCaptureCleanupBatchSize)
+		if err != nil {
+			logger.LogError(ctx, fmt.Sprintf("body capture cleanup: query failed: %v", err))
+			return
+		}
+		if len(captures) == 0 {
+			break
+		}
+		ids := make([]int, 0, len(captures))
+		for _, capture := range captures {
+			ids = append(ids, capture.Id)
+			if capture.StoragePath == "" {
+				continue
+			}
+			if err := os.Remove(capture.StoragePath); err != nil && !os.IsNotExist(err) {
+				logger.LogWarn(ctx, fmt.Sprintf("body capture cleanup: remove %s failed: %v", capture.StoragePath, err))
+			}
+			// 按天分目录，目录清空后一并删除，非空时删除失败可忽略
+			_ = os.Remove(filepath.Dir(capture.StoragePath))
+		}
+		if err := model.DeleteBodyCapturesByIds(ids); err != nil {
+			logger.LogError(ctx, fmt.Sprintf("body capture cleanup: delete failed: %v", err))
+			return
+		}
+		deleted += len(ids)
+		if len(captures) < bodyCaptureCleanupBatchSize {
+			break
+		}
+	}
+	if deleted > 0 {
+		logger.LogInfo(ctx, fmt.Sprintf("body capture cleanup: deleted %d captures older than %d days", deleted, retentionDays))
+	}
+}
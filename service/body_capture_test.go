@@ -0,0 +1,87 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/model"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandJSONPath(t *testing.T) {
+	body := []byte(`{"messages":[{"content":"a"},{"content":"b"}],"meta":{"x.y":1,"z":2},"empty":[]}`)
+
+	require.Equal(t, []string{"messages.0.content", "messages.1.content"}, expandJSONPath(body, "", []string{"messages", "#", "content"}))
+	// 对象字段中的特殊字符需要转义
+	require.ElementsMatch(t, []string{`meta.x\.y`, "meta.z"}, expandJSONPath(body, "", []string{"meta", "*"}))
+	require.Equal(t, []string{"user"}, expandJSONPath(body, "", []string{"user"}))
+	require.Empty(t, expandJSONPath(body, "", []string{"empty", "#"}))
+	require.Empty(t, expandJSONPath(body, "", []string{"messages", "0", "content", "#"}))
+	require.Empty(t, expandJSONPath(body, "", nil))
+}
+
+func TestRedactJSONPaths(t *testing.T) {
+	body := []byte(`{"model":"gpt-4o","messages":[{"role":"user","content":"secret"},{"role":"assistant","content":"reply"}],"meta":{"a.b":"k","c":"v"}}`)
+
+	redacted := string(redactJSONPaths(body, []string{"messages.#.content", " meta.* ", "missing.path", ""}))
+	require.JSONEq(t, `{"model":"gpt-4o","messages":[{"role":"user","content":"[REDACTED]"},{"role":"assistant","content":"[REDACTED]"}],"meta":{"a.b":"[REDACTED]","c":"[REDACTED]"}}`, redacted)
+
+	// 非 JSON 或没有规则时原样返回
+	require.Equal(t, "not json", string(redactJSONPaths([]byte("not json"), []string{"a"})))
+	require.Equal(t, string(body), string(redactJSONPaths(body, nil)))
+}
+
+func TestAssembleStreamResponse(t *testing.T) {
+	openai := "data: {\"choices\":[{\"delta\":{\"content\":\"Hel\"}}]}\n\n" +
+		"data: {\"choices\":[{\"delta\":{\"content\":\"lo\"}}]}\n\n" +
+		"data: [DONE]\n\n"
+	require.Equal(t, "Hello", assembleStreamResponse([]byte(openai)))
+
+	claude := "event: content_block_delta\n" +
+		"data: {\"type\":\"content_block_delta\",\"delta\":{\"type\":\"text_delta\",\"text\":\"Hi\"}}\n\n" +
+		"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n"
+	require.Equal(t, "Hi", assembleStreamResponse([]byte(claude)))
+
+	responses := "data: {\"type\":\"response.output_text.delta\",\"delta\":\"A\"}\n" +
+		"data: {\"type\":\"response.output_text.delta\",\"delta\":\"B\"}\n"
+	require.Equal(t, "AB", assembleStreamResponse([]byte(responses)))
+
+	gemini := "data: {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"x\"},{\"text\":\"y\"}]}}]}\r\n"
+	require.Equal(t, "xy", assembleStreamResponse([]byte(gemini)))
+
+	require.Empty(t, assembleStreamResponse([]byte("data: {\"id\":\"1\"}\n\nnot sse")))
+}
+
+func TestRunBodyCaptureCleanupOnce_OnlyOwnNode(t *testing.T) {
+	setupTestDB(t)
+	require.NoError(t, model.DB.AutoMigrate(&model.BodyCapture{}))
+
+	dir := t.TempDir()
+	createCapture := func(node string) (*model.BodyCapture, string) {
+		record := &model.BodyCapture{RequestId: node + "-" + common.GetRandomString(8), CreatedAt: common.GetTimestamp() - 30*86400, Node: node}
+		path, err := writeBodyCaptureFile(record, dir)
+		require.NoError(t, err)
+		record.StoragePath = path
+		require.NoError(t, record.Insert())
+		return record, path
+	}
+	own, ownPath := createCapture(localNodeName)
+	other, otherPath := createCapture(localNodeName + "-other")
+
+	runBodyCaptureCleanupOnce()
+
+	_, err := os.Stat(ownPath)
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Dir(ownPath))
+	require.NoError(t, err, "其他节点的文件仍在同一目录中")
+	_, err = model.GetBodyCaptureByRequestId(own.RequestId)
+	require.Error(t, err)
+
+	_, err = os.Stat(otherPath)
+	require.NoError(t, err)
+	_, err = model.GetBodyCaptureByRequestId(other.RequestId)
+	require.NoError(t, err)
+}
@@ -0,0 +1,743 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/model"
+
+	"github.com/samber/lo"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ConfigDocumentVersion = 1
+
+	// 导出时密钥类字段（渠道密钥与密钥类配置项）的处理方式
+	ConfigSecretsOmit    = "omit"
+	ConfigSecretsEncrypt = "encrypt"
+	ConfigSecretsPlain   = "plain"
+
+	ConfigFormatYAML = "yaml"
+	ConfigFormatJSON = "json"
+
+	ConfigKindOption       = "option"
+	ConfigKindVendor       = "vendor"
+	ConfigKindModel        = "model"
+	ConfigKindPrefillGroup = "prefill_group"
+	ConfigKindChannel      = "channel"
+
+	ConfigActionCreate = "create"
+	ConfigActionUpdate = "update"
+
+	configMaskedValue = "***"
+)
+
+// ConfigDocument 声明式配置文档，各类对象按名称（配置项按键名）关联，不包含数据库 ID 与运行时状态。
+// 对象中未填写的可选字段（指针字段）导入时保留现有值，新建时使用默认值。
+type ConfigDocument struct {
+	Version       int                  `json:"version" yaml:"version"`
+	ExportedAt    int64                `json:"exported_at,omitempty" yaml:"exported_at,omitempty"`
+	Secrets       string               `json:"secrets,omitempty" yaml:"secrets,omitempty"`
+	Options       map[string]string    `json:"options,omitempty" yaml:"options,omitempty"`
+	Vendors       []ConfigVendor       `json:"vendors,omitempty" yaml:"vendors,omitempty"`
+	Models        []ConfigModel        `json:"models,omitempty" yaml:"models,omitempty"`
+	PrefillGroups []ConfigPrefillGroup `json:"prefill_groups,omitempty" yaml:"prefill_groups,omitempty"`
+	Channels      []ConfigChannel      `json:"channels,omitempty" yaml:"channels,omitempty"`
+}
+
+type ConfigVendor struct {
+	Name        string `json:"name" yaml:"name"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	Icon        string `json:"icon,omitempty" yaml:"icon,omitempty"`
+	Status      *int   `json:"status,omitempty" yaml:"status,omitempty"`
+}
+
+// ConfigModel 模型元数据，供应商以名称引用
+type ConfigModel struct {
+	ModelName    string `json:"model_name" yaml:"model_name"`
+	Description  string `json:"description,omitempty" yaml:"description,omitempty"`
+	Icon         string `json:"icon,omitempty" yaml:"icon,omitempty"`
+	Tags         string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Vendor       string `json:"vendor,omitempty" yaml:"vendor,omitempty"`
+	Endpoints    string `json:"endpoints,omitempty" yaml:"endpoints,omitempty"`
+	Status       *int   `json:"status,omitempty" yaml:"status,omitempty"`
+	SyncOfficial *int   `json:"sync_official,omitempty" yaml:"sync_official,omitempty"`
+	NameRule     int    `json:"name_rule" yaml:"name_rule"`
+}
+
+type ConfigPrefillGroup struct {
+	Name        string `json:"name" yaml:"name"`
+	Type        string `json:"type" yaml:"type"`
+	Items       any    `json:"items" yaml:"items"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+}
+
+// ConfigChannel 渠道配置，Key 为空表示导入时保留现有密钥
+type ConfigChannel struct {
+	Name               string  `json:"name" yaml:"name"`
+	Type               int     `json:"type" yaml:"type"`
+	Key                string  `json:"key,omitempty" yaml:"key,omitempty"`
+	Status             *int    `json:"status,omitempty" yaml:"status,omitempty"`
+	IsMultiKey         bool    `json:"is_multi_key,omitempty" yaml:"is_multi_key,omitempty"`
+	MultiKeyMode       string  `json:"multi_key_mode,omitempty" yaml:"multi_key_mode,omitempty"`
+	OpenAIOrganization *string `json:"openai_organization,omitempty" yaml:"openai_organization,omitempty"`
+	TestModel          *string `json:"test_model,omitempty" yaml:"test_model,omitempty"`
+	Weight             *uint   `json:"weight,omitempty" yaml:"weight,omitempty"`
+	BaseURL            *string `json:"base_url,omitempty" yaml:"base_url,omitempty"`
+	Other              string  `json:"other,omitempty" yaml:"other,omitempty"`
+	Models             string  `json:"models" yaml:"models"`
+	Group              string  `json:"group" yaml:"group"`
+	ModelMapping       *string `json:"model_mapping,omitempty" yaml:"model_mapping,omitempty"`
+	StatusCodeMapping  *string `json:"status_code_mapping,omitempty" yaml:"status_code_mapping,omitempty"`
+	Priority           *int64  `json:"priority,omitempty" yaml:"priority,omitempty"`
+	AutoBan            *int    `json:"auto_ban,omitempty" yaml:"auto_ban,omitempty"`
+	Tag                *string `json:"tag,omitempty" yaml:"tag,omitempty"`
+	Setting            *string `json:"setting,omitempty" yaml:"setting,omitempty"`
+	ParamOverride      *string `json:"param_override,omitempty" yaml:"param_override,omitempty"`
+	HeaderOverride     *string `json:"header_override,omitempty" yaml:"header_override,omitempty"`
+	Remark             *string `json:"remark,omitempty" yaml:"remark,omitempty"`
+	Settings           string  `json:"settings,omitempty" yaml:"settings,omitempty"`
+}
+
+// ConfigChange 导入计划中的一项变更，Changes 中的密钥类字段已脱敏
+type ConfigChange struct {
+	Kind    string                       `json:"kind"`
+	Name    string                       `json:"name"`
+	Action  string                       `json:"action"`
+	Changes map[string]model.FieldChange `json:"changes,omitempty"`
+	Error   string                       `json:"error,omitempty"`
+}
+
+type ConfigImportResult struct {
+	DryRun    bool            `json:"dry_run"`
+	Changes   []*ConfigChange `json:"changes"`
+	Unchanged int             `json:"unchanged"`
+	Failed    int             `json:"failed"`
+}
+
+type configImporter struct {
+	result   *ConfigImportResult
+	userId   int
+	username string
+	// 实际写入过的对象类型，用于应用后刷新缓存
+	applied map[string]bool
+}
+
+// fillUnset 将 desired 中未填写的指针字段补为 current 中的值，两者须为同一结构体类型的指针
+func fillUnset(desired any, current any) {
+	dv := reflect.ValueOf(desired).Elem()
+	cv := reflect.ValueOf(current).Elem()
+	for i := 0; i < dv.NumField(); i++ {
+		if field := dv.Field(i); field.Kind() == reflect.Ptr && field.IsNil() {
+			field.Set(cv.Field(i))
+		}
+	}
+}
+
+// channelConfigColumns 导入更新渠道时写入的列，与 ConfigChannel.applyTo 对应
+var channelConfigColumns = []string{
+	"name", "type", "key", "status", "channel_info", "open_ai_organization", "test_model", "weight",
+	"base_url", "other", "models", "group", "model_mapping", "status_code_mapping", "priority",
+	"auto_ban", "tag", "setting", "param_override", "header_override", "remark", "settings",
+}
+
+// updateConfigColumns 按列更新已有对象，零值同样写入
+func updateConfigColumns(value any, columns ...string) error {
+	return model.DB.Model(value).Select(columns).Updates(value).Error
+}
+
+// protectSecret 按导出方式处理密钥，encrypter 仅在 encrypt 方式下使用
+func protectSecret(value string, secrets string, encrypter *common.PassphraseEncrypter) (string, bool, error) {
+	switch secrets {
+	case ConfigSecretsPlain:
+		return value, true, nil
+	case ConfigSecretsEncrypt:
+		if value == "" {
+			return "", true, nil
+		}
+		encrypted, err := encrypter.Encrypt(value)
+		return encrypted, true, err
+	default:
+		return "", false, nil
+	}
+}
+
+func toConfigChannel(channel *model.Channel) ConfigChannel {
+	return ConfigChannel{
+		Name:               channel.Name,
+		Type:               channel.Type,
+		Key:                channel.Key,
+		Status:             &channel.Status,
+		IsMultiKey:         channel.ChannelInfo.IsMultiKey,
+		MultiKeyMode:       string(channel.ChannelInfo.MultiKeyMode),
+		OpenAIOrganization: channel.OpenAIOrganization,
+		TestModel:          channel.TestModel,
+		Weight:             channel.Weight,
+		BaseURL:            channel.BaseURL,
+		Other:              channel.Other,
+		Models:             channel.Models,
+		Group:              channel.Group,
+		ModelMapping:       channel.ModelMapping,
+		StatusCodeMapping:  channel.StatusCodeMapping,
+		Priority:           channel.Priority,
+		AutoBan:            channel.AutoBan,
+		Tag:                channel.Tag,
+		Setting:            channel.Setting,
+		ParamOverride:      channel.ParamOverride,
+		HeaderOverride:     channel.HeaderOverride,
+		Remark:             channel.Remark,
+		Settings:           channel.OtherSettings,
+	}
+}
+
+// applyTo 将配置写入渠道对象，保留 ID、统计数据与多 Key 运行状态
+func (cc *ConfigChannel) applyTo(channel *model.Channel) {
+	channel.Name = cc.Name
+	channel.Type = cc.Type
+	if cc.Key != "" {
+		channel.Key = cc.Key
+	}
+	if cc.Status != nil {
+		channel.Status = *cc.Status
+	}
+	channel.ChannelInfo.IsMultiKey = cc.IsMultiKey
+	channel.ChannelInfo.MultiKeyMode = constant.MultiKeyMode(cc.MultiKeyMode)
+	channel.OpenAIOrganization = cc.OpenAIOrganization
+	channel.TestModel = cc.TestModel
+	channel.Weight = cc.Weight
+	channel.BaseURL = cc.BaseURL
+	channel.Other = cc.Other
+	channel.Models = cc.Models
+	channel.Group = cc.Group
+	channel.ModelMapping = cc.ModelMapping
+	channel.StatusCodeMapping = cc.StatusCodeMapping
+	channel.Priority = cc.Priority
+	channel.AutoBan = cc.AutoBan
+	channel.Tag = cc.Tag
+	channel.Setting = cc.Setting
+	channel.ParamOverride = cc.ParamOverride
+	channel.HeaderOverride = cc.HeaderOverride
+	channel.Remark = cc.Remark
+	channel.OtherSettings = cc.Settings
+}
+
+func toConfigPrefillGroup(group *model.PrefillGroup) ConfigPrefillGroup {
+	var items any
+	if len(group.Items) > 0 {
+		_ = common.Unmarshal(group.Items, &items)
+	}
+	return ConfigPrefillGroup{
+		Name:        group.Name,
+		Type:        group.Type,
+		Items:       items,
+		Description: group.Description,
+	}
+}
+
+// ExportConfig 导出当前配置，secrets 为 omit 时不导出密钥，为 encrypt 时以 passphrase 加密
+func ExportConfig(secrets string, passphrase string) (*ConfigDocument, error) {
+	if secrets == "" {
+		secrets = ConfigSecretsOmit
+	}
+	if secrets != ConfigSecretsOmit && secrets != ConfigSecretsEncrypt && secrets != ConfigSecretsPlain {
+		return nil, fmt.Errorf("不支持的密钥导出方式: %s", secrets)
+	}
+	var encrypter *common.PassphraseEncrypter
+	if secrets == ConfigSecretsEncrypt {
+		if passphrase == "" {
+			return nil, errors.New("加密导出需要提供口令")
+		}
+		// 同一次导出共用一个盐值，只需派生一次密钥
+		var err error
+		if encrypter, err = common.NewPassphraseEncrypter(passphrase); err != nil {
+			return nil, err
+		}
+	}
+	doc := &ConfigDocument{
+		Version:    ConfigDocumentVersion,
+		ExportedAt: common.GetTimestamp(),
+		Secrets:    secrets,
+		Options:    make(map[string]string),
+	}
+
+	options, err := model.AllOption()
+	if err != nil {
+		return nil, err
+	}
+	for _, option := range options {
+		value := option.Value
+		if model.IsSensitiveOptionKey(option.Key) {
+			var keep bool
+			value, keep, err = protectSecret(value, secrets, encrypter)
+			if err != nil {
+				return nil, err
+			}
+			if !keep {
+				continue
+			}
+		}
+		doc.Options[option.Key] = value
+	}
+
+	var vendors []*model.Vendor
+	if err := model.DB.Order("id").Find(&vendors).Error; err != nil {
+		return nil, err
+	}
+	vendorNames := make(map[int]string, len(vendors))
+	for _, vendor := range vendors {
+		vendorNames[vendor.Id] = vendor.Name
+		doc.Vendors = append(doc.Vendors, ConfigVendor{
+			Name:        vendor.Name,
+			Description: vendor.Description,
+			Icon:        vendor.Icon,
+			Status:      &vendor.Status,
+		})
+	}
+
+	var models []*model.Model
+	if err := model.DB.Order("id").Find(&models).Error; err != nil {
+		return nil, err
+	}
+	for _, m := range models {
+		doc.Models = append(doc.Models, ConfigModel{
+			ModelName:    m.ModelName,
+			Description:  m.Description,
+			Icon:         m.Icon,
+			Tags:         m.Tags,
+			Vendor:       vendorNames[m.VendorID],
+			Endpoints:    m.Endpoints,
+			Status:       &m.Status,
+			SyncOfficial: &m.SyncOfficial,
+			NameRule:     m.NameRule,
+		})
+	}
+
+	var groups []*model.PrefillGroup
+	if err := model.DB.Order("id").Find(&groups).Error; err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		doc.PrefillGroups = append(doc.PrefillGroups, toConfigPrefillGroup(group))
+	}
+
+	var channels []*model.Channel
+	if err := model.DB.Order("id").Find(&channels).Error; err != nil {
+		return nil, err
+	}
+	for _, channel := range channels {
+		cc := toConfigChannel(channel)
+		if cc.Key, _, err = protectSecret(cc.Key, secrets, encrypter); err != nil {
+			return nil, err
+		}
+		// 请求头覆盖与渠道设置中可能带有鉴权信息，不导出密钥时一并省略，导入时保留现有值
+		if secrets == ConfigSecretsOmit {
+			cc.HeaderOverride = nil
+			cc.Setting = nil
+		}
+		doc.Channels = append(doc.Channels, cc)
+	}
+	return doc, nil
+}
+
+func EncodeConfigDocument(doc *ConfigDocument, format string) ([]byte, error) {
+	if format == ConfigFormatJSON {
+		return json.MarshalIndent(doc, "", "  ")
+	}
+	return yaml.Marshal(doc)
+}
+
+// DecodeConfigDocument 解析 YAML 或 JSON 格式的配置文档
+func DecodeConfigDocument(data []byte) (*ConfigDocument, error) {
+	doc := &ConfigDocument{}
+	if err := yaml.Unmarshal(data, doc); err != nil {
+		return nil, fmt.Errorf("配置文档解析失败: %w", err)
+	}
+	if doc.Version != ConfigDocumentVersion {
+		return nil, fmt.Errorf("不支持的配置文档版本: %d", doc.Version)
+	}
+	return doc, nil
+}
+
+// decryptSecrets 解密文档中的加密字段，任一字段解密失败时整个导入中止
+func decryptSecrets(doc *ConfigDocument, passphrase string) error {
+	decrypter := common.NewPassphraseDecrypter(passphrase)
+	for key, value := range doc.Options {
+		if !common.IsEncryptedValue(value) {
+			continue
+		}
+		plaintext, err := decrypter.Decrypt(value)
+		if err != nil {
+			return fmt.Errorf("配置项 %s: %w", key, err)
+		}
+		doc.Options[key] = plaintext
+	}
+	for i := range doc.Channels {
+		if !common.IsEncryptedValue(doc.Channels[i].Key) {
+			continue
+		}
+		plaintext, err := decrypter.Decrypt(doc.Channels[i].Key)
+		if err != nil {
+			return fmt.Errorf("渠道 %s: %w", doc.Channels[i].Name, err)
+		}
+		doc.Channels[i].Key = plaintext
+	}
+	return nil
+}
+
+func (im *configImporter) add(kind string, name string, action string, changes map[string]model.FieldChange, err error) {
+	change := &ConfigChange{Kind: kind, Name: name, Action: action, Changes: changes}
+	if err != nil {
+		change.Error = err.Error()
+		im.result.Failed++
+	} else if !im.result.DryRun {
+		im.applied[kind] = true
+	}
+	im.result.Changes = append(im.result.Changes, change)
+}
+
+func maskConfigChange(changes map[string]model.FieldChange, field string) {
+	change, ok := changes[field]
+	if !ok {
+		return
+	}
+	if change.Before != nil {
+		change.Before = configMaskedValue
+	}
+	if change.After != nil {
+		change.After = configMaskedValue
+	}
+	changes[field] = change
+}
+
+func (im *configImporter) importOptions(desired map[string]string) error {
+	options, err := model.AllOption()
+	if err != nil {
+		return err
+	}
+	current := make(map[string]string, len(options))
+	for _, option := range options {
+		current[option.Key] = option.Value
+	}
+	keys := make([]string, 0, len(desired))
+	for key := range desired {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := desired[key]
+		before, exists := current[key]
+		if exists && before == value {
+			im.result.Unchanged++
+			continue
+		}
+		action := ConfigActionUpdate
+		change := model.FieldChange{Before: before, After: value}
+		if !exists {
+			action = ConfigActionCreate
+			change.Before = nil
+		}
+		changes := map[string]model.FieldChange{"value": change}
+		if model.IsSensitiveOptionKey(key) {
+			maskConfigChange(changes, "value")
+		}
+		// 预演时同样校验取值，使无效配置在计划中即可发现
+		applyErr := model.ValidateOptionValue(key, value)
+		if applyErr == nil && !im.result.DryRun {
+			applyErr = model.UpdateOptionByUser(key, value, im.userId, im.username)
+		}
+		im.add(ConfigKindOption, key, action, changes, applyErr)
+	}
+	return nil
+}
+
+func (im *configImporter) importVendors(desired []ConfigVendor) error {
+	var vendors []*model.Vendor
+	if err := model.DB.Find(&vendors).Error; err != nil {
+		return err
+	}
+	existing := make(map[string]*model.Vendor, len(vendors))
+	for _, vendor := range vendors {
+		existing[vendor.Name] = vendor
+	}
+	for _, cv := range desired {
+		vendor, ok := existing[cv.Name]
+		if !ok {
+			var applyErr error
+			if !im.result.DryRun {
+				applyErr = (&model.Vendor{Name: cv.Name, Description: cv.Description, Icon: cv.Icon, Status: lo.FromPtrOr(cv.Status, 1)}).Insert()
+			}
+			im.add(ConfigKindVendor, cv.Name, ConfigActionCreate, model.DiffObjects(nil, cv), applyErr)
+			continue
+		}
+		current := ConfigVendor{Name: vendor.Name, Description: vendor.Description, Icon: vendor.Icon, Status: &vendor.Status}
+		fillUnset(&cv, &current)
+		changes := model.DiffObjects(current, cv)
+		if len(changes) == 0 {
+			im.result.Unchanged++
+			continue
+		}
+		var applyErr error
+		if !im.result.DryRun {
+			vendor.Description = cv.Description
+			vendor.Icon = cv.Icon
+			vendor.Status = *cv.Status
+			vendor.UpdatedTime = common.GetTimestamp()
+			applyErr = updateConfigColumns(vendor, "description", "icon", "status", "updated_time")
+		}
+		im.add(ConfigKindVendor, cv.Name, ConfigActionUpdate, changes, applyErr)
+	}
+	return nil
+}
+
+func (im *configImporter) importModels(desired []ConfigModel) error {
+	var vendors []*model.Vendor
+	if err := model.DB.Find(&vendors).Error; err != nil {
+		return err
+	}
+	vendorIds := make(map[string]int, len(vendors))
+	vendorNames := make(map[int]string, len(vendors))
+	for _, vendor := range vendors {
+		vendorIds[vendor.Name] = vendor.Id
+		vendorNames[vendor.Id] = vendor.Name
+	}
+	var models []*model.Model
+	if err := model.DB.Find(&models).Error; err != nil {
+		return err
+	}
+	existing := make(map[string]*model.Model, len(models))
+	for _, m := range models {
+		existing[m.ModelName] = m
+	}
+	for _, cm := range desired {
+		vendorId, vendorFound := vendorIds[cm.Vendor]
+		var vendorErr error
+		// 预演时供应商可能尚未创建，只在实际应用时校验
+		if cm.Vendor != "" && !vendorFound && !im.result.DryRun {
+			vendorErr = fmt.Errorf("供应商 %s 不存在", cm.Vendor)
+		}
+		m, ok := existing[cm.ModelName]
+		if !ok {
+			applyErr := vendorErr
+			if !im.result.DryRun && applyErr == nil {
+				applyErr = (&model.Model{
+					ModelName:    cm.ModelName,
+					Description:  cm.Description,
+					Icon:         cm.Icon,
+					Tags:         cm.Tags,
+					VendorID:     vendorId,
+					Endpoints:    cm.Endpoints,
+					Status:       lo.FromPtrOr(cm.Status, 1),
+					SyncOfficial: lo.FromPtrOr(cm.SyncOfficial, 1),
+					NameRule:     cm.NameRule,
+				}).Insert()
+			}
+			im.add(ConfigKindModel, cm.ModelName, ConfigActionCreate, model.DiffObjects(nil, cm), applyErr)
+			continue
+		}
+		current := ConfigModel{
+			ModelName:    m.ModelName,
+			Description:  m.Description,
+			Icon:         m.Icon,
+			Tags:         m.Tags,
+			Vendor:       vendorNames[m.VendorID],
+			Endpoints:    m.Endpoints,
+			Status:       &m.Status,
+			SyncOfficial: &m.SyncOfficial,
+			NameRule:     m.NameRule,
+		}
+		fillUnset(&cm, &current)
+		changes := model.DiffObjects(current, cm)
+		if len(changes) == 0 {
+			im.result.Unchanged++
+			continue
+		}
+		applyErr := vendorErr
+		if !im.result.DryRun && applyErr == nil {
+			m.Description = cm.Description
+			m.Icon = cm.Icon
+			m.Tags = cm.Tags
+			m.VendorID = vendorId
+			m.Endpoints = cm.Endpoints
+			m.Status = *cm.Status
+			m.SyncOfficial = *cm.SyncOfficial
+			m.NameRule = cm.NameRule
+			m.UpdatedTime = common.GetTimestamp()
+			applyErr = updateConfigColumns(m, "description", "icon", "tags", "vendor_id", "endpoints",
+				"status", "sync_official", "name_rule", "updated_time")
+		}
+		im.add(ConfigKindModel, cm.ModelName, ConfigActionUpdate, changes, applyErr)
+	}
+	return nil
+}
+
+func (im *configImporter) importPrefillGroups(desired []ConfigPrefillGroup) error {
+	var groups []*model.PrefillGroup
+	if err := model.DB.Find(&groups).Error; err != nil {
+		return err
+	}
+	existing := make(map[string]*model.PrefillGroup, len(groups))
+	for _, group := range groups {
+		existing[group.Name] = group
+	}
+	for _, cg := range desired {
+		items, err := common.Marshal(cg.Items)
+		if err != nil {
+			im.add(ConfigKindPrefillGroup, cg.Name, ConfigActionUpdate, nil, err)
+			continue
+		}
+		group, ok := existing[cg.Name]
+		if !ok {
+			var applyErr error
+			if !im.result.DryRun {
+				applyErr = (&model.PrefillGroup{Name: cg.Name, Type: cg.Type, Items: model.JSONValue(items), Description: cg.Description}).Insert()
+			}
+			im.add(ConfigKindPrefillGroup, cg.Name, ConfigActionCreate, model.DiffObjects(nil, cg), applyErr)
+			continue
+		}
+		changes := model.DiffObjects(toConfigPrefillGroup(group), cg)
+		if len(changes) == 0 {
+			im.result.Unchanged++
+			continue
+		}
+		var applyErr error
+		if !im.result.DryRun {
+			group.Type = cg.Type
+			group.Items = model.JSONValue(items)
+			group.Description = cg.Description
+			group.UpdatedTime = common.GetTimestamp()
+			applyErr = updateConfigColumns(group, "type", "items", "description", "updated_time")
+		}
+		im.add(ConfigKindPrefillGroup, cg.Name, ConfigActionUpdate, changes, applyErr)
+	}
+	return nil
+}
+
+func (im *configImporter) importChannels(desired []ConfigChannel) error {
+	var channels []*model.Channel
+	if err := model.DB.Find(&channels).Error; err != nil {
+		return err
+	}
+	existing := make(map[string][]*model.Channel, len(channels))
+	for _, channel := range channels {
+		existing[channel.Name] = append(existing[channel.Name], channel)
+	}
+	seen := make(map[string]bool, len(desired))
+	for _, cc := range desired {
+		if seen[cc.Name] {
+			im.add(ConfigKindChannel, cc.Name, ConfigActionUpdate, nil, errors.New("配置文档中存在同名渠道"))
+			continue
+		}
+		seen[cc.Name] = true
+		matched := existing[cc.Name]
+		if len(matched) > 1 {
+			im.add(ConfigKindChannel, cc.Name, ConfigActionUpdate, nil, fmt.Errorf("存在 %d 个同名渠道，无法按名称匹配", len(matched)))
+			continue
+		}
+		if len(matched) == 0 {
+			changes := model.DiffObjects(nil, cc)
+			for _, field := range []string{"key", "header_override", "setting"} {
+				maskConfigChange(changes, field)
+			}
+			var applyErr error
+			if cc.Key == "" {
+				applyErr = errors.New("新建渠道缺少密钥")
+			} else if !im.result.DryRun {
+				channel := model.Channel{CreatedTime: common.GetTimestamp()}
+				cc.applyTo(&channel)
+				applyErr = model.BatchInsertChannels([]model.Channel{channel})
+			}
+			im.add(ConfigKindChannel, cc.Name, ConfigActionCreate, changes, applyErr)
+			continue
+		}
+		channel := matched[0]
+		if cc.Key == "" {
+			cc.Key = channel.Key
+		}
+		current := toConfigChannel(channel)
+		fillUnset(&cc, &current)
+		changes := model.DiffObjects(current, cc)
+		if len(changes) == 0 {
+			im.result.Unchanged++
+			continue
+		}
+		for _, field := range []string{"key", "header_override", "setting"} {
+			maskConfigChange(changes, field)
+		}
+		var applyErr error
+		if !im.result.DryRun {
+			cc.applyTo(channel)
+			applyErr = channel.UpdateColumns(channelConfigColumns...)
+		}
+		im.add(ConfigKindChannel, cc.Name, ConfigActionUpdate, changes, applyErr)
+	}
+	return nil
+}
+
+// ImportConfig 按名称将配置文档同步到数据库，只新增或更新，不删除文档中未出现的对象。
+// dryRun 为 true 时只返回变更计划。
+func ImportConfig(doc *ConfigDocument, passphrase string, dryRun bool, userId int, username string) (*ConfigImportResult, error) {
+	if err := decryptSecrets(doc, passphrase); err != nil {
+		return nil, err
+	}
+	im := &configImporter{
+		result:   &ConfigImportResult{DryRun: dryRun, Changes: []*ConfigChange{}},
+		userId:   userId,
+		username: username,
+		applied:  make(map[string]bool),
+	}
+	// 供应商需先于模型写入，以便模型按名称引用
+	steps := []func() error{
+		func() error { return im.importOptions(doc.Options) },
+		func() error { return im.importVendors(doc.Vendors) },
+		func() error { return im.importModels(doc.Models) },
+		func() error { return im.importPrefillGroups(doc.PrefillGroups) },
+		func() error { return im.importChannels(doc.Channels) },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return im.result, err
+		}
+	}
+	if im.applied[ConfigKindChannel] {
+		model.InitChannelCache()
+		ResetProxyClientCache()
+	}
+	if im.applied[ConfigKindOption] || im.applied[ConfigKindVendor] || im.applied[ConfigKindModel] {
+		model.RefreshPricing()
+	}
+	return im.result, nil
+}
+
+// ReconcileConfigFromFile 主节点启动时按 CONFIG_RECONCILE_FILE 同步配置，单项失败只记录日志
+func ReconcileConfigFromFile() error {
+	if common.ConfigReconcileFile == "" || !common.IsMasterNode {
+		return nil
+	}
+	data, err := os.ReadFile(common.ConfigReconcileFile)
+	if err != nil {
+		return fmt.Errorf("failed to read config reconcile file: %w", err)
+	}
+	doc, err := DecodeConfigDocument(data)
+	if err != nil {
+		return err
+	}
+	result, err := ImportConfig(doc, common.ConfigSecretPassphrase, false, 0, "config-reconcile")
+	if err != nil {
+		return err
+	}
+	for _, change := range result.Changes {
+		if change.Error != "" {
+			common.SysError(fmt.Sprintf("config reconcile failed: %s %s: %s", change.Kind, change.Name, change.Error))
+		}
+	}
+	common.SysLog(fmt.Sprintf("config reconciled from %s: %d changed, %d unchanged, %d failed",
+		common.ConfigReconcileFile, len(result.Changes)-result.Failed, result.Unchanged, result.Failed))
+	return nil
+}
@@ -0,0 +1,340 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+
+	"github.com/bytedance/gopkg/util/gopool"
+)
+
+const (
+	logExportBatchSize = 1000
+	// 超过该时长仍未完成的任务视为节点重启遗留，不再阻止用户创建新任务
+	logExportJobTimeout = 6 * time.Hour
+
+	logExportCleanupTickInterval = time.Hour
+	logExportCleanupBatchSize    = 500
+)
+
+// logExportOtherFields 从 Other 中展开为 CSV 列的字段，JSONL 则输出完整的 other 对象
+var logExportOtherFields = []string{
+	"cache_tokens",
+	"cache_creation_tokens",
+	"cache_ratio",
+	"model_ratio",
+	"completion_ratio",
+	"group_ratio",
+	"user_group_ratio",
+	"model_price",
+	"frt",
+	"reasoning_effort",
+	"upstream_model_name",
+	"request_path",
+}
+
+// escapeCSVCell 以 = + - @ 或制表符、回车开头的文本在表格软件中会被当作公式执行，前面加单引号使其按文本显示
+func escapeCSVCell(value string) string {
+	if value == "" {
+		return value
+	}
+	switch value[0] {
+	case '=', '+', '-', '@', '\t', '\r':
+		return "'" + value
+	}
+	return value
+}
+
+// logExportRecord JSONL 的一行，other 解析为对象输出
+type logExportRecord struct {
+	*model.Log
+	Other map[string]interface{} `json:"other"`
+}
+
+// IsValidLogExportFormat 判断导出格式是否受支持
+func IsValidLogExportFormat(format string) bool {
+	return format == model.LogExportFormatCSV || format == model.LogExportFormatJSONL
+}
+
+// LogExportContentType 导出格式对应的 Content-Type
+func LogExportContentType(format string) string {
+	if format == model.LogExportFormatJSONL {
+		return "application/x-ndjson; charset=utf-8"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// WriteLogExport 将符合条件的日志逐批写入 w，每批写完后调用 flush，返回写入行数
+func WriteLogExport(w io.Writer, query *model.LogExportQuery, format string, flush func()) (int64, error) {
+	var rows int64
+	admin := query.UserId == 0
+	if format == model.LogExportFormatJSONL {
+		err := model.IterateExportLogs(query, logExportBatchSize, func(logs []*model.Log) error {
+			for _, log := range logs {
+				other, _ := common.StrToMap(log.Other)
+				data, err := common.Marshal(logExportRecord{Log: log, Other: other})
+				if err != nil {
+					return err
+				}
+				if _, err := w.Write(append(data, '\n')); err != nil {
+					return err
+				}
+				rows++
+			}
+			if flush != nil {
+				flush()
+			}
+			return nil
+		})
+		return rows, err
+	}
+
+	// 写入 BOM 便于 Excel 识别 UTF-8
+	if _, err := io.WriteString(w, "\xEF\xBB\xBF"); err != nil {
+		return 0, err
+	}
+	cw := csv.NewWriter(w)
+	header := []string{"id", "created_at", "type", "username", "token_name", "model_name", "group",
+		"quota", "prompt_tokens", "completion_tokens", "use_time", "is_stream", "channel_id", "ip"}
+	if admin {
+		header = append(header, "channel_name", "upstream_cost")
+	}
+	header = append(header, logExportOtherFields...)
+	header = append(header, "content")
+	if err := cw.Write(header); err != nil {
+		return 0, err
+	}
+	err := model.IterateExportLogs(query, logExportBatchSize, func(logs []*model.Log) error {
+		for _, log := range logs {
+			record := []string{
+				strconv.Itoa(log.Id),
+				time.Unix(log.CreatedAt, 0).Format(time.RFC3339),
+				strconv.Itoa(log.Type),
+				escapeCSVCell(log.Username),
+				escapeCSVCell(log.TokenName),
+				escapeCSVCell(log.ModelName),
+				escapeCSVCell(log.Group),
+				strconv.Itoa(log.Quota),
+				strconv.Itoa(log.PromptTokens),
+				strconv.Itoa(log.CompletionTokens),
+				strconv.Itoa(log.UseTime),
+				strconv.FormatBool(log.IsStream),
+				strconv.Itoa(log.ChannelId),
+				escapeCSVCell(log.Ip),
+			}
+			if admin {
+				record = append(record, escapeCSVCell(log.ChannelName), strconv.Itoa(log.UpstreamCost))
+			}
+			other, _ := common.StrToMap(log.Other)
+			for _, field := range logExportOtherFields {
+				value, ok := other[field]
+				if !ok || value == nil {
+					record = append(record, "")
+					continue
+				}
+				// 数值保持原样，避免负数被加上引号
+				if text, ok := value.(string); ok {
+					record = append(record, escapeCSVCell(text))
+					continue
+				}
+				record = append(record, fmt.Sprint(value))
+			}
+			record = append(record, escapeCSVCell(log.Content))
+			if err := cw.Write(record); err != nil {
+				return err
+			}
+			rows++
+		}
+		cw.Flush()
+		if flush != nil {
+			flush()
+		}
+		return cw.Error()
+	})
+	cw.Flush()
+	return rows, err
+}
+
+var (
+	logExportSlots     chan struct{}
+	logExportSlotsOnce sync.Once
+)
+
+func acquireLogExportSlot() {
+	logExportSlotsOnce.Do(func() {
+		logExportSlots = make(chan struct{}, max(operation_setting.GetLogExportSetting().MaxConcurrentJobs, 1))
+	})
+	logExportSlots <- struct{}{}
+}
+
+func releaseLogExportSlot() {
+	<-logExportSlots
+}
+
+// CreateLogExportJob 创建后台导出任务，由当前节点执行，完成后可通过任务 id 下载
+func CreateLogExportJob(userId int, query *model.LogExportQuery, format string) (*model.LogExportJob, error) {
+	active, err := model.HasActiveLogExportJob(userId, time.Now().Add(-logExportJobTimeout).Unix())
+	if err != nil {
+		return nil, err
+	}
+	if active {
+		return nil, errors.New("已有未完成的导出任务，请稍后再试")
+	}
+	queryJson, err := common.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+	job := &model.LogExportJob{
+		UserId: userId,
+		Format: format,
+		Query:  string(queryJson),
+		Status: model.LogExportJobPending,
+		Node:   localNodeName,
+	}
+	if err := job.Insert(); err != nil {
+		return nil, err
+	}
+	queryCopy := *query
+	gopool.Go(func() {
+		acquireLogExportSlot()
+		defer releaseLogExportSlot()
+		runLogExportJob(job, &queryCopy)
+	})
+	return job, nil
+}
+
+func runLogExportJob(job *model.LogExportJob, query *model.LogExportQuery) {
+	ctx := context.Background()
+	job.Status = model.LogExportJobRunning
+	if err := job.UpdateStatus(); err != nil {
+		logger.LogError(ctx, fmt.Sprintf("log export job %d: update status failed: %v", job.Id, err))
+	}
+
+	rows, size, path, err := writeLogExportFile(job, query)
+	job.FinishedAt = common.GetTimestamp()
+	if err != nil {
+		logger.LogError(ctx, fmt.Sprintf("log export job %d failed: %v", job.Id, err))
+		if path != "" {
+			_ = os.Remove(path)
+		}
+		job.Status = model.LogExportJobFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = model.LogExportJobSucceeded
+		job.RowCount = rows
+		job.FileSize = size
+		job.FilePath = path
+	}
+	if err := job.UpdateStatus(); err != nil {
+		logger.LogError(ctx, fmt.Sprintf("log export job %d: update status failed: %v", job.Id, err))
+	}
+}
+
+func writeLogExportFile(job *model.LogExportJob, query *model.LogExportQuery) (rows int64, size int64, path string, err error) {
+	dir := operation_setting.GetLogExportSetting().Dir
+	if err = os.MkdirAll(dir, 0o750); err != nil {
+		return 0, 0, "", err
+	}
+	path = filepath.Join(dir, fmt.Sprintf("log-export-%d-%s.%s", job.Id, time.Now().Format("20060102150405"), job.Format))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	defer file.Close()
+	w := bufio.NewWriterSize(file, 256*1024)
+	rows, err = WriteLogExport(w, query, job.Format, nil)
+	if err != nil {
+		return rows, 0, path, err
+	}
+	if err = w.Flush(); err != nil {
+		return rows, 0, path, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return rows, 0, path, err
+	}
+	return rows, info.Size(), path, nil
+}
+
+var (
+	logExportCleanupOnce    sync.Once
+	logExportCleanupRunning atomic.Bool
+)
+
+// StartLogExportCleanupTask 定期删除超过保留时间的导出文件与任务记录。
+// 导出文件保存在执行任务的节点上，因此每个节点都运行清理，且只处理本节点的任务
+func StartLogExportCleanupTask() {
+	logExportCleanupOnce.Do(func() {
+		gopool.Go(func() {
+			logger.LogInfo(context.Background(), fmt.Sprintf("log export cleanup task started: node=%s, tick=%s", localNodeName, logExportCleanupTickInterval))
+
+			ticker := time.NewTicker(logExportCleanupTickInterval)
+			defer ticker.Stop()
+
+			runLogExportCleanupOnce()
+			for range ticker.C {
+				runLogExportCleanupOnce()
+			}
+		})
+	})
+}
+
+func runLogExportCleanupOnce() {
+	if !logExportCleanupRunning.CompareAndSwap(false, true) {
+		return
+	}
+	defer logExportCleanupRunning.Store(false)
+
+	retentionHours := operation_setting.GetLogExportSetting().RetentionHours
+	if retentionHours <= 0 {
+		return
+	}
+	ctx := context.Background()
+	before := common.GetTimestamp() - int64(retentionHours)*3600
+	deleted := 0
+	for {
+		jobs, err := model.GetExpiredLogExportJobs(localNodeName, before, logExportCleanupBatchSize)
+		if err != nil {
+			logger.LogError(ctx, fmt.Sprintf("log export cleanup: query failed: %v", err))
+			return
+		}
+		if len(jobs) == 0 {
+			break
+		}
+		ids := make([]int, 0, len(jobs))
+		for _, job := range jobs {
+			ids = append(ids, job.Id)
+			if job.FilePath == "" {
+				continue
+			}
+			if err := os.Remove(job.FilePath); err != nil && !os.IsNotExist(err) {
+				logger.LogWarn(ctx, fmt.Sprintf("log export cleanup: remove %s failed: %v", job.FilePath, err))
+			}
+		}
+		if err := model.DeleteLogExportJobsByIds(ids); err != nil {
+			logger.LogError(ctx, fmt.Sprintf("log export cleanup: delete failed: %v", err))
+			return
+		}
+		deleted += len(ids)
+		if len(jobs) < logExportCleanupBatchSize {
+			break
+		}
+	}
+	if deleted > 0 {
+		logger.LogInfo(ctx, fmt.Sprintf("log export cleanup: deleted %d jobs older than %d hours", deleted, retentionHours))
+	}
+}
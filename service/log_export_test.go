@@ -0,0 +1,94 @@
+package service
+
+import (
+	"bytes"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/model"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEscapeCSVCell(t *testing.T) {
+	cases := map[string]string{
+		"":                  "",
+		"alice":             "alice",
+		"=HYPERLINK(\"x\")": "'=HYPERLINK(\"x\")",
+		"+1":                "'+1",
+		"-2+3":              "'-2+3",
+		"@SUM(A1)":          "'@SUM(A1)",
+		"\tcmd":             "'\tcmd",
+		"a=b":               "a=b",
+		"gpt-4o":            "gpt-4o",
+	}
+	for input, want := range cases {
+		require.Equal(t, want, escapeCSVCell(input), input)
+	}
+}
+
+func TestWriteLogExport_CSVEscapesFormulas(t *testing.T) {
+	setupTestDB(t)
+	require.NoError(t, model.LOG_DB.Create(&model.Log{
+		UserId:    1,
+		Username:  "=cmd|' /C calc'!A0",
+		TokenName: "@token",
+		ModelName: "gpt-4o",
+		Type:      model.LogTypeConsume,
+		Quota:     -5,
+		Content:   "+content",
+		Other:     `{"request_path":"-path","cache_tokens":-1}`,
+		CreatedAt: common.GetTimestamp(),
+	}).Error)
+
+	var buf bytes.Buffer
+	rows, err := WriteLogExport(&buf, &model.LogExportQuery{UserId: 1}, model.LogExportFormatCSV, nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), rows)
+
+	records, err := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(buf.Bytes(), []byte("\xEF\xBB\xBF")))).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	row := make(map[string]string, len(records[0]))
+	for i, column := range records[0] {
+		row[column] = records[1][i]
+	}
+	require.Equal(t, "'=cmd|' /C calc'!A0", row["username"])
+	require.Equal(t, "'@token", row["token_name"])
+	require.Equal(t, "'+content", row["content"])
+	require.Equal(t, "'-path", row["request_path"])
+	require.Equal(t, "-5", row["quota"])
+	require.Equal(t, "-1", row["cache_tokens"])
+}
+
+func TestRunLogExportCleanupOnce_OnlyOwnNode(t *testing.T) {
+	setupTestDB(t)
+	require.NoError(t, model.DB.AutoMigrate(&model.LogExportJob{}))
+
+	dir := t.TempDir()
+	createJob := func(node string) (*model.LogExportJob, string) {
+		path := filepath.Join(dir, node+".csv")
+		require.NoError(t, os.WriteFile(path, []byte("id\n"), 0o640))
+		job := &model.LogExportJob{UserId: 1, Format: model.LogExportFormatCSV, Status: model.LogExportJobSucceeded, Node: node, FilePath: path}
+		require.NoError(t, job.Insert())
+		require.NoError(t, model.DB.Model(job).Update("created_at", common.GetTimestamp()-48*3600).Error)
+		return job, path
+	}
+	own, ownPath := createJob(localNodeName)
+	other, otherPath := createJob(localNodeName + "-other")
+
+	runLogExportCleanupOnce()
+
+	_, err := os.Stat(ownPath)
+	require.True(t, os.IsNotExist(err))
+	_, err = model.GetLogExportJob(own.Id, 0)
+	require.Error(t, err)
+
+	_, err = os.Stat(otherPath)
+	require.NoError(t, err)
+	_, err = model.GetLogExportJob(other.Id, 0)
+	require.NoError(t, err)
+}
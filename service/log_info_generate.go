@@ -45,6 +45,17 @@ func GenerateTextOtherInfo(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, m
 	if relayInfo.ReasoningEffort != "" {
 		other["reasoning_effort"] = relayInfo.ReasoningEffort
 	}
+	if relayInfo.PriceData.ContextTier != 0 {
+		other["context_tier"] = relayInfo.PriceData.ContextTier
+		other["context_tier_max_tokens"] = relayInfo.PriceData.ContextTierMaxTokens
+	}
+	if relayInfo.PriceData.PriceOverrideId != 0 {
+		other["price_override_id"] = relayInfo.PriceData.PriceOverrideId
+	}
+	if relayInfo.PriceData.PricingWindow != "" {
+		other["pricing_window"] = relayInfo.PriceData.PricingWindow
+		other["pricing_window_ratio"] = relayInfo.PriceData.PricingWindowRatio
+	}
 	if relayInfo.IsModelMapped {
 		other["is_model_mapped"] = true
 		other["upstream_model_name"] = relayInfo.UpstreamModelName
@@ -156,6 +167,10 @@ func GenerateMjOtherInfo(relayInfo *relaycommon.RelayInfo, priceData types.PerCa
 	if priceData.GroupRatioInfo.HasSpecialRatio {
 		other["user_group_ratio"] = priceData.GroupRatioInfo.GroupSpecialRatio
 	}
+	if priceData.PricingWindow != "" {
+		other["pricing_window"] = priceData.PricingWindow
+		other["pricing_window_ratio"] = priceData.PricingWindowRatio
+	}
 	appendRequestPath(nil, relayInfo, other)
 	return other
 }
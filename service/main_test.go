@@ -0,0 +1,69 @@
+package service
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/model"
+
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// setupTestDB 使用临时 SQLite 数据库替换 model.DB 与 model.LOG_DB，并关闭 Redis 与批量更新
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.db") + "?_pragma=busy_timeout(5000)"
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	require.NoError(t, err)
+
+	oldDB, oldLogDB := model.DB, model.LOG_DB
+	oldRedis, oldBatch := common.RedisEnabled, common.BatchUpdateEnabled
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			_ = sqlDB.Close()
+		}
+		model.DB, model.LOG_DB = oldDB, oldLogDB
+		common.RedisEnabled, common.BatchUpdateEnabled = oldRedis, oldBatch
+	})
+
+	model.DB, model.LOG_DB = db, db
+	common.RedisEnabled = false
+	common.BatchUpdateEnabled = false
+	require.NoError(t, db.AutoMigrate(
+		&model.User{},
+		&model.Log{},
+		&model.Organization{},
+		&model.OrganizationMember{},
+		&model.SubscriptionPlan{},
+		&model.UserSubscription{},
+		&model.QuotaLot{},
+		&model.QuotaLedger{},
+		&model.Token{},
+		&model.TopUp{},
+		&model.Statement{},
+	))
+}
+
+func createTestUser(t *testing.T, quota int) *model.User {
+	t.Helper()
+	user := &model.User{
+		Username: "user" + common.GetRandomString(8),
+		Password: "password123",
+		Quota:    quota,
+		Status:   common.UserStatusEnabled,
+		AffCode:  common.GetRandomString(8),
+	}
+	require.NoError(t, model.DB.Create(user).Error)
+	return user
+}
+
+func getTestUserQuota(t *testing.T, userId int) int {
+	t.Helper()
+	quota, err := model.GetUserQuota(userId, true)
+	require.NoError(t, err)
+	return quota
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/pkg/metrics"
+	"github.com/QuantumNous/new-api/setting/ratio_setting"
+
+	"github.com/bytedance/gopkg/util/gopool"
+)
+
+var metricsLabelSyncOnce sync.Once
+
+// StartMetricsLabelSync 在每个节点上定期将已配置的渠道、模型与分组同步为监控指标允许的标签取值
+func StartMetricsLabelSync() {
+	metricsLabelSyncOnce.Do(func() {
+		gopool.Go(func() {
+			interval := time.Duration(max(common.SyncFrequency, 10)) * time.Second
+			logger.LogInfo(context.Background(), fmt.Sprintf("metrics label sync task started: tick=%s", interval))
+
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			syncMetricsLabelsOnce()
+			for range ticker.C {
+				syncMetricsLabelsOnce()
+			}
+		})
+	})
+}
+
+func syncMetricsLabelsOnce() {
+	channelIds, models, groups, err := model.GetMetricsLabelValues()
+	if err != nil {
+		common.SysError("failed to load metrics label values: " + err.Error())
+		return
+	}
+	// 分组倍率中配置但尚无渠道的分组同样允许记录
+	for group := range ratio_setting.GetGroupRatioCopy() {
+		groups = append(groups, group)
+	}
+	metrics.SetKnownLabelValues(channelIds, models, groups)
+}
@@ -0,0 +1,14 @@
+package service
+
+import "os"
+
+// localNodeName 当前节点名，记录在导出任务、内容留存等写入本地磁盘的记录上，各节点只清理自己写入的文件
+var localNodeName = newLocalNodeName()
+
+func newLocalNodeName() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "node"
+	}
+	return hostname
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"github.com/QuantumNous/new-api/model"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+)
+
+// GetPayerQuota 返回本次请求扣费方的可用额度：组织令牌为组织额度池，否则为用户额度。
+// 后付费账户的可用额度包含信用额度，余额可透支至 -CreditLimit，信用额度记录在 relayInfo.CreditLimit。
+func GetPayerQuota(relayInfo *relaycommon.RelayInfo) (int, error) {
+	var quota, creditLimit int
+	var err error
+	if relayInfo.OrgId != 0 {
+		if quota, err = model.GetOrgQuota(relayInfo.OrgId); err != nil {
+			return 0, err
+		}
+		creditLimit, err = model.GetOrgCreditLimit(relayInfo.OrgId)
+	} else {
+		if quota, err = model.GetUserQuota(relayInfo.UserId, false); err != nil {
+			return 0, err
+		}
+		creditLimit, err = model.GetUserCreditLimit(relayInfo.UserId)
+	}
+	if err != nil {
+		return 0, err
+	}
+	relayInfo.CreditLimit = creditLimit
+	return quota + creditLimit, nil
+}
+
+// deltaUpdatePayerQuota 按扣费方更新额度，delta 为正表示扣除、为负表示返还。
+// 使用订阅额度时，订阅额度不足且套餐允许超额的部分从用户余额扣除；
+// 返还时按扣除的来源原路退回，先退回超额扣除的用户余额，再退回订阅额度。
+func deltaUpdatePayerQuota(relayInfo *relaycommon.RelayInfo, delta int) error {
+	if delta == 0 {
+		return nil
+	}
+	if relayInfo.OrgId != 0 {
+		return model.DeltaUpdateOrgQuota(relayInfo.OrgId, relayInfo.UserId, delta, relayInfo.RequestId)
+	}
+	if relayInfo.SubscriptionId == 0 {
+		return updateUserQuotaWithLedger(relayInfo, delta)
+	}
+	if delta > 0 {
+		consumed, err := model.ConsumeSubscriptionQuota(relayInfo.SubscriptionId, relayInfo.UserId, relayInfo.SubscriptionPeriodStart, delta, relayInfo.SubscriptionOverage, relayInfo.RequestId)
+		if err != nil {
+			return err
+		}
+		relayInfo.SubscriptionConsumed += consumed
+		if overflow := delta - consumed; overflow > 0 {
+			if err := updateUserQuotaWithLedger(relayInfo, overflow); err != nil {
+				return err
+			}
+			relayInfo.BalanceConsumed += overflow
+		}
+		return nil
+	}
+
+	refund := -delta
+	toBalance := min(refund, relayInfo.BalanceConsumed)
+	toSubscription := min(refund-toBalance, relayInfo.SubscriptionConsumed)
+	// 超出本次请求已扣除额度的部分（正常不会出现）按无订阅时的方式退回余额
+	toBalance += refund - toBalance - toSubscription
+	if toSubscription > 0 {
+		// 订阅已过期或进入新周期时，上一周期的额度作废，不再返还
+		if _, err := model.RefundSubscriptionQuota(relayInfo.SubscriptionId, relayInfo.UserId, relayInfo.SubscriptionPeriodStart, toSubscription, relayInfo.RequestId); err != nil {
+			return err
+		}
+		relayInfo.SubscriptionConsumed -= toSubscription
+	}
+	if toBalance > 0 {
+		if err := updateUserQuotaWithLedger(relayInfo, -toBalance); err != nil {
+			return err
+		}
+		relayInfo.BalanceConsumed = max(relayInfo.BalanceConsumed-toBalance, 0)
+	}
+	return nil
+}
+
+func updateUserQuotaWithLedger(relayInfo *relaycommon.RelayInfo, delta int) error {
+	if delta > 0 {
+		return model.UpdateUserQuotaWithLedger(relayInfo.UserId, -delta, model.LedgerSourceConsume, relayInfo.RequestId, true)
+	}
+	return model.UpdateUserQuotaWithLedger(relayInfo.UserId, -delta, model.LedgerSourceRefund, relayInfo.RequestId, true)
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/QuantumNous/new-api/model"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+func setupSubscriptionRelay(t *testing.T, userQuota int, includedQuota int) (*relaycommon.RelayInfo, *model.UserSubscription) {
+	t.Helper()
+	setupTestDB(t)
+	user := createTestUser(t, userQuota)
+	plan := &model.SubscriptionPlan{Name: "plan", PeriodDays: 30, IncludedQuota: includedQuota, Overage: model.SubscriptionOverageBalance, Enabled: true}
+	require.NoError(t, plan.Insert())
+	sub, err := model.GrantSubscription(user.Id, plan.Id)
+	require.NoError(t, err)
+	return &relaycommon.RelayInfo{
+		UserId:                  user.Id,
+		SubscriptionId:          sub.Id,
+		SubscriptionOverage:     true,
+		SubscriptionPeriodStart: sub.PeriodStart,
+	}, sub
+}
+
+func getSubscriptionRemain(t *testing.T, subId int) int {
+	t.Helper()
+	sub, err := model.GetUserSubscriptionById(subId)
+	require.NoError(t, err)
+	return sub.RemainQuota
+}
+
+func TestDeltaUpdatePayerQuota_RefundsSpilledBalanceFirst(t *testing.T) {
+	relayInfo, sub := setupSubscriptionRelay(t, 1000, 100)
+
+	require.NoError(t, deltaUpdatePayerQuota(relayInfo, 150))
+	require.Equal(t, 0, getSubscriptionRemain(t, sub.Id))
+	require.Equal(t, 950, getTestUserQuota(t, relayInfo.UserId))
+	require.Equal(t, 100, relayInfo.SubscriptionConsumed)
+	require.Equal(t, 50, relayInfo.BalanceConsumed)
+
+	// 实际消耗 90：先退回超额扣除的余额 50，再退回订阅 10
+	require.NoError(t, deltaUpdatePayerQuota(relayInfo, -60))
+	require.Equal(t, 1000, getTestUserQuota(t, relayInfo.UserId))
+	require.Equal(t, 10, getSubscriptionRemain(t, sub.Id))
+	require.Equal(t, 90, relayInfo.SubscriptionConsumed)
+	require.Equal(t, 0, relayInfo.BalanceConsumed)
+}
+
+func TestDeltaUpdatePayerQuota_RefundSkipsRenewedSubscription(t *testing.T) {
+	relayInfo, sub := setupSubscriptionRelay(t, 1000, 100)
+
+	require.NoError(t, deltaUpdatePayerQuota(relayInfo, 40))
+	require.Equal(t, 60, getSubscriptionRemain(t, sub.Id))
+
+	// 请求期间订阅进入新周期，上一周期预扣的额度不再返还到新周期
+	require.NoError(t, model.DB.Model(&model.UserSubscription{}).Where("id = ?", sub.Id).
+		Updates(map[string]interface{}{"period_start": sub.PeriodStart + 1, "remain_quota": 100}).Error)
+
+	require.NoError(t, deltaUpdatePayerQuota(relayInfo, -40))
+	require.Equal(t, 100, getSubscriptionRemain(t, sub.Id))
+	require.Equal(t, 1000, getTestUserQuota(t, relayInfo.UserId))
+}
+
+func TestDeltaUpdatePayerQuota_WithoutSubscription(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, 100)
+	relayInfo := &relaycommon.RelayInfo{UserId: user.Id}
+
+	require.NoError(t, deltaUpdatePayerQuota(relayInfo, 30))
+	require.Equal(t, 70, getTestUserQuota(t, user.Id))
+	require.NoError(t, deltaUpdatePayerQuota(relayInfo, -30))
+	require.Equal(t, 100, getTestUserQuota(t, user.Id))
+}
@@ -1,12 +1,14 @@
 package service
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 
 	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/logger"
 	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/pkg/metrics"
 	relaycommon "github.com/QuantumNous/new-api/relay/common"
 	"github.com/QuantumNous/new-api/types"
 
@@ -16,6 +18,7 @@ import (
 
 func ReturnPreConsumedQuota(c *gin.Context, relayInfo *relaycommon.RelayInfo) {
 	if relayInfo.FinalPreConsumedQuota != 0 {
+		metrics.AddPreConsumeRefund(relayInfo.UsingGroup, relayInfo.FinalPreConsumedQuota)
 		logger.LogInfo(c, fmt.Sprintf("用户 %d 请求失败, 返还预扣费额度 %s", relayInfo.UserId, logger.FormatQuota(relayInfo.FinalPreConsumedQuota)))
 		gopool.Go(func() {
 			relayInfoCopy := *relayInfo
@@ -31,10 +34,53 @@ func ReturnPreConsumedQuota(c *gin.Context, relayInfo *relaycommon.RelayInfo) {
 // PreConsumeQuota checks if the user has enough quota to pre-consume.
 // It returns the pre-consumed quota if successful, or an error if not.
 func PreConsumeQuota(c *gin.Context, preConsumedQuota int, relayInfo *relaycommon.RelayInfo) *types.NewAPIError {
-	userQuota, err := model.GetUserQuota(relayInfo.UserId, false)
+	userQuota, err := GetPayerQuota(relayInfo)
 	if err != nil {
 		return types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry())
 	}
+	// 组织令牌：校验成员个人消费上限，设置了上限的成员不走信任额度；上限读缓存，已用额度只在设置了上限时读库
+	spendLimit := 0
+	if relayInfo.OrgId != 0 {
+		memberCache, err := model.GetOrgMemberCache(relayInfo.OrgId, relayInfo.UserId)
+		if err != nil {
+			return types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry())
+		}
+		if memberCache.Role == "" {
+			return types.NewErrorWithStatusCode(errors.New("用户不是该组织的成员"), types.ErrorCodeAccessDenied, http.StatusForbidden, types.ErrOptionWithSkipRetry(), types.ErrOptionWithNoRecordErrorLog())
+		}
+		spendLimit = memberCache.SpendLimit
+	}
+	if spendLimit > 0 {
+		usedQuota, err := model.GetOrgMemberUsedQuota(relayInfo.OrgId, relayInfo.UserId)
+		if err != nil {
+			return types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry())
+		}
+		orgMember := &model.OrganizationMember{SpendLimit: spendLimit, UsedQuota: usedQuota}
+		if orgMember.IsOverSpendLimit(preConsumedQuota) {
+			return types.NewErrorWithStatusCode(fmt.Errorf("已达到组织成员消费上限, 上限: %s, 已使用: %s", logger.FormatQuota(orgMember.SpendLimit), logger.FormatQuota(orgMember.UsedQuota)), types.ErrorCodeInsufficientUserQuota, http.StatusForbidden, types.ErrOptionWithSkipRetry(), types.ErrOptionWithNoRecordErrorLog())
+		}
+	}
+	// 个人令牌：存在生效订阅时优先使用订阅额度，套餐允许超额时可用额度包含用户余额
+	if relayInfo.OrgId == 0 {
+		sub, err := model.GetActiveSubscriptionCache(relayInfo.UserId)
+		if err != nil {
+			return types.NewError(err, types.ErrorCodeQueryDataError, types.ErrOptionWithSkipRetry())
+		}
+		if sub != nil && !sub.AllowOverage() {
+			if sub.RemainQuota <= 0 {
+				return types.NewErrorWithStatusCode(fmt.Errorf("套餐 %s 本周期额度已用尽", sub.PlanName), types.ErrorCodeInsufficientUserQuota, http.StatusForbidden, types.ErrOptionWithSkipRetry(), types.ErrOptionWithNoRecordErrorLog())
+			}
+			relayInfo.SubscriptionId = sub.Id
+			relayInfo.SubscriptionPeriodStart = sub.PeriodStart
+			relayInfo.CreditLimit = 0
+			userQuota = sub.RemainQuota
+		} else if sub != nil && sub.RemainQuota > 0 {
+			relayInfo.SubscriptionId = sub.Id
+			relayInfo.SubscriptionPeriodStart = sub.PeriodStart
+			relayInfo.SubscriptionOverage = true
+			userQuota += sub.RemainQuota
+		}
+	}
 	if userQuota <= 0 {
 		return types.NewErrorWithStatusCode(fmt.Errorf("用户额度不足, 剩余额度: %s", logger.FormatQuota(userQuota)), types.ErrorCodeInsufficientUserQuota, http.StatusForbidden, types.ErrOptionWithSkipRetry(), types.ErrOptionWithNoRecordErrorLog())
 	}
@@ -45,7 +91,7 @@ func PreConsumeQuota(c *gin.Context, preConsumedQuota int, relayInfo *relaycommo
 	trustQuota := common.GetTrustQuota()
 
 	relayInfo.UserQuota = userQuota
-	if userQuota > trustQuota {
+	if userQuota > trustQuota && spendLimit == 0 {
 		// 用户额度充足，判断令牌额度是否充足
 		if !relayInfo.TokenUnlimited {
 			// 非无限令牌，判断令牌额度是否充足
@@ -68,7 +114,7 @@ func PreConsumeQuota(c *gin.Context, preConsumedQuota int, relayInfo *relaycommo
 		if err != nil {
 			return types.NewErrorWithStatusCode(err, types.ErrorCodePreConsumeTokenQuotaFailed, http.StatusForbidden, types.ErrOptionWithSkipRetry(), types.ErrOptionWithNoRecordErrorLog())
 		}
-		err = model.DecreaseUserQuota(relayInfo.UserId, preConsumedQuota)
+		err = deltaUpdatePayerQuota(relayInfo, preConsumedQuota)
 		if err != nil {
 			return types.NewError(err, types.ErrorCodeUpdateDataError, types.ErrOptionWithSkipRetry())
 		}
@@ -14,6 +14,7 @@ import (
 	"github.com/QuantumNous/new-api/logger"
 	"github.com/QuantumNous/new-api/model"
 	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
 	"github.com/QuantumNous/new-api/setting/ratio_setting"
 	"github.com/QuantumNous/new-api/setting/system_setting"
 	"github.com/QuantumNous/new-api/types"
@@ -30,13 +31,14 @@ type TokenDetails struct {
 }
 
 type QuotaInfo struct {
-	InputDetails  TokenDetails
-	OutputDetails TokenDetails
-	ModelName     string
-	UsePrice      bool
-	ModelPrice    float64
-	ModelRatio    float64
-	GroupRatio    float64
+	InputDetails    TokenDetails
+	OutputDetails   TokenDetails
+	ModelName       string
+	UsePrice        bool
+	ModelPrice      float64
+	ModelRatio      float64
+	CompletionRatio float64
+	GroupRatio      float64
 }
 
 func hasCustomModelRatio(modelName string, currentRatio float64) bool {
@@ -57,7 +59,7 @@ func calculateAudioQuota(info QuotaInfo) int {
 		return int(quota.IntPart())
 	}
 
-	completionRatio := decimal.NewFromFloat(ratio_setting.GetCompletionRatio(info.ModelName))
+	completionRatio := decimal.NewFromFloat(info.CompletionRatio)
 	audioRatio := decimal.NewFromFloat(ratio_setting.GetAudioRatio(info.ModelName))
 	audioCompletionRatio := decimal.NewFromFloat(ratio_setting.GetAudioCompletionRatio(info.ModelName))
 
@@ -90,7 +92,7 @@ func PreWssConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, usag
 	if relayInfo.UsePrice {
 		return nil
 	}
-	userQuota, err := model.GetUserQuota(relayInfo.UserId, false)
+	userQuota, err := GetPayerQuota(relayInfo)
 	if err != nil {
 		return err
 	}
@@ -107,6 +109,13 @@ func PreWssConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, usag
 	audioOutTokens := usage.OutputTokenDetails.AudioTokens
 	groupRatio := ratio_setting.GetGroupRatio(relayInfo.UsingGroup)
 	modelRatio, _, _ := ratio_setting.GetModelRatio(modelName)
+	completionRatio := ratio_setting.GetCompletionRatio(modelName)
+	// 按本次响应的输入 token 数选择上下文分档，只用于预估，不修改会话的价格数据
+	priceData := relayInfo.PriceData
+	if ratio_setting.ApplyContextTier(modelName, usage.InputTokens, &priceData) {
+		modelRatio = priceData.ModelRatio
+		completionRatio = priceData.CompletionRatio
+	}
 
 	autoGroup, exists := common.GetContextKey(ctx, constant.ContextKeyAutoGroup)
 	if exists {
@@ -130,13 +139,14 @@ func PreWssConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, usag
 			TextTokens:  textOutTokens,
 			AudioTokens: audioOutTokens,
 		},
-		ModelName:  modelName,
-		UsePrice:   relayInfo.UsePrice,
-		ModelRatio: modelRatio,
-		GroupRatio: actualGroupRatio,
+		ModelName:       modelName,
+		UsePrice:        relayInfo.UsePrice,
+		ModelRatio:      modelRatio,
+		CompletionRatio: completionRatio,
+		GroupRatio:      actualGroupRatio,
 	}
 
-	quota := calculateAudioQuota(quotaInfo)
+	quota := int(float64(calculateAudioQuota(quotaInfo)) * relayInfo.PriceData.PricingWindowMultiplier())
 
 	if userQuota < quota {
 		return fmt.Errorf("user quota is not enough, user quota: %s, need quota: %s", logger.FormatQuota(userQuota), logger.FormatQuota(quota))
@@ -169,6 +179,11 @@ func PostWssConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, mod
 	audioRatio := decimal.NewFromFloat(ratio_setting.GetAudioRatio(relayInfo.OriginModelName))
 	audioCompletionRatio := decimal.NewFromFloat(ratio_setting.GetAudioCompletionRatio(modelName))
 
+	// 按本次响应的实际输入 token 数重新选择上下文分档
+	if ratio_setting.ApplyContextTier(relayInfo.OriginModelName, usage.InputTokens, &relayInfo.PriceData) {
+		completionRatio = decimal.NewFromFloat(relayInfo.PriceData.CompletionRatio)
+	}
+
 	modelRatio := relayInfo.PriceData.ModelRatio
 	groupRatio := relayInfo.PriceData.GroupRatioInfo.GroupRatio
 	modelPrice := relayInfo.PriceData.ModelPrice
@@ -183,13 +198,14 @@ func PostWssConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, mod
 			TextTokens:  textOutTokens,
 			AudioTokens: audioOutTokens,
 		},
-		ModelName:  modelName,
-		UsePrice:   usePrice,
-		ModelRatio: modelRatio,
-		GroupRatio: groupRatio,
+		ModelName:       modelName,
+		UsePrice:        usePrice,
+		ModelRatio:      modelRatio,
+		CompletionRatio: completionRatio.InexactFloat64(),
+		GroupRatio:      groupRatio,
 	}
 
-	quota := calculateAudioQuota(quotaInfo)
+	quota := int(float64(calculateAudioQuota(quotaInfo)) * relayInfo.PriceData.PricingWindowMultiplier())
 
 	totalTokens := usage.TotalTokens
 	var logContent string
@@ -219,6 +235,15 @@ func PostWssConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, mod
 	}
 	other := GenerateWssOtherInfo(ctx, relayInfo, usage, modelRatio, groupRatio,
 		completionRatio.InexactFloat64(), audioRatio.InexactFloat64(), audioCompletionRatio.InexactFloat64(), modelPrice, relayInfo.PriceData.GroupRatioInfo.GroupSpecialRatio)
+	upstreamCost := 0
+	if totalTokens != 0 {
+		upstreamCost = CalculateUpstreamCost(relayInfo, UpstreamUsage{
+			InputTokens:       textInputTokens,
+			OutputTokens:      textOutTokens,
+			AudioInputTokens:  audioInputTokens,
+			AudioOutputTokens: audioOutTokens,
+		})
+	}
 	model.RecordConsumeLog(ctx, relayInfo.UserId, model.RecordConsumeLogParams{
 		ChannelId:        relayInfo.ChannelId,
 		PromptTokens:     usage.InputTokens,
@@ -226,6 +251,7 @@ func PostWssConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, mod
 		ModelName:        logModel,
 		TokenName:        tokenName,
 		Quota:            quota,
+		UpstreamCost:     upstreamCost,
 		Content:          logContent,
 		TokenId:          relayInfo.TokenId,
 		UseTimeSeconds:   int(useTimeSeconds),
@@ -242,6 +268,13 @@ func PostClaudeConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo,
 	completionTokens := usage.CompletionTokens
 	modelName := relayInfo.OriginModelName
 
+	// 按实际提示 token 数重新选择上下文分档，OpenRouter 的 prompt_tokens 已包含缓存 tokens
+	contextTokens := promptTokens
+	if relayInfo.ChannelType != constant.ChannelTypeOpenRouter {
+		contextTokens += usage.PromptTokensDetails.CachedTokens + usage.PromptTokensDetails.CachedCreationTokens
+	}
+	ratio_setting.ApplyContextTier(modelName, contextTokens, &relayInfo.PriceData)
+
 	tokenName := ctx.GetString("token_name")
 	completionRatio := relayInfo.PriceData.CompletionRatio
 	modelRatio := relayInfo.PriceData.ModelRatio
@@ -284,6 +317,7 @@ func PostClaudeConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo,
 	} else {
 		calculateQuota = modelPrice * common.QuotaPerUnit * groupRatio
 	}
+	calculateQuota *= relayInfo.PriceData.PricingWindowMultiplier()
 
 	if modelRatio != 0 && calculateQuota <= 0 {
 		calculateQuota = 1
@@ -336,6 +370,15 @@ func PostClaudeConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo,
 		cacheCreationTokens5m, cacheCreationRatio5m,
 		cacheCreationTokens1h, cacheCreationRatio1h,
 		modelPrice, relayInfo.PriceData.GroupRatioInfo.GroupSpecialRatio)
+	upstreamCost := 0
+	if totalTokens != 0 {
+		upstreamCost = CalculateUpstreamCost(relayInfo, UpstreamUsage{
+			InputTokens:      promptTokens,
+			OutputTokens:     completionTokens,
+			CacheReadTokens:  cacheTokens,
+			CacheWriteTokens: cacheCreationTokens,
+		})
+	}
 	model.RecordConsumeLog(ctx, relayInfo.UserId, model.RecordConsumeLogParams{
 		ChannelId:        relayInfo.ChannelId,
 		PromptTokens:     promptTokens,
@@ -343,6 +386,7 @@ func PostClaudeConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo,
 		ModelName:        modelName,
 		TokenName:        tokenName,
 		Quota:            quota,
+		UpstreamCost:     upstreamCost,
 		Content:          logContent,
 		TokenId:          relayInfo.TokenId,
 		UseTimeSeconds:   int(useTimeSeconds),
@@ -388,6 +432,11 @@ func PostAudioConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, u
 	audioRatio := decimal.NewFromFloat(ratio_setting.GetAudioRatio(relayInfo.OriginModelName))
 	audioCompletionRatio := decimal.NewFromFloat(ratio_setting.GetAudioCompletionRatio(relayInfo.OriginModelName))
 
+	// 按实际提示 token 数重新选择上下文分档
+	if ratio_setting.ApplyContextTier(relayInfo.OriginModelName, usage.PromptTokens, &relayInfo.PriceData) {
+		completionRatio = decimal.NewFromFloat(relayInfo.PriceData.CompletionRatio)
+	}
+
 	modelRatio := relayInfo.PriceData.ModelRatio
 	groupRatio := relayInfo.PriceData.GroupRatioInfo.GroupRatio
 	modelPrice := relayInfo.PriceData.ModelPrice
@@ -402,13 +451,14 @@ func PostAudioConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, u
 			TextTokens:  textOutTokens,
 			AudioTokens: audioOutTokens,
 		},
-		ModelName:  relayInfo.OriginModelName,
-		UsePrice:   usePrice,
-		ModelRatio: modelRatio,
-		GroupRatio: groupRatio,
+		ModelName:       relayInfo.OriginModelName,
+		UsePrice:        usePrice,
+		ModelRatio:      modelRatio,
+		CompletionRatio: completionRatio.InexactFloat64(),
+		GroupRatio:      groupRatio,
 	}
 
-	quota := calculateAudioQuota(quotaInfo)
+	quota := int(float64(calculateAudioQuota(quotaInfo)) * relayInfo.PriceData.PricingWindowMultiplier())
 
 	totalTokens := usage.TotalTokens
 	var logContent string
@@ -461,6 +511,15 @@ func PostAudioConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, u
 	}
 	other := GenerateAudioOtherInfo(ctx, relayInfo, usage, modelRatio, groupRatio,
 		completionRatio.InexactFloat64(), audioRatio.InexactFloat64(), audioCompletionRatio.InexactFloat64(), modelPrice, relayInfo.PriceData.GroupRatioInfo.GroupSpecialRatio)
+	upstreamCost := 0
+	if totalTokens != 0 {
+		upstreamCost = CalculateUpstreamCost(relayInfo, UpstreamUsage{
+			InputTokens:       textInputTokens,
+			OutputTokens:      textOutTokens,
+			AudioInputTokens:  audioInputTokens,
+			AudioOutputTokens: audioOutTokens,
+		})
+	}
 	model.RecordConsumeLog(ctx, relayInfo.UserId, model.RecordConsumeLogParams{
 		ChannelId:        relayInfo.ChannelId,
 		PromptTokens:     usage.PromptTokens,
@@ -468,6 +527,7 @@ func PostAudioConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, u
 		ModelName:        logModel,
 		TokenName:        tokenName,
 		Quota:            quota,
+		UpstreamCost:     upstreamCost,
 		Content:          logContent,
 		TokenId:          relayInfo.TokenId,
 		UseTimeSeconds:   int(useTimeSeconds),
@@ -491,6 +551,9 @@ func PreConsumeTokenQuota(relayInfo *relaycommon.RelayInfo, quota int) error {
 	if err != nil {
 		return err
 	}
+	if !relayInfo.TokenUnlimited && token.RemainQuota < quota {
+		token.RemainQuota += TryAutoRefillToken(token)
+	}
 	if !relayInfo.TokenUnlimited && token.RemainQuota < quota {
 		return fmt.Errorf("token quota is not enough, token remain quota: %s, need quota: %s", logger.FormatQuota(token.RemainQuota), logger.FormatQuota(quota))
 	}
@@ -503,11 +566,7 @@ func PreConsumeTokenQuota(relayInfo *relaycommon.RelayInfo, quota int) error {
 
 func PostConsumeQuota(relayInfo *relaycommon.RelayInfo, quota int, preConsumedQuota int, sendEmail bool) (err error) {
 
-	if quota > 0 {
-		err = model.DecreaseUserQuota(relayInfo.UserId, quota)
-	} else {
-		err = model.IncreaseUserQuota(relayInfo.UserId, -quota, false)
-	}
+	err = deltaUpdatePayerQuota(relayInfo, quota)
 	if err != nil {
 		return err
 	}
@@ -521,11 +580,19 @@ func PostConsumeQuota(relayInfo *relaycommon.RelayInfo, quota int, preConsumedQu
 		if err != nil {
 			return err
 		}
+		// 本次请求使令牌剩余额度跌破阈值时自动充值
+		if shouldAutoRefillAfterConsume(relayInfo, preConsumedQuota+quota) {
+			autoRefillToken(relayInfo.TokenId)
+		}
 	}
 
 	if sendEmail {
 		if (quota + preConsumedQuota) != 0 {
-			checkAndSendQuotaNotify(relayInfo, quota, preConsumedQuota)
+			if model.IsPostpaid(relayInfo.CreditLimit) {
+				checkAndSendCreditNotify(relayInfo, quota, preConsumedQuota)
+			} else {
+				checkAndSendQuotaNotify(relayInfo, quota, preConsumedQuota)
+			}
 		}
 	}
 
@@ -579,3 +646,49 @@ func checkAndSendQuotaNotify(relayInfo *relaycommon.RelayInfo, quota int, preCon
 		}
 	})
 }
+
+// creditUsagePercent 返回可用额度为 available 时信用额度的已用百分比
+func creditUsagePercent(available int, creditLimit int) float64 {
+	used := creditLimit - available
+	if used <= 0 {
+		return 0
+	}
+	return float64(used) * 100 / float64(creditLimit)
+}
+
+// checkAndSendCreditNotify 后付费账户本次消费使信用额度使用比例越过配置的阈值时通知用户，
+// 同一次消费越过多个阈值时只按最高的阈值通知一次
+func checkAndSendCreditNotify(relayInfo *relaycommon.RelayInfo, quota int, preConsumedQuota int) {
+	gopool.Go(func() {
+		creditLimit := relayInfo.CreditLimit
+		before := creditUsagePercent(relayInfo.UserQuota, creditLimit)
+		after := creditUsagePercent(relayInfo.UserQuota-(quota+preConsumedQuota), creditLimit)
+		crossed := 0
+		for _, threshold := range operation_setting.GetCreditSetting().WarningThresholds {
+			if threshold > 0 && before < float64(threshold) && after >= float64(threshold) && threshold > crossed {
+				crossed = threshold
+			}
+		}
+		if crossed == 0 {
+			return
+		}
+
+		userSetting := relayInfo.UserSetting
+		prompt := fmt.Sprintf("您的信用额度已使用 %d%%", crossed)
+		if crossed >= 100 {
+			prompt = "您的信用额度已用尽"
+		}
+		used := max(creditLimit-(relayInfo.UserQuota-quota-preConsumedQuota), 0)
+		values := []interface{}{prompt, logger.FormatQuota(creditLimit), logger.FormatQuota(used)}
+		content := "{{value}}，信用额度为 {{value}}，已使用 {{value}}。超出信用额度后请求将被拒绝，请及时结算或联系管理员调整额度。"
+		if userSetting.NotifyType == dto.NotifyTypeBark || userSetting.NotifyType == dto.NotifyTypeGotify {
+			// Bark 与 Gotify 推送使用简短文本
+			content = "{{value}}，信用额度：{{value}}，已使用：{{value}}"
+		}
+
+		err := NotifyUser(relayInfo.UserId, relayInfo.UserEmail, relayInfo.UserSetting, dto.NewNotify(dto.NotifyTypeQuotaExceed, prompt, content, values))
+		if err != nil {
+			common.SysError(fmt.Sprintf("failed to send credit notify to user %d: %s", relayInfo.UserId, err.Error()))
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+
+	"github.com/bytedance/gopkg/util/gopool"
+)
+
+const (
+	ledgerReconcileTickInterval = 1 * time.Hour
+	ledgerReconcileBatchSize    = 500
+)
+
+var (
+	ledgerReconcileOnce    sync.Once
+	ledgerReconcileRunning atomic.Bool
+
+	ledgerReconcileReportLock sync.RWMutex
+	ledgerReconcileReport     *LedgerReconcileReport
+)
+
+// LedgerReconcileReport 最近一次对账结果
+type LedgerReconcileReport struct {
+	StartedAt  int64                   `json:"started_at"`
+	FinishedAt int64                   `json:"finished_at"`
+	Checked    int                     `json:"checked"`
+	Mismatches []*model.LedgerMismatch `json:"mismatches"`
+	Error      string                  `json:"error,omitempty"`
+}
+
+// StartLedgerReconcileTask 定期核对用户和组织余额与账本合计
+func StartLedgerReconcileTask() {
+	ledgerReconcileOnce.Do(func() {
+		if !common.IsMasterNode {
+			return
+		}
+
+		gopool.Go(func() {
+			logger.LogInfo(context.Background(), fmt.Sprintf("quota ledger reconcile task started: tick=%s", ledgerReconcileTickInterval))
+
+			ticker := time.NewTicker(ledgerReconcileTickInterval)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				RunLedgerReconcile()
+			}
+		})
+	})
+}
+
+// GetLedgerReconcileReport 返回最近一次对账结果，尚未执行过时返回 nil
+func GetLedgerReconcileReport() *LedgerReconcileReport {
+	ledgerReconcileReportLock.RLock()
+	defer ledgerReconcileReportLock.RUnlock()
+	return ledgerReconcileReport
+}
+
+// RunLedgerReconcile 执行一次全量对账，已有对账在执行时返回 false
+func RunLedgerReconcile() bool {
+	if !ledgerReconcileRunning.CompareAndSwap(false, true) {
+		return false
+	}
+	defer ledgerReconcileRunning.Store(false)
+
+	ctx := context.Background()
+	report := &LedgerReconcileReport{
+		StartedAt:  common.GetTimestamp(),
+		Mismatches: make([]*model.LedgerMismatch, 0),
+	}
+	for _, accountType := range []string{model.LedgerAccountUser, model.LedgerAccountOrg, model.LedgerAccountSubscription} {
+		afterId := 0
+		for {
+			mismatches, lastId, checked, err := model.ReconcileLedgerAccounts(accountType, afterId, ledgerReconcileBatchSize)
+			if err != nil {
+				report.Error = err.Error()
+				logger.LogError(ctx, fmt.Sprintf("quota ledger reconcile: %s accounts after %d failed: %v", accountType, afterId, err))
+				break
+			}
+			if checked == 0 {
+				break
+			}
+			report.Checked += checked
+			report.Mismatches = append(report.Mismatches, mismatches...)
+			afterId = lastId
+		}
+	}
+	report.FinishedAt = common.GetTimestamp()
+
+	for _, m := range report.Mismatches {
+		logger.LogWarn(ctx, fmt.Sprintf("quota ledger reconcile: %s %d balance %d != ledger sum %d", m.AccountType, m.AccountId, m.Balance, m.LedgerSum))
+	}
+	ledgerReconcileReportLock.Lock()
+	ledgerReconcileReport = report
+	ledgerReconcileReportLock.Unlock()
+	return true
+}
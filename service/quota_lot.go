@@ -0,0 +1,89 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+
+	"github.com/bytedance/gopkg/util/gopool"
+)
+
+const (
+	quotaLotExpiryTickInterval = 10 * time.Minute
+	quotaLotExpiryBatchSize    = 200
+)
+
+var (
+	quotaLotExpiryOnce    sync.Once
+	quotaLotExpiryRunning atomic.Bool
+)
+
+// StartQuotaLotExpiryTask 定期扣除已过期额度批次的剩余额度
+func StartQuotaLotExpiryTask() {
+	quotaLotExpiryOnce.Do(func() {
+		if !common.IsMasterNode {
+			return
+		}
+
+		gopool.Go(func() {
+			logger.LogInfo(context.Background(), fmt.Sprintf("quota lot expiry task started: tick=%s", quotaLotExpiryTickInterval))
+
+			ticker := time.NewTicker(quotaLotExpiryTickInterval)
+			defer ticker.Stop()
+
+			runQuotaLotExpiryOnce()
+			for range ticker.C {
+				runQuotaLotExpiryOnce()
+			}
+		})
+	})
+}
+
+func runQuotaLotExpiryOnce() {
+	if !quotaLotExpiryRunning.CompareAndSwap(false, true) {
+		return
+	}
+	defer quotaLotExpiryRunning.Store(false)
+
+	ctx := context.Background()
+	now := common.GetTimestamp()
+
+	var users int
+	var expiredTotal int
+	failed := map[int]bool{}
+	for {
+		userIds, err := model.GetUsersWithExpiredQuotaLots(now, quotaLotExpiryBatchSize)
+		if err != nil {
+			logger.LogError(ctx, fmt.Sprintf("quota lot expiry: query users failed: %v", err))
+			return
+		}
+		progressed := false
+		for _, userId := range userIds {
+			if failed[userId] {
+				continue
+			}
+			expired, err := model.ExpireUserQuotaLots(userId, now)
+			if err != nil {
+				failed[userId] = true
+				logger.LogError(ctx, fmt.Sprintf("quota lot expiry: user %d failed: %v", userId, err))
+				continue
+			}
+			progressed = true
+			users++
+			expiredTotal += expired
+		}
+		if !progressed || len(userIds) < quotaLotExpiryBatchSize {
+			break
+		}
+	}
+
+	if users > 0 {
+		logger.LogInfo(ctx, fmt.Sprintf("quota lot expiry: processed %d users, expired quota %d", users, expiredTotal))
+	}
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/model"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/setting/ratio_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+// setupContextTierTest 为测试模型配置两档上下文分档：1000 token 以内模型倍率 1、补全倍率 2，超出后模型倍率 2、补全倍率 4
+func setupContextTierTest(t *testing.T, modelName string) (*gin.Context, *relaycommon.RelayInfo) {
+	t.Helper()
+	setupTestDB(t)
+	oldTiers := ratio_setting.ContextTiers2JSONString()
+	oldLogConsume := common.LogConsumeEnabled
+	t.Cleanup(func() {
+		require.NoError(t, ratio_setting.UpdateContextTiersByJSONString(oldTiers))
+		common.LogConsumeEnabled = oldLogConsume
+	})
+	common.LogConsumeEnabled = false
+	require.NoError(t, ratio_setting.UpdateContextTiersByJSONString(`{"`+modelName+`":[`+
+		`{"max_prompt_tokens":1000,"model_ratio":1,"completion_ratio":2},`+
+		`{"max_prompt_tokens":0,"model_ratio":2,"completion_ratio":4}]}`))
+
+	user := createTestUser(t, 0)
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	relayInfo := &relaycommon.RelayInfo{
+		UserId:          user.Id,
+		OriginModelName: modelName,
+		StartTime:       time.Now(),
+		ChannelMeta:     &relaycommon.ChannelMeta{UpstreamModelName: modelName},
+		PriceData: types.PriceData{
+			ModelRatio:      1,
+			CompletionRatio: 2,
+			GroupRatioInfo:  types.GroupRatioInfo{GroupRatio: 1},
+		},
+	}
+	require.True(t, ratio_setting.ApplyContextTier(modelName, 10, &relayInfo.PriceData))
+	return ctx, relayInfo
+}
+
+func getTestConsumeLogParams(t *testing.T, ctx *gin.Context) model.RecordConsumeLogParams {
+	t.Helper()
+	params, ok := common.GetContextKeyType[model.RecordConsumeLogParams](ctx, constant.ContextKeyConsumeLogParams)
+	require.True(t, ok)
+	return params
+}
+
+func TestPostAudioConsumeQuota_AppliesContextTier(t *testing.T) {
+	ctx, relayInfo := setupContextTierTest(t, "test-audio-tier")
+	// 第二档：(2000 + 100*4) * 2 = 4800，与预扣费相同时不再补扣
+	relayInfo.FinalPreConsumedQuota = 4800
+	usage := &dto.Usage{
+		PromptTokens:           2000,
+		CompletionTokens:       100,
+		TotalTokens:            2100,
+		PromptTokensDetails:    dto.InputTokenDetails{TextTokens: 2000},
+		CompletionTokenDetails: dto.OutputTokenDetails{TextTokens: 100},
+	}
+
+	PostAudioConsumeQuota(ctx, relayInfo, usage, "")
+	params := getTestConsumeLogParams(t, ctx)
+	require.Equal(t, 4800, params.Quota)
+	require.Equal(t, 2, params.Other["context_tier"])
+}
+
+func TestPostWssConsumeQuota_AppliesContextTier(t *testing.T) {
+	ctx, relayInfo := setupContextTierTest(t, "test-realtime-tier")
+	usage := &dto.RealtimeUsage{
+		TotalTokens:        2100,
+		InputTokens:        2000,
+		OutputTokens:       100,
+		InputTokenDetails:  dto.InputTokenDetails{TextTokens: 2000},
+		OutputTokenDetails: dto.OutputTokenDetails{TextTokens: 100},
+	}
+
+	PostWssConsumeQuota(ctx, relayInfo, relayInfo.UpstreamModelName, usage, "")
+	params := getTestConsumeLogParams(t, ctx)
+	require.Equal(t, 4800, params.Quota)
+	require.Equal(t, 2, params.Other["context_tier"])
+
+	// 同一会话中后续较短的响应回到第一档：(500 + 100*2) * 1 = 700
+	usage.InputTokens = 500
+	usage.InputTokenDetails.TextTokens = 500
+	usage.TotalTokens = 600
+	PostWssConsumeQuota(ctx, relayInfo, relayInfo.UpstreamModelName, usage, "")
+	require.Equal(t, 700, getTestConsumeLogParams(t, ctx).Quota)
+}
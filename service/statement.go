@@ -0,0 +1,300 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"html/template"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/setting/system_setting"
+
+	"github.com/bytedance/gopkg/util/gopool"
+)
+
+const statementTickInterval = 1 * time.Hour
+
+var (
+	statementTaskOnce    sync.Once
+	statementTaskRunning atomic.Bool
+	// 已完成自动生成的账单月份，同一月份只需扫描一次
+	statementLastPeriod string
+)
+
+// StartStatementTask 每月初为上月有消费的用户和组织自动生成账单，需在系统设置中开启
+func StartStatementTask() {
+	statementTaskOnce.Do(func() {
+		if !common.IsMasterNode {
+			return
+		}
+
+		gopool.Go(func() {
+			logger.LogInfo(context.Background(), fmt.Sprintf("statement task started: tick=%s", statementTickInterval))
+
+			ticker := time.NewTicker(statementTickInterval)
+			defer ticker.Stop()
+
+			runStatementTaskOnce()
+			for range ticker.C {
+				runStatementTaskOnce()
+			}
+		})
+	})
+}
+
+func runStatementTaskOnce() {
+	settings := system_setting.GetStatementSettings()
+	if !settings.AutoGenerate {
+		return
+	}
+	if !statementTaskRunning.CompareAndSwap(false, true) {
+		return
+	}
+	defer statementTaskRunning.Store(false)
+
+	ctx := context.Background()
+	now := time.Now()
+	period := time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.Local).Format(model.StatementPeriodLayout)
+	if period == statementLastPeriod {
+		return
+	}
+	start, end, err := model.StatementPeriodRange(period)
+	if err != nil {
+		return
+	}
+	userIds, orgIds, err := model.GetStatementCandidates(start, end)
+	if err != nil {
+		logger.LogWarn(ctx, fmt.Sprintf("statement task: failed to load candidates: %v", err))
+		return
+	}
+	generated := 0
+	generate := func(ownerType string, ownerId int) {
+		// 月末后生成过的账单不再重复生成和发送，月中生成的部分账单需要重新生成
+		if existing, err := model.GetStatementByPeriod(ownerType, ownerId, period); err == nil && existing.IsFinal() {
+			return
+		}
+		statement, err := model.GenerateStatement(ownerType, ownerId, period)
+		if err != nil {
+			logger.LogWarn(ctx, fmt.Sprintf("statement task: %s %d: %v", ownerType, ownerId, err))
+			return
+		}
+		generated++
+		if settings.AutoEmail {
+			if err := SendStatementEmail(statement); err != nil {
+				logger.LogWarn(ctx, fmt.Sprintf("statement task: failed to email statement %d: %v", statement.Id, err))
+			}
+		}
+	}
+	for _, userId := range userIds {
+		generate(model.LedgerAccountUser, userId)
+	}
+	for _, orgId := range orgIds {
+		generate(model.LedgerAccountOrg, orgId)
+	}
+	statementLastPeriod = period
+	if generated > 0 {
+		logger.LogInfo(ctx, fmt.Sprintf("statement task: generated %d statements for %s", generated, period))
+	}
+}
+
+// RenderStatementCSV 导出账单明细为 CSV，金额同时给出额度与按额度展示类型换算后的金额
+func RenderStatementCSV(statement *model.Statement) ([]byte, error) {
+	data, err := statement.GetData()
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	// 写入 BOM 便于 Excel 识别 UTF-8
+	buf.WriteString("\xEF\xBB\xBF")
+	w := csv.NewWriter(buf)
+	_ = w.Write([]string{"period", statement.Period, "owner", data.OwnerName})
+	if model.IsPostpaid(data.CreditLimit) || statement.AmountOwed > 0 {
+		_ = w.Write([]string{"credit_limit", strconv.Itoa(data.CreditLimit), logger.FormatQuota(data.CreditLimit),
+			"amount_owed", strconv.FormatInt(statement.AmountOwed, 10), logger.FormatQuota(int(statement.AmountOwed))})
+	}
+	_ = w.Write([]string{})
+	_ = w.Write([]string{"model_name", "token_name", "request_count", "prompt_tokens", "completion_tokens", "quota", "amount"})
+	for _, line := range data.Lines {
+		_ = w.Write([]string{
+			line.ModelName,
+			line.TokenName,
+			strconv.FormatInt(line.RequestCount, 10),
+			strconv.FormatInt(line.PromptTokens, 10),
+			strconv.FormatInt(line.CompletionTokens, 10),
+			strconv.FormatInt(line.Quota, 10),
+			logger.FormatQuota(int(line.Quota)),
+		})
+	}
+	_ = w.Write([]string{"total", "", strconv.FormatInt(statement.RequestCount, 10), "", "",
+		strconv.FormatInt(statement.UsageQuota, 10), logger.FormatQuota(int(statement.UsageQuota))})
+	if len(data.Topups) > 0 {
+		_ = w.Write([]string{})
+		_ = w.Write([]string{"trade_no", "payment_method", "complete_time", "money", "quota", "amount"})
+		for _, topup := range data.Topups {
+			_ = w.Write([]string{
+				topup.TradeNo,
+				topup.PaymentMethod,
+				time.Unix(topup.CompleteTime, 0).Format("2006-01-02 15:04:05"),
+				strconv.FormatFloat(topup.Money, 'f', 2, 64),
+				strconv.FormatInt(topup.Quota, 10),
+				logger.FormatQuota(int(topup.Quota)),
+			})
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+var statementHTMLTemplate = template.Must(template.New("statement").Funcs(template.FuncMap{
+	"quota": func(q int64) string { return logger.FormatQuota(int(q)) },
+	"date": func(ts int64) string {
+		return time.Unix(ts, 0).Format("2006-01-02 15:04")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Company.CompanyName}} 账单 {{.Statement.Period}}</title>
+<style>
+body { font-family: sans-serif; font-size: 13px; color: #222; margin: 32px; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 24px; }
+th, td { border: 1px solid #ccc; padding: 6px 8px; text-align: left; }
+th { background: #f5f5f5; }
+td.num { text-align: right; }
+.header { display: flex; justify-content: space-between; margin-bottom: 24px; }
+@media print { body { margin: 0; } }
+</style>
+</head>
+<body>
+<div class="header">
+<div>
+<h2>{{.Company.CompanyName}}</h2>
+{{if .Company.CompanyAddress}}<div>{{.Company.CompanyAddress}}</div>{{end}}
+{{if .Company.TaxId}}<div>税号：{{.Company.TaxId}}</div>{{end}}
+{{if .Company.ContactEmail}}<div>{{.Company.ContactEmail}}</div>{{end}}
+</div>
+<div>
+<h2>账单 {{.Statement.Period}}</h2>
+<div>客户：{{.Data.OwnerName}}</div>
+<div>账单编号：{{.Statement.Id}}</div>
+<div>期间：{{date .Statement.StartTime}} - {{date .Statement.EndTime}}</div>
+</div>
+</div>
+{{if .Data.Summary}}
+<table>
+<tr><th>期初余额</th><th>本期入账</th><th>本期支出</th><th>期末余额</th></tr>
+<tr>
+<td class="num">{{quota .Opening}}</td>
+<td class="num">{{quota .Credit}}</td>
+<td class="num">{{quota .Debit}}</td>
+<td class="num">{{quota .Closing}}</td>
+</tr>
+</table>
+{{end}}
+{{if or (gt .Data.CreditLimit 0) (gt .Statement.AmountOwed 0)}}
+<table>
+<tr><th>信用额度</th><th>应付金额</th></tr>
+<tr>
+<td class="num">{{quota .CreditLimit}}</td>
+<td class="num">{{quota .Statement.AmountOwed}}</td>
+</tr>
+</table>
+{{end}}
+<h3>用量明细</h3>
+<table>
+<tr><th>模型</th><th>令牌</th><th>请求数</th><th>提示 tokens</th><th>补全 tokens</th><th>金额</th></tr>
+{{range .Data.Lines}}
+<tr>
+<td>{{.ModelName}}</td>
+<td>{{.TokenName}}</td>
+<td class="num">{{.RequestCount}}</td>
+<td class="num">{{.PromptTokens}}</td>
+<td class="num">{{.CompletionTokens}}</td>
+<td class="num">{{quota .Quota}}</td>
+</tr>
+{{end}}
+<tr><th colspan="2">合计</th><th class="num">{{.Statement.RequestCount}}</th><th></th><th></th><th class="num">{{quota .Statement.UsageQuota}}</th></tr>
+</table>
+{{if .Data.Topups}}
+<h3>充值记录</h3>
+<table>
+<tr><th>订单号</th><th>支付方式</th><th>完成时间</th><th>支付金额</th><th>入账额度</th></tr>
+{{range .Data.Topups}}
+<tr>
+<td>{{.TradeNo}}</td>
+<td>{{.PaymentMethod}}</td>
+<td>{{date .CompleteTime}}</td>
+<td class="num">{{printf "%.2f" .Money}}</td>
+<td class="num">{{quota .Quota}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
+{{if .Company.Footer}}<p>{{.Company.Footer}}</p>{{end}}
+</body>
+</html>
+`))
+
+// RenderStatementHTML 渲染可打印的 HTML 账单，浏览器打印为 PDF 即可得到正式账单
+func RenderStatementHTML(statement *model.Statement) ([]byte, error) {
+	data, err := statement.GetData()
+	if err != nil {
+		return nil, err
+	}
+	view := struct {
+		Statement *model.Statement
+		Data      *model.StatementData
+		Company   *system_setting.StatementSettings
+		Opening   int64
+		Credit    int64
+		Debit     int64
+		Closing   int64
+		// 后付费主体的信用额度，期末透支部分即应付金额
+		CreditLimit int64
+	}{Statement: statement, Data: data, Company: system_setting.GetStatementSettings()}
+	if data.Summary != nil {
+		view.Opening = int64(data.Summary.OpeningBalance)
+		view.Credit = int64(data.Summary.Credit)
+		view.Debit = int64(data.Summary.Debit)
+		view.Closing = int64(data.Summary.ClosingBalance)
+	}
+	view.CreditLimit = int64(data.CreditLimit)
+	buf := &bytes.Buffer{}
+	if err := statementHTMLTemplate.Execute(buf, view); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SendStatementEmail 将 HTML 账单发送给用户，组织账单发送给组织所有者
+func SendStatementEmail(statement *model.Statement) error {
+	userId := statement.OwnerId
+	if statement.OwnerType == model.LedgerAccountOrg {
+		org, err := model.GetOrganizationById(statement.OwnerId)
+		if err != nil {
+			return err
+		}
+		userId = org.OwnerId
+	}
+	user, err := model.GetUserById(userId, false)
+	if err != nil {
+		return err
+	}
+	if user.Email == "" {
+		return errors.New("用户未绑定邮箱")
+	}
+	content, err := RenderStatementHTML(statement)
+	if err != nil {
+		return err
+	}
+	subject := fmt.Sprintf("%s %s 月度账单", common.SystemName, statement.Period)
+	return common.SendEmail(subject, user.Email, string(content))
+}
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/setting/system_setting"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunStatementTaskOnce_RegeneratesPartialStatement(t *testing.T) {
+	setupTestDB(t)
+	settings := system_setting.GetStatementSettings()
+	oldSettings := *settings
+	t.Cleanup(func() {
+		*settings = oldSettings
+		statementLastPeriod = ""
+	})
+	settings.AutoGenerate, settings.AutoEmail = true, false
+	statementLastPeriod = ""
+
+	now := time.Now()
+	period := time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.Local).Format(model.StatementPeriodLayout)
+	start, end, err := model.StatementPeriodRange(period)
+	require.NoError(t, err)
+	partialUser := createTestUser(t, 0)
+	finalUser := createTestUser(t, 0)
+	for _, userId := range []int{partialUser.Id, finalUser.Id} {
+		require.NoError(t, model.LOG_DB.Create(&model.Log{UserId: userId, Type: model.LogTypeConsume, CreatedAt: start + 10, ModelName: "m", Quota: 100}).Error)
+		require.NoError(t, model.LOG_DB.Create(&model.Log{UserId: userId, Type: model.LogTypeConsume, CreatedAt: end - 10, ModelName: "m", Quota: 200}).Error)
+	}
+	// 月中生成的部分账单只包含第一条消费，月末后生成的账单保持不变
+	require.NoError(t, model.DB.Create(&model.Statement{OwnerType: model.LedgerAccountUser, OwnerId: partialUser.Id, Period: period,
+		StartTime: start, EndTime: end, UsageQuota: 100, CreatedTime: start + 20}).Error)
+	require.NoError(t, model.DB.Create(&model.Statement{OwnerType: model.LedgerAccountUser, OwnerId: finalUser.Id, Period: period,
+		StartTime: start, EndTime: end, UsageQuota: 1, CreatedTime: end + 1}).Error)
+
+	runStatementTaskOnce()
+
+	partial, err := model.GetStatementByPeriod(model.LedgerAccountUser, partialUser.Id, period)
+	require.NoError(t, err)
+	require.True(t, partial.IsFinal())
+	require.Equal(t, int64(300), partial.UsageQuota)
+	final, err := model.GetStatementByPeriod(model.LedgerAccountUser, finalUser.Id, period)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), final.UsageQuota)
+}
+
+func TestIsStatementPeriodClosed(t *testing.T) {
+	current := time.Now().Format(model.StatementPeriodLayout)
+	closed, err := model.IsStatementPeriodClosed(current)
+	require.NoError(t, err)
+	require.False(t, closed)
+
+	closed, err = model.IsStatementPeriodClosed("2020-01")
+	require.NoError(t, err)
+	require.True(t, closed)
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+
+	"github.com/bytedance/gopkg/util/gopool"
+)
+
+const (
+	subscriptionTickInterval   = 5 * time.Minute
+	subscriptionRemindBefore   = 3 * 24 * time.Hour
+	subscriptionProviderGrace  = 24 * time.Hour // 第三方订阅到期后等待续费回调的宽限期
+	subscriptionPendingTimeout = 24 * time.Hour
+	subscriptionBatchSize      = 100
+)
+
+var (
+	subscriptionTaskOnce    sync.Once
+	subscriptionTaskRunning atomic.Bool
+)
+
+// StartSubscriptionTask 启动订阅续订与到期处理任务，仅在主节点运行
+func StartSubscriptionTask() {
+	subscriptionTaskOnce.Do(func() {
+		if !common.IsMasterNode {
+			return
+		}
+
+		gopool.Go(func() {
+			logger.LogInfo(context.Background(), fmt.Sprintf("subscription task started: tick=%s", subscriptionTickInterval))
+
+			ticker := time.NewTicker(subscriptionTickInterval)
+			defer ticker.Stop()
+
+			runSubscriptionTaskOnce()
+			for range ticker.C {
+				runSubscriptionTaskOnce()
+			}
+		})
+	})
+}
+
+func runSubscriptionTaskOnce() {
+	if !subscriptionTaskRunning.CompareAndSwap(false, true) {
+		return
+	}
+	defer subscriptionTaskRunning.Store(false)
+
+	ctx := context.Background()
+	now := time.Now()
+
+	remindSubscriptions(ctx, now)
+
+	subs, err := model.GetDueSubscriptions(now.Unix(), now.Add(-subscriptionProviderGrace).Unix(), subscriptionBatchSize)
+	if err != nil {
+		logger.LogError(ctx, fmt.Sprintf("subscription task: query due subscriptions failed: %v", err))
+		return
+	}
+	for _, sub := range subs {
+		processDueSubscription(ctx, sub)
+	}
+
+	if err := model.ExpirePendingSubscriptions(now.Add(-subscriptionPendingTimeout).Unix()); err != nil {
+		logger.LogError(ctx, fmt.Sprintf("subscription task: expire pending subscriptions failed: %v", err))
+	}
+}
+
+func remindSubscriptions(ctx context.Context, now time.Time) {
+	subs, err := model.GetSubscriptionsToRemind(now.Add(subscriptionRemindBefore).Unix(), subscriptionBatchSize)
+	if err != nil {
+		logger.LogError(ctx, fmt.Sprintf("subscription task: query subscriptions to remind failed: %v", err))
+		return
+	}
+	for _, sub := range subs {
+		plan, err := model.GetSubscriptionPlanById(sub.PlanId)
+		if err != nil {
+			continue
+		}
+		endTime := time.Unix(sub.PeriodEnd, 0).Format("2006-01-02 15:04:05")
+		if sub.AutoRenew {
+			NotifySubscriptionEvent(sub.UserId, "套餐即将续订", fmt.Sprintf("您的套餐 %s 将于 %s 自动续订。", plan.Name, endTime))
+		} else {
+			NotifySubscriptionEvent(sub.UserId, "套餐即将到期", fmt.Sprintf("您的套餐 %s 将于 %s 到期，到期后未使用的套餐额度将失效。", plan.Name, endTime))
+		}
+		if err := sub.MarkRenewNotified(); err != nil {
+			logger.LogError(ctx, fmt.Sprintf("subscription task: mark subscription %d notified failed: %v", sub.Id, err))
+		}
+	}
+}
+
+func processDueSubscription(ctx context.Context, sub *model.UserSubscription) {
+	plan, err := model.GetSubscriptionPlanById(sub.PlanId)
+	if err == nil && sub.AutoRenew && sub.Provider == model.SubscriptionProviderBalance && plan.Enabled {
+		err = model.RenewSubscriptionWithBalance(sub, plan)
+		if err == nil {
+			NotifySubscriptionEvent(sub.UserId, "套餐续订成功", fmt.Sprintf("您的套餐 %s 已使用账户余额续订，本周期额度 %s。", plan.Name, logger.FormatQuota(plan.IncludedQuota)))
+			return
+		}
+		logger.LogWarn(ctx, fmt.Sprintf("subscription task: renew subscription %d with balance failed: %v", sub.Id, err))
+		model.RecordLog(sub.UserId, model.LogTypeSystem, fmt.Sprintf("套餐 %s 自动续订失败：%s", plan.Name, err.Error()))
+	}
+
+	if err := model.ExpireSubscription(sub); err != nil {
+		logger.LogError(ctx, fmt.Sprintf("subscription task: expire subscription %d failed: %v", sub.Id, err))
+		return
+	}
+	planName := fmt.Sprintf("#%d", sub.PlanId)
+	if plan != nil && plan.Id != 0 {
+		planName = plan.Name
+	}
+	model.RecordLog(sub.UserId, model.LogTypeSystem, fmt.Sprintf("套餐 %s 已到期", planName))
+	NotifySubscriptionEvent(sub.UserId, "套餐已到期", fmt.Sprintf("您的套餐 %s 已到期，后续请求将使用账户余额计费。", planName))
+}
+
+// NotifySubscriptionEvent 按用户的通知设置发送订阅相关通知
+func NotifySubscriptionEvent(userId int, title string, content string) {
+	gopool.Go(func() {
+		user, err := model.GetUserById(userId, false)
+		if err != nil {
+			return
+		}
+		err = NotifyUser(user.Id, user.Email, user.GetSetting(), dto.NewNotify(dto.NotifyTypeSubscription, title, content, nil))
+		if err != nil {
+			common.SysLog(fmt.Sprintf("failed to send subscription notification to user %d: %s", userId, err.Error()))
+		}
+	})
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+
+	"github.com/bytedance/gopkg/util/gopool"
+)
+
+// TryAutoRefillToken 令牌开启自动充值且剩余额度低于阈值时补充额度并通知令牌所有者，返回补充的额度。
+// 缓存中的剩余额度可能尚未扣减，是否低于阈值以数据库为准。
+func TryAutoRefillToken(token *model.Token) int {
+	if token == nil || !token.AutoRefillEnabled || token.UnlimitedQuota {
+		return 0
+	}
+	return autoRefillToken(token.Id)
+}
+
+// shouldAutoRefillAfterConsume 按鉴权时的令牌剩余额度判断本次请求的消耗是否使其跌破自动充值阈值，
+// 只有跨过阈值的请求才会尝试充值，避免每次请求都查询并更新令牌。
+// 并发请求导致的漏判由预扣费与鉴权时的额度不足充值兜底。
+func shouldAutoRefillAfterConsume(relayInfo *relaycommon.RelayInfo, consumed int) bool {
+	threshold := relayInfo.TokenAutoRefillThreshold
+	if threshold <= 0 || relayInfo.TokenUnlimited || consumed <= 0 {
+		return false
+	}
+	remain := relayInfo.TokenRemainQuota - consumed
+	return remain < threshold && remain+consumed >= threshold
+}
+
+func autoRefillToken(tokenId int) int {
+	refilled, refilledToken, err := model.AutoRefillToken(tokenId)
+	if err != nil {
+		common.SysError(fmt.Sprintf("failed to auto refill token %d: %s", tokenId, err.Error()))
+		return 0
+	}
+	if refilled > 0 {
+		notifyTokenAutoRefill(refilledToken, refilled)
+	}
+	return refilled
+}
+
+func notifyTokenAutoRefill(token *model.Token, refilled int) {
+	gopool.Go(func() {
+		userCache, err := model.GetUserCache(token.UserId)
+		if err != nil {
+			common.SysError(fmt.Sprintf("failed to get user %d for token refill notify: %s", token.UserId, err.Error()))
+			return
+		}
+		prompt := fmt.Sprintf("令牌 %s 已自动充值", token.Name)
+		content := "{{value}}，本次充值 {{value}}，令牌剩余额度 {{value}}，今日已自动充值 {{value}}（上限 {{value}}）。"
+		values := []interface{}{prompt, logger.FormatQuota(refilled), logger.FormatQuota(token.RemainQuota),
+			logger.FormatQuota(token.AutoRefillDateQuota), logger.FormatQuota(token.AutoRefillDailyMax)}
+		err = NotifyUser(token.UserId, userCache.Email, userCache.GetSetting(), dto.NewNotify(dto.NotifyTypeTokenRefill, prompt, content, values))
+		if err != nil {
+			common.SysError(fmt.Sprintf("failed to send token refill notify to user %d: %s", token.UserId, err.Error()))
+		}
+	})
+}
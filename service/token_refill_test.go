@@ -0,0 +1,31 @@
+package service
+
+import (
+	"testing"
+
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShouldAutoRefillAfterConsume(t *testing.T) {
+	relayInfo := &relaycommon.RelayInfo{TokenRemainQuota: 150, TokenAutoRefillThreshold: 100}
+
+	require.False(t, shouldAutoRefillAfterConsume(relayInfo, 30))
+	require.True(t, shouldAutoRefillAfterConsume(relayInfo, 60))
+	require.False(t, shouldAutoRefillAfterConsume(relayInfo, 50))
+	// 退款或未消耗不触发
+	require.False(t, shouldAutoRefillAfterConsume(relayInfo, 0))
+	require.False(t, shouldAutoRefillAfterConsume(relayInfo, -60))
+
+	// 鉴权时已低于阈值的令牌不再每次请求都尝试充值
+	relayInfo.TokenRemainQuota = 80
+	require.False(t, shouldAutoRefillAfterConsume(relayInfo, 10))
+
+	relayInfo.TokenRemainQuota = 150
+	relayInfo.TokenAutoRefillThreshold = 0
+	require.False(t, shouldAutoRefillAfterConsume(relayInfo, 60))
+	relayInfo.TokenAutoRefillThreshold = 100
+	relayInfo.TokenUnlimited = true
+	require.False(t, shouldAutoRefillAfterConsume(relayInfo, 60))
+}
@@ -0,0 +1,380 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+
+	"github.com/bytedance/gopkg/util/gopool"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	TrafficPhaseStart  = "start"
+	TrafficPhaseFinish = "finish"
+
+	trafficRingSize         = 1000
+	trafficSubscriberBuffer = 256
+	trafficRedisChannel     = "new-api:traffic_inspector:v1"
+	// 有节点正在查看时设置该键，其余节点据此决定是否经 Redis 广播事件
+	trafficWatcherKey         = "new-api:traffic_inspector:watchers:v1"
+	trafficWatcherTTL         = 30 * time.Second
+	trafficWatcherRefresh     = 10 * time.Second
+	trafficWatcherCheckPeriod = 5 * time.Second
+	// 未收到结束事件的进行中请求（节点宕机、广播中断等）超过该时长后清除，总数超过上限时清除最早的请求
+	trafficInflightTTL         = time.Hour
+	trafficInflightMax         = 10000
+	trafficInflightSweepPeriod = time.Minute
+)
+
+// TrafficEvent 一次中继请求的开始或结束事件
+type TrafficEvent struct {
+	RequestId        string   `json:"request_id"`
+	Node             string   `json:"node"`
+	Phase            string   `json:"phase"`
+	Time             int64    `json:"time"`
+	UserId           int      `json:"user_id"`
+	Username         string   `json:"username"`
+	TokenId          int      `json:"token_id"`
+	TokenName        string   `json:"token_name"`
+	Group            string   `json:"group"`
+	Model            string   `json:"model"`
+	ChannelId        int      `json:"channel_id"`
+	RetryChain       []string `json:"retry_chain,omitempty"`
+	IsStream         bool     `json:"is_stream"`
+	StatusCode       int      `json:"status_code,omitempty"`
+	LatencyMs        int64    `json:"latency_ms,omitempty"`
+	PromptTokens     int      `json:"prompt_tokens,omitempty"`
+	CompletionTokens int      `json:"completion_tokens,omitempty"`
+	Error            string   `json:"error,omitempty"`
+}
+
+// TrafficFilter 事件过滤条件，零值表示不过滤。
+// Status 可为 inflight、error、2xx/4xx/5xx 形式的状态码类别或具体状态码。
+type TrafficFilter struct {
+	UserId    int
+	Model     string
+	ChannelId int
+	Status    string
+}
+
+func (f TrafficFilter) Match(event *TrafficEvent) bool {
+	if f.UserId != 0 && event.UserId != f.UserId {
+		return false
+	}
+	if f.Model != "" && event.Model != f.Model {
+		return false
+	}
+	if f.ChannelId != 0 && event.ChannelId != f.ChannelId && !slices.Contains(event.RetryChain, strconv.Itoa(f.ChannelId)) {
+		return false
+	}
+	switch status := strings.ToLower(f.Status); {
+	case status == "":
+		return true
+	case status == "inflight":
+		return event.Phase == TrafficPhaseStart
+	case event.Phase != TrafficPhaseFinish:
+		return false
+	case status == "error":
+		return event.StatusCode >= 400
+	case len(status) == 3 && strings.HasSuffix(status, "xx"):
+		return strconv.Itoa(event.StatusCode/100) == status[:1]
+	default:
+		return strconv.Itoa(event.StatusCode) == status
+	}
+}
+
+// TrafficSubscription 一个查看连接的订阅，事件写入 C，消费过慢时丢弃新事件；
+// 服务退出时关闭 Done，查看连接需随之结束
+type TrafficSubscription struct {
+	C         chan *TrafficEvent
+	Done      chan struct{}
+	filter    TrafficFilter
+	Dropped   atomic.Int64
+	closeOnce sync.Once
+}
+
+func (sub *TrafficSubscription) close() {
+	sub.closeOnce.Do(func() {
+		close(sub.Done)
+	})
+}
+
+type trafficInspector struct {
+	mu          sync.RWMutex
+	ring        []*TrafficEvent
+	next        int
+	inflight    map[string]*TrafficEvent
+	lastSweep   int64
+	subscribers map[*TrafficSubscription]struct{}
+	closed      bool
+}
+
+var (
+	inspector = &trafficInspector{
+		ring:        make([]*TrafficEvent, 0, trafficRingSize),
+		inflight:    make(map[string]*TrafficEvent),
+		subscribers: make(map[*TrafficSubscription]struct{}),
+	}
+	trafficNodeId = newTrafficNodeId()
+
+	trafficRemoteWatching  atomic.Bool
+	trafficWatcherChecked  atomic.Int64
+	trafficInspectorOnce   sync.Once
+	trafficLocalWatchCount atomic.Int64
+)
+
+func newTrafficNodeId() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "node"
+	}
+	return hostname + "-" + common.GetRandomString(6)
+}
+
+// record 写入环形缓冲与进行中列表，并推送给本节点的订阅者
+func (t *trafficInspector) record(event *TrafficEvent) {
+	t.mu.Lock()
+	if event.Phase == TrafficPhaseStart {
+		now := time.Now().UnixMilli()
+		if len(t.inflight) >= trafficInflightMax || now-t.lastSweep >= trafficInflightSweepPeriod.Milliseconds() {
+			t.evictInflight(now)
+		}
+		t.inflight[event.Node+"/"+event.RequestId] = event
+	} else {
+		delete(t.inflight, event.Node+"/"+event.RequestId)
+		if len(t.ring) < trafficRingSize {
+			t.ring = append(t.ring, event)
+		} else {
+			t.ring[t.next] = event
+		}
+		t.next = (t.next + 1) % trafficRingSize
+	}
+	subscribers := make([]*TrafficSubscription, 0, len(t.subscribers))
+	for sub := range t.subscribers {
+		subscribers = append(subscribers, sub)
+	}
+	t.mu.Unlock()
+
+	for _, sub := range subscribers {
+		if !sub.filter.Match(event) {
+			continue
+		}
+		select {
+		case sub.C <- event:
+		default:
+			sub.Dropped.Add(1)
+		}
+	}
+}
+
+// evictInflight 清除超时的进行中请求，仍达到上限时按开始时间清除最早的请求，调用方需持有写锁
+func (t *trafficInspector) evictInflight(now int64) {
+	t.lastSweep = now
+	expireBefore := now - trafficInflightTTL.Milliseconds()
+	for key, event := range t.inflight {
+		if event.Time < expireBefore {
+			delete(t.inflight, key)
+		}
+	}
+	if len(t.inflight) < trafficInflightMax {
+		return
+	}
+	keys := make([]string, 0, len(t.inflight))
+	for key := range t.inflight {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return int(t.inflight[a].Time - t.inflight[b].Time)
+	})
+	for _, key := range keys[:len(keys)-trafficInflightMax+1] {
+		delete(t.inflight, key)
+	}
+}
+
+// snapshot 返回符合条件的进行中请求与最近完成的请求，按时间先后排列
+func (t *trafficInspector) snapshot(filter TrafficFilter) []*TrafficEvent {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	events := make([]*TrafficEvent, 0, len(t.ring)+len(t.inflight))
+	start := 0
+	if len(t.ring) == trafficRingSize {
+		start = t.next
+	}
+	for i := 0; i < len(t.ring); i++ {
+		event := t.ring[(start+i)%len(t.ring)]
+		if filter.Match(event) {
+			events = append(events, event)
+		}
+	}
+	inflight := make([]*TrafficEvent, 0, len(t.inflight))
+	for _, event := range t.inflight {
+		if filter.Match(event) {
+			inflight = append(inflight, event)
+		}
+	}
+	slices.SortFunc(inflight, func(a, b *TrafficEvent) int {
+		return int(a.Time - b.Time)
+	})
+	return append(events, inflight...)
+}
+
+// SubscribeTraffic 订阅中继事件，返回订阅与当前快照，使用完毕需调用 UnsubscribeTraffic
+func SubscribeTraffic(filter TrafficFilter) (*TrafficSubscription, []*TrafficEvent) {
+	sub := &TrafficSubscription{
+		C:      make(chan *TrafficEvent, trafficSubscriberBuffer),
+		Done:   make(chan struct{}),
+		filter: filter,
+	}
+	inspector.mu.Lock()
+	inspector.subscribers[sub] = struct{}{}
+	if inspector.closed {
+		sub.close()
+	}
+	inspector.mu.Unlock()
+	if trafficLocalWatchCount.Add(1) == 1 {
+		refreshTrafficWatcher()
+	}
+	return sub, inspector.snapshot(filter)
+}
+
+func UnsubscribeTraffic(sub *TrafficSubscription) {
+	inspector.mu.Lock()
+	delete(inspector.subscribers, sub)
+	inspector.mu.Unlock()
+	trafficLocalWatchCount.Add(-1)
+}
+
+// CloseTrafficSubscriptions 服务退出前结束所有查看连接，之后建立的订阅立即结束，
+// 避免长连接阻塞 HTTP 服务的关闭
+func CloseTrafficSubscriptions() {
+	inspector.mu.Lock()
+	defer inspector.mu.Unlock()
+	inspector.closed = true
+	for sub := range inspector.subscribers {
+		sub.close()
+	}
+}
+
+// TrafficRelayStarted 记录中继请求开始
+func TrafficRelayStarted(c *gin.Context, info *relaycommon.RelayInfo) {
+	publishTrafficEvent(newTrafficEvent(c, info, TrafficPhaseStart))
+}
+
+// TrafficRelayFinished 记录中继请求结束，包含重试链、状态码、耗时与计费 token 数
+func TrafficRelayFinished(c *gin.Context, info *relaycommon.RelayInfo, statusCode int, err error) {
+	event := newTrafficEvent(c, info, TrafficPhaseFinish)
+	event.RetryChain = c.GetStringSlice("use_channel")
+	event.StatusCode = statusCode
+	event.LatencyMs = time.Since(info.StartTime).Milliseconds()
+	if err != nil {
+		event.Error = err.Error()
+	}
+	if params, ok := common.GetContextKeyType[model.RecordConsumeLogParams](c, constant.ContextKeyConsumeLogParams); ok {
+		event.PromptTokens = params.PromptTokens
+		event.CompletionTokens = params.CompletionTokens
+	} else {
+		event.PromptTokens = info.GetEstimatePromptTokens()
+	}
+	publishTrafficEvent(event)
+}
+
+func newTrafficEvent(c *gin.Context, info *relaycommon.RelayInfo, phase string) *TrafficEvent {
+	return &TrafficEvent{
+		RequestId: c.GetString(common.RequestIdKey),
+		Node:      trafficNodeId,
+		Phase:     phase,
+		Time:      time.Now().UnixMilli(),
+		UserId:    info.UserId,
+		Username:  c.GetString("username"),
+		TokenId:   info.TokenId,
+		TokenName: c.GetString("token_name"),
+		Group:     info.UsingGroup,
+		Model:     info.OriginModelName,
+		ChannelId: common.GetContextKeyInt(c, constant.ContextKeyChannelId),
+		IsStream:  info.IsStream,
+	}
+}
+
+func publishTrafficEvent(event *TrafficEvent) {
+	inspector.record(event)
+	if !common.RedisEnabled || !trafficClusterWatching() {
+		return
+	}
+	data, err := common.Marshal(event)
+	if err != nil {
+		return
+	}
+	gopool.Go(func() {
+		if err := common.RDB.Publish(context.Background(), trafficRedisChannel, data).Err(); err != nil {
+			common.SysError("failed to publish traffic event: " + err.Error())
+		}
+	})
+}
+
+// trafficClusterWatching 集群中是否有节点正在查看，结果缓存 trafficWatcherCheckPeriod
+func trafficClusterWatching() bool {
+	if trafficLocalWatchCount.Load() > 0 {
+		return true
+	}
+	now := time.Now().UnixMilli()
+	last := trafficWatcherChecked.Load()
+	if now-last < trafficWatcherCheckPeriod.Milliseconds() || !trafficWatcherChecked.CompareAndSwap(last, now) {
+		return trafficRemoteWatching.Load()
+	}
+	exists, err := common.RDB.Exists(context.Background(), trafficWatcherKey).Result()
+	trafficRemoteWatching.Store(err == nil && exists > 0)
+	return trafficRemoteWatching.Load()
+}
+
+func refreshTrafficWatcher() {
+	if !common.RedisEnabled {
+		return
+	}
+	if err := common.RDB.Set(context.Background(), trafficWatcherKey, trafficNodeId, trafficWatcherTTL).Err(); err != nil {
+		common.SysError("failed to refresh traffic watcher: " + err.Error())
+	}
+}
+
+// StartTrafficInspector 订阅其他节点广播的中继事件，并在本节点有查看连接时维持观察者标记
+func StartTrafficInspector() {
+	trafficInspectorOnce.Do(func() {
+		if !common.RedisEnabled {
+			return
+		}
+		gopool.Go(func() {
+			ctx := context.Background()
+			pubsub := common.RDB.Subscribe(ctx, trafficRedisChannel)
+			defer pubsub.Close()
+			logger.LogInfo(ctx, fmt.Sprintf("traffic inspector subscribed: node=%s", trafficNodeId))
+			for msg := range pubsub.Channel() {
+				var event TrafficEvent
+				if err := common.UnmarshalJsonStr(msg.Payload, &event); err != nil || event.Node == trafficNodeId {
+					continue
+				}
+				inspector.record(&event)
+			}
+		})
+		gopool.Go(func() {
+			ticker := time.NewTicker(trafficWatcherRefresh)
+			defer ticker.Stop()
+			for range ticker.C {
+				if trafficLocalWatchCount.Load() > 0 {
+					refreshTrafficWatcher()
+				}
+			}
+		})
+	})
+}
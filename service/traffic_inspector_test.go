@@ -0,0 +1,78 @@
+package service
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTrafficInspector() *trafficInspector {
+	return &trafficInspector{
+		inflight:    make(map[string]*TrafficEvent),
+		subscribers: make(map[*TrafficSubscription]struct{}),
+	}
+}
+
+func TestTrafficInspector_FinishRemovesInflight(t *testing.T) {
+	ti := newTestTrafficInspector()
+	now := time.Now().UnixMilli()
+	ti.record(&TrafficEvent{RequestId: "r1", Node: "n1", Phase: TrafficPhaseStart, Time: now})
+	require.Len(t, ti.inflight, 1)
+	ti.record(&TrafficEvent{RequestId: "r1", Node: "n1", Phase: TrafficPhaseFinish, Time: now})
+	require.Empty(t, ti.inflight)
+	require.Len(t, ti.ring, 1)
+}
+
+func TestTrafficInspector_EvictsStaleInflight(t *testing.T) {
+	ti := newTestTrafficInspector()
+	now := time.Now().UnixMilli()
+	// 其他节点宕机，开始事件永远等不到结束事件
+	ti.record(&TrafficEvent{RequestId: "stale", Node: "dead", Phase: TrafficPhaseStart, Time: now - 2*trafficInflightTTL.Milliseconds()})
+	ti.lastSweep = 0
+	ti.record(&TrafficEvent{RequestId: "fresh", Node: "n1", Phase: TrafficPhaseStart, Time: now})
+	require.Len(t, ti.inflight, 1)
+	require.Contains(t, ti.inflight, "n1/fresh")
+}
+
+func TestTrafficInspector_InflightCapped(t *testing.T) {
+	ti := newTestTrafficInspector()
+	now := time.Now().UnixMilli()
+	for i := 0; i < trafficInflightMax+10; i++ {
+		ti.record(&TrafficEvent{RequestId: strconv.Itoa(i), Node: "n1", Phase: TrafficPhaseStart, Time: now + int64(i)})
+	}
+	require.Len(t, ti.inflight, trafficInflightMax)
+	require.NotContains(t, ti.inflight, "n1/0")
+	require.Contains(t, ti.inflight, "n1/"+strconv.Itoa(trafficInflightMax+9))
+}
+
+func TestCloseTrafficSubscriptions(t *testing.T) {
+	oldInspector, oldRedis := inspector, common.RedisEnabled
+	inspector, common.RedisEnabled = newTestTrafficInspector(), false
+	t.Cleanup(func() {
+		inspector, common.RedisEnabled = oldInspector, oldRedis
+	})
+
+	sub, _ := SubscribeTraffic(TrafficFilter{})
+	defer UnsubscribeTraffic(sub)
+	CloseTrafficSubscriptions()
+	CloseTrafficSubscriptions()
+	require.True(t, isTrafficSubscriptionDone(sub))
+
+	// 退出过程中新建立的订阅立即结束
+	late, _ := SubscribeTraffic(TrafficFilter{})
+	defer UnsubscribeTraffic(late)
+	require.True(t, isTrafficSubscriptionDone(late))
+}
+
+func isTrafficSubscriptionDone(sub *TrafficSubscription) bool {
+	select {
+	case <-sub.Done:
+		return true
+	default:
+		return false
+	}
+}
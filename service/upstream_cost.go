@@ -0,0 +1,72 @@
+package service
+
+import (
+	"github.com/QuantumNous/new-api/common"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/setting/ratio_setting"
+)
+
+// UpstreamUsage 计算上游成本所需的用量，InputTokens 不包含缓存命中与缓存写入的 tokens
+type UpstreamUsage struct {
+	InputTokens       int
+	OutputTokens      int
+	CacheReadTokens   int
+	CacheWriteTokens  int
+	AudioInputTokens  int
+	AudioOutputTokens int
+}
+
+// CalculateUpstreamCost 按渠道的上游成本定义计算本次请求的上游成本，单位与额度相同。
+// 渠道未配置上游成本时返回 0；工具调用等附加费用不计入。
+func CalculateUpstreamCost(relayInfo *relaycommon.RelayInfo, usage UpstreamUsage) int {
+	setting := relayInfo.ChannelOtherSettings.UpstreamCost
+	if setting == nil {
+		return 0
+	}
+	upstreamModel := relayInfo.UpstreamModelName
+	if upstreamModel == "" {
+		upstreamModel = relayInfo.OriginModelName
+	}
+	price, ok := setting.ModelPrices[upstreamModel]
+	if !ok {
+		price, ok = setting.ModelPrices[relayInfo.OriginModelName]
+	}
+	if ok {
+		if price.PerCall > 0 {
+			return int(price.PerCall * common.QuotaPerUnit)
+		}
+		usd := float64(usage.InputTokens+usage.AudioInputTokens)*price.Input +
+			float64(usage.OutputTokens+usage.AudioOutputTokens)*price.Output +
+			float64(usage.CacheReadTokens)*price.CacheRead +
+			float64(usage.CacheWriteTokens)*price.CacheWrite
+		return int(usd / 1000000 * common.QuotaPerUnit)
+	}
+	if setting.Multiplier <= 0 {
+		return 0
+	}
+	return int(officialQuota(relayInfo.OriginModelName, usage) * setting.Multiplier)
+}
+
+// officialQuota 按系统模型倍率或模型价格计算的官方价格，不含分组倍率、价格覆盖与分时计价
+func officialQuota(modelName string, usage UpstreamUsage) float64 {
+	if modelPrice, ok := ratio_setting.GetModelPrice(modelName, false); ok {
+		return modelPrice * common.QuotaPerUnit
+	}
+	modelRatio, ok, _ := ratio_setting.GetModelRatio(modelName)
+	if !ok {
+		return 0
+	}
+	cacheRatio, _ := ratio_setting.GetCacheRatio(modelName)
+	cacheCreationRatio, _ := ratio_setting.GetCreateCacheRatio(modelName)
+	completionRatio := ratio_setting.GetCompletionRatio(modelName)
+	audioRatio := ratio_setting.GetAudioRatio(modelName)
+	audioCompletionRatio := ratio_setting.GetAudioCompletionRatio(modelName)
+
+	tokens := float64(usage.InputTokens)
+	tokens += float64(usage.CacheReadTokens) * cacheRatio
+	tokens += float64(usage.CacheWriteTokens) * cacheCreationRatio
+	tokens += float64(usage.OutputTokens) * completionRatio
+	tokens += float64(usage.AudioInputTokens) * audioRatio
+	tokens += float64(usage.AudioOutputTokens) * audioRatio * audioCompletionRatio
+	return tokens * modelRatio
+}
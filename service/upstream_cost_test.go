@@ -0,0 +1,58 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/setting/ratio_setting"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newUpstreamCostRelayInfo(setting *dto.UpstreamCostSetting, originModel string, upstreamModel string) *relaycommon.RelayInfo {
+	return &relaycommon.RelayInfo{
+		OriginModelName: originModel,
+		ChannelMeta: &relaycommon.ChannelMeta{
+			UpstreamModelName:    upstreamModel,
+			ChannelOtherSettings: dto.ChannelOtherSettings{UpstreamCost: setting},
+		},
+	}
+}
+
+func TestCalculateUpstreamCost_ExplicitPrices(t *testing.T) {
+	setting := &dto.UpstreamCostSetting{ModelPrices: map[string]dto.UpstreamModelPrice{
+		"upstream-model": {Input: 2, Output: 8, CacheRead: 0.5, CacheWrite: 2.5},
+		"origin-model":   {Input: 1},
+		"per-call-model": {Input: 100, PerCall: 0.04},
+	}}
+	usage := UpstreamUsage{InputTokens: 1000, OutputTokens: 500, CacheReadTokens: 2000, CacheWriteTokens: 400, AudioInputTokens: 100}
+
+	// 优先按映射后的上游模型计价，音频输入按输入价格计入
+	expected := int((1100*2 + 500*8 + 2000*0.5 + 400*2.5) / 1000000 * common.QuotaPerUnit)
+	require.Equal(t, expected, CalculateUpstreamCost(newUpstreamCostRelayInfo(setting, "origin-model", "upstream-model"), usage))
+	// 上游模型未配置价格时回退到请求的模型名
+	require.Equal(t, int(1100.0/1000000*common.QuotaPerUnit), CalculateUpstreamCost(newUpstreamCostRelayInfo(setting, "origin-model", "mapped-model"), usage))
+	// 按次价格优先于 token 价格
+	require.Equal(t, int(0.04*common.QuotaPerUnit), CalculateUpstreamCost(newUpstreamCostRelayInfo(setting, "per-call-model", ""), usage))
+}
+
+func TestCalculateUpstreamCost_Multiplier(t *testing.T) {
+	oldRatios, oldPrices := ratio_setting.ModelRatio2JSONString(), ratio_setting.ModelPrice2JSONString()
+	t.Cleanup(func() {
+		require.NoError(t, ratio_setting.UpdateModelRatioByJSONString(oldRatios))
+		require.NoError(t, ratio_setting.UpdateModelPriceByJSONString(oldPrices))
+	})
+	require.NoError(t, ratio_setting.UpdateModelRatioByJSONString(`{"test-upstream-ratio": 2}`))
+	require.NoError(t, ratio_setting.UpdateModelPriceByJSONString(`{"test-upstream-price": 0.02}`))
+	usage := UpstreamUsage{InputTokens: 1000}
+
+	setting := &dto.UpstreamCostSetting{Multiplier: 0.5}
+	require.Equal(t, 1000, CalculateUpstreamCost(newUpstreamCostRelayInfo(setting, "test-upstream-ratio", ""), usage))
+	require.Equal(t, int(0.02*common.QuotaPerUnit*0.5), CalculateUpstreamCost(newUpstreamCostRelayInfo(setting, "test-upstream-price", ""), usage))
+	// 官方价格未配置、倍率为 0 或渠道未配置上游成本时不统计
+	require.Zero(t, CalculateUpstreamCost(newUpstreamCostRelayInfo(setting, "test-upstream-unknown", ""), usage))
+	require.Zero(t, CalculateUpstreamCost(newUpstreamCostRelayInfo(&dto.UpstreamCostSetting{}, "test-upstream-ratio", ""), usage))
+	require.Zero(t, CalculateUpstreamCost(newUpstreamCostRelayInfo(nil, "test-upstream-ratio", ""), usage))
+}
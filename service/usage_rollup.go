@@ -0,0 +1,127 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+
+	"github.com/bytedance/gopkg/util/gopool"
+)
+
+const (
+	usageRollupTickInterval = time.Minute
+	// 每批重新汇总的小时桶数，每批一个事务
+	usageRollupBatchHours = 24
+	// 每轮最多处理的批次数，首次启用时历史日志分多轮追赶，避免长时间占用数据库
+	usageRollupMaxBatches = 10
+
+	usageRollupRetentionInterval = time.Hour
+	usageRollupLogDeleteBatch    = 1000
+)
+
+var (
+	usageRollupOnce          sync.Once
+	usageRollupRunning       atomic.Bool
+	usageRollupLastRetention time.Time
+)
+
+// StartUsageRollupTask 定期将新日志累加到用量汇总表，并按保留天数清理汇总表和已汇总的原始日志
+func StartUsageRollupTask() {
+	usageRollupOnce.Do(func() {
+		if !common.IsMasterNode {
+			return
+		}
+
+		gopool.Go(func() {
+			logger.LogInfo(context.Background(), fmt.Sprintf("usage rollup task started: tick=%s", usageRollupTickInterval))
+
+			ticker := time.NewTicker(usageRollupTickInterval)
+			defer ticker.Stop()
+
+			runUsageRollupOnce()
+			for range ticker.C {
+				runUsageRollupOnce()
+			}
+		})
+	})
+}
+
+func runUsageRollupOnce() {
+	if !usageRollupRunning.CompareAndSwap(false, true) {
+		return
+	}
+	defer usageRollupRunning.Store(false)
+
+	setting := operation_setting.GetUsageRollupSetting()
+	if !setting.Enabled {
+		return
+	}
+	ctx := context.Background()
+	rolled := 0
+	for i := 0; i < usageRollupMaxBatches; i++ {
+		n, err := model.RollupUsageLogs(usageRollupBatchHours)
+		if err != nil {
+			logger.LogError(ctx, fmt.Sprintf("usage rollup: rollup failed: %v", err))
+			return
+		}
+		rolled += n
+		if n < usageRollupBatchHours {
+			break
+		}
+	}
+	logger.LogDebug(ctx, "usage rollup: rolled up %d hours", rolled)
+
+	if time.Since(usageRollupLastRetention) < usageRollupRetentionInterval {
+		return
+	}
+	usageRollupLastRetention = time.Now()
+	applyUsageRollupRetention(ctx, setting)
+}
+
+func applyUsageRollupRetention(ctx context.Context, setting *operation_setting.UsageRollupSetting) {
+	now := common.GetTimestamp()
+	if setting.HourlyRetentionDays > 0 {
+		deleted, err := model.DeleteOldUsageRollups(model.UsageRollupGranularityHour, now-int64(setting.HourlyRetentionDays)*86400)
+		if err != nil {
+			logger.LogError(ctx, fmt.Sprintf("usage rollup: delete hourly rollups failed: %v", err))
+		} else if deleted > 0 {
+			logger.LogInfo(ctx, fmt.Sprintf("usage rollup: deleted %d hourly rollups older than %d days", deleted, setting.HourlyRetentionDays))
+		}
+	}
+	if setting.DailyRetentionDays > 0 {
+		deleted, err := model.DeleteOldUsageRollups(model.UsageRollupGranularityDay, now-int64(setting.DailyRetentionDays)*86400)
+		if err != nil {
+			logger.LogError(ctx, fmt.Sprintf("usage rollup: delete daily rollups failed: %v", err))
+		} else if deleted > 0 {
+			logger.LogInfo(ctx, fmt.Sprintf("usage rollup: deleted %d daily rollups older than %d days", deleted, setting.DailyRetentionDays))
+		}
+	}
+	if setting.LogRetentionDays <= 0 {
+		return
+	}
+	state, err := model.GetUsageRollupState()
+	if err != nil {
+		logger.LogError(ctx, fmt.Sprintf("usage rollup: load state failed: %v", err))
+		return
+	}
+	// 尚未汇总的日志不删除，避免统计数据丢失；只删除已汇总的消费日志，错误、充值、管理等其他类型日志保留
+	target := min(now-int64(setting.LogRetentionDays)*86400, state.CoveredUntil)
+	if target <= 0 {
+		return
+	}
+	deleted, err := model.DeleteOldLogByType(ctx, target, model.LogTypeConsume, usageRollupLogDeleteBatch)
+	if err != nil {
+		logger.LogError(ctx, fmt.Sprintf("usage rollup: delete logs failed: %v", err))
+		return
+	}
+	if deleted > 0 {
+		logger.LogInfo(ctx, fmt.Sprintf("usage rollup: deleted %d consume logs older than %d days", deleted, setting.LogRetentionDays))
+	}
+}
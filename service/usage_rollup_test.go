@@ -0,0 +1,46 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/setting/operation_setting"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyUsageRollupRetention_DeletesOnlyRolledUpConsumeLogs(t *testing.T) {
+	setupTestDB(t)
+	require.NoError(t, model.DB.AutoMigrate(&model.UsageRollupHourly{}, &model.UsageRollupDaily{}, &model.UsageRollupState{}))
+
+	now := common.GetTimestamp()
+	old := now - 3*86400
+	for _, log := range []*model.Log{
+		{UserId: 1, Type: model.LogTypeConsume, Quota: 10, CreatedAt: old},
+		{UserId: 1, Type: model.LogTypeError, CreatedAt: old},
+		{UserId: 1, Type: model.LogTypeTopup, Quota: 1000, CreatedAt: old},
+		{UserId: 1, Type: model.LogTypeManage, CreatedAt: old},
+		{UserId: 1, Type: model.LogTypeConsume, Quota: 20, CreatedAt: now},
+	} {
+		require.NoError(t, model.LOG_DB.Create(log).Error)
+	}
+	require.NoError(t, model.LOG_DB.Create(&model.UsageRollupState{Id: 1, CoveredUntil: now - 60}).Error)
+
+	applyUsageRollupRetention(context.Background(), &operation_setting.UsageRollupSetting{Enabled: true, LogRetentionDays: 1})
+
+	var types []int
+	require.NoError(t, model.LOG_DB.Model(&model.Log{}).Where("created_at = ?", old).Order("type").Pluck("type", &types).Error)
+	require.Equal(t, []int{model.LogTypeTopup, model.LogTypeManage, model.LogTypeError}, types)
+	var count int64
+	require.NoError(t, model.LOG_DB.Model(&model.Log{}).Where("created_at = ?", now).Count(&count).Error)
+	require.Equal(t, int64(1), count)
+
+	// 尚未汇总的日志即使超过保留天数也不删除
+	require.NoError(t, model.LOG_DB.Model(&model.UsageRollupState{}).Where("id = ?", 1).Update("covered_until", old).Error)
+	require.NoError(t, model.LOG_DB.Create(&model.Log{UserId: 1, Type: model.LogTypeConsume, CreatedAt: old}).Error)
+	applyUsageRollupRetention(context.Background(), &operation_setting.UsageRollupSetting{Enabled: true, LogRetentionDays: 1})
+	require.NoError(t, model.LOG_DB.Model(&model.Log{}).Where("type = ?", model.LogTypeConsume).Count(&count).Error)
+	require.Equal(t, int64(2), count)
+}
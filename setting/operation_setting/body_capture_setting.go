@@ -0,0 +1,65 @@
+package operation_setting
+
+import (
+	"slices"
+
+	"github.com/QuantumNous/new-api/setting/config"
+)
+
+const (
+	BodyCaptureStorageDB   = "db"
+	BodyCaptureStorageDisk = "disk"
+)
+
+// BodyCaptureSetting 请求/响应内容留存配置，仅对命中用户、令牌或分组的请求按采样率留存
+type BodyCaptureSetting struct {
+	Enabled  bool     `json:"enabled"`
+	UserIds  []int    `json:"user_ids"`
+	TokenIds []int    `json:"token_ids"`
+	Groups   []string `json:"groups"`
+	// 采样率，0~1
+	SampleRate float64 `json:"sample_rate"`
+	// 请求体与响应体各自保留的最大字节数，超出部分截断
+	MaxBodyBytes int `json:"max_body_bytes"`
+	// 正则脱敏规则，匹配内容替换为 [REDACTED]
+	RedactPatterns []string `json:"redact_patterns"`
+	// JSON 路径脱敏规则，以 . 分隔，# 表示数组全部元素，如 messages.#.content
+	RedactJSONPaths []string `json:"redact_json_paths"`
+	// 存储方式：db 存入 body_captures 表，disk 写入处理请求的节点本地的 DiskDir 目录，表中只保留索引与节点名；
+	// 多节点部署时只能在写入的节点上查看，除非 DiskDir 为各节点共享的存储
+	Storage       string `json:"storage"`
+	DiskDir       string `json:"disk_dir"`
+	RetentionDays int    `json:"retention_days"`
+}
+
+var bodyCaptureSetting = BodyCaptureSetting{
+	Enabled:         false,
+	UserIds:         []int{},
+	TokenIds:        []int{},
+	Groups:          []string{},
+	SampleRate:      1,
+	MaxBodyBytes:    64 * 1024,
+	RedactPatterns:  []string{`sk-[A-Za-z0-9_\-]{16,}`},
+	RedactJSONPaths: []string{},
+	Storage:         BodyCaptureStorageDB,
+	DiskDir:         "./data/body_captures",
+	RetentionDays:   7,
+}
+
+func init() {
+	config.GlobalConfig.Register("body_capture_setting", &bodyCaptureSetting)
+}
+
+func GetBodyCaptureSetting() *BodyCaptureSetting {
+	return &bodyCaptureSetting
+}
+
+// Matches 请求方是否开启了内容留存
+func (s *BodyCaptureSetting) Matches(userId int, tokenId int, group string) bool {
+	if !s.Enabled {
+		return false
+	}
+	return slices.Contains(s.UserIds, userId) ||
+		(tokenId != 0 && slices.Contains(s.TokenIds, tokenId)) ||
+		(group != "" && slices.Contains(s.Groups, group))
+}
@@ -0,0 +1,21 @@
+package operation_setting
+
+import "github.com/QuantumNous/new-api/setting/config"
+
+// CreditSetting 后付费信用额度配置
+type CreditSetting struct {
+	// 信用额度使用比例达到这些百分比时通知用户，如 [80, 100]
+	WarningThresholds []int `json:"warning_thresholds"`
+}
+
+var creditSetting = CreditSetting{
+	WarningThresholds: []int{80, 100},
+}
+
+func init() {
+	config.GlobalConfig.Register("credit_setting", &creditSetting)
+}
+
+func GetCreditSetting() *CreditSetting {
+	return &creditSetting
+}
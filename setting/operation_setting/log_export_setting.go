@@ -0,0 +1,29 @@
+package operation_setting
+
+import "github.com/QuantumNous/new-api/setting/config"
+
+// LogExportSetting 日志导出配置，超过 SyncMaxRows 行的导出需创建后台任务
+type LogExportSetting struct {
+	SyncMaxRows int `json:"sync_max_rows"`
+	// 后台任务导出文件所在目录，多节点部署时应挂载为共享目录，否则只能在生成文件的节点下载
+	Dir string `json:"dir"`
+	// 导出文件保留小时数，过期后删除文件和任务记录
+	RetentionHours int `json:"retention_hours"`
+	// 同时运行的后台任务数上限，每个用户同一时间只能有一个未完成任务
+	MaxConcurrentJobs int `json:"max_concurrent_jobs"`
+}
+
+var logExportSetting = LogExportSetting{
+	SyncMaxRows:       100000,
+	Dir:               "./data/log_exports",
+	RetentionHours:    24,
+	MaxConcurrentJobs: 2,
+}
+
+func init() {
+	config.GlobalConfig.Register("log_export_setting", &logExportSetting)
+}
+
+func GetLogExportSetting() *LogExportSetting {
+	return &logExportSetting
+}
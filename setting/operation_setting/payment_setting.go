@@ -5,12 +5,20 @@ import "github.com/QuantumNous/new-api/setting/config"
 type PaymentSetting struct {
 	AmountOptions  []int           `json:"amount_options"`
 	AmountDiscount map[int]float64 `json:"amount_discount"` // 充值金额对应的折扣，例如 100 元 0.9 表示 100 元充值享受 9 折优惠
+	// 对账任务：定期向支付平台查询创建超过 ReconcileMinutes 分钟仍未支付的订单，补记漏掉回调的已支付订单
+	ReconcileEnabled bool `json:"reconcile_enabled"`
+	ReconcileMinutes int  `json:"reconcile_minutes"`
+	// 创建超过该小时数仍未支付的订单置为过期
+	PendingExpireHours int `json:"pending_expire_hours"`
 }
 
 // 默认配置
 var paymentSetting = PaymentSetting{
-	AmountOptions:  []int{10, 20, 50, 100, 200, 500},
-	AmountDiscount: map[int]float64{},
+	AmountOptions:      []int{10, 20, 50, 100, 200, 500},
+	AmountDiscount:     map[int]float64{},
+	ReconcileEnabled:   true,
+	ReconcileMinutes:   10,
+	PendingExpireHours: 24,
 }
 
 func init() {
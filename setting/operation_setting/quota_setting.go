@@ -4,6 +4,7 @@ import "github.com/QuantumNous/new-api/setting/config"
 
 type QuotaSetting struct {
 	EnableFreeModelPreConsume bool `json:"enable_free_model_pre_consume"` // 是否对免费模型启用预消耗
+	ReferralQuotaExpireDays   int  `json:"referral_quota_expire_days"`    // 邀请奖励额度的有效天数，0 表示永不过期
 }
 
 // 默认配置
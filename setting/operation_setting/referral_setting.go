@@ -0,0 +1,43 @@
+package operation_setting
+
+import "github.com/QuantumNous/new-api/setting/config"
+
+// ReferralSetting 邀请返佣配置：被邀请人充值成功后，按比例向上级邀请人发放邀请额度
+type ReferralSetting struct {
+	CommissionEnabled bool `json:"commission_enabled"`
+	// 各级返佣百分比，第一个为直接邀请人，如 [10, 2] 表示一级 10%、二级 2%
+	CommissionRates []float64 `json:"commission_rates"`
+	// 返佣有效天数，从被邀请人首次充值成功起计算，0 表示不限
+	CommissionDays int `json:"commission_days"`
+	// 低于该支付金额的充值订单不返佣，0 表示不限
+	MinTopupMoney float64 `json:"min_topup_money"`
+	// 单个被邀请人为每个邀请人带来的返佣额度上限，0 表示不限
+	MaxQuotaPerInvitee int `json:"max_quota_per_invitee"`
+	// 每个邀请人每天获得的返佣额度上限，0 表示不限
+	MaxDailyQuota int `json:"max_daily_quota"`
+	// 禁止获得返佣的用户 id
+	BlockedUserIds []int `json:"blocked_user_ids"`
+}
+
+var referralSetting = ReferralSetting{
+	CommissionRates: []float64{},
+	BlockedUserIds:  []int{},
+}
+
+func init() {
+	config.GlobalConfig.Register("referral_setting", &referralSetting)
+}
+
+func GetReferralSetting() *ReferralSetting {
+	return &referralSetting
+}
+
+// IsReferralBlocked 用户是否被禁止获得返佣
+func IsReferralBlocked(userId int) bool {
+	for _, id := range referralSetting.BlockedUserIds {
+		if id == userId {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,28 @@
+package operation_setting
+
+import "github.com/QuantumNous/new-api/setting/config"
+
+// UsageRollupSetting 用量汇总配置，汇总表与原始日志的保留天数相互独立，0 表示永久保留
+type UsageRollupSetting struct {
+	// 开启后主节点定期将消费与错误日志汇总到小时/天汇总表，统计接口优先读取汇总表
+	Enabled             bool `json:"enabled"`
+	HourlyRetentionDays int  `json:"hourly_retention_days"`
+	DailyRetentionDays  int  `json:"daily_retention_days"`
+	// 原始消费日志保留天数，只清理已汇总的消费日志，其他类型日志不受影响
+	LogRetentionDays int `json:"log_retention_days"`
+}
+
+var usageRollupSetting = UsageRollupSetting{
+	Enabled:             true,
+	HourlyRetentionDays: 90,
+	DailyRetentionDays:  0,
+	LogRetentionDays:    0,
+}
+
+func init() {
+	config.GlobalConfig.Register("usage_rollup_setting", &usageRollupSetting)
+}
+
+func GetUsageRollupSetting() *UsageRollupSetting {
+	return &usageRollupSetting
+}
@@ -0,0 +1,170 @@
+package ratio_setting
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/types"
+)
+
+// ContextTier 按提示 token 数分档的倍率，提示 token 数不超过 MaxPromptTokens 时命中该档，
+// MaxPromptTokens 为 0 表示无上限。缓存倍率为空时沿用模型的缓存倍率。
+type ContextTier struct {
+	MaxPromptTokens    int      `json:"max_prompt_tokens"`
+	ModelRatio         float64  `json:"model_ratio"`
+	CompletionRatio    float64  `json:"completion_ratio"`
+	CacheRatio         *float64 `json:"cache_ratio,omitempty"`
+	CacheCreationRatio *float64 `json:"cache_creation_ratio,omitempty"`
+}
+
+// https://docs.claude.com/en/docs/build-with-claude/prompt-caching#1-hour-cache-duration
+const ClaudeCacheCreation1hMultiplier = 6 / 3.75
+
+var (
+	contextTierMap      map[string][]ContextTier
+	contextTierMapMutex sync.RWMutex
+)
+
+func ContextTiers2JSONString() string {
+	contextTierMapMutex.RLock()
+	defer contextTierMapMutex.RUnlock()
+	jsonBytes, err := common.Marshal(contextTierMap)
+	if err != nil {
+		common.SysError("error marshalling context tiers: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+// UpdateContextTiersByJSONString 更新模型上下文分档，分档按上限升序排列，无上限的分档只能有一个且排在最后
+func UpdateContextTiersByJSONString(jsonStr string) error {
+	tmp, err := parseContextTiers(jsonStr)
+	if err != nil {
+		return err
+	}
+	contextTierMapMutex.Lock()
+	contextTierMap = tmp
+	contextTierMapMutex.Unlock()
+	InvalidateExposedDataCache()
+	return nil
+}
+
+// CheckContextTiers 校验上下文分档配置，不修改当前生效的分档
+func CheckContextTiers(jsonStr string) error {
+	_, err := parseContextTiers(jsonStr)
+	return err
+}
+
+func parseContextTiers(jsonStr string) (map[string][]ContextTier, error) {
+	tmp := make(map[string][]ContextTier)
+	if jsonStr != "" {
+		if err := common.Unmarshal([]byte(jsonStr), &tmp); err != nil {
+			return nil, err
+		}
+	}
+	for name, tiers := range tmp {
+		if err := normalizeContextTiers(tiers); err != nil {
+			return nil, fmt.Errorf("模型 %s 的上下文分档配置错误：%s", name, err.Error())
+		}
+	}
+	return tmp, nil
+}
+
+func normalizeContextTiers(tiers []ContextTier) error {
+	if len(tiers) == 0 {
+		return fmt.Errorf("分档不能为空")
+	}
+	sort.SliceStable(tiers, func(i, j int) bool {
+		if tiers[i].MaxPromptTokens == 0 {
+			return false
+		}
+		if tiers[j].MaxPromptTokens == 0 {
+			return true
+		}
+		return tiers[i].MaxPromptTokens < tiers[j].MaxPromptTokens
+	})
+	for i, tier := range tiers {
+		if tier.MaxPromptTokens < 0 {
+			return fmt.Errorf("max_prompt_tokens 不能为负数")
+		}
+		if tier.MaxPromptTokens == 0 && i != len(tiers)-1 {
+			return fmt.Errorf("只能有一个无上限的分档")
+		}
+		if i > 0 && tier.MaxPromptTokens != 0 && tier.MaxPromptTokens == tiers[i-1].MaxPromptTokens {
+			return fmt.Errorf("分档上限 %d 重复", tier.MaxPromptTokens)
+		}
+		if tier.ModelRatio < 0 || tier.CompletionRatio < 0 {
+			return fmt.Errorf("倍率不能为负数")
+		}
+	}
+	return nil
+}
+
+func getContextTiers(name string) []ContextTier {
+	contextTierMapMutex.RLock()
+	defer contextTierMapMutex.RUnlock()
+	tiers, ok := contextTierMap[name]
+	if !ok {
+		tiers = contextTierMap[FormatMatchingModelName(name)]
+	}
+	return tiers
+}
+
+// GetContextTiersCopy 返回模型的上下文分档副本，未配置时返回 nil
+func GetContextTiersCopy(name string) []ContextTier {
+	tiers := getContextTiers(name)
+	if len(tiers) == 0 {
+		return nil
+	}
+	copied := make([]ContextTier, len(tiers))
+	copy(copied, tiers)
+	return copied
+}
+
+func GetContextTiersMapCopy() map[string][]ContextTier {
+	contextTierMapMutex.RLock()
+	defer contextTierMapMutex.RUnlock()
+	copyMap := make(map[string][]ContextTier, len(contextTierMap))
+	for k, v := range contextTierMap {
+		copyMap[k] = append([]ContextTier(nil), v...)
+	}
+	return copyMap
+}
+
+// ApplyContextTier 按提示 token 数选择模型的上下文分档，并将分档倍率写入 priceData。
+// 超出所有分档上限时使用最后一档；按次计费、命中价格覆盖或未配置分档时不做处理，返回 false。
+func ApplyContextTier(modelName string, promptTokens int, priceData *types.PriceData) bool {
+	if priceData.UsePrice || priceData.PriceOverrideId != 0 {
+		return false
+	}
+	tiers := getContextTiers(modelName)
+	if len(tiers) == 0 {
+		return false
+	}
+	index := len(tiers) - 1
+	for i, tier := range tiers {
+		if tier.MaxPromptTokens == 0 || promptTokens <= tier.MaxPromptTokens {
+			index = i
+			break
+		}
+	}
+	tier := tiers[index]
+	priceData.ModelRatio = tier.ModelRatio
+	priceData.CompletionRatio = tier.CompletionRatio
+	// 结算时可能与预扣费命中不同分档，未单独配置缓存倍率时需恢复为模型的缓存倍率
+	priceData.CacheRatio, _ = GetCacheRatio(modelName)
+	if tier.CacheRatio != nil {
+		priceData.CacheRatio = *tier.CacheRatio
+	}
+	cacheCreationRatio, _ := GetCreateCacheRatio(modelName)
+	if tier.CacheCreationRatio != nil {
+		cacheCreationRatio = *tier.CacheCreationRatio
+	}
+	priceData.CacheCreationRatio = cacheCreationRatio
+	priceData.CacheCreation5mRatio = cacheCreationRatio
+	priceData.CacheCreation1hRatio = cacheCreationRatio * ClaudeCacheCreation1hMultiplier
+	priceData.ContextTier = index + 1
+	priceData.ContextTierMaxTokens = tier.MaxPromptTokens
+	return true
+}
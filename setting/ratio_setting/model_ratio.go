@@ -374,6 +374,11 @@ func InitRatioSettings() {
 	audioCompletionRatioMapMutex.Lock()
 	audioCompletionRatioMap = defaultAudioCompletionRatio
 	audioCompletionRatioMapMutex.Unlock()
+
+	// initialize contextTierMap
+	contextTierMapMutex.Lock()
+	contextTierMap = make(map[string][]ContextTier)
+	contextTierMapMutex.Unlock()
 }
 
 func GetModelPriceMap() map[string]float64 {
@@ -0,0 +1,201 @@
+package ratio_setting
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/types"
+)
+
+// PricingWindow 分时计价时段，命中时段的请求在原价基础上乘以 Multiplier。
+// 时段为 [Start, End)，End 不大于 Start 时表示跨越零点；Days 为星期（0 表示周日），为空表示每天，
+// 跨零点时段按开始时刻所在的星期判断。Models 支持以 * 结尾的前缀匹配，Models、Groups 为空表示全部。
+type PricingWindow struct {
+	Name       string   `json:"name"`
+	Timezone   string   `json:"timezone,omitempty"` // IANA 时区，为空使用服务器时区
+	Days       []int    `json:"days,omitempty"`
+	Start      string   `json:"start"` // HH:MM
+	End        string   `json:"end"`   // HH:MM
+	Models     []string `json:"models,omitempty"`
+	Groups     []string `json:"groups,omitempty"`
+	Multiplier float64  `json:"multiplier"`
+
+	location    *time.Location
+	startMinute int
+	endMinute   int
+}
+
+// PricingWindowStatus 用于价格接口展示的时段及其当前状态
+type PricingWindowStatus struct {
+	PricingWindow
+	Active bool `json:"active"`
+}
+
+var (
+	pricingWindows      []*PricingWindow
+	pricingWindowsMutex sync.RWMutex
+)
+
+func PricingWindows2JSONString() string {
+	pricingWindowsMutex.RLock()
+	defer pricingWindowsMutex.RUnlock()
+	if pricingWindows == nil {
+		return "[]"
+	}
+	jsonBytes, err := common.Marshal(pricingWindows)
+	if err != nil {
+		common.SysError("error marshalling pricing windows: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func parseClockMinute(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("时间 %q 格式应为 HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// UpdatePricingWindowsByJSONString 更新分时计价时段，按配置顺序匹配，命中第一个时段即停止
+func UpdatePricingWindowsByJSONString(jsonStr string) error {
+	tmp, err := parsePricingWindows(jsonStr)
+	if err != nil {
+		return err
+	}
+	pricingWindowsMutex.Lock()
+	pricingWindows = tmp
+	pricingWindowsMutex.Unlock()
+	return nil
+}
+
+// CheckPricingWindows 校验分时计价配置，不修改当前生效的时段
+func CheckPricingWindows(jsonStr string) error {
+	_, err := parsePricingWindows(jsonStr)
+	return err
+}
+
+func parsePricingWindows(jsonStr string) ([]*PricingWindow, error) {
+	var tmp []*PricingWindow
+	if jsonStr != "" {
+		if err := common.Unmarshal([]byte(jsonStr), &tmp); err != nil {
+			return nil, err
+		}
+	}
+	for i, w := range tmp {
+		if w.Name == "" {
+			return nil, fmt.Errorf("时段 %d 的名称不能为空", i+1)
+		}
+		if w.Multiplier < 0 {
+			return nil, fmt.Errorf("时段 %d 的倍率不能为负数", i+1)
+		}
+		w.location = time.Local
+		if w.Timezone != "" {
+			loc, err := time.LoadLocation(w.Timezone)
+			if err != nil {
+				return nil, fmt.Errorf("时段 %d 的时区无效：%s", i+1, w.Timezone)
+			}
+			w.location = loc
+		}
+		var err error
+		if w.startMinute, err = parseClockMinute(w.Start); err != nil {
+			return nil, err
+		}
+		if w.endMinute, err = parseClockMinute(w.End); err != nil {
+			return nil, err
+		}
+		if w.startMinute == w.endMinute {
+			return nil, fmt.Errorf("时段 %d 的开始与结束时间不能相同", i+1)
+		}
+		for _, d := range w.Days {
+			if d < 0 || d > 6 {
+				return nil, fmt.Errorf("时段 %d 的星期应在 0-6 之间", i+1)
+			}
+		}
+	}
+	return tmp, nil
+}
+
+func (w *PricingWindow) activeAt(now time.Time) bool {
+	local := now.In(w.location)
+	minute := local.Hour()*60 + local.Minute()
+	weekday := int(local.Weekday())
+	if w.startMinute < w.endMinute {
+		if minute < w.startMinute || minute >= w.endMinute {
+			return false
+		}
+	} else {
+		if minute < w.startMinute && minute >= w.endMinute {
+			return false
+		}
+		// 零点之后的部分属于前一天开始的时段
+		if minute < w.endMinute {
+			weekday = (weekday + 6) % 7
+		}
+	}
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *PricingWindow) matches(modelName string, group string) bool {
+	if len(w.Groups) > 0 && !common.StringsContains(w.Groups, group) {
+		return false
+	}
+	if len(w.Models) == 0 {
+		return true
+	}
+	for _, pattern := range w.Models {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(modelName, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if pattern == modelName {
+			return true
+		}
+	}
+	return false
+}
+
+// GetActivePricingWindow 返回 now 时刻对该模型和分组生效的第一个时段，未命中返回 nil
+func GetActivePricingWindow(modelName string, group string, now time.Time) *PricingWindow {
+	pricingWindowsMutex.RLock()
+	defer pricingWindowsMutex.RUnlock()
+	for _, w := range pricingWindows {
+		if w.matches(modelName, group) && w.activeAt(now) {
+			return w
+		}
+	}
+	return nil
+}
+
+// ApplyPricingWindow 将当前生效的分时计价时段记录到 priceData，返回是否命中
+func ApplyPricingWindow(modelName string, group string, now time.Time, priceData *types.PriceData) bool {
+	w := GetActivePricingWindow(modelName, group, now)
+	if w == nil {
+		return false
+	}
+	priceData.PricingWindow = w.Name
+	priceData.PricingWindowRatio = w.Multiplier
+	return true
+}
+
+// GetPricingWindowsStatus 返回全部时段及其在 now 时刻是否处于生效时间
+func GetPricingWindowsStatus(now time.Time) []PricingWindowStatus {
+	pricingWindowsMutex.RLock()
+	defer pricingWindowsMutex.RUnlock()
+	result := make([]PricingWindowStatus, 0, len(pricingWindows))
+	for _, w := range pricingWindows {
+		result = append(result, PricingWindowStatus{PricingWindow: *w, Active: w.activeAt(now)})
+	}
+	return result
+}
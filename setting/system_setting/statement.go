@@ -0,0 +1,26 @@
+package system_setting
+
+import "github.com/QuantumNous/new-api/setting/config"
+
+// StatementSettings 月度账单配置，公司信息会展示在导出的账单抬头
+type StatementSettings struct {
+	CompanyName    string `json:"company_name"`
+	CompanyAddress string `json:"company_address"`
+	TaxId          string `json:"tax_id"`
+	ContactEmail   string `json:"contact_email"`
+	Footer         string `json:"footer"`
+	// 每月初自动为上月有消费的用户和组织生成账单
+	AutoGenerate bool `json:"auto_generate"`
+	// 自动生成后发送邮件给用户或组织所有者
+	AutoEmail bool `json:"auto_email"`
+}
+
+var defaultStatementSettings = StatementSettings{}
+
+func init() {
+	config.GlobalConfig.Register("statement", &defaultStatementSettings)
+}
+
+func GetStatementSettings() *StatementSettings {
+	return &defaultStatementSettings
+}
@@ -64,6 +64,7 @@ const (
 	ErrorCodeReadRequestBodyFailed ErrorCode = "read_request_body_failed"
 	ErrorCodeConvertRequestFailed  ErrorCode = "convert_request_failed"
 	ErrorCodeAccessDenied          ErrorCode = "access_denied"
+	ErrorCodeTokenScopeDenied      ErrorCode = "token_scope_denied"
 
 	// request error
 	ErrorCodeBadRequestBody ErrorCode = "bad_request_body"
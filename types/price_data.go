@@ -22,7 +22,12 @@ type PriceData struct {
 	AudioCompletionRatio float64
 	OtherRatios          map[string]float64
 	UsePrice             bool
-	QuotaToPreConsume    int // 预消耗额度
+	QuotaToPreConsume    int     // 预消耗额度
+	ContextTier          int     // 命中的上下文分档（从 1 开始），0 表示未分档
+	ContextTierMaxTokens int     // 命中分档的提示 token 上限，0 表示无上限
+	PricingWindow        string  // 请求开始时命中的分时计价时段，为空表示未命中
+	PriceOverrideId      int     // 命中的用户或令牌价格覆盖，非 0 时不再按上下文分档
+	PricingWindowRatio   float64 // 分时计价倍率
 	GroupRatioInfo       GroupRatioInfo
 }
 
@@ -36,10 +41,20 @@ func (p *PriceData) AddOtherRatio(key string, ratio float64) {
 	p.OtherRatios[key] = ratio
 }
 
+// PricingWindowMultiplier 返回分时计价倍率，未命中时段时为 1
+func (p *PriceData) PricingWindowMultiplier() float64 {
+	if p.PricingWindow == "" {
+		return 1
+	}
+	return p.PricingWindowRatio
+}
+
 type PerCallPriceData struct {
-	ModelPrice     float64
-	Quota          int
-	GroupRatioInfo GroupRatioInfo
+	ModelPrice         float64
+	Quota              int
+	PricingWindow      string  // 请求开始时命中的分时计价时段，为空表示未命中
+	PricingWindowRatio float64 // 分时计价倍率
+	GroupRatioInfo     GroupRatioInfo
 }
 
 func (p *PriceData) ToSetting() string {